@@ -0,0 +1,69 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+const (
+	computeAPIVersionConfigKey           = "computeAPIVersion"
+	storageManagementAPIVersionConfigKey = "storageManagementAPIVersion"
+)
+
+// armAPIVersionRegexp matches ARM API versions, e.g. 2019-07-01 or
+// 2021-04-01-preview.
+var armAPIVersionRegexp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(-preview)?$`)
+
+// getARMAPIVersion returns the ARM API version in config[key], or "" to use
+// the SDK's, for clouds that don't have the SDK's version yet, e.g. Azure
+// Stack Hub or sovereign clouds.
+func getARMAPIVersion(config map[string]string, key string) (string, error) {
+	val := config[key]
+	if val != "" && !armAPIVersionRegexp.MatchString(val) {
+		return "", errors.Errorf("invalid value %q for config key %q (expected an API version, e.g. 2019-07-01)", val, key)
+	}
+	return val, nil
+}
+
+// withARMAPIVersion has the requests of an ARM client use the given API
+// version instead of the one its SDK package was generated for. The request
+// and response bodies are unchanged, so the version must have the same
+// schema for the properties the plugin uses.
+func withARMAPIVersion(client *autorest.Client, apiVersion string) {
+	if apiVersion == "" {
+		return
+	}
+	client.RequestInspector = func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			query := r.URL.Query()
+			if query.Get("api-version") != "" {
+				query.Set("api-version", apiVersion)
+				r.URL.RawQuery = query.Encode()
+			}
+			return r, nil
+		})
+	}
+}
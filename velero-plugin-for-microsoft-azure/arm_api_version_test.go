@@ -0,0 +1,63 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetARMAPIVersion(t *testing.T) {
+	for _, val := range []string{"", "2019-03-01", "2021-04-01-preview"} {
+		version, err := getARMAPIVersion(map[string]string{computeAPIVersionConfigKey: val}, computeAPIVersionConfigKey)
+		require.NoError(t, err)
+		assert.Equal(t, val, version)
+	}
+
+	for _, val := range []string{"latest", "2019-3-1", "2019-03-01-beta"} {
+		_, err := getARMAPIVersion(map[string]string{computeAPIVersionConfigKey: val}, computeAPIVersionConfigKey)
+		assert.Error(t, err, val)
+	}
+}
+
+func TestWithARMAPIVersion(t *testing.T) {
+	var requested []string
+	client := disk.NewSnapshotsClient("sub")
+	client.Sender = autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.Query().Get("api-version"))
+		return &http.Response{StatusCode: http.StatusOK, Request: req, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+	})
+
+	// without a pinned version, the SDK's is used
+	withARMAPIVersion(&client.Client, "")
+	_, err := client.Get(context.Background(), "rg", "snap-1")
+	require.NoError(t, err)
+
+	withARMAPIVersion(&client.Client, "2019-03-01")
+	_, err = client.Get(context.Background(), "rg", "snap-1")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"2019-07-01", "2019-03-01"}, requested)
+}
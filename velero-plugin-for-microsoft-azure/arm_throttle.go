@@ -0,0 +1,131 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+const (
+	apiRetryAttemptsConfigKey = "apiRetryAttempts"
+
+	// defaultThrottleDelay is how long requests are held back after a
+	// throttled response without a Retry-After header.
+	defaultThrottleDelay = 10 * time.Second
+)
+
+// ARM metrics, per volume snapshot location
+var (
+	armRequests         = expvar.NewMap("azure_arm_requests")
+	armThrottled        = expvar.NewMap("azure_arm_throttled_requests")
+	armThrottledSeconds = expvar.NewMap("azure_arm_throttled_seconds")
+)
+
+// armThrottle holds back the ARM requests of one volume snapshot location
+// while it's being throttled. ARM throttles per subscription, so when
+// locations target different subscriptions, each has its own throttle and a
+// location being throttled doesn't delay the requests of the others.
+type armThrottle struct {
+	key   string
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	lock  sync.Mutex
+	until time.Time
+}
+
+var (
+	armThrottlesLock sync.Mutex
+	armThrottles     = map[string]*armThrottle{}
+)
+
+// getARMThrottle returns the throttle for the volume snapshot location with
+// the given key. Throttles are shared by the location's plugin instances.
+func getARMThrottle(key string) *armThrottle {
+	armThrottlesLock.Lock()
+	defer armThrottlesLock.Unlock()
+
+	t, ok := armThrottles[key]
+	if !ok {
+		t = &armThrottle{key: key, now: time.Now, sleep: time.Sleep}
+		armThrottles[key] = t
+	}
+	return t
+}
+
+// wait blocks until the location is no longer being throttled.
+func (t *armThrottle) wait() {
+	t.lock.Lock()
+	delay := t.until.Sub(t.now())
+	t.lock.Unlock()
+
+	if delay > 0 {
+		armThrottledSeconds.AddFloat(t.key, delay.Seconds())
+		t.sleep(delay)
+	}
+}
+
+// record records the response to a request, holding back the location's
+// requests for as long as a throttled response asks.
+func (t *armThrottle) record(resp *http.Response) {
+	armRequests.Add(t.key, 1)
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	armThrottled.Add(t.key, 1)
+
+	until := t.now().Add(autorest.GetRetryAfter(resp, defaultThrottleDelay))
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if until.After(t.until) {
+		t.until = until
+	}
+}
+
+// sender returns a sender for the location's ARM clients that sends requests
+// with next, holding them back while the location is throttled.
+func (t *armThrottle) sender(next autorest.Sender) autorest.Sender {
+	return autorest.SenderFunc(func(req *http.Request) (*http.Response, error) {
+		t.wait()
+		resp, err := next.Do(req)
+		t.record(resp)
+		return resp, err
+	})
+}
+
+// getAPIRetryAttempts returns config.apiRetryAttempts, or the ARM clients'
+// default if it's not set.
+func getAPIRetryAttempts(config map[string]string) (int, error) {
+	val := config[apiRetryAttemptsConfigKey]
+	if val == "" {
+		return autorest.DefaultRetryAttempts, nil
+	}
+
+	attempts, err := strconv.Atoi(val)
+	if err != nil || attempts < 0 {
+		return 0, errors.Errorf("unable to parse value %q for config key %q (expected a non-negative integer)", val, apiRetryAttemptsConfigKey)
+	}
+	return attempts, nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestARMThrottle(t *testing.T) {
+	now := time.Now()
+	var slept []time.Duration
+
+	throttled := &armThrottle{
+		key:   "sub-1/rg",
+		now:   func() time.Time { return now },
+		sleep: func(d time.Duration) { slept = append(slept, d) },
+	}
+	other := &armThrottle{
+		key:   "sub-2/rg",
+		now:   func() time.Time { return now },
+		sleep: func(d time.Duration) { slept = append(slept, d) },
+	}
+
+	responses := []*http.Response{
+		{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"30"}}},
+		{StatusCode: http.StatusOK},
+	}
+	next := autorest.SenderFunc(func(*http.Request) (*http.Response, error) {
+		resp := responses[0]
+		responses = responses[1:]
+		return resp, nil
+	})
+
+	req, err := http.NewRequest(http.MethodGet, "https://management.azure.com", nil)
+	require.NoError(t, err)
+
+	send := throttled.sender(next)
+	_, err = send.Do(req)
+	require.NoError(t, err)
+	assert.Empty(t, slept)
+
+	// the throttled location's next request waits for Retry-After
+	_, err = send.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Duration{30 * time.Second}, slept)
+
+	// another location's requests aren't held back
+	other.wait()
+	assert.Len(t, slept, 1)
+
+	assert.Equal(t, "2", armRequests.Get("sub-1/rg").String())
+	assert.Equal(t, "1", armThrottled.Get("sub-1/rg").String())
+	assert.Equal(t, "30", armThrottledSeconds.Get("sub-1/rg").String())
+	assert.Nil(t, armThrottled.Get("sub-2/rg"))
+}
+
+func TestARMThrottleDefaultDelay(t *testing.T) {
+	now := time.Now()
+	throttle := &armThrottle{key: "sub-3/rg", now: func() time.Time { return now }}
+
+	throttle.record(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}})
+	assert.Equal(t, now.Add(defaultThrottleDelay), throttle.until)
+
+	// a shorter Retry-After doesn't shorten the throttling
+	throttle.record(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"1"}}})
+	assert.Equal(t, now.Add(defaultThrottleDelay), throttle.until)
+}
+
+func TestGetARMThrottleIsShared(t *testing.T) {
+	assert.True(t, getARMThrottle("sub-4/rg") == getARMThrottle("sub-4/rg"))
+	assert.False(t, getARMThrottle("sub-4/rg") == getARMThrottle("sub-5/rg"))
+}
+
+func TestGetAPIRetryAttempts(t *testing.T) {
+	attempts, err := getAPIRetryAttempts(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, autorest.DefaultRetryAttempts, attempts)
+
+	attempts, err = getAPIRetryAttempts(map[string]string{apiRetryAttemptsConfigKey: "0"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts)
+
+	_, err = getAPIRetryAttempts(map[string]string{apiRetryAttemptsConfigKey: "-1"})
+	assert.Error(t, err)
+}
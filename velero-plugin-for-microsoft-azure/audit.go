@@ -0,0 +1,264 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	auditLogConfigKey = "auditLog"
+
+	auditDeleteObject   = "DeleteObject"
+	auditDeleteSnapshot = "DeleteSnapshot"
+	auditSetAccessTier  = "SetAccessTier"
+
+	auditResultSucceeded = "succeeded"
+	auditResultFailed    = "failed"
+
+	auditDateFormat = "2006-01-02"
+
+	auditLogPrefix = pluginObjectsPrefix + "audit/"
+)
+
+// auditRecord describes a destructive operation performed by the plugin.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Target    string    `json:"target"`
+	// Tier is the access tier objects are moved to by SetAccessTier.
+	Tier     string `json:"tier,omitempty"`
+	Actor    string `json:"actor"`
+	Identity string `json:"identity,omitempty"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+}
+
+// auditLog records destructive operations as JSON lines in append blobs, one
+// per day, under auditLogPrefix in a metadata store. Moving objects to an
+// access tier is recorded too, since archived objects can't be read until
+// they're rehydrated. Append blobs can't be
+// modified other than by appending, so records can't be altered once
+// written.
+type auditLog struct {
+	log      logrus.FieldLogger
+	store    *metadataStore
+	actor    string
+	identity string
+}
+
+// getAuditLog returns whether config.auditLog is set.
+func getAuditLog(config map[string]string) (bool, error) {
+	val := config[auditLogConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	audit, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, auditLogConfigKey)
+	}
+
+	return audit, nil
+}
+
+func newAuditLog(log logrus.FieldLogger, store *metadataStore, config map[string]string) *auditLog {
+	actor := config[clusterNameConfigKey]
+	if actor == "" {
+		actor, _ = os.Hostname()
+	}
+
+	return &auditLog{
+		log:      log,
+		store:    store,
+		actor:    actor,
+		identity: os.Getenv(clientIDEnvVar),
+	}
+}
+
+func auditLogName(day time.Time) string {
+	return auditLogPrefix + day.UTC().Format(auditDateFormat) + ".jsonl"
+}
+
+// record appends a record of the given operation on target, which failed if
+// err isn't nil. Errors writing the record are logged rather than returned,
+// since the operation has already happened.
+func (a *auditLog) record(operation, target string, err error) {
+	a.write(auditRecord{Operation: operation, Target: target}, err)
+}
+
+// recordAccessTier appends a record of moving target to the given access
+// tier, which failed if err isn't nil.
+func (a *auditLog) recordAccessTier(target, tier string, err error) {
+	a.write(auditRecord{Operation: auditSetAccessTier, Target: target, Tier: tier}, err)
+}
+
+func (a *auditLog) write(r auditRecord, err error) {
+	r.Time = time.Now().UTC()
+	r.Actor = a.actor
+	r.Identity = a.identity
+	r.Result = auditResultSucceeded
+	if err != nil {
+		r.Result = auditResultFailed
+		r.Error = err.Error()
+	}
+
+	if err := a.append(r); err != nil {
+		a.log.WithError(err).WithFields(logrus.Fields{"operation": r.Operation, "target": r.Target}).Error("Error writing audit record")
+	}
+}
+
+func (a *auditLog) append(r auditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return a.store.append(auditLogName(r.Time), append(data, '\n'))
+}
+
+// readAuditRecords returns the records written on the given day, or none if
+// no records were written that day.
+func readAuditRecords(store *metadataStore, day time.Time) ([]auditRecord, error) {
+	data, err := store.get(auditLogName(day))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, errors.Wrapf(err, "error decoding audit record in %s", auditLogName(day))
+		}
+		records = append(records, r)
+	}
+
+	return records, errors.WithStack(scanner.Err())
+}
+
+// filterAuditRecords returns the records at or after since that match the
+// given operation and target prefix, if they're set.
+func filterAuditRecords(records []auditRecord, since time.Time, operation, targetPrefix string) []auditRecord {
+	var filtered []auditRecord
+	for _, r := range records {
+		if r.Time.Before(since) {
+			continue
+		}
+		if operation != "" && !strings.EqualFold(r.Operation, operation) {
+			continue
+		}
+		if !strings.HasPrefix(r.Target, targetPrefix) {
+			continue
+		}
+		filtered = append(filtered, r)
+	}
+	return filtered
+}
+
+func printAuditRecords(w io.Writer, records []auditRecord) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tOPERATION\tTARGET\tACTOR\tRESULT")
+	for _, r := range records {
+		operation := r.Operation
+		if r.Tier != "" {
+			operation += " (" + r.Tier + ")"
+		}
+		result := r.Result
+		if r.Error != "" {
+			result += ": " + r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Time.Format(time.RFC3339), operation, r.Target, r.Actor, result)
+	}
+	tw.Flush()
+}
+
+func runAuditLog(_ logrus.FieldLogger, args []string) error {
+	var (
+		config       map[string]string
+		since        time.Duration
+		operation    string
+		targetPrefix string
+	)
+
+	flags := pflag.NewFlagSet("audit-log", pflag.ContinueOnError)
+	flags.StringToStringVar(&config, "config", nil, fmt.Sprintf("The container holding the audit log, as %s, %s, %s, %s and %s key=value pairs",
+		storageAccountConfigKey, storageAccountKeyEnvVarConfigKey, resourceGroupConfigKey, bucketConfigKey, prefixConfigKey))
+	flags.DurationVar(&since, "since", 7*24*time.Hour, "Only show operations performed within this long")
+	flags.StringVar(&operation, "operation", "", fmt.Sprintf("Only show this operation (%s, %s or %s)", auditDeleteObject, auditDeleteSnapshot, auditSetAccessTier))
+	flags.StringVar(&targetPrefix, "target-prefix", "", "Only show operations on targets starting with this prefix")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := loadCredentialsIntoEnv(credentialsFileFromEnv()); err != nil {
+		return err
+	}
+	env, err := getAzureEnvironment(config)
+	if err != nil {
+		return err
+	}
+
+	if config[bucketConfigKey] == "" {
+		return errors.Errorf("--config %s is required", bucketConfigKey)
+	}
+	store, err := newMetadataStore(map[string]string{
+		metadataStorageAccountConfigKey:          config[storageAccountConfigKey],
+		metadataStorageAccountKeyEnvVarConfigKey: config[storageAccountKeyEnvVarConfigKey],
+		metadataResourceGroupConfigKey:           config[resourceGroupConfigKey],
+		metadataBucketConfigKey:                  config[bucketConfigKey],
+		metadataPrefixConfigKey:                  config[prefixConfigKey],
+	}, env)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	start := now.Add(-since)
+
+	var records []auditRecord
+	for day := start.Truncate(24 * time.Hour); !day.After(now); day = day.Add(24 * time.Hour) {
+		dayRecords, err := readAuditRecords(store, day)
+		if err != nil {
+			return err
+		}
+		records = append(records, dayRecords...)
+	}
+
+	printAuditRecords(os.Stdout, filterAuditRecords(records, start, operation, targetPrefix))
+	return nil
+}
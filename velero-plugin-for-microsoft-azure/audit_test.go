@@ -0,0 +1,81 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	blobs := newMemBlobs(time.Now())
+	store := &metadataStore{blobGetter: blobs, bucket: "bucket", prefix: "velero"}
+	audit := newAuditLog(logrus.New(), store, map[string]string{clusterNameConfigKey: "cluster-1"})
+
+	audit.record(auditDeleteObject, "bucket/velero/backups/b1/b1.tar.gz", nil)
+	audit.record(auditDeleteSnapshot, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/s1", errors.New("bad"))
+	audit.recordAccessTier("bucket/velero/backups/b1/b1.tar.gz", "Archive", nil)
+
+	// the log is under Velero's "plugins" directory, so the location stays valid
+	_, err := store.get("plugins/azure/audit/" + time.Now().UTC().Format(auditDateFormat) + ".jsonl")
+	require.NoError(t, err)
+
+	records, err := readAuditRecords(store, time.Now())
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+
+	assert.Equal(t, auditDeleteObject, records[0].Operation)
+	assert.Equal(t, "cluster-1", records[0].Actor)
+	assert.Equal(t, auditResultSucceeded, records[0].Result)
+	assert.Equal(t, auditResultFailed, records[1].Result)
+	assert.Equal(t, "bad", records[1].Error)
+	assert.Equal(t, auditSetAccessTier, records[2].Operation)
+	assert.Equal(t, "Archive", records[2].Tier)
+
+	// days without records have no audit log
+	records, err = readAuditRecords(store, time.Now().Add(-48*time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestFilterAuditRecords(t *testing.T) {
+	now := time.Now()
+	records := []auditRecord{
+		{Time: now.Add(-2 * time.Hour), Operation: auditDeleteObject, Target: "bucket/a"},
+		{Time: now, Operation: auditDeleteObject, Target: "bucket/b"},
+		{Time: now, Operation: auditDeleteSnapshot, Target: "snap"},
+		{Time: now, Operation: auditSetAccessTier, Target: "bucket/c", Tier: "Cool"},
+	}
+
+	assert.Len(t, filterAuditRecords(records, now.Add(-time.Hour), "", ""), 3)
+	assert.Len(t, filterAuditRecords(records, time.Time{}, "deleteobject", ""), 2)
+	assert.Equal(t, records[1:2], filterAuditRecords(records, time.Time{}, "", "bucket/b"))
+
+	var out bytes.Buffer
+	printAuditRecords(&out, records[2:3])
+	assert.Contains(t, out.String(), "DeleteSnapshot  snap")
+
+	out.Reset()
+	printAuditRecords(&out, records[3:])
+	assert.Contains(t, out.String(), "SetAccessTier (Cool)  bucket/c")
+}
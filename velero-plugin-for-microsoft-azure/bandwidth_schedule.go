@@ -0,0 +1,296 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	bandwidthScheduleConfigKey = "bandwidthSchedule"
+
+	unlimitedBandwidth = "unlimited"
+)
+
+// bandwidthUnits are the units of bandwidth limits, in bytes per second.
+var bandwidthUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"GBps", 1000 * 1000 * 1000},
+	{"MBps", 1000 * 1000},
+	{"KBps", 1000},
+	{"Bps", 1},
+}
+
+// bandwidthWindow limits the bandwidth between two times of day, as
+// offsets from midnight UTC. Windows ending before they start wrap around
+// midnight.
+type bandwidthWindow struct {
+	start, end time.Duration
+	// limit is in bytes per second, or 0 for no limit
+	limit int64
+}
+
+func (w bandwidthWindow) contains(offset time.Duration) bool {
+	if w.start <= w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// bandwidthSchedule is the bandwidth limit of a location's storage requests
+// by time of day, e.g. "00:00-06:00=unlimited,50MBps" for no limit at night
+// and 50MB/s otherwise.
+type bandwidthSchedule struct {
+	windows []bandwidthWindow
+	// otherwise is the limit outside of the windows, or 0 for no limit
+	otherwise int64
+}
+
+// limitAt returns the bandwidth limit at the given time, in bytes per
+// second, or 0 for no limit. The first window containing it applies.
+func (s *bandwidthSchedule) limitAt(t time.Time) int64 {
+	t = t.UTC()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, w := range s.windows {
+		if w.contains(offset) {
+			return w.limit
+		}
+	}
+	return s.otherwise
+}
+
+// getBandwidthSchedule parses config.bandwidthSchedule, a comma-separated
+// list of "<start>-<end>=<limit>" windows, with times of day in UTC as
+// HH:MM, and an optional limit for the rest of the day, e.g.
+// "00:00-06:00=unlimited,50MBps". It returns nil if it's not set.
+func getBandwidthSchedule(config map[string]string) (*bandwidthSchedule, error) {
+	val := config[bandwidthScheduleConfigKey]
+	if strings.TrimSpace(val) == "" {
+		return nil, nil
+	}
+
+	invalid := func(reason string) error {
+		return errors.Errorf("invalid value %q for config key %q (%s)", val, bandwidthScheduleConfigKey, reason)
+	}
+
+	var (
+		s            bandwidthSchedule
+		hasOtherwise bool
+	)
+	for _, entry := range strings.Split(val, ",") {
+		entry = strings.TrimSpace(entry)
+		i := strings.IndexByte(entry, '=')
+		if i < 0 {
+			if hasOtherwise {
+				return nil, invalid("expected at most one limit outside of time windows")
+			}
+			limit, err := parseBandwidthLimit(entry)
+			if err != nil {
+				return nil, invalid(err.Error())
+			}
+			s.otherwise, hasOtherwise = limit, true
+			continue
+		}
+
+		times := strings.Split(entry[:i], "-")
+		if len(times) != 2 {
+			return nil, invalid("expected time windows of the form HH:MM-HH:MM=<limit>")
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, invalid(err.Error())
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, invalid(err.Error())
+		}
+		if start == end {
+			return nil, invalid("time windows can't be empty")
+		}
+		limit, err := parseBandwidthLimit(entry[i+1:])
+		if err != nil {
+			return nil, invalid(err.Error())
+		}
+		s.windows = append(s.windows, bandwidthWindow{start: start, end: end, limit: limit})
+	}
+
+	return &s, nil
+}
+
+// parseTimeOfDay parses a time of day of the form HH:MM, 24:00 being the
+// end of the day.
+func parseTimeOfDay(val string) (time.Duration, error) {
+	val = strings.TrimSpace(val)
+	if val == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", val)
+	if err != nil {
+		return 0, errors.Errorf("invalid time of day %q, expected HH:MM", val)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseBandwidthLimit parses a bandwidth limit, e.g. "50MBps", in bytes per
+// second, or "unlimited", returned as 0.
+func parseBandwidthLimit(val string) (int64, error) {
+	val = strings.TrimSpace(val)
+	if strings.EqualFold(val, unlimitedBandwidth) {
+		return 0, nil
+	}
+	for _, unit := range bandwidthUnits {
+		if !strings.HasSuffix(val, unit.suffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(val, unit.suffix)), 10, 64)
+		if err != nil || n <= 0 {
+			break
+		}
+		return n * unit.bytes, nil
+	}
+	return 0, errors.Errorf("invalid bandwidth limit %q, expected e.g. 50MBps or %s", val, unlimitedBandwidth)
+}
+
+// bandwidthLimiter paces the bytes sent and received by a location's storage
+// requests to its schedule's limit at the time.
+type bandwidthLimiter struct {
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	lock     sync.Mutex
+	schedule *bandwidthSchedule
+	// next is when the bytes transferred so far are paid for at the limit
+	next time.Time
+}
+
+var (
+	bandwidthLimitersLock sync.Mutex
+	bandwidthLimiters     = map[string]*bandwidthLimiter{}
+)
+
+// getBandwidthLimiter returns the limiter of the location with the given
+// key, updated to the given schedule. Limiters are shared by the location's
+// plugin instances, so that concurrent operations share its bandwidth.
+func getBandwidthLimiter(key string, schedule *bandwidthSchedule) *bandwidthLimiter {
+	bandwidthLimitersLock.Lock()
+	defer bandwidthLimitersLock.Unlock()
+
+	l, ok := bandwidthLimiters[key]
+	if !ok {
+		l = &bandwidthLimiter{now: time.Now, sleep: time.Sleep}
+		bandwidthLimiters[key] = l
+	}
+
+	l.lock.Lock()
+	l.schedule = schedule
+	l.lock.Unlock()
+	return l
+}
+
+// take blocks until n more bytes can be transferred within the current limit.
+func (l *bandwidthLimiter) take(n int) {
+	if n <= 0 {
+		return
+	}
+
+	l.lock.Lock()
+	now := l.now()
+	limit := l.schedule.limitAt(now)
+	if limit == 0 {
+		l.next = time.Time{}
+		l.lock.Unlock()
+		return
+	}
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(limit) * float64(time.Second)))
+	l.lock.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
+
+// maxBandwidthChunk is the most bytes read at once through a limiter, so
+// that large reads are paced rather than sent in bursts.
+const maxBandwidthChunk = 64 * 1024
+
+// limitedReadCloser reads from a request or response body at the limiter's
+// pace.
+type limitedReadCloser struct {
+	io.ReadCloser
+	limiter *bandwidthLimiter
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	if len(p) > maxBandwidthChunk {
+		p = p[:maxBandwidthChunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.limiter.take(n)
+	return n, err
+}
+
+// bandwidthTransport limits the bandwidth of the request and response
+// bodies of each try of a request, retries included, as they're sent and
+// received.
+type bandwidthTransport struct {
+	limiter *bandwidthLimiter
+	next    http.RoundTripper
+}
+
+func (t *bandwidthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		// the request mustn't be modified, so send a copy
+		copied := *req
+		copied.Body = &limitedReadCloser{ReadCloser: req.Body, limiter: t.limiter}
+		req = &copied
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = &limitedReadCloser{ReadCloser: resp.Body, limiter: t.limiter}
+	return resp, nil
+}
+
+// withBandwidthLimit returns an HTTP client sending requests like client, or
+// like http.DefaultClient if it's nil, at the limiter's pace.
+func withBandwidthLimit(client *http.Client, limiter *bandwidthLimiter) *http.Client {
+	copied := http.Client{}
+	if client != nil {
+		copied = *client
+	}
+	next := copied.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	copied.Transport = &bandwidthTransport{limiter: limiter, next: next}
+	return &copied
+}
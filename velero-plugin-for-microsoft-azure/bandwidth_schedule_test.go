@@ -0,0 +1,107 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBandwidthSchedule(t *testing.T) {
+	s, err := getBandwidthSchedule(map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	s, err = getBandwidthSchedule(map[string]string{bandwidthScheduleConfigKey: "00:00-06:00=unlimited, 22:00-24:00=200MBps, 50MBps"})
+	require.NoError(t, err)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, int64(0), s.limitAt(day.Add(3*time.Hour)))
+	assert.Equal(t, int64(50*1000*1000), s.limitAt(day.Add(6*time.Hour)))
+	assert.Equal(t, int64(50*1000*1000), s.limitAt(day.Add(12*time.Hour)))
+	assert.Equal(t, int64(200*1000*1000), s.limitAt(day.Add(23*time.Hour)))
+
+	// windows may wrap around midnight, and times are in UTC
+	s, err = getBandwidthSchedule(map[string]string{bandwidthScheduleConfigKey: "22:00-06:00=10MBps"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10*1000*1000), s.limitAt(day.Add(23*time.Hour)))
+	assert.Equal(t, int64(10*1000*1000), s.limitAt(day.Add(time.Hour)))
+	assert.Equal(t, int64(0), s.limitAt(day.Add(12*time.Hour)))
+	assert.Equal(t, int64(10*1000*1000), s.limitAt(time.Date(2020, 1, 1, 12, 0, 0, 0, time.FixedZone("UTC+12", 12*60*60))))
+
+	for _, val := range []string{"50", "50MB", "0MBps", "00:00-06:00", "06:00-06:00=1MBps", "25:00-06:00=1MBps", "1MBps,2MBps", "00:00-06:00-08:00=1MBps"} {
+		_, err := getBandwidthSchedule(map[string]string{bandwidthScheduleConfigKey: val})
+		assert.Error(t, err, val)
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	var slept time.Duration
+	l := &bandwidthLimiter{
+		now:      func() time.Time { return now },
+		sleep:    func(d time.Duration) { slept += d; now = now.Add(d) },
+		schedule: &bandwidthSchedule{windows: []bandwidthWindow{{start: 0, end: 6 * time.Hour}}, otherwise: 1000},
+	}
+
+	// transfers are paced to the limit
+	l.take(500)
+	l.take(1000)
+	l.take(500)
+	assert.Equal(t, 1500*time.Millisecond, slept)
+
+	// and aren't limited in unlimited windows
+	slept = 0
+	now = time.Date(2020, 1, 2, 1, 0, 0, 0, time.UTC)
+	l.take(1000 * 1000)
+	l.take(1000 * 1000)
+	assert.Equal(t, time.Duration(0), slept)
+}
+
+func TestBandwidthTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	var slept time.Duration
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := &bandwidthLimiter{
+		now:      func() time.Time { return now },
+		sleep:    func(d time.Duration) { slept += d },
+		schedule: &bandwidthSchedule{otherwise: 1000},
+	}
+	client := withBandwidthLimit(nil, limiter)
+
+	res, err := client.Post(server.URL, "text/plain", strings.NewReader(strings.Repeat("x", 2000)))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Len(t, body, 2000)
+
+	// both the request's and the response's bytes are paced, at 1000 bytes
+	// per second on a clock that doesn't advance
+	assert.True(t, slept >= 3*time.Second, "slept %s", slept)
+}
@@ -0,0 +1,361 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	labelUploadsConfigKey     = "labelUploads"
+	blobTagTemplatesConfigKey = "blobTagTemplates"
+
+	// blobTagsAPIVersion is the storage API version of Set Blob Tags requests,
+	// the first that supports blob index tags
+	blobTagsAPIVersion = "2019-12-12"
+
+	// maxBlobTags is the maximum number of index tags of a blob
+	maxBlobTags = 10
+
+	// maxBuiltInTags is the maximum number of tags labelUploads sets on an
+	// object: a backup object's backup, schedule and expiration
+	maxBuiltInTags = 3
+
+	// rememberedBackups is the number of backups whose schedule and
+	// expiration are kept to label the objects uploaded after their metadata
+	rememberedBackups = 64
+)
+
+// blobTagPattern matches the keys and values of blob index tags.
+// ref. https://docs.microsoft.com/en-us/azure/storage/blobs/storage-manage-find-blobs#setting-blob-index-tags
+var blobTagPattern = regexp.MustCompile(`^[a-zA-Z0-9 +\-./:=_]*$`)
+
+// uploadLabels describe the backup or restore an uploaded object belongs
+// to. They're the data of tag templates, e.g. "{{.Backup}}".
+type uploadLabels struct {
+	Backup     string
+	Schedule   string
+	Expiration string
+	Restore    string
+	Cluster    string
+}
+
+// metadata returns the labels as blob metadata, whose names must be valid C#
+// identifiers.
+func (l uploadLabels) metadata() storage.BlobMetadata {
+	metadata := storage.BlobMetadata{}
+	for name, value := range map[string]string{
+		"velerobackup":     l.Backup,
+		"veleroschedule":   l.Schedule,
+		"veleroexpiration": l.Expiration,
+		"velerorestore":    l.Restore,
+	} {
+		if value != "" {
+			metadata[name] = value
+		}
+	}
+	return metadata
+}
+
+// tags returns the labels as blob index tags.
+func (l uploadLabels) tags() map[string]string {
+	tags := map[string]string{}
+	for key, value := range map[string]string{
+		"velero.io/backup":     l.Backup,
+		"velero.io/schedule":   l.Schedule,
+		"velero.io/expiration": l.Expiration,
+		"velero.io/restore":    l.Restore,
+	} {
+		if value != "" {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// parseBlobTagTemplates parses a comma-separated list of <tag>=<template>
+// pairs, whose templates are rendered with an object's uploadLabels.
+func parseBlobTagTemplates(val string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	for _, pair := range strings.Split(val, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || len(key) > 128 || !blobTagPattern.MatchString(key) {
+			return nil, errors.Errorf("invalid value %q in config key %q (expected <tag>=<template>, with tags of up to 128 letters, digits, spaces and +-./:=_)", pair, blobTagTemplatesConfigKey)
+		}
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid template for tag %q in config key %q", key, blobTagTemplatesConfigKey)
+		}
+		templates[key] = tmpl
+	}
+	return templates, nil
+}
+
+// backupMetadata is the part of a backup's metadata file that labels its
+// objects.
+type backupMetadata struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Status struct {
+		Expiration *time.Time `json:"expiration"`
+	} `json:"status"`
+}
+
+// blobTagger sets the index tags of blobs.
+type blobTagger interface {
+	setTags(bucket, key string, tags map[string]string) error
+}
+
+// azureBlobTagger sets index tags with Set Blob Tags requests, which the
+// storage client has no operation for.
+type azureBlobTagger struct {
+	account string
+	service *lazyBlobService
+}
+
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/set-blob-tags
+func (t *azureBlobTagger) setTags(bucket, key string, tags map[string]string) error {
+	type tag struct {
+		Key   string `xml:"Key"`
+		Value string `xml:"Value"`
+	}
+	body := struct {
+		XMLName xml.Name `xml:"Tags"`
+		Tags    []tag    `xml:"TagSet>Tag"`
+	}{}
+	for _, k := range sortedKeys(tags) {
+		body.Tags = append(body.Tags, tag{Key: k, Value: tags[k]})
+	}
+	data, err := xml.Marshal(body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	resp, err := t.service.do(t.account, blobRequest{
+		method:     http.MethodPut,
+		bucket:     bucket,
+		key:        key,
+		query:      url.Values{"comp": {"tags"}},
+		headers:    map[string]string{"Content-Type": "application/xml; charset=utf-8"},
+		body:       append([]byte(xml.Header), data...),
+		apiVersion: blobTagsAPIVersion,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// uploadLabeler labels the objects of backups and restores with blob
+// metadata and index tags: the names of their backup or restore, and the
+// schedule and expiration of their backup, which are known once the backup's
+// metadata file is uploaded, plus the tags rendered from templates.
+type uploadLabeler struct {
+	log       logrus.FieldLogger
+	prefix    string
+	cluster   string
+	builtIn   bool
+	templates map[string]*template.Template
+	tagger    blobTagger
+
+	lock    sync.Mutex
+	backups map[string]uploadLabels
+	order   []string
+}
+
+// newUploadLabeler returns the labeler for the given config, or nil if
+// uploads aren't labeled.
+func newUploadLabeler(log logrus.FieldLogger, config map[string]string, tagger blobTagger) (*uploadLabeler, error) {
+	var builtIn bool
+	if val := config[labelUploadsConfigKey]; val != "" {
+		var err error
+		if builtIn, err = strconv.ParseBool(val); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, labelUploadsConfigKey)
+		}
+	}
+	templates, err := parseBlobTagTemplates(config[blobTagTemplatesConfigKey])
+	if err != nil {
+		return nil, err
+	}
+	if !builtIn && len(templates) == 0 {
+		return nil, nil
+	}
+
+	maxTemplates := maxBlobTags
+	if builtIn {
+		maxTemplates -= maxBuiltInTags
+	}
+	if len(templates) > maxTemplates {
+		return nil, errors.Errorf("config key %q has %d tags, more than the %d left of the %d a blob can have", blobTagTemplatesConfigKey, len(templates), maxTemplates, maxBlobTags)
+	}
+
+	return &uploadLabeler{
+		log:       log,
+		prefix:    config[prefixConfigKey],
+		cluster:   config[clusterNameConfigKey],
+		builtIn:   builtIn,
+		templates: templates,
+		tagger:    tagger,
+		backups:   map[string]uploadLabels{},
+	}, nil
+}
+
+// metadataBuffer returns a buffer to keep the content of the object uploaded
+// to key, if it's a backup metadata file, or nil.
+func (l *uploadLabeler) metadataBuffer(key string) *limitedBuffer {
+	if _, ok := backupNameFromMetadataKey(l.prefix, key); !ok {
+		return nil
+	}
+	return &limitedBuffer{limit: maxBackupMetadataSize}
+}
+
+// labelsFor returns the labels of the object uploaded to key, with the given
+// content if it's a backup metadata file, or false if it doesn't belong to a
+// backup or restore.
+func (l *uploadLabeler) labelsFor(key string, metadata *limitedBuffer) (uploadLabels, bool) {
+	rel := key
+	if l.prefix != "" {
+		if !strings.HasPrefix(key, l.prefix+"/") {
+			return uploadLabels{}, false
+		}
+		rel = strings.TrimPrefix(key, l.prefix+"/")
+	}
+	parts := strings.Split(rel, "/")
+	if len(parts) != 3 {
+		return uploadLabels{}, false
+	}
+
+	switch parts[0] {
+	case "restores":
+		return uploadLabels{Restore: parts[1], Cluster: l.cluster}, true
+	case "backups":
+	default:
+		return uploadLabels{}, false
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if parts[2] == backupMetadataFile && metadata != nil && !metadata.truncated {
+		var backup backupMetadata
+		if err := json.Unmarshal(metadata.Bytes(), &backup); err != nil {
+			l.log.WithError(err).WithField("backup", parts[1]).Warn("Unable to read the schedule and expiration of the backup to label its objects")
+		} else {
+			labels := uploadLabels{Backup: parts[1], Schedule: backup.Metadata.Labels["velero.io/schedule-name"], Cluster: l.cluster}
+			if backup.Status.Expiration != nil {
+				labels.Expiration = backup.Status.Expiration.UTC().Format(time.RFC3339)
+			}
+			l.remember(parts[1], labels)
+		}
+	}
+
+	if labels, ok := l.backups[parts[1]]; ok {
+		return labels, true
+	}
+	return uploadLabels{Backup: parts[1], Cluster: l.cluster}, true
+}
+
+// remember keeps the labels of the given backup, forgetting the oldest
+// backup's once rememberedBackups are kept.
+func (l *uploadLabeler) remember(backup string, labels uploadLabels) {
+	if _, ok := l.backups[backup]; !ok {
+		l.order = append(l.order, backup)
+		if len(l.order) > rememberedBackups {
+			delete(l.backups, l.order[0])
+			l.order = l.order[1:]
+		}
+	}
+	l.backups[backup] = labels
+}
+
+// label sets the metadata and index tags of the object uploaded to key.
+// Labels are best effort: objects that can't be labeled are uploaded anyway.
+func (l *uploadLabeler) label(b blob, bucket, key string, metadata *limitedBuffer) {
+	labels, ok := l.labelsFor(key, metadata)
+	if !ok {
+		return
+	}
+	log := l.log.WithField("key", key)
+
+	tags := map[string]string{}
+	if l.builtIn {
+		if err := b.SetMetadata(labels.metadata(), nil); err != nil {
+			log.WithError(err).Warn("Unable to set the object's metadata")
+		}
+		tags = labels.tags()
+	}
+	for _, key := range sortedTemplateKeys(l.templates) {
+		var value bytes.Buffer
+		if err := l.templates[key].Execute(&value, labels); err != nil {
+			log.WithError(err).WithField("tag", key).Warn("Unable to render the object's tag")
+			continue
+		}
+		if value.Len() > 256 || !blobTagPattern.MatchString(value.String()) {
+			log.WithField("tag", key).Warnf("Not setting tag with invalid value %q", value.String())
+			continue
+		}
+		if value.Len() > 0 {
+			tags[key] = value.String()
+		}
+	}
+	if len(tags) == 0 {
+		return
+	}
+
+	if err := l.tagger.setTags(bucket, key, tags); err != nil {
+		log.WithError(err).Warn("Unable to set the object's index tags")
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedTemplateKeys(m map[string]*template.Template) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
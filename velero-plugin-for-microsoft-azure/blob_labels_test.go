@@ -0,0 +1,164 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUploadLabeler(t *testing.T) {
+	labeler, err := newUploadLabeler(logrus.New(), map[string]string{}, nil)
+	require.NoError(t, err)
+	assert.Nil(t, labeler)
+
+	labeler, err = newUploadLabeler(logrus.New(), map[string]string{labelUploadsConfigKey: "true"}, nil)
+	require.NoError(t, err)
+	assert.True(t, labeler.builtIn)
+
+	labeler, err = newUploadLabeler(logrus.New(), map[string]string{blobTagTemplatesConfigKey: "team=payments, month={{.Expiration}}"}, nil)
+	require.NoError(t, err)
+	assert.False(t, labeler.builtIn)
+	assert.Len(t, labeler.templates, 2)
+
+	for _, config := range []map[string]string{
+		{labelUploadsConfigKey: "sure"},
+		{blobTagTemplatesConfigKey: "team"},
+		{blobTagTemplatesConfigKey: "team!=payments"},
+		{blobTagTemplatesConfigKey: "team={{.Backup"},
+		{labelUploadsConfigKey: "true", blobTagTemplatesConfigKey: "a=1,b=2,c=3,d=4,e=5,f=6,g=7,h=8"},
+	} {
+		_, err := newUploadLabeler(logrus.New(), config, nil)
+		assert.Error(t, err, config)
+	}
+}
+
+type fakeBlobTagger struct {
+	tags map[string]map[string]string
+	err  error
+}
+
+func (f *fakeBlobTagger) setTags(bucket, key string, tags map[string]string) error {
+	f.tags[key] = tags
+	return f.err
+}
+
+func TestPutObjectLabels(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	blobs := map[string]*mockBlob{}
+	for _, key := range []string{
+		"cluster-1/backups/b1/b1-logs.gz",
+		"cluster-1/backups/b1/velero-backup.json",
+		"cluster-1/backups/b1/b1.tar.gz",
+		"cluster-1/restores/r1/restore-r1-logs.gz",
+		"cluster-1/other",
+	} {
+		blob := new(mockBlob)
+		blob.On("PutBlock", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		blob.On("PutBlockList", mock.Anything, mock.Anything).Return(nil)
+		blob.On("SetMetadata", mock.Anything, mock.Anything).Return(errors.New("boom"))
+		blobGetter.On("getBlob", "b", key).Return(blob, nil)
+		blobs[key] = blob
+	}
+
+	tagger := &fakeBlobTagger{tags: map[string]map[string]string{}}
+	labeler, err := newUploadLabeler(logrus.New(), map[string]string{
+		labelUploadsConfigKey:     "true",
+		blobTagTemplatesConfigKey: "team=payments,cluster={{.Cluster}},bad={{.Backup}}!",
+		prefixConfigKey:           "cluster-1",
+		clusterNameConfigKey:      "cluster-1",
+	}, tagger)
+	require.NoError(t, err)
+	o := &ObjectStore{
+		log:        logrus.New(),
+		blobGetter: blobGetter,
+		blockSize:  1024,
+		labeler:    labeler,
+	}
+
+	// objects are labeled with what's known of their backup when they're uploaded
+	require.NoError(t, o.PutObject("b", "cluster-1/backups/b1/b1-logs.gz", strings.NewReader("logs")))
+	require.NoError(t, o.PutObject("b", "cluster-1/backups/b1/velero-backup.json", strings.NewReader(
+		`{"metadata":{"name":"b1","labels":{"velero.io/schedule-name":"daily"}},"status":{"expiration":"2020-07-01T12:00:00Z"}}`)))
+	require.NoError(t, o.PutObject("b", "cluster-1/backups/b1/b1.tar.gz", strings.NewReader("contents")))
+	require.NoError(t, o.PutObject("b", "cluster-1/restores/r1/restore-r1-logs.gz", strings.NewReader("logs")))
+	require.NoError(t, o.PutObject("b", "cluster-1/other", strings.NewReader("other")))
+
+	assert.Equal(t, map[string]map[string]string{
+		"cluster-1/backups/b1/b1-logs.gz": {
+			"velero.io/backup": "b1", "team": "payments", "cluster": "cluster-1",
+		},
+		"cluster-1/backups/b1/velero-backup.json": {
+			"velero.io/backup": "b1", "velero.io/schedule": "daily", "velero.io/expiration": "2020-07-01T12:00:00Z", "team": "payments", "cluster": "cluster-1",
+		},
+		"cluster-1/backups/b1/b1.tar.gz": {
+			"velero.io/backup": "b1", "velero.io/schedule": "daily", "velero.io/expiration": "2020-07-01T12:00:00Z", "team": "payments", "cluster": "cluster-1",
+		},
+		"cluster-1/restores/r1/restore-r1-logs.gz": {
+			"velero.io/restore": "r1", "team": "payments", "cluster": "cluster-1",
+		},
+	}, tagger.tags)
+
+	// metadata is set even though it fails, which doesn't fail uploads
+	blobs["cluster-1/backups/b1/b1.tar.gz"].AssertCalled(t, "SetMetadata", storage.BlobMetadata{
+		"velerobackup": "b1", "veleroschedule": "daily", "veleroexpiration": "2020-07-01T12:00:00Z",
+	}, mock.Anything)
+	blobs["cluster-1/other"].AssertNotCalled(t, "SetMetadata", mock.Anything, mock.Anything)
+}
+
+func TestUploadLabelerForgetsOldBackups(t *testing.T) {
+	labeler := &uploadLabeler{backups: map[string]uploadLabels{}}
+	for i := 0; i <= rememberedBackups; i++ {
+		labeler.remember(strings.Repeat("b", i+1), uploadLabels{Schedule: "daily"})
+	}
+	assert.Len(t, labeler.backups, rememberedBackups)
+	assert.NotContains(t, labeler.backups, "b")
+}
+
+func TestAzureBlobTagger(t *testing.T) {
+	credential := &storageCredential{accountKey: "a2V5"}
+	sender := &respondingSender{resp: &http.Response{StatusCode: http.StatusNoContent, Body: ioutil.NopCloser(strings.NewReader(""))}}
+	service := newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+		client, err := newStorageClient("account", credential, &azure.PublicCloud, "")
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		client.Sender = sender
+		return &client, credential, nil
+	})
+	tagger := &azureBlobTagger{account: "account", service: service}
+
+	require.NoError(t, tagger.setTags("b", "backups/b1/b1.tar.gz", map[string]string{"velero.io/backup": "b1", "team": "payments"}))
+	req := sender.requests[0]
+	assert.Equal(t, "https://account.blob.core.windows.net/b/backups/b1/b1.tar.gz?comp=tags", req.URL.String())
+	assert.Equal(t, blobTagsAPIVersion, req.Header.Get("x-ms-version"))
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<Tags><TagSet><Tag><Key>team</Key><Value>payments</Value></Tag><Tag><Key>velero.io/backup</Key><Value>b1</Value></Tag></TagSet></Tags>`, string(body))
+	assert.Equal(t, int64(len(body)), req.ContentLength)
+}
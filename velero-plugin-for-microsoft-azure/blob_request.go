@@ -0,0 +1,237 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+)
+
+// blobRequest is a request for a blob operation the storage package has no
+// support for, e.g. because it was added in a later storage API version.
+type blobRequest struct {
+	method string
+	// bucket is the container's name, or "" for requests for the blob
+	// service itself
+	bucket string
+	// key is the blob's name, or "" for requests for the container itself
+	key string
+	// dfs sends the request to the account's Data Lake Storage endpoint,
+	// "<account>.dfs.<endpoint suffix>", rather than its blob endpoint
+	dfs        bool
+	query      url.Values
+	headers    map[string]string
+	body       []byte
+	apiVersion string
+}
+
+// do sends the request through the storage client of the given account's
+// blob service, so that it goes through the same senders as the client's own
+// requests, authorized with the service's credential. Error responses are
+// returned as storage.AzureStorageServiceError.
+func (s *lazyBlobService) do(account string, r blobRequest) (*http.Response, error) {
+	client, credential, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	service := client.GetBlobService()
+	container := service.GetContainerReference(r.bucket)
+	uri := container.GetURL()
+	switch {
+	case r.bucket == "":
+		// the storage client names the root container "$root" when no name is
+		// given, so the service's URL is the root container's without it
+		uri = strings.TrimSuffix(uri, "$root")
+	case r.key != "":
+		uri = container.GetBlobReference(r.key).GetURL()
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if r.dfs {
+		u.Host = strings.Replace(u.Host, ".blob.", ".dfs.", 1)
+	}
+	query := url.Values{}
+	for k, v := range r.query {
+		query[k] = v
+	}
+	if credential.sasToken != "" {
+		sas, err := url.ParseQuery(credential.sasToken)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to parse storage account SAS")
+		}
+		for k, v := range sas {
+			query[k] = v
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequest(r.method, u.String(), body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("x-ms-version", r.apiVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+
+	// requests authorized with a token get theirs from the client's sender
+	if credential.accountKey != "" {
+		if err := signSharedKey(req, account, credential.accountKey); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := client.Sender.Send(client, req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		serviceErr := storage.AzureStorageServiceError{}
+		if body, err := ioutil.ReadAll(resp.Body); err == nil && len(body) > 0 {
+			_ = xml.Unmarshal(body, &serviceErr)
+		}
+		if serviceErr.Code == "" {
+			serviceErr.Code = resp.Header.Get("x-ms-error-code")
+		}
+		serviceErr.StatusCode = resp.StatusCode
+		serviceErr.RequestID = resp.Header.Get("x-ms-request-id")
+		serviceErr.Date = resp.Header.Get("Date")
+		serviceErr.APIVersion = r.apiVersion
+		return nil, serviceErr
+	}
+	return resp, nil
+}
+
+// setClientRequestHeaders sets headers the storage client has no support for
+// on one of its requests, raising the request's API version to apiVersion if
+// it's older. The request is signed again if it's signed with the account's
+// key, i.e. if accountKey is set.
+func setClientRequestHeaders(req *http.Request, account, accountKey, apiVersion string, headers map[string]string) error {
+	// API versions are dates, so they sort as strings
+	if getHeader(req.Header, "x-ms-version") < apiVersion {
+		setHeader(req.Header, "x-ms-version", apiVersion)
+	}
+	for k, v := range headers {
+		setHeader(req.Header, k, v)
+	}
+
+	if accountKey == "" {
+		return nil
+	}
+	return signSharedKey(req, account, accountKey)
+}
+
+// signSharedKey authorizes req with the account's key.
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func signSharedKey(req *http.Request, account, accountKey string) error {
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return errors.Wrap(err, "unable to decode storage account key")
+	}
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	lines := []string{
+		req.Method,
+		getHeader(req.Header, "Content-Encoding"),
+		getHeader(req.Header, "Content-Language"),
+		contentLength,
+		getHeader(req.Header, "Content-MD5"),
+		getHeader(req.Header, "Content-Type"),
+		getHeader(req.Header, "Date"),
+		getHeader(req.Header, "If-Modified-Since"),
+		getHeader(req.Header, "If-Match"),
+		getHeader(req.Header, "If-None-Match"),
+		getHeader(req.Header, "If-Unmodified-Since"),
+		getHeader(req.Header, "Range"),
+	}
+
+	var headers []string
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			headers = append(headers, name+":"+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(headers)
+	lines = append(lines, headers...)
+
+	resource := "/" + account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+	lines = append(lines, resource)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	setHeader(req.Header, "Authorization", "SharedKey "+account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// The storage client sets headers by their names as given, e.g.
+// "x-ms-version", rather than by their canonical names, so getHeader and
+// setHeader find headers by any case.
+
+func getHeader(h http.Header, name string) string {
+	for k, v := range h {
+		if strings.EqualFold(k, name) && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func setHeader(h http.Header, name, value string) {
+	for k := range h {
+		if strings.EqualFold(k, name) {
+			delete(h, k)
+		}
+	}
+	h.Set(name, value)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	blockBlobAccessTierConfigKey = "blockBlobAccessTier"
+
+	// accessTierAPIVersion is the storage API version of Set Blob Tier
+	// requests, the first that supports the Cold tier
+	accessTierAPIVersion = "2021-12-02"
+
+	archiveAccessTier = "Archive"
+)
+
+var accessTiers = []string{"Hot", "Cool", "Cold", archiveAccessTier}
+
+// getBlockBlobAccessTier returns the access tier uploaded objects are moved
+// to, or "" if they're left in the account's default tier.
+func getBlockBlobAccessTier(config map[string]string) (string, error) {
+	val := config[blockBlobAccessTierConfigKey]
+	if val == "" {
+		return "", nil
+	}
+	for _, tier := range accessTiers {
+		if strings.EqualFold(val, tier) {
+			return tier, nil
+		}
+	}
+	return "", errors.Errorf("invalid value %q for config key %q (expected one of %s)", val, blockBlobAccessTierConfigKey, strings.Join(accessTiers, ", "))
+}
+
+// accessTierFor returns the access tier of the uploaded object with the
+// given key, or "" if it stays in the account's default tier. Archived blobs
+// can't be read until they're rehydrated, which takes hours, so only backup
+// contents tarballs, which Velero reads only to restore, are archived: the
+// other objects are read to sync, describe and download backups.
+func accessTierFor(tier, key string) string {
+	if tier != archiveAccessTier {
+		return tier
+	}
+
+	// e.g. "<prefix>/backups/b1/b1.tar.gz"
+	dir, file := path.Split(key)
+	backup := path.Base(dir)
+	if path.Base(path.Dir(path.Clean(dir))) != "backups" || file != backup+".tar.gz" {
+		return ""
+	}
+	return tier
+}
+
+// accessTierSetter moves blobs to other access tiers.
+type accessTierSetter interface {
+	setAccessTier(bucket, key, tier string) error
+}
+
+// azureAccessTierSetter sets the access tier of blobs with Set Blob Tier
+// requests, which the storage client has no operation for.
+type azureAccessTierSetter struct {
+	account string
+	service *lazyBlobService
+}
+
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/set-blob-tier
+func (s *azureAccessTierSetter) setAccessTier(bucket, key, tier string) error {
+	resp, err := s.service.do(s.account, blobRequest{
+		method:     http.MethodPut,
+		bucket:     bucket,
+		key:        key,
+		query:      url.Values{"comp": {"tier"}},
+		headers:    map[string]string{"x-ms-access-tier": tier},
+		apiVersion: accessTierAPIVersion,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBlockBlobAccessTier(t *testing.T) {
+	tier, err := getBlockBlobAccessTier(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, "", tier)
+
+	tier, err = getBlockBlobAccessTier(map[string]string{blockBlobAccessTierConfigKey: "cold"})
+	require.NoError(t, err)
+	assert.Equal(t, "Cold", tier)
+
+	_, err = getBlockBlobAccessTier(map[string]string{blockBlobAccessTierConfigKey: "Premium"})
+	assert.Error(t, err)
+}
+
+func TestAccessTierFor(t *testing.T) {
+	assert.Equal(t, "Cool", accessTierFor("Cool", "cluster-1/backups/b1/velero-backup.json"))
+	assert.Equal(t, "", accessTierFor("", "backups/b1/b1.tar.gz"))
+
+	// only backup contents are archived
+	assert.Equal(t, "Archive", accessTierFor("Archive", "backups/b1/b1.tar.gz"))
+	assert.Equal(t, "Archive", accessTierFor("Archive", "cluster-1/backups/b1/b1.tar.gz"))
+	assert.Equal(t, "", accessTierFor("Archive", "backups/b1/velero-backup.json"))
+	assert.Equal(t, "", accessTierFor("Archive", "backups/b1/b1-logs.gz"))
+	assert.Equal(t, "", accessTierFor("Archive", "restores/b1/b1.tar.gz"))
+}
+
+type fakeAccessTierSetter struct {
+	tiers map[string]string
+	err   error
+}
+
+func (s *fakeAccessTierSetter) setAccessTier(bucket, key, tier string) error {
+	s.tiers[bucket+"/"+key] = tier
+	return s.err
+}
+
+func TestPutObjectAccessTier(t *testing.T) {
+	for _, setErr := range []error{nil, errors.New("boom")} {
+		blobGetter := new(mockBlobGetter)
+		blob := new(mockBlob)
+		blobGetter.On("getBlob", "b", mock.Anything).Return(blob, nil)
+		blob.On("PutBlock", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		blob.On("PutBlockList", mock.Anything, mock.Anything).Return(nil)
+
+		setter := &fakeAccessTierSetter{tiers: map[string]string{}, err: setErr}
+		o := &ObjectStore{
+			log:        logrus.New(),
+			blobGetter: blobGetter,
+			blockSize:  4,
+			accessTier: "Archive",
+			tierSetter: setter,
+		}
+
+		// failing to tier an object doesn't fail its upload
+		require.NoError(t, o.PutObject("b", "backups/b1/b1.tar.gz", strings.NewReader("contents")))
+		require.NoError(t, o.PutObject("b", "backups/b1/velero-backup.json", strings.NewReader("{}")))
+		assert.Equal(t, map[string]string{"b/backups/b1/b1.tar.gz": "Archive"}, setter.tiers)
+	}
+}
+
+func TestSignSharedKey(t *testing.T) {
+	// requests are signed the way the storage client signs its own
+	client, err := storage.NewBasicClient("account", "a2V5")
+	require.NoError(t, err)
+	sender := new(recordingSender)
+	client.Sender = sender
+	blobService := client.GetBlobService()
+	_, err = blobService.GetContainerReference("container").GetBlobReference("dir/blob 1").Exists()
+	require.NoError(t, err)
+	require.Len(t, sender.requests, 1)
+
+	req := sender.requests[0]
+	signed := req.Header.Get("Authorization")
+	req.Header.Del("Authorization")
+	require.NoError(t, signSharedKey(req, "account", "a2V5"))
+	assert.Equal(t, signed, req.Header.Get("Authorization"))
+}
+
+type respondingSender struct {
+	recordingSender
+	resp *http.Response
+}
+
+func (s *respondingSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	s.recordingSender.Send(c, req)
+	return s.resp, nil
+}
+
+func TestAzureAccessTierSetter(t *testing.T) {
+	connect := func(credential *storageCredential, sender storage.Sender) *lazyBlobService {
+		return newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+			client, err := newStorageClient("account", credential, &azure.PublicCloud, "")
+			require.NoError(t, err)
+			client.Sender = sender
+			return &client, credential, nil
+		})
+	}
+
+	// with a key, requests are signed
+	sender := &respondingSender{resp: &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}}
+	setter := &azureAccessTierSetter{account: "account", service: connect(&storageCredential{accountKey: "a2V5"}, sender)}
+	require.NoError(t, setter.setAccessTier("b", "backups/b1/b1.tar.gz", "Cool"))
+	require.Len(t, sender.requests, 1)
+	req := sender.requests[0]
+	assert.Equal(t, http.MethodPut, req.Method)
+	assert.Equal(t, "https://account.blob.core.windows.net/b/backups/b1/b1.tar.gz?comp=tier", req.URL.String())
+	assert.Equal(t, "Cool", req.Header.Get("x-ms-access-tier"))
+	assert.Equal(t, accessTierAPIVersion, req.Header.Get("x-ms-version"))
+	assert.True(t, strings.HasPrefix(req.Header.Get("Authorization"), "SharedKey account:"))
+
+	// with a SAS, it's added to the query, and errors are storage errors
+	sender = &respondingSender{resp: &http.Response{
+		StatusCode: http.StatusConflict,
+		Header:     http.Header{"X-Ms-Request-Id": []string{"request-1"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`<?xml version="1.0" encoding="utf-8"?><Error><Code>BlobBeingRehydrated</Code><Message>This operation is not permitted because the blob is being rehydrated.</Message></Error>`)),
+	}}
+	setter = &azureAccessTierSetter{account: "account", service: connect(&storageCredential{sasToken: "sv=2019-12-12&sig=c2ln"}, sender)}
+	err := setter.setAccessTier("b", "backups/b1/b1.tar.gz", "Cool")
+	require.Len(t, sender.requests, 1)
+	assert.Equal(t, "c2ln", sender.requests[0].URL.Query().Get("sig"))
+	assert.Equal(t, "tier", sender.requests[0].URL.Query().Get("comp"))
+	assert.Equal(t, "", sender.requests[0].Header.Get("Authorization"))
+	serviceErr, ok := errors.Cause(err).(storage.AzureStorageServiceError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusConflict, serviceErr.StatusCode)
+	assert.Equal(t, "BlobBeingRehydrated", serviceErr.Code)
+	assert.Equal(t, "request-1", serviceErr.RequestID)
+}
@@ -0,0 +1,73 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"expvar"
+	"strconv"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+)
+
+const reuseUnchangedBlocksConfigKey = "reuseUnchangedBlocks"
+
+// the bytes of uploads that weren't uploaded again because the object already
+// had blocks with the same content
+var uploadReusedBytes = expvar.NewInt("azure_upload_reused_bytes")
+
+// getReuseUnchangedBlocks returns whether uploads reuse the blocks of the
+// objects they replace whose content is unchanged.
+func getReuseUnchangedBlocks(config map[string]string) (bool, error) {
+	val := config[reuseUnchangedBlocksConfigKey]
+	if val == "" {
+		return false, nil
+	}
+	reuse, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, reuseUnchangedBlocksConfigKey)
+	}
+	return reuse, nil
+}
+
+// contentBlockID returns the ID of a block with the given content, the
+// base64 encoding of its SHA-256 hash, so that every ID has the same length
+// and blocks with the same content have the same ID across uploads.
+func contentBlockID(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// committedBlocks returns the IDs of the committed blocks of the given blob,
+// which is empty if the blob doesn't exist.
+func committedBlocks(b blob) (map[string]bool, error) {
+	res, err := b.GetBlockList(storage.BlockListTypeCommitted, nil)
+	if isNotFound(err) {
+		return map[string]bool{}, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	ids := make(map[string]bool, len(res.CommittedBlocks))
+	for _, block := range res.CommittedBlocks {
+		ids[block.Name] = true
+	}
+	return ids, nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentBlockID(t *testing.T) {
+	assert.Equal(t, contentBlockID([]byte("abcd")), contentBlockID([]byte("abcd")))
+	assert.NotEqual(t, contentBlockID([]byte("abcd")), contentBlockID([]byte("abce")))
+	assert.Len(t, contentBlockID([]byte("a")), len(contentBlockID([]byte("abcd"))))
+}
+
+func TestPutObjectReusesUnchangedBlocks(t *testing.T) {
+	tests := []struct {
+		name           string
+		committed      []string
+		listErr        error
+		expectedPuts   []string
+		expectedStatus []storage.BlockStatus
+	}{
+		{
+			name:           "unchanged blocks aren't uploaded",
+			committed:      []string{contentBlockID([]byte("abcd")), contentBlockID([]byte("efgh"))},
+			expectedPuts:   []string{contentBlockID([]byte("EFGH")), contentBlockID([]byte("ij"))},
+			expectedStatus: []storage.BlockStatus{storage.BlockStatusCommitted, storage.BlockStatusLatest, storage.BlockStatusLatest},
+		},
+		{
+			name:           "new objects upload every block",
+			listErr:        storage.AzureStorageServiceError{StatusCode: http.StatusNotFound},
+			expectedPuts:   []string{contentBlockID([]byte("abcd")), contentBlockID([]byte("EFGH")), contentBlockID([]byte("ij"))},
+			expectedStatus: []storage.BlockStatus{storage.BlockStatusLatest, storage.BlockStatusLatest, storage.BlockStatusLatest},
+		},
+		{
+			name:           "failing to list blocks uploads every block",
+			listErr:        errors.New("boom"),
+			expectedPuts:   []string{contentBlockID([]byte("abcd")), contentBlockID([]byte("EFGH")), contentBlockID([]byte("ij"))},
+			expectedStatus: []storage.BlockStatus{storage.BlockStatusLatest, storage.BlockStatusLatest, storage.BlockStatusLatest},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			blobGetter := new(mockBlobGetter)
+			blob := new(mockBlob)
+			blobGetter.On("getBlob", "b", "k").Return(blob, nil)
+
+			var list storage.BlockListResponse
+			for _, id := range tc.committed {
+				list.CommittedBlocks = append(list.CommittedBlocks, storage.BlockResponse{Name: id, Size: 4})
+			}
+			blob.On("GetBlockList", storage.BlockListTypeCommitted, mock.Anything).Return(list, tc.listErr)
+
+			var puts []string
+			blob.On("PutBlock", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				puts = append(puts, args.String(0))
+			}).Return(nil)
+			var committed []storage.Block
+			blob.On("PutBlockList", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				committed = args.Get(0).([]storage.Block)
+			}).Return(nil)
+
+			o := &ObjectStore{
+				log:         logrus.New(),
+				blobGetter:  blobGetter,
+				blockSize:   4,
+				reuseBlocks: true,
+			}
+			require.NoError(t, o.PutObject("b", "k", strings.NewReader("abcdEFGHij")))
+
+			assert.Equal(t, tc.expectedPuts, puts)
+			require.Len(t, committed, 3)
+			for i, block := range committed {
+				assert.Equal(t, tc.expectedStatus[i], block.Status)
+			}
+		})
+	}
+}
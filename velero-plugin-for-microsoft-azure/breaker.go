@@ -0,0 +1,328 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	circuitBreakerFailuresConfigKey = "circuitBreakerFailures"
+	circuitBreakerCooldownConfigKey = "circuitBreakerCooldown"
+
+	defaultCircuitBreakerCooldown = 30 * time.Second
+	circuitBreakerProbeTimeout    = 10 * time.Second
+
+	// maxRetryDelay caps the exponential backoff between retries, unless
+	// config.storageMaxRetryDelay is set.
+	maxRetryDelay = 2 * time.Minute
+)
+
+// circuitBreakerOpen is 1 for each storage endpoint whose circuit breaker is
+// open, and 0 for the others.
+var circuitBreakerOpen = expvar.NewMap("azure_storage_circuit_breaker_open")
+
+// jitterSender sends storage requests, retrying throttled or failed requests
+// with exponential backoff and full jitter, so that the retries of many
+// concurrent uploads don't arrive in waves. If it has a circuit breaker, it
+// fails fast while the breaker of the request's endpoint is open. With a
+// TryTimeout, tries that take longer, including reading their response, are
+// abandoned and retried.
+type jitterSender struct {
+	RetryAttempts    int
+	RetryDuration    time.Duration
+	MaxRetryDelay    time.Duration
+	TryTimeout       time.Duration
+	ValidStatusCodes []int
+
+	breakers *circuitBreakers
+	sleep    func(time.Duration)
+	random   func(int64) int64
+}
+
+func (s *jitterSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	var breaker *circuitBreaker
+	if s.breakers != nil {
+		breaker = s.breakers.get(req.URL.Scheme, req.URL.Host)
+		if err := breaker.allow(c.HTTPClient); err != nil {
+			return nil, err
+		}
+	}
+
+	rr := autorest.NewRetriableRequest(req)
+	var (
+		resp *http.Response
+		err  error
+	)
+	for attempt := 0; attempt < s.RetryAttempts; attempt++ {
+		if err = rr.Prepare(); err != nil {
+			return resp, err
+		}
+		tryReq, cancel := rr.Request(), context.CancelFunc(func() {})
+		if s.TryTimeout > 0 {
+			var ctx context.Context
+			ctx, cancel = context.WithTimeout(req.Context(), s.TryTimeout)
+			tryReq = tryReq.WithContext(ctx)
+		}
+
+		start := time.Now()
+		resp, err = c.HTTPClient.Do(tryReq)
+		diagnostics.recordRequest(req, resp, err, time.Since(start), time.Now())
+		timedOut := err != nil && tryReq.Context().Err() == context.DeadlineExceeded && req.Context().Err() == nil
+		if (err != nil && !timedOut) || (err == nil && !autorest.ResponseHasStatusCode(resp, s.ValidStatusCodes...)) {
+			// the try's timeout applies until its response is read
+			if resp != nil {
+				resp.Body = &cancelingReadCloser{ReadCloser: resp.Body, cancel: cancel}
+			} else {
+				cancel()
+			}
+			break
+		}
+		if resp != nil {
+			autorest.DrainResponseBody(resp)
+		}
+		cancel()
+		if attempt < s.RetryAttempts-1 {
+			s.sleep(s.delay(attempt))
+		}
+	}
+
+	if breaker != nil {
+		breaker.record(err == nil && !autorest.ResponseHasStatusCode(resp, s.ValidStatusCodes...))
+	}
+
+	return resp, err
+}
+
+// delay returns a random delay of up to RetryDuration * 2^attempt, capped at
+// MaxRetryDelay, or maxRetryDelay if it's not set.
+func (s *jitterSender) delay(attempt int) time.Duration {
+	limit := s.MaxRetryDelay
+	if limit <= 0 {
+		limit = maxRetryDelay
+	}
+
+	backoff := limit
+	if attempt < 16 {
+		if d := s.RetryDuration << uint(attempt); d < limit {
+			backoff = d
+		}
+	}
+	return time.Duration(s.random(int64(backoff) + 1))
+}
+
+// cancelingReadCloser cancels the context of a request once its response's
+// body is closed.
+type cancelingReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReadCloser) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// circuitBreakerError is returned for requests to a storage endpoint whose
+// circuit breaker is open.
+type circuitBreakerError struct {
+	endpoint string
+	failures int
+	until    time.Time
+}
+
+func (e *circuitBreakerError) Error() string {
+	return fmt.Sprintf("circuit breaker for storage endpoint %s is open after %d consecutive failures: failing fast until %s", e.endpoint, e.failures, e.until.Format(time.RFC3339))
+}
+
+// circuitBreaker tracks the consecutive failures of requests to a storage
+// endpoint. Once threshold requests in a row have failed it opens, and
+// requests fail fast until the cooldown has elapsed. The next request then
+// probes the endpoint with an unauthenticated HEAD request, closing the
+// breaker if the endpoint responds and reopening it otherwise.
+type circuitBreaker struct {
+	log       logrus.FieldLogger
+	endpoint  string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow(client *http.Client) error {
+	b.lock.Lock()
+	if b.failures < b.threshold {
+		b.lock.Unlock()
+		return nil
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		err := &circuitBreakerError{endpoint: b.endpoint, failures: b.failures, until: b.openUntil}
+		b.lock.Unlock()
+		return err
+	}
+	b.probing = true
+	b.lock.Unlock()
+
+	healthy := b.probe(client)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+	if !healthy {
+		b.openUntil = b.now().Add(b.cooldown)
+		b.log.WithField("endpoint", b.endpoint).Warn("Storage endpoint is still failing, keeping circuit breaker open")
+		return &circuitBreakerError{endpoint: b.endpoint, failures: b.failures, until: b.openUntil}
+	}
+
+	b.failures = 0
+	circuitBreakerOpen.Set(b.endpoint, new(expvar.Int))
+	b.log.WithField("endpoint", b.endpoint).Info("Storage endpoint recovered, closing circuit breaker")
+	return nil
+}
+
+// probe returns whether the endpoint responds to a lightweight request. Any
+// response other than a server error means the endpoint is serving requests;
+// the probe isn't authorized, so it's expected to be rejected.
+func (b *circuitBreaker) probe(client *http.Client) bool {
+	req, err := http.NewRequest(http.MethodHead, b.endpoint+"/", nil)
+	if err != nil {
+		return false
+	}
+
+	probeClient := *client
+	probeClient.Timeout = circuitBreakerProbeTimeout
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode < http.StatusInternalServerError
+}
+
+// record records the outcome of a request, opening the breaker if it's the
+// threshold'th failure in a row.
+func (b *circuitBreaker) record(success bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if success {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures == b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+		open := new(expvar.Int)
+		open.Set(1)
+		circuitBreakerOpen.Set(b.endpoint, open)
+		b.log.WithFields(logrus.Fields{"endpoint": b.endpoint, "failures": b.failures}).Warnf("Storage endpoint is failing, opening circuit breaker for %s", b.cooldown)
+	}
+}
+
+// circuitBreakers holds the circuit breakers of storage endpoints. Breakers
+// are shared by every client in the process with the same settings, so that
+// all of a plugin's uploads back off from a degraded storage account
+// together, while locations that configure the breaker differently each get
+// their own.
+type circuitBreakers struct {
+	log       logrus.FieldLogger
+	threshold int
+	cooldown  time.Duration
+}
+
+var (
+	circuitBreakersLock sync.Mutex
+	// circuitBreakersByKey holds the process's breakers by endpoint, threshold
+	// and cooldown.
+	circuitBreakersByKey = map[string]*circuitBreaker{}
+)
+
+func (c *circuitBreakers) get(scheme, host string) *circuitBreaker {
+	endpoint := scheme + "://" + host
+	key := fmt.Sprintf("%s/%d/%s", endpoint, c.threshold, c.cooldown)
+
+	circuitBreakersLock.Lock()
+	defer circuitBreakersLock.Unlock()
+
+	breaker, ok := circuitBreakersByKey[key]
+	if !ok {
+		breaker = &circuitBreaker{
+			log:       c.log,
+			endpoint:  endpoint,
+			threshold: c.threshold,
+			cooldown:  c.cooldown,
+			now:       time.Now,
+		}
+		circuitBreakersByKey[key] = breaker
+	}
+	return breaker
+}
+
+// getCircuitBreakers returns the circuit breaker settings in config, or nil
+// if config.circuitBreakerFailures isn't set.
+func getCircuitBreakers(log logrus.FieldLogger, config map[string]string) (*circuitBreakers, error) {
+	val := config[circuitBreakerFailuresConfigKey]
+	if val == "" {
+		return nil, nil
+	}
+
+	threshold, err := strconv.Atoi(val)
+	if err != nil || threshold <= 0 {
+		return nil, errors.Errorf("unable to parse value %q for config key %q (expected a positive integer)", val, circuitBreakerFailuresConfigKey)
+	}
+
+	cooldown := defaultCircuitBreakerCooldown
+	if val := config[circuitBreakerCooldownConfigKey]; val != "" {
+		if cooldown, err = time.ParseDuration(val); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a duration string)", val, circuitBreakerCooldownConfigKey)
+		}
+		// with no cooldown, an open breaker would probe the endpoint on
+		// every request rather than failing fast
+		if cooldown <= 0 {
+			return nil, errors.Errorf("invalid value %q for config key %q (expected a positive duration string)", val, circuitBreakerCooldownConfigKey)
+		}
+	}
+
+	return &circuitBreakers{log: log, threshold: threshold, cooldown: cooldown}, nil
+}
+
+// withCircuitBreakers returns the sender with the given circuit breakers, if
+// it supports them.
+func withCircuitBreakers(sender storage.Sender, breakers *circuitBreakers) storage.Sender {
+	if s, ok := sender.(*jitterSender); ok && breakers != nil {
+		s.breakers = breakers
+	}
+	return sender
+}
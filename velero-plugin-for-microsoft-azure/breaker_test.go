@@ -0,0 +1,202 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJitterSenderDelay(t *testing.T) {
+	var max int64
+	s := &jitterSender{
+		RetryDuration: 5 * time.Second,
+		random: func(n int64) int64 {
+			max = n
+			return n - 1
+		},
+	}
+
+	assert.Equal(t, 5*time.Second, s.delay(0))
+	assert.Equal(t, int64(5*time.Second)+1, max)
+	assert.Equal(t, 20*time.Second, s.delay(2))
+	assert.Equal(t, maxRetryDelay, s.delay(10))
+	assert.Equal(t, maxRetryDelay, s.delay(100))
+}
+
+func TestJitterSenderRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var sleeps []time.Duration
+	s := &jitterSender{
+		RetryAttempts:    5,
+		RetryDuration:    time.Second,
+		ValidStatusCodes: []int{http.StatusServiceUnavailable},
+		sleep:            func(d time.Duration) { sleeps = append(sleeps, d) },
+		random:           func(n int64) int64 { return n / 2 },
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	resp, err := s.Send(&storage.Client{HTTPClient: server.Client()}, req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), requests)
+	assert.Equal(t, []time.Duration{time.Second / 2, time.Second}, sleeps)
+}
+
+func TestJitterSenderTryTimeout(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// hang until the try is abandoned
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	s := &jitterSender{
+		RetryAttempts: 3,
+		TryTimeout:    100 * time.Millisecond,
+		sleep:         func(time.Duration) {},
+		random:        func(n int64) int64 { return 0 },
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	resp, err := s.Send(&storage.Client{HTTPClient: server.Client()}, req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// the response of the last try can still be read
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, int32(2), requests)
+
+	s.MaxRetryDelay = 3 * time.Second
+	s.RetryDuration = time.Second
+	s.random = func(n int64) int64 { return n - 1 }
+	assert.Equal(t, 3*time.Second, s.delay(5))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// probes are unauthenticated, so a healthy endpoint rejects them
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	b := &circuitBreaker{
+		log:       logrus.New(),
+		endpoint:  server.URL,
+		threshold: 2,
+		cooldown:  time.Minute,
+		now:       func() time.Time { return now },
+	}
+
+	// the breaker stays closed until the threshold is reached
+	require.NoError(t, b.allow(server.Client()))
+	b.record(false)
+	require.NoError(t, b.allow(server.Client()))
+	b.record(false)
+
+	// then fails fast during the cooldown
+	err := b.allow(server.Client())
+	require.Error(t, err)
+	assert.IsType(t, &circuitBreakerError{}, err)
+	assert.Equal(t, "1", circuitBreakerOpen.Get(server.URL).String())
+
+	// and keeps failing if the probe fails once it has elapsed
+	now = now.Add(time.Minute)
+	require.Error(t, b.allow(server.Client()))
+	assert.Equal(t, now.Add(time.Minute), b.openUntil)
+
+	// and closes once the probe succeeds
+	now = now.Add(time.Minute)
+	atomic.StoreInt32(&healthy, 1)
+	require.NoError(t, b.allow(server.Client()))
+	assert.Equal(t, 0, b.failures)
+	assert.Equal(t, "0", circuitBreakerOpen.Get(server.URL).String())
+
+	// a success resets the consecutive failures
+	b.record(false)
+	b.record(true)
+	b.record(false)
+	assert.NoError(t, b.allow(server.Client()))
+}
+
+func TestCircuitBreakersAreSharedBySettings(t *testing.T) {
+	strict := &circuitBreakers{log: logrus.New(), threshold: 2, cooldown: time.Minute}
+	alsoStrict := &circuitBreakers{log: logrus.New(), threshold: 2, cooldown: time.Minute}
+	lenient := &circuitBreakers{log: logrus.New(), threshold: 20, cooldown: time.Minute}
+
+	breaker := strict.get("https", "shared.blob.core.windows.net")
+	assert.Same(t, breaker, alsoStrict.get("https", "shared.blob.core.windows.net"))
+	assert.True(t, breaker != strict.get("https", "other.blob.core.windows.net"))
+
+	other := lenient.get("https", "shared.blob.core.windows.net")
+	assert.True(t, breaker != other)
+	assert.Equal(t, 20, other.threshold)
+}
+
+func TestGetCircuitBreakers(t *testing.T) {
+	breakers, err := getCircuitBreakers(logrus.New(), map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, breakers)
+
+	breakers, err = getCircuitBreakers(logrus.New(), map[string]string{circuitBreakerFailuresConfigKey: "10", circuitBreakerCooldownConfigKey: "1m"})
+	require.NoError(t, err)
+	assert.Equal(t, 10, breakers.threshold)
+	assert.Equal(t, time.Minute, breakers.cooldown)
+
+	for _, config := range []map[string]string{
+		{circuitBreakerFailuresConfigKey: "0"},
+		{circuitBreakerFailuresConfigKey: "many"},
+		{circuitBreakerFailuresConfigKey: "10", circuitBreakerCooldownConfigKey: "a while"},
+		{circuitBreakerFailuresConfigKey: "10", circuitBreakerCooldownConfigKey: "0s"},
+		{circuitBreakerFailuresConfigKey: "10", circuitBreakerCooldownConfigKey: "-1m"},
+	} {
+		_, err := getCircuitBreakers(logrus.New(), config)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// byoSnapshotsAnnotation is the restore annotation listing the existing
+	// snapshots to restore persistent volumes from, as
+	// "<persistent volume>=<snapshot ID>,...".
+	byoSnapshotsAnnotation = "azure.velero.io/snapshots"
+	// byoDiskSkuAnnotation is the restore annotation setting the SKU of the
+	// disks created from those snapshots.
+	byoDiskSkuAnnotation = "azure.velero.io/snapshot-disk-sku"
+
+	defaultBYODiskSku = "Premium_LRS"
+)
+
+// zoneLabels are the labels of persistent volumes that record their
+// availability zone, in order of preference.
+var zoneLabels = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+
+// volumeRestorer creates disks from snapshots and points persistent volumes
+// at them. It's implemented by VolumeSnapshotter.
+type volumeRestorer interface {
+	CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error)
+	SetVolumeID(pv runtime.Unstructured, volumeID string) (runtime.Unstructured, error)
+}
+
+// byoSnapshotRestoreAction restores persistent volumes from snapshots that
+// weren't taken by Velero, e.g. by other backup tooling, as listed in the
+// restore's azure.velero.io/snapshots annotation. Each listed volume is
+// recreated from its snapshot in the same way as from one of Velero's.
+//
+// Velero dynamically reprovisions volumes that have neither a snapshot nor a
+// Retain reclaim policy before restore item actions run, so only volumes
+// with a Retain reclaim policy can be restored from such snapshots.
+type byoSnapshotRestoreAction struct {
+	log         logrus.FieldLogger
+	newRestorer func() (volumeRestorer, error)
+}
+
+func newBYOSnapshotRestoreAction(log logrus.FieldLogger) *byoSnapshotRestoreAction {
+	return &byoSnapshotRestoreAction{
+		log: log,
+		newRestorer: func() (volumeRestorer, error) {
+			// snapshots are restored in the cluster's resource group, as
+			// configured by the credentials file
+			snapshotter := newVolumeSnapshotter(log)
+			if err := snapshotter.Init(map[string]string{}); err != nil {
+				return nil, err
+			}
+			return snapshotter, nil
+		},
+	}
+}
+
+func (a *byoSnapshotRestoreAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+func (a *byoSnapshotRestoreAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	output := velero.NewRestoreItemActionExecuteOutput(input.Item)
+
+	snapshots, err := parseBYOSnapshots(input.Restore.Annotations[byoSnapshotsAnnotation])
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return output, nil
+	}
+
+	// snapshots are listed by the volumes' names in the backup, since
+	// restored volumes may be renamed
+	original := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.ItemFromBackup.UnstructuredContent(), original); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	snapshotID, ok := snapshots[original.Name]
+	if !ok {
+		return output, nil
+	}
+	log := a.log.WithFields(logrus.Fields{"persistentVolume": original.Name, "snapshotID": snapshotID})
+
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if pv.Spec.AzureDisk == nil {
+		return nil, errors.Errorf("persistent volume %s is not an Azure disk", original.Name)
+	}
+
+	// don't replace (and leak) a disk Velero restored from its own snapshot
+	if original.Spec.AzureDisk != nil && !strings.EqualFold(pv.Spec.AzureDisk.DataDiskURI, original.Spec.AzureDisk.DataDiskURI) {
+		log.Warn("Persistent volume was restored from a Velero snapshot, ignoring the snapshot in the restore's annotations")
+		return output, nil
+	}
+
+	// disks can't be adopted by Azure Container Storage pools
+	if isContainerStorageClass(pv.Spec.StorageClassName, input.Restore.Annotations[containerStorageClassesAnnotation]) {
+		return nil, errContainerStoragePool(original.Name, pv.Spec.StorageClassName)
+	}
+
+	sku := input.Restore.Annotations[byoDiskSkuAnnotation]
+	if sku == "" {
+		sku = defaultBYODiskSku
+	}
+
+	restorer, err := a.newRestorer()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Restoring persistent volume from snapshot in the restore's annotations")
+	diskName, err := restorer.CreateVolumeFromSnapshot(snapshotID, sku, pvZone(original), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error restoring persistent volume %s from snapshot %s", original.Name, snapshotID)
+	}
+
+	updated, err := restorer.SetVolumeID(input.Item, diskName)
+	if err != nil {
+		return nil, err
+	}
+	output.UpdatedItem = updated
+
+	return output, nil
+}
+
+// parseBYOSnapshots parses the value of the azure.velero.io/snapshots restore
+// annotation into a map of persistent volume names to snapshot IDs.
+func parseBYOSnapshots(val string) (map[string]string, error) {
+	snapshots := map[string]string{}
+	for _, pair := range strings.Split(val, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid value %q in annotation %q (expected <persistent volume>=<snapshot ID>)", pair, byoSnapshotsAnnotation)
+		}
+		if _, err := parseFullSnapshotName(parts[1]); err != nil {
+			return nil, errors.Wrapf(err, "invalid snapshot ID for persistent volume %s in annotation %q", parts[0], byoSnapshotsAnnotation)
+		}
+		snapshots[parts[0]] = parts[1]
+	}
+	return snapshots, nil
+}
+
+// pvZone returns the availability zone of the given persistent volume, e.g.
+// "westus2-1", or "" if it isn't zonal.
+func pvZone(pv *v1.PersistentVolume) string {
+	for _, label := range zoneLabels {
+		if zone := pv.Labels[label]; zone != "" {
+			return zone
+		}
+	}
+	return ""
+}
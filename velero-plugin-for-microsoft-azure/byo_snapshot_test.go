@@ -0,0 +1,147 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const testBYOSnapshotID = "/subscriptions/sub/resourceGroups/other-rg/providers/Microsoft.Compute/snapshots/migrated"
+
+type fakeVolumeRestorer struct {
+	*VolumeSnapshotter
+	snapshotID, volumeType, volumeAZ string
+}
+
+func (r *fakeVolumeRestorer) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
+	r.snapshotID, r.volumeType, r.volumeAZ = snapshotID, volumeType, volumeAZ
+	return "restore-1", nil
+}
+
+func TestParseBYOSnapshots(t *testing.T) {
+	snapshots, err := parseBYOSnapshots("")
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+
+	snapshots, err = parseBYOSnapshots("pv-1=" + testBYOSnapshotID + ", pv-2=" + testBYOSnapshotID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pv-1": testBYOSnapshotID, "pv-2": testBYOSnapshotID}, snapshots)
+
+	_, err = parseBYOSnapshots("pv-1")
+	assert.EqualError(t, err, `invalid value "pv-1" in annotation "azure.velero.io/snapshots" (expected <persistent volume>=<snapshot ID>)`)
+
+	_, err = parseBYOSnapshots("pv-1=snapshot")
+	assert.Error(t, err)
+}
+
+func TestBYOSnapshotRestoreAction(t *testing.T) {
+	pv := func(name, diskURI string) *unstructured.Unstructured {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{"failure-domain.beta.kubernetes.io/zone": "westus2-2"},
+			},
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					AzureDisk: &v1.AzureDiskVolumeSource{DiskName: "original", DataDiskURI: diskURI},
+				},
+			},
+		})
+		require.NoError(t, err)
+		return &unstructured.Unstructured{Object: obj}
+	}
+	originalURI := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/original"
+
+	tests := []struct {
+		name             string
+		annotations      map[string]string
+		item             *unstructured.Unstructured
+		expectedRestored bool
+		expectedSku      string
+	}{
+		{
+			name:        "restores without the annotation are unchanged",
+			annotations: nil,
+			item:        pv("pv-1", originalURI),
+		},
+		{
+			name:        "volumes that aren't listed are unchanged",
+			annotations: map[string]string{byoSnapshotsAnnotation: "pv-2=" + testBYOSnapshotID},
+			item:        pv("pv-1", originalURI),
+		},
+		{
+			name:             "listed volumes are restored from their snapshot",
+			annotations:      map[string]string{byoSnapshotsAnnotation: "pv-1=" + testBYOSnapshotID},
+			item:             pv("pv-1", originalURI),
+			expectedRestored: true,
+			expectedSku:      defaultBYODiskSku,
+		},
+		{
+			name:             "renamed volumes are matched by their original name",
+			annotations:      map[string]string{byoSnapshotsAnnotation: "pv-1=" + testBYOSnapshotID, byoDiskSkuAnnotation: "StandardSSD_LRS"},
+			item:             pv("velero-clone-1", originalURI),
+			expectedRestored: true,
+			expectedSku:      "StandardSSD_LRS",
+		},
+		{
+			name:        "volumes restored from Velero snapshots are unchanged",
+			annotations: map[string]string{byoSnapshotsAnnotation: "pv-1=" + testBYOSnapshotID},
+			item:        pv("pv-1", "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/restore-0"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			restorer := &fakeVolumeRestorer{VolumeSnapshotter: &VolumeSnapshotter{disksSubscription: "sub", disksResourceGroup: "rg"}}
+			action := &byoSnapshotRestoreAction{
+				log:         logrus.New(),
+				newRestorer: func() (volumeRestorer, error) { return restorer, nil },
+			}
+
+			out, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+				Item:           tc.item,
+				ItemFromBackup: pv("pv-1", originalURI),
+				Restore:        &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations}},
+			})
+			require.NoError(t, err)
+
+			res := new(v1.PersistentVolume)
+			require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(out.UpdatedItem.UnstructuredContent(), res))
+
+			if !tc.expectedRestored {
+				assert.Equal(t, "", restorer.snapshotID)
+				assert.Equal(t, tc.item.Object, out.UpdatedItem.UnstructuredContent())
+				return
+			}
+			assert.Equal(t, testBYOSnapshotID, restorer.snapshotID)
+			assert.Equal(t, tc.expectedSku, restorer.volumeType)
+			assert.Equal(t, "westus2-2", restorer.volumeAZ)
+			assert.Equal(t, "restore-1", res.Spec.AzureDisk.DiskName)
+			assert.Equal(t, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/restore-1", res.Spec.AzureDisk.DataDiskURI)
+		})
+	}
+}
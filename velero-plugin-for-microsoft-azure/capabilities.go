@@ -0,0 +1,206 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	objectStoreKind       = "objectstore"
+	volumeSnapshotterKind = "volumesnapshotter"
+)
+
+// capability is an optional feature of a plugin and whether it's active.
+type capability struct {
+	name    string
+	enabled bool
+}
+
+// signedURLsAvailable returns whether signed URLs can be created with the
+// given config. The credentials file must already be loaded into the
+// environment.
+func signedURLsAvailable(config map[string]string) bool {
+	// signed URLs are signed with the account key, or with a user delegation
+	// key when AAD tokens are used, so they're unavailable when only a SAS is
+	// provided
+	if boolConfig(config, useAADConfigKey) {
+		return config[customerProvidedKeyEnvVarConfigKey] == ""
+	}
+	sasOnly := config[storageAccountSASEnvVarConfigKey] != "" ||
+		config[storageAccountKeyEnvVarConfigKey] == "" && os.Getenv(storageAccountSASEnvVar) != ""
+	if connectionString, err := getStorageConnectionString(config); err == nil && connectionString != nil {
+		sasOnly = connectionString.sasToken != ""
+	}
+	// reads of blobs encrypted with a customer-provided key must carry the
+	// key in their headers, which signed URLs can't
+	return !sasOnly && config[customerProvidedKeyEnvVarConfigKey] == ""
+}
+
+// accountSASAvailable returns whether URLs can be signed with the storage
+// account's key with the given config, as server-side copies from the
+// location's container require. The credentials file must already be loaded
+// into the environment.
+func accountSASAvailable(config map[string]string) bool {
+	return !boolConfig(config, useAADConfigKey) && signedURLsAvailable(config)
+}
+
+func boolConfig(config map[string]string, key string) bool {
+	enabled, _ := strconv.ParseBool(config[key])
+	return enabled
+}
+
+// objectStoreCapabilities returns the optional features of the object store
+// and whether they're active for the given config. The credentials file must
+// already be loaded into the environment.
+func objectStoreCapabilities(config map[string]string) []capability {
+	useAAD := boolConfig(config, useAADConfigKey)
+	prefetchWindow, _ := getPrefetchWindow(config)
+	recordDiagnostics, _ := getRecordDiagnostics(config)
+
+	return []capability{
+		{"signedURLs", signedURLsAvailable(config)},
+		{"resumableDownloads", true},
+		{"requestCoalescing", true},
+		{"prefetch", prefetchWindow > 0},
+		{"dataProtectionEnforcement", boolConfig(config, enforceDataProtectionConfigKey)},
+		{"catalogIndex", boolConfig(config, catalogIndexConfigKey)},
+		{"failureSummaries", boolConfig(config, failureSummariesConfigKey)},
+		{"replication", config[replicationStorageAccountConfigKey] != ""},
+		{"readFromReplica", boolConfig(config, readFromReplicaConfigKey)},
+		{"readCache", config[readCacheURLConfigKey] != ""},
+		{"proxy", config[proxyURLConfigKey] != ""},
+		{"bandwidthSchedule", config[bandwidthScheduleConfigKey] != ""},
+		{"endpointPinning", config[storageEndpointIPsConfigKey] != "" || config[dnsServerConfigKey] != ""},
+		{"metrics", config[metricsBindAddressConfigKey] != ""},
+		{"maxObjectSize", config[maxObjectSizeConfigKey] != ""},
+		{"uploadConcurrency", config[uploadConcurrencyConfigKey] != ""},
+		{"runtimeControl", config[controlPollIntervalConfigKey] != ""},
+		{"smallObjectPacking", boolConfig(config, packSmallObjectsConfigKey)},
+		{"configDriftDetection", boolConfig(config, detectConfigDriftConfigKey)},
+		{"auditLog", boolConfig(config, auditLogConfigKey)},
+		{"mirrors", config[mirrorLocationsConfigKey] != ""},
+		{"logRedaction", boolConfig(config, redactLogSecretsConfigKey)},
+		{"circuitBreaker", config[circuitBreakerFailuresConfigKey] != ""},
+		{"operationTimeout", config[operationTimeoutConfigKey] != ""},
+		{"storageRetryPolicy", config[storageMaxTriesConfigKey] != "" || config[storageTryTimeoutConfigKey] != "" || config[storageRetryDelayConfigKey] != "" || config[storageMaxRetryDelayConfigKey] != ""},
+		{"inlineLogURLs", boolConfig(config, inlineLogURLsConfigKey)},
+		{"storedAccessPolicy", config[sasAccessPolicyConfigKey] != ""},
+		{"operationJournal", boolConfig(config, operationJournalConfigKey)},
+		{"latencyBaseline", boolConfig(config, latencyBaselineConfigKey)},
+		{"resourceGraphQueries", boolConfig(config, resourceGraphQueriesConfigKey)},
+		{"insecureSkipTLSVerify", boolConfig(config, insecureSkipTLSVerifyConfigKey)},
+		{"aadAuthentication", useAAD},
+		{"storageEmulator", boolConfig(config, useEmulatorConfigKey) || config[storageAccountURIConfigKey] != ""},
+		{"customBlobDomain", config[blobDomainConfigKey] != ""},
+		{"blockBlobAccessTier", config[blockBlobAccessTierConfigKey] != ""},
+		{"archiveRehydration", boolConfig(config, rehydrateArchivedObjectsConfigKey)},
+		{"immutabilityPolicy", config[immutabilityPeriodDaysConfigKey] != ""},
+		{"legalHold", boolConfig(config, legalHoldConfigKey)},
+		{"requireImmutableStorage", boolConfig(config, requireImmutableStorageConfigKey)},
+		{"blockReuse", boolConfig(config, reuseUnchangedBlocksConfigKey)},
+		{"customerProvidedKey", config[customerProvidedKeyEnvVarConfigKey] != ""},
+		{"encryptionScope", config[storageEncryptionScopeConfigKey] != ""},
+		{"uploadLabels", boolConfig(config, labelUploadsConfigKey) || config[blobTagTemplatesConfigKey] != ""},
+		{"diagnostics", recordDiagnostics},
+	}
+}
+
+// volumeSnapshotterCapabilities returns the optional features of the volume
+// snapshotter and whether they're active for the given config.
+func volumeSnapshotterCapabilities(config map[string]string) []capability {
+	recordDiagnostics, _ := getRecordDiagnostics(config)
+
+	return []capability{
+		{"snapshots", true},
+		{"incrementalSnapshots", boolConfig(config, snapsIncrementalConfigKey)},
+		{"crossSubscriptionSnapshots", config[subscriptionIDConfigKey] != ""},
+		{"detachedRestores", boolConfig(config, restoreDisksDetachedConfigKey)},
+		{"snapshotVerification", boolConfig(config, verifySnapshotsConfigKey)},
+		{"excludedStorageClasses", config[excludedStorageClassesConfigKey] != ""},
+		{"restoredDiskTags", config[restoredDiskTagsConfigKey] != ""},
+		{"restoreSnapshotTagSelector", config[restoreSnapshotTagSelectorConfigKey] != ""},
+		{"restoredDiskNetworkAccess", config[restoredDiskNetworkAccessPolicyConfigKey] != "" || config[restoredDiskAccessIDConfigKey] != ""},
+		{"scaleDownSnapshots", config[scaleDownSnapshotsConfigKey] != ""},
+		{"apiRetryAttempts", config[apiRetryAttemptsConfigKey] != ""},
+		{"computeAPIVersion", config[computeAPIVersionConfigKey] != ""},
+		{"deleteLockWait", config[deleteLockWaitConfigKey] != ""},
+		{"snapshotCostReport", boolConfig(config, snapshotCostReportConfigKey)},
+		{"deterministicSnapshotNames", boolConfig(config, deterministicSnapshotNamesConfigKey)},
+		{"operationJournal", boolConfig(config, operationJournalConfigKey)},
+		{"snapshotMetrics", config[snapshotMetricsIntervalConfigKey] != ""},
+		{"snapshotSidecars", config[metadataBucketConfigKey] != ""},
+		{"auditLog", boolConfig(config, auditLogConfigKey)},
+		{"diagnostics", recordDiagnostics},
+	}
+}
+
+// logCapabilities logs the given capabilities at debug level, since plugins
+// are initialized for every operation.
+func logCapabilities(log logrus.FieldLogger, kind string, caps []capability) {
+	fields := logrus.Fields{}
+	for _, c := range caps {
+		fields[c.name] = c.enabled
+	}
+	log.WithFields(fields).Debugf("Active %s capabilities", kind)
+}
+
+func printCapabilities(w io.Writer, caps []capability) {
+	for _, c := range caps {
+		state := "disabled"
+		if c.enabled {
+			state = "enabled"
+		}
+		fmt.Fprintf(w, "%-28s %s\n", c.name, state)
+	}
+}
+
+func runCapabilities(_ logrus.FieldLogger, args []string) error {
+	var (
+		kind   string
+		config map[string]string
+	)
+
+	flags := pflag.NewFlagSet("capabilities", pflag.ContinueOnError)
+	flags.StringVar(&kind, "kind", objectStoreKind, fmt.Sprintf("The plugin kind to report on (%s or %s)", objectStoreKind, volumeSnapshotterKind))
+	flags.StringToStringVar(&config, "config", nil, "The location's config, as key=value pairs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := loadCredentialsIntoEnv(credentialsFileFromEnv()); err != nil {
+		return err
+	}
+
+	switch kind {
+	case objectStoreKind:
+		printCapabilities(os.Stdout, objectStoreCapabilities(config))
+	case volumeSnapshotterKind:
+		printCapabilities(os.Stdout, volumeSnapshotterCapabilities(config))
+	default:
+		return errors.Errorf("unknown plugin kind %q", kind)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func capabilityMap(caps []capability) map[string]bool {
+	res := map[string]bool{}
+	for _, c := range caps {
+		res[c.name] = c.enabled
+	}
+	return res
+}
+
+func TestObjectStoreCapabilities(t *testing.T) {
+	defer setEnv(t, nil)()
+
+	caps := capabilityMap(objectStoreCapabilities(map[string]string{
+		prefetchObjectsConfigKey:           "4",
+		replicationStorageAccountConfigKey: "secondary",
+		catalogIndexConfigKey:              "true",
+	}))
+	assert.True(t, caps["signedURLs"])
+	assert.True(t, caps["prefetch"])
+	assert.True(t, caps["replication"])
+	assert.True(t, caps["catalogIndex"])
+	assert.False(t, caps["readFromReplica"])
+	assert.False(t, caps["endpointPinning"])
+
+	defer setEnv(t, map[string]string{storageAccountSASEnvVar: "sv=2019-02-02&sig=abc"})()
+	assert.False(t, capabilityMap(objectStoreCapabilities(map[string]string{}))["signedURLs"])
+
+	assert.False(t, capabilityMap(objectStoreCapabilities(map[string]string{storageAccountSASEnvVarConfigKey: "MY_SAS"}))["signedURLs"])
+
+	caps = capabilityMap(objectStoreCapabilities(map[string]string{useAADConfigKey: "true"}))
+	assert.True(t, caps["aadAuthentication"])
+	assert.True(t, caps["signedURLs"])
+}
+
+func TestVolumeSnapshotterCapabilities(t *testing.T) {
+	caps := capabilityMap(volumeSnapshotterCapabilities(map[string]string{
+		snapsIncrementalConfigKey: "true",
+		metadataBucketConfigKey:   "bucket",
+	}))
+	assert.True(t, caps["snapshots"])
+	assert.True(t, caps["incrementalSnapshots"])
+	assert.True(t, caps["snapshotSidecars"])
+	assert.False(t, caps["snapshotMetrics"])
+}
+
+func TestPrintCapabilities(t *testing.T) {
+	var out bytes.Buffer
+	printCapabilities(&out, []capability{{"a", true}, {"b", false}})
+	assert.Equal(t, "a                            enabled\nb                            disabled\n", out.String())
+}
@@ -0,0 +1,210 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	catalogIndexConfigKey = "catalogIndex"
+	clusterNameConfigKey  = "clusterName"
+
+	// catalogIndexKey is the key, relative to the container root, of the
+	// index summarizing the backups of every cluster writing to the container.
+	catalogIndexKey = "velero-catalog.json"
+
+	backupMetadataFile = "velero-backup.json"
+
+	maxCatalogUpdateAttempts = 5
+)
+
+type catalogEntry struct {
+	Cluster   string    `json:"cluster"`
+	Prefix    string    `json:"prefix,omitempty"`
+	Backup    string    `json:"backup"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type catalog struct {
+	Backups []catalogEntry `json:"backups"`
+}
+
+// set adds or replaces the entry for the given cluster, prefix and backup.
+func (c *catalog) set(entry catalogEntry) {
+	c.remove(entry.Cluster, entry.Prefix, entry.Backup)
+	c.Backups = append(c.Backups, entry)
+
+	sort.Slice(c.Backups, func(i, j int) bool {
+		a, b := c.Backups[i], c.Backups[j]
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		if a.Prefix != b.Prefix {
+			return a.Prefix < b.Prefix
+		}
+		return a.Backup < b.Backup
+	})
+}
+
+// remove removes the entry for the given cluster, prefix and backup, if any.
+func (c *catalog) remove(cluster, prefix, backup string) {
+	entries := c.Backups[:0]
+	for _, entry := range c.Backups {
+		if entry.Cluster == cluster && entry.Prefix == prefix && entry.Backup == backup {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	c.Backups = entries
+}
+
+// catalogIndex maintains an index blob at the root of a container that lists
+// the backups of every cluster writing to it, so that a fleet-wide inventory
+// can be built from the container alone. Updates use optimistic concurrency
+// on the blob's ETag, so concurrent writers never lose each other's entries.
+type catalogIndex struct {
+	log        logrus.FieldLogger
+	blobGetter blobGetter
+	cluster    string
+	prefix     string
+}
+
+// backupNameFromMetadataKey returns the name of the backup whose metadata
+// file is stored at key, or false if key isn't a backup metadata file.
+func (c *catalogIndex) backupNameFromMetadataKey(key string) (string, bool) {
+	return backupNameFromMetadataKey(c.prefix, key)
+}
+
+// backupNameFromMetadataKey returns the name of the backup whose metadata
+// file is stored at key under the given prefix, or false if key isn't a
+// backup metadata file.
+func backupNameFromMetadataKey(prefix, key string) (string, bool) {
+	rel := key
+	if prefix != "" {
+		if !strings.HasPrefix(key, prefix+"/") {
+			return "", false
+		}
+		rel = strings.TrimPrefix(key, prefix+"/")
+	}
+
+	parts := strings.Split(rel, "/")
+	if len(parts) != 3 || parts[0] != "backups" || parts[2] != backupMetadataFile {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+// recordPut updates the catalog if key is a backup metadata file.
+func (c *catalogIndex) recordPut(bucket, key string) {
+	backup, ok := c.backupNameFromMetadataKey(key)
+	if !ok {
+		return
+	}
+
+	err := c.update(bucket, func(cat *catalog) {
+		cat.set(catalogEntry{
+			Cluster:   c.cluster,
+			Prefix:    c.prefix,
+			Backup:    backup,
+			UpdatedAt: time.Now().UTC(),
+		})
+	})
+	if err != nil {
+		c.log.WithError(err).WithField("backup", backup).Warn("Error adding backup to the catalog index")
+	}
+}
+
+// recordDelete updates the catalog if key is a backup metadata file.
+func (c *catalogIndex) recordDelete(bucket, key string) {
+	backup, ok := c.backupNameFromMetadataKey(key)
+	if !ok {
+		return
+	}
+
+	err := c.update(bucket, func(cat *catalog) {
+		cat.remove(c.cluster, c.prefix, backup)
+	})
+	if err != nil {
+		c.log.WithError(err).WithField("backup", backup).Warn("Error removing backup from the catalog index")
+	}
+}
+
+// update performs a read-modify-write of the catalog index, retrying if
+// another writer updated it concurrently.
+func (c *catalogIndex) update(bucket string, mutate func(*catalog)) error {
+	for attempt := 1; ; attempt++ {
+		err := c.tryUpdate(bucket, mutate)
+		if err == nil {
+			return nil
+		}
+
+		status := storageErrorStatusCode(err)
+		conflict := status == http.StatusPreconditionFailed || status == http.StatusConflict
+		if !conflict || attempt >= maxCatalogUpdateAttempts {
+			return err
+		}
+
+		c.log.Debugf("Catalog index was updated concurrently, retrying (attempt %d)", attempt)
+	}
+}
+
+func (c *catalogIndex) tryUpdate(bucket string, mutate func(*catalog)) error {
+	blob, err := c.blobGetter.getBlob(bucket, catalogIndexKey)
+	if err != nil {
+		return err
+	}
+
+	var (
+		cat     catalog
+		options = &storage.PutBlobOptions{IfNoneMatch: "*"}
+	)
+
+	res, err := blob.Get(nil)
+	switch {
+	case storageErrorStatusCode(err) == http.StatusNotFound:
+		// no catalog yet, so create it as long as nobody else does first
+	case err != nil:
+		return errors.Wrap(err, "error getting catalog index")
+	default:
+		decodeErr := json.NewDecoder(res).Decode(&cat)
+		res.Close()
+		if decodeErr != nil {
+			return errors.Wrap(decodeErr, "error decoding catalog index")
+		}
+		options = &storage.PutBlobOptions{IfMatch: blob.Properties().Etag}
+	}
+
+	mutate(&cat)
+
+	data, err := json.Marshal(cat)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(blob.CreateBlockBlobFromReader(bytes.NewReader(data), options))
+}
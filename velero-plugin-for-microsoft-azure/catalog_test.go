@@ -0,0 +1,104 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupNameFromMetadataKey(t *testing.T) {
+	c := &catalogIndex{}
+
+	name, ok := c.backupNameFromMetadataKey("backups/backup-1/velero-backup.json")
+	assert.True(t, ok)
+	assert.Equal(t, "backup-1", name)
+
+	_, ok = c.backupNameFromMetadataKey("backups/backup-1/backup-1.tar.gz")
+	assert.False(t, ok)
+
+	_, ok = c.backupNameFromMetadataKey("restores/restore-1/velero-backup.json")
+	assert.False(t, ok)
+
+	c.prefix = "cluster-a"
+	name, ok = c.backupNameFromMetadataKey("cluster-a/backups/backup-1/velero-backup.json")
+	assert.True(t, ok)
+	assert.Equal(t, "backup-1", name)
+
+	_, ok = c.backupNameFromMetadataKey("backups/backup-1/velero-backup.json")
+	assert.False(t, ok)
+}
+
+func TestCatalogIndexRecordPut(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	defer blobGetter.AssertExpectations(t)
+
+	blob := new(mockBlob)
+	defer blob.AssertExpectations(t)
+	blobGetter.On("getBlob", "bucket", catalogIndexKey).Return(blob, nil)
+
+	existing := `{"backups":[{"cluster":"other","backup":"backup-0"}]}`
+
+	// the first write loses a race with another writer, so the update is retried
+	blob.On("Get", mock.Anything).Return(ioutil.NopCloser(strings.NewReader(existing)), nil).Once()
+	blob.On("Get", mock.Anything).Return(ioutil.NopCloser(strings.NewReader(existing)), nil).Once()
+	blob.On("Properties").Return(storage.BlobProperties{Etag: "etag-1"}).Once()
+	blob.On("Properties").Return(storage.BlobProperties{Etag: "etag-2"}).Once()
+	blob.On("CreateBlockBlobFromReader", mock.Anything, &storage.PutBlobOptions{IfMatch: "etag-1"}).
+		Return(storage.AzureStorageServiceError{StatusCode: http.StatusPreconditionFailed}).Once()
+
+	var written catalog
+	blob.On("CreateBlockBlobFromReader", mock.Anything, &storage.PutBlobOptions{IfMatch: "etag-2"}).
+		Run(func(args mock.Arguments) {
+			require.NoError(t, json.NewDecoder(args.Get(0).(io.Reader)).Decode(&written))
+		}).
+		Return(nil).Once()
+
+	c := &catalogIndex{
+		log:        logrus.New(),
+		blobGetter: blobGetter,
+		cluster:    "cluster-a",
+	}
+	c.recordPut("bucket", "backups/backup-1/velero-backup.json")
+
+	require.Len(t, written.Backups, 2)
+	assert.Equal(t, "cluster-a", written.Backups[0].Cluster)
+	assert.Equal(t, "backup-1", written.Backups[0].Backup)
+	assert.Equal(t, "other", written.Backups[1].Cluster)
+}
+
+func TestCatalogRemove(t *testing.T) {
+	cat := &catalog{}
+	cat.set(catalogEntry{Cluster: "a", Backup: "backup-1"})
+	cat.set(catalogEntry{Cluster: "b", Backup: "backup-1"})
+	cat.set(catalogEntry{Cluster: "a", Backup: "backup-1"})
+	require.Len(t, cat.Backups, 2)
+
+	cat.remove("a", "", "backup-1")
+	require.Len(t, cat.Backups, 1)
+	assert.Equal(t, "b", cat.Backups[0].Cluster)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	v1 "k8s.io/api/core/v1"
+)
+
+// unknownOwner labels snapshots whose persistent volume has no claim or
+// storage class, or wasn't seen by GetVolumeID.
+const unknownOwner = "unknown"
+
+// the size of the disks snapshotted and the number of snapshots taken, by
+// the namespace and storage class of their persistent volumes' claims, as
+// "<namespace>/<storage class>", for charging teams back for their backups.
+// Backup tarballs hold the resources of every namespace in the backup, so
+// uploads can't be attributed.
+var (
+	snapshotBytesByOwner = expvar.NewMap("azure_snapshot_bytes")
+	snapshotsByOwner     = expvar.NewMap("azure_snapshots")
+)
+
+// volumeOwner is the namespace and storage class of a persistent volume's
+// claim.
+type volumeOwner struct {
+	namespace    string
+	storageClass string
+}
+
+func (o volumeOwner) String() string {
+	namespace, storageClass := o.namespace, o.storageClass
+	if namespace == "" {
+		namespace = unknownOwner
+	}
+	if storageClass == "" {
+		storageClass = unknownOwner
+	}
+	return namespace + "/" + storageClass
+}
+
+// Velero calls GetVolumeID with a persistent volume right before it calls
+// CreateSnapshot with the volume's ID, which is all CreateSnapshot gets, so
+// the owners of the volumes seen by GetVolumeID are kept by volume ID.
+var (
+	volumeOwnersLock sync.Mutex
+	volumeOwners     = map[string]volumeOwner{}
+)
+
+// rememberVolumeOwner records the owner of the given persistent volume,
+// whose volume ID is volumeID.
+func rememberVolumeOwner(volumeID string, pv *v1.PersistentVolume) {
+	owner := volumeOwner{storageClass: pv.Spec.StorageClassName}
+	if pv.Spec.ClaimRef != nil {
+		owner.namespace = pv.Spec.ClaimRef.Namespace
+	}
+
+	volumeOwnersLock.Lock()
+	defer volumeOwnersLock.Unlock()
+	volumeOwners[strings.ToLower(volumeID)] = owner
+}
+
+// takeVolumeOwner returns and forgets the owner of the volume with the given
+// ID.
+func takeVolumeOwner(volumeID string) volumeOwner {
+	volumeOwnersLock.Lock()
+	defer volumeOwnersLock.Unlock()
+
+	key := strings.ToLower(volumeID)
+	owner := volumeOwners[key]
+	delete(volumeOwners, key)
+	return owner
+}
+
+// recordSnapshotOwner adds a snapshot of the given disk to the metrics of
+// its volume's owner.
+func recordSnapshotOwner(volumeID string, diskInfo disk.Disk) {
+	owner := takeVolumeOwner(volumeID).String()
+
+	var size int64
+	if diskInfo.DiskProperties != nil {
+		switch {
+		case diskInfo.DiskSizeBytes != nil:
+			size = *diskInfo.DiskSizeBytes
+		case diskInfo.DiskSizeGB != nil:
+			size = int64(*diskInfo.DiskSizeGB) * 1024 * 1024 * 1024
+		}
+	}
+
+	snapshotBytesByOwner.Add(owner, size)
+	snapshotsByOwner.Add(owner, 1)
+}
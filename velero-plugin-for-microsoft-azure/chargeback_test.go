@@ -0,0 +1,57 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"testing"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestRecordSnapshotOwner(t *testing.T) {
+	value := func(m *expvar.Map, key string) int64 {
+		v, ok := m.Get(key).(*expvar.Int)
+		if !ok {
+			return 0
+		}
+		return v.Value()
+	}
+
+	pv := &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: "managed-premium",
+			ClaimRef:         &v1.ObjectReference{Namespace: "chargeback-test"},
+		},
+	}
+	sizeBytes, sizeGB := int64(1000), int32(1)
+	rememberVolumeOwner("Disk-1", pv)
+	recordSnapshotOwner("disk-1", disk.Disk{DiskProperties: &disk.DiskProperties{DiskSizeBytes: &sizeBytes}})
+	rememberVolumeOwner("disk-2", pv)
+	recordSnapshotOwner("disk-2", disk.Disk{DiskProperties: &disk.DiskProperties{DiskSizeGB: &sizeGB}})
+
+	assert.Equal(t, int64(1000+1024*1024*1024), value(snapshotBytesByOwner, "chargeback-test/managed-premium"))
+	assert.Equal(t, int64(2), value(snapshotsByOwner, "chargeback-test/managed-premium"))
+
+	// owners are forgotten once their snapshot is recorded
+	before := value(snapshotsByOwner, "unknown/unknown")
+	recordSnapshotOwner("disk-1", disk.Disk{})
+	assert.Equal(t, before+1, value(snapshotsByOwner, "unknown/unknown"))
+	assert.Equal(t, int64(2), value(snapshotsByOwner, "chargeback-test/managed-premium"))
+}
@@ -0,0 +1,158 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+const (
+	storageMaxTriesConfigKey      = "storageMaxTries"
+	storageTryTimeoutConfigKey    = "storageTryTimeout"
+	storageRetryDelayConfigKey    = "storageRetryDelay"
+	storageMaxRetryDelayConfigKey = "storageMaxRetryDelay"
+)
+
+// azureStackCloudName is the conventional name of Azure Stack Hub environments
+// loaded from AZURE_ENVIRONMENT_FILEPATH, with AZURE_CLOUD_NAME=AzureStackCloud.
+const azureStackCloudName = "AzureStackCloud"
+
+// cloudQuirks holds the operational differences between Azure clouds that
+// go beyond the endpoints in azure.Environment.
+type cloudQuirks struct {
+	// defaultAPITimeout is the default timeout for disk and snapshot
+	// operations, which are long-running operations in ARM.
+	defaultAPITimeout time.Duration
+
+	// pollingDelay is the delay between polls of long-running operations.
+	pollingDelay time.Duration
+
+	// storageRetryAttempts and storageRetryDuration configure the retries of
+	// throttled or failed blob requests, storageMaxRetryDelay caps their
+	// backoff and storageTryTimeout, if set, limits each try.
+	storageRetryAttempts int
+	storageRetryDuration time.Duration
+	storageMaxRetryDelay time.Duration
+	storageTryTimeout    time.Duration
+
+	// customMetricsDomain is the domain of the regional Azure Monitor
+	// endpoints that accept custom metrics, or empty if the cloud doesn't
+	// support them.
+	customMetricsDomain string
+}
+
+var defaultCloudQuirks = cloudQuirks{
+	defaultAPITimeout:    2 * time.Minute,
+	pollingDelay:         5 * time.Second,
+	storageRetryAttempts: 5,
+	storageRetryDuration: 5 * time.Second,
+	customMetricsDomain:  "monitoring.azure.com",
+}
+
+// quirksFor returns the quirks of the given cloud.
+func quirksFor(env *azure.Environment) cloudQuirks {
+	switch env.Name {
+	case azure.ChinaCloud.Name:
+		// Azure China (operated by 21Vianet) completes disk and snapshot
+		// operations noticeably slower, storage requests from outside China
+		// cross the border and are throttled more aggressively, and Azure
+		// Monitor doesn't support custom metrics.
+		return cloudQuirks{
+			defaultAPITimeout:    5 * time.Minute,
+			pollingDelay:         10 * time.Second,
+			storageRetryAttempts: 8,
+			storageRetryDuration: 10 * time.Second,
+		}
+	case hybridEnvironmentName, azureStackCloudName:
+		quirks := defaultCloudQuirks
+		// Azure Stack Hub has no Azure Monitor custom metrics
+		quirks.customMetricsDomain = ""
+		return quirks
+	case azure.USGovernmentCloud.Name, azure.GermanCloud.Name:
+		quirks := defaultCloudQuirks
+		// custom metrics are only available in a few US Government regions,
+		// and in no Azure Germany regions, so treat them as unsupported
+		quirks.customMetricsDomain = ""
+		return quirks
+	default:
+		return defaultCloudQuirks
+	}
+}
+
+// storageSender returns a sender for storage clients that retries according
+// to the quirks.
+func (q cloudQuirks) storageSender() storage.Sender {
+	return &jitterSender{
+		RetryAttempts: q.storageRetryAttempts,
+		RetryDuration: q.storageRetryDuration,
+		MaxRetryDelay: q.storageMaxRetryDelay,
+		TryTimeout:    q.storageTryTimeout,
+		ValidStatusCodes: []int{
+			http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+		sleep:  time.Sleep,
+		random: rand.Int63n,
+	}
+}
+
+// withStorageRetryConfig returns the quirks with the retry policy of blob
+// requests overridden by config.storageMaxTries, config.storageTryTimeout,
+// config.storageRetryDelay and config.storageMaxRetryDelay, e.g. for flaky
+// networks between on-premises clusters and Azure.
+func (q cloudQuirks) withStorageRetryConfig(config map[string]string) (cloudQuirks, error) {
+	if val := config[storageMaxTriesConfigKey]; val != "" {
+		tries, err := strconv.Atoi(val)
+		if err != nil || tries <= 0 {
+			return q, errors.Errorf("unable to parse value %q for config key %q (expected a positive integer)", val, storageMaxTriesConfigKey)
+		}
+		q.storageRetryAttempts = tries
+	}
+
+	durations := []struct {
+		key   string
+		value *time.Duration
+	}{
+		{storageTryTimeoutConfigKey, &q.storageTryTimeout},
+		{storageRetryDelayConfigKey, &q.storageRetryDuration},
+		{storageMaxRetryDelayConfigKey, &q.storageMaxRetryDelay},
+	}
+	for _, d := range durations {
+		val := config[d.key]
+		if val == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(val)
+		if err != nil || duration <= 0 {
+			return q, errors.Errorf("unable to parse value %q for config key %q (expected a positive duration string)", val, d.key)
+		}
+		*d.value = duration
+	}
+
+	return q, nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuirksFor(t *testing.T) {
+	assert.Equal(t, defaultCloudQuirks, quirksFor(&azure.PublicCloud))
+
+	china := quirksFor(&azure.ChinaCloud)
+	assert.Equal(t, 5*time.Minute, china.defaultAPITimeout)
+	assert.True(t, china.pollingDelay > defaultCloudQuirks.pollingDelay)
+	assert.True(t, china.storageRetryAttempts > defaultCloudQuirks.storageRetryAttempts)
+	assert.Empty(t, china.customMetricsDomain)
+
+	usgov := quirksFor(&azure.USGovernmentCloud)
+	assert.Equal(t, defaultCloudQuirks.defaultAPITimeout, usgov.defaultAPITimeout)
+	assert.Empty(t, usgov.customMetricsDomain)
+
+	assert.Equal(t, defaultCloudQuirks.defaultAPITimeout, quirksFor(&azure.GermanCloud).defaultAPITimeout)
+	assert.Empty(t, quirksFor(&azure.GermanCloud).customMetricsDomain)
+
+	assert.Empty(t, quirksFor(&azure.Environment{Name: hybridEnvironmentName}).customMetricsDomain)
+	assert.Empty(t, quirksFor(&azure.Environment{Name: azureStackCloudName}).customMetricsDomain)
+}
+
+func TestGetAzureEnvironment(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/metadata/endpoints", r.URL.Path)
+		w.Write([]byte(`{"authentication": {"loginEndpoint": "https://adfs.local.azurestack.external/adfs", "audiences": ["https://management.adfs.azurestack.local/1234"]}}`))
+	}))
+	defer server.Close()
+
+	env, err := getAzureEnvironment(map[string]string{resourceManagerEndpointConfigKey: server.URL})
+	require.NoError(t, err)
+	assert.Equal(t, hybridEnvironmentName, env.Name)
+	assert.Equal(t, server.URL, env.ResourceManagerEndpoint)
+	assert.Equal(t, "https://adfs.local.azurestack.external/adfs", env.ActiveDirectoryEndpoint)
+	assert.Equal(t, "https://management.adfs.azurestack.local/1234", armResource(env))
+
+	_, err = getAzureEnvironment(map[string]string{resourceManagerEndpointConfigKey: server.URL, cloudNameConfigKey: "AzureChinaCloud"})
+	assert.Error(t, err)
+
+	env, err = getAzureEnvironment(map[string]string{cloudNameConfigKey: "AzureChinaCloud"})
+	require.NoError(t, err)
+	assert.Equal(t, "core.chinacloudapi.cn", env.StorageEndpointSuffix)
+	assert.Equal(t, azure.ChinaCloud.ActiveDirectoryEndpoint, env.ActiveDirectoryEndpoint)
+
+	_, err = getAzureEnvironment(map[string]string{cloudNameConfigKey: "AzureMoonCloud"})
+	assert.EqualError(t, err, `invalid value "AzureMoonCloud" for config key "cloudName" (expected AzurePublicCloud, AzureUSGovernmentCloud, AzureChinaCloud or AzureGermanCloud)`)
+
+	env, err = getAzureEnvironment(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, &azure.PublicCloud, env)
+	assert.Equal(t, azure.PublicCloud.TokenAudience, armResource(env))
+	assert.Equal(t, "https://management.azure.com/", armResource(&azure.Environment{ResourceManagerEndpoint: "https://management.azure.com/"}))
+}
+
+func TestStorageSender(t *testing.T) {
+	sender, ok := quirksFor(&azure.ChinaCloud).storageSender().(*jitterSender)
+	require.True(t, ok)
+	assert.Equal(t, 8, sender.RetryAttempts)
+	assert.Contains(t, sender.ValidStatusCodes, http.StatusTooManyRequests)
+	assert.Contains(t, sender.ValidStatusCodes, http.StatusServiceUnavailable)
+}
+
+func TestWithStorageRetryConfig(t *testing.T) {
+	quirks, err := quirksFor(&azure.PublicCloud).withStorageRetryConfig(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, defaultCloudQuirks, quirks)
+
+	quirks, err = quirksFor(&azure.PublicCloud).withStorageRetryConfig(map[string]string{
+		storageMaxTriesConfigKey:      "10",
+		storageTryTimeoutConfigKey:    "10m",
+		storageRetryDelayConfigKey:    "10s",
+		storageMaxRetryDelayConfigKey: "5m",
+	})
+	require.NoError(t, err)
+	sender := quirks.storageSender().(*jitterSender)
+	assert.Equal(t, 10, sender.RetryAttempts)
+	assert.Equal(t, 10*time.Minute, sender.TryTimeout)
+	assert.Equal(t, 10*time.Second, sender.RetryDuration)
+	assert.Equal(t, 5*time.Minute, sender.MaxRetryDelay)
+
+	for _, config := range []map[string]string{
+		{storageMaxTriesConfigKey: "0"},
+		{storageTryTimeoutConfigKey: "10"},
+		{storageRetryDelayConfigKey: "-1s"},
+	} {
+		_, err = quirksFor(&azure.PublicCloud).withStorageRetryConfig(config)
+		assert.Error(t, err)
+	}
+}
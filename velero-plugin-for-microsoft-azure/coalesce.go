@@ -0,0 +1,71 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"sync"
+)
+
+// the number of requests that weren't made because an identical one was
+// already in flight
+var coalescedRequests = expvar.NewInt("azure_coalesced_requests")
+
+// coalescedCall is a request in flight, whose result is shared by every
+// caller that asked for it while it was.
+type coalescedCall struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// coalescer coalesces concurrent identical requests into a single request in
+// flight, e.g. the bursts of existence checks Velero makes while syncing
+// backups. Results aren't cached: a request made after the one in flight
+// completed is made again. The zero value is ready to use.
+type coalescer struct {
+	lock  sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// do calls fn and returns its result, unless a call for the same key is in
+// flight, in which case it waits for that call and returns its result.
+func (c *coalescer) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	c.lock.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.lock.Unlock()
+		coalescedRequests.Add(1)
+		<-call.done
+		return call.result, call.err
+	}
+	if c.calls == nil {
+		c.calls = map[string]*coalescedCall{}
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.calls, key)
+		c.lock.Unlock()
+		close(call.done)
+	}()
+
+	call.result, call.err = fn()
+	return call.result, call.err
+}
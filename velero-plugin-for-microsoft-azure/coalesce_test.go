@@ -0,0 +1,75 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalescer(t *testing.T) {
+	var c coalescer
+	before := coalescedRequests.Value()
+
+	calls := 0
+	started, release := make(chan struct{}), make(chan struct{})
+	fn := func() (interface{}, error) {
+		calls++
+		close(started)
+		<-release
+		return true, errors.New("shared")
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	errs := make([]error, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], errs[0] = c.do("bucket/key", fn)
+	}()
+	<-started
+
+	for i := 1; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = c.do("bucket/key", fn)
+		}(i)
+	}
+	// release the request once every other caller is waiting for it
+	for coalescedRequests.Value()-before < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 1, calls)
+	for i := range results {
+		assert.Equal(t, true, results[i])
+		assert.EqualError(t, errs[i], "shared")
+	}
+
+	// completed requests aren't cached
+	result, err := c.do("bucket/key", func() (interface{}, error) { return false, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, false, result)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// command is an administrative operation that can be run by invoking the
+// plugin binary directly (e.g. with kubectl exec into the Velero pod) with
+// the command's name as the first argument.
+type command struct {
+	description string
+	run         func(log logrus.FieldLogger, args []string) error
+}
+
+var commands = map[string]command{
+	"audit-log": {
+		description: "Show the destructive operations recorded in a location's audit log",
+		run:         runAuditLog,
+	},
+	"capabilities": {
+		description: "Report the optional features active for a location's config",
+		run:         runCapabilities,
+	},
+	"cleanup-orphaned-disks": {
+		description: "Delete disks created by restores that never attached them",
+		run:         runCleanupOrphanedDisks,
+	},
+	"export-restore-plan": {
+		description: "Export an ARM template or Bicep file that recreates a backup's disks",
+		run:         runExportRestorePlan,
+	},
+	"reconcile-inventory": {
+		description: "Check that the blobs and snapshots referenced by a location's backups exist",
+		run:         runReconcileInventory,
+	},
+	"rehearse-restore": {
+		description: "Restore a backup's snapshots to scratch disks and verify their data",
+		run:         runRehearseRestore,
+	},
+	"support-bundle": {
+		description: "Gather diagnostics for a location into a tarball for troubleshooting",
+		run:         runSupportBundle,
+	},
+	"tier-old-backups": {
+		description: "Move the objects of a location's old backups to a colder access tier",
+		run:         runTierOldBackups,
+	},
+	"verify-encryption": {
+		description: "Sample a location's backups and report on their encryption at rest",
+		run:         runVerifyEncryption,
+	},
+}
+
+// runCommand runs the command named by args[0], returning false if there is
+// no such command.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	if args[0] == "help" {
+		printCommands(os.Stdout)
+		return true
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+
+	log := logrus.New()
+	if err := cmd.run(log.WithField("command", args[0]), args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+
+	return true
+}
+
+func printCommands(w io.Writer) {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-28s %s\n", name, commands[name].description)
+	}
+}
+
+// commandAuthorizer loads the credentials file from the environment, as the
+// plugins do, and returns an ARM authorizer along with the Azure environment.
+func commandAuthorizer() (autorest.Authorizer, *azure.Environment, error) {
+	if err := loadCredentialsIntoEnv(credentialsFileFromEnv()); err != nil {
+		return nil, nil, err
+	}
+
+	env, err := parseAzureEnvironment(os.Getenv(cloudNameEnvVar))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "unable to parse azure cloud name environment variable")
+	}
+
+	authorizer, err := newAADCredentialProvider(env).GetARMToken(armResource(env))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error getting authorizer from environment")
+	}
+
+	return authorizer, env, nil
+}
+
+// confirm asks the user to confirm the given prompt on stdin.
+func confirm(in io.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprintf(out, "%s [y/N]: ", prompt)
+
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
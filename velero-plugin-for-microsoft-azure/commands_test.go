@@ -0,0 +1,49 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCommandUnknown(t *testing.T) {
+	assert.False(t, runCommand(nil))
+	assert.False(t, runCommand([]string{"--log-level", "info"}))
+}
+
+func TestPrintCommands(t *testing.T) {
+	var out bytes.Buffer
+	printCommands(&out)
+
+	for name := range commands {
+		assert.Contains(t, out.String(), name)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	var out bytes.Buffer
+
+	assert.True(t, confirm(strings.NewReader("y\n"), &out, "Delete?"))
+	assert.True(t, confirm(strings.NewReader("YES\n"), &out, "Delete?"))
+	assert.False(t, confirm(strings.NewReader("n\n"), &out, "Delete?"))
+	assert.False(t, confirm(strings.NewReader(""), &out, "Delete?"))
+	assert.Equal(t, strings.Repeat("Delete? [y/N]: ", 4), out.String())
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/joho/godotenv"
@@ -29,8 +30,19 @@ const (
 	subscriptionIDEnvVar = "AZURE_SUBSCRIPTION_ID"
 	cloudNameEnvVar      = "AZURE_CLOUD_NAME"
 
-	resourceGroupConfigKey   = "resourceGroup"
-	credentialsFileConfigKey = "credentialsFile"
+	resourceGroupConfigKey           = "resourceGroup"
+	credentialsFileConfigKey         = "credentialsFile"
+	resourceManagerEndpointConfigKey = "resourceManagerEndpoint"
+	cloudNameConfigKey               = "cloudName"
+
+	// hybridEnvironmentName is the name of environments discovered from an
+	// Azure Stack Hub's ARM endpoint
+	hybridEnvironmentName = "HybridEnvironment"
+
+	// pluginObjectsPrefix is where the plugin's own objects are stored in a
+	// location's container. It's under Velero's "plugins" directory, since
+	// Velero rejects backup storage locations with other top-level directories.
+	pluginObjectsPrefix = "plugins/azure/"
 )
 
 // credentialsFileFromEnv retrieves the Azure credentials file from the environment.
@@ -80,6 +92,68 @@ func parseAzureEnvironment(cloudName string) (*azure.Environment, error) {
 	return &env, errors.WithStack(err)
 }
 
+// getAzureEnvironment returns the environment of the Azure Stack Hub whose ARM
+// endpoint is config.resourceManagerEndpoint, discovered from the endpoint's
+// metadata, if set. Otherwise it returns the cloud named by config.cloudName,
+// or by AZURE_CLOUD_NAME, or azure.PublicCloud if neither is set, so that
+// locations in different clouds can share a credentials file.
+func getAzureEnvironment(config map[string]string) (*azure.Environment, error) {
+	if endpoint := config[resourceManagerEndpointConfigKey]; endpoint != "" {
+		if config[cloudNameConfigKey] != "" {
+			return nil, errors.Errorf("config.%s and config.%s can't both be set", cloudNameConfigKey, resourceManagerEndpointConfigKey)
+		}
+		env, err := azure.EnvironmentFromURL(endpoint)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to get Azure Stack Hub environment from %s", endpoint)
+		}
+		return &env, nil
+	}
+
+	if name := config[cloudNameConfigKey]; name != "" {
+		env, err := parseAzureEnvironment(name)
+		if err != nil {
+			return nil, errors.Errorf("invalid value %q for config key %q (expected AzurePublicCloud, AzureUSGovernmentCloud, AzureChinaCloud or AzureGermanCloud)", name, cloudNameConfigKey)
+		}
+		return env, nil
+	}
+
+	env, err := parseAzureEnvironment(os.Getenv(cloudNameEnvVar))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse azure cloud name environment variable")
+	}
+	return env, nil
+}
+
+// armResource returns the resource to request ARM tokens for. Azure Stack Hub's
+// token audience differs from its ARM endpoint.
+func armResource(env *azure.Environment) string {
+	if env.TokenAudience != "" {
+		return env.TokenAudience
+	}
+	return env.ResourceManagerEndpoint
+}
+
+var (
+	backgroundTasksLock sync.Mutex
+	backgroundTasks     = map[string]bool{}
+)
+
+// startBackgroundTask runs fn in a new goroutine unless a task with the same
+// key has already been started by this process. Velero initializes plugins
+// repeatedly over the life of the plugin process, so long-running loops
+// started from Init must be deduplicated.
+func startBackgroundTask(key string, fn func()) {
+	backgroundTasksLock.Lock()
+	defer backgroundTasksLock.Unlock()
+
+	if backgroundTasks[key] {
+		return
+	}
+	backgroundTasks[key] = true
+
+	go fn()
+}
+
 func getRequiredValues(getValue func(string) string, keys ...string) (map[string]string, error) {
 	missing := []string{}
 	results := map[string]string{}
@@ -0,0 +1,221 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	detectConfigDriftConfigKey = "detectConfigDrift"
+
+	// configRecordKey is the key, relative to the location's prefix, of the
+	// record of the location's config.
+	configRecordKey = "velero-azure-config.json"
+
+	configRecordSchemaVersion = 1
+)
+
+// localConfigKeys are the config keys that legitimately differ between the
+// clusters sharing a location, so they're not recorded.
+var localConfigKeys = map[string]bool{
+	bucketConfigKey:                             true,
+	prefixConfigKey:                             true,
+	credentialsFileConfigKey:                    true,
+	storageAccountKeyEnvVarConfigKey:            true,
+	replicationStorageAccountKeyEnvVarConfigKey: true,
+	clusterNameConfigKey:                        true,
+	metricsBindAddressConfigKey:                 true,
+	storageEndpointIPsConfigKey:                 true,
+	dnsServerConfigKey:                          true,
+	detectConfigDriftConfigKey:                  true,
+}
+
+// configRecord is the config last used with a location. The digest detects
+// edits made outside the plugin, and the signature, an HMAC of the digest
+// keyed with the storage account key, detects edits by anyone without the
+// key. Recording the config is versioned by its generation.
+type configRecord struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Generation    int               `json:"generation"`
+	Settings      map[string]string `json:"settings"`
+	WrittenBy     string            `json:"writtenBy"`
+	WrittenAt     time.Time         `json:"writtenAt"`
+	Digest        string            `json:"digest"`
+	Signature     string            `json:"signature,omitempty"`
+}
+
+// getDetectConfigDrift returns whether config.detectConfigDrift is set.
+func getDetectConfigDrift(config map[string]string) (bool, error) {
+	val := config[detectConfigDriftConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	detect, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, detectConfigDriftConfigKey)
+	}
+
+	return detect, nil
+}
+
+// sharedSettings returns the settings of config that should be the same for
+// every cluster using the location.
+func sharedSettings(config map[string]string) map[string]string {
+	settings := map[string]string{}
+	for key, val := range config {
+		if !localConfigKeys[key] {
+			settings[key] = val
+		}
+	}
+	return settings
+}
+
+func settingsDigest(settings map[string]string) string {
+	// maps are marshaled with sorted keys, so this is canonical
+	data, _ := json.Marshal(settings)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signDigest returns the signature of the given digest, or "" if no account
+// key is available.
+func signDigest(digest, accountKey string) string {
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil || len(key) == 0 {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(digest))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// changedSettings returns the keys whose values differ between a and b.
+func changedSettings(a, b map[string]string) []string {
+	var changed []string
+	for key, val := range a {
+		if other, ok := b[key]; !ok || other != val {
+			changed = append(changed, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// configDriftDetector records the config of a location in the location
+// itself, and warns when it changes, since a change made by another cluster
+// or operator sharing the location otherwise goes unnoticed.
+type configDriftDetector struct {
+	log        logrus.FieldLogger
+	blobGetter blobGetter
+	bucket     string
+	prefix     string
+	writer     string
+	accountKey string
+}
+
+func newConfigDriftDetector(log logrus.FieldLogger, blobGetter blobGetter, config map[string]string, accountKey string) *configDriftDetector {
+	writer := config[clusterNameConfigKey]
+	if writer == "" {
+		writer, _ = os.Hostname()
+	}
+
+	return &configDriftDetector{
+		log:        log,
+		blobGetter: blobGetter,
+		bucket:     config[bucketConfigKey],
+		prefix:     config[prefixConfigKey],
+		writer:     writer,
+		accountKey: accountKey,
+	}
+}
+
+// check compares the given config with the recorded one, warning about any
+// differences, and records it if it differs.
+func (d *configDriftDetector) check(config map[string]string, now time.Time) error {
+	blob, err := d.blobGetter.getBlob(d.bucket, path.Join(d.prefix, configRecordKey))
+	if err != nil {
+		return err
+	}
+
+	settings := sharedSettings(config)
+	record := &configRecord{SchemaVersion: configRecordSchemaVersion}
+
+	res, err := blob.Get(nil)
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		return errors.Wrap(err, "error reading config record")
+	default:
+		err := json.NewDecoder(res).Decode(record)
+		res.Close()
+		if err != nil {
+			return errors.Wrap(err, "error decoding config record")
+		}
+
+		log := d.log.WithFields(logrus.Fields{
+			"generation": record.Generation,
+			"writtenBy":  record.WrittenBy,
+			"writtenAt":  record.WrittenAt,
+		})
+		if record.Digest != settingsDigest(record.Settings) {
+			log.Warn("The location's config record was modified outside the plugin")
+		} else if record.Signature != "" && d.accountKey != "" && !hmac.Equal([]byte(record.Signature), []byte(signDigest(record.Digest, d.accountKey))) {
+			log.Warn("The location's config record has an invalid signature")
+		}
+
+		changed := changedSettings(record.Settings, settings)
+		if len(changed) == 0 {
+			return nil
+		}
+		log.WithField("changedKeys", changed).Warn("The location's config differs from the config it was last used with; another cluster or operator sharing the location may have changed it")
+	}
+
+	record.Generation++
+	record.Settings = settings
+	record.WrittenBy = d.writer
+	record.WrittenAt = now.UTC()
+	record.Digest = settingsDigest(settings)
+	record.Signature = signDigest(record.Digest, d.accountKey)
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.Wrap(blob.CreateBlockBlobFromReader(bytes.NewReader(data), nil), "error writing config record")
+}
@@ -0,0 +1,92 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangedSettings(t *testing.T) {
+	assert.Empty(t, changedSettings(map[string]string{"a": "1"}, map[string]string{"a": "1"}))
+	assert.Equal(t, []string{"a", "b", "c"}, changedSettings(
+		map[string]string{"a": "1", "b": "2"},
+		map[string]string{"a": "2", "c": "3"},
+	))
+}
+
+func TestConfigDriftDetector(t *testing.T) {
+	now := time.Now()
+	blobs := newMemBlobs(now)
+	log, hook := test.NewNullLogger()
+
+	config := map[string]string{
+		bucketConfigKey:                  "bucket",
+		prefixConfigKey:                  "velero",
+		storageAccountConfigKey:          "account",
+		storageAccountKeyEnvVarConfigKey: "KEY_A",
+		packSmallObjectsConfigKey:        "true",
+	}
+	d := newConfigDriftDetector(log, blobs, config, "a2V5")
+
+	// the first check records the config
+	require.NoError(t, d.check(config, now))
+	assert.Empty(t, hook.AllEntries())
+
+	record := new(configRecord)
+	require.NoError(t, json.Unmarshal(blobs.data["velero/"+configRecordKey], record))
+	assert.Equal(t, 1, record.Generation)
+	assert.NotContains(t, record.Settings, storageAccountKeyEnvVarConfigKey)
+	assert.NotEmpty(t, record.Signature)
+
+	// local settings may differ between clusters
+	local := map[string]string{}
+	for k, v := range config {
+		local[k] = v
+	}
+	local[storageAccountKeyEnvVarConfigKey] = "KEY_B"
+	require.NoError(t, d.check(local, now))
+	assert.Empty(t, hook.AllEntries())
+
+	// shared settings may not
+	changed := map[string]string{}
+	for k, v := range config {
+		changed[k] = v
+	}
+	changed[packSmallObjectsConfigKey] = "false"
+	require.NoError(t, d.check(changed, now))
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Equal(t, []string{packSmallObjectsConfigKey}, hook.LastEntry().Data["changedKeys"])
+
+	require.NoError(t, json.Unmarshal(blobs.data["velero/"+configRecordKey], record))
+	assert.Equal(t, 2, record.Generation)
+
+	// edits made outside the plugin are detected
+	hook.Reset()
+	record.Settings[packSmallObjectsConfigKey] = "true"
+	data, _ := json.Marshal(record)
+	blobs.put("velero/"+configRecordKey, string(data), now)
+	require.NoError(t, d.check(config, now))
+	assert.Equal(t, "The location's config record was modified outside the plugin", hook.AllEntries()[0].Message)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
+)
+
+// velero adds these keys to every object store's config
+var veleroObjectStoreConfigKeys = []string{bucketConfigKey, prefixConfigKey, "caCert"}
+
+// validateObjectStoreConfigKeys validates an object store's config keys like
+// veleroplugin.ValidateObjectStoreConfigKeys, suggesting the intended key for
+// each invalid one that looks like a misspelling.
+func validateObjectStoreConfigKeys(config map[string]string, validKeys ...string) error {
+	if err := veleroplugin.ValidateObjectStoreConfigKeys(config, validKeys...); err != nil {
+		return withKeySuggestions(err, config, append(validKeys, veleroObjectStoreConfigKeys...))
+	}
+	return nil
+}
+
+// validateVolumeSnapshotterConfigKeys validates a volume snapshotter's config
+// keys like veleroplugin.ValidateVolumeSnapshotterConfigKeys, suggesting the
+// intended key for each invalid one that looks like a misspelling.
+func validateVolumeSnapshotterConfigKeys(config map[string]string, validKeys ...string) error {
+	if err := veleroplugin.ValidateVolumeSnapshotterConfigKeys(config, validKeys...); err != nil {
+		return withKeySuggestions(err, config, validKeys)
+	}
+	return nil
+}
+
+func withKeySuggestions(err error, config map[string]string, validKeys []string) error {
+	valid := map[string]bool{}
+	for _, key := range validKeys {
+		valid[key] = true
+	}
+
+	var suggestions []string
+	for key := range config {
+		if valid[key] {
+			continue
+		}
+		if suggestion := suggestKey(key, validKeys); suggestion != "" {
+			suggestions = append(suggestions, fmt.Sprintf("%q instead of %q", suggestion, key))
+		}
+	}
+	if len(suggestions) == 0 {
+		return err
+	}
+	sort.Strings(suggestions)
+
+	return errors.Errorf("%v; did you mean %s?", err, strings.Join(suggestions, ", "))
+}
+
+// suggestKey returns the valid key closest to the given invalid one, or "" if
+// none is close enough to be a likely misspelling.
+func suggestKey(key string, validKeys []string) string {
+	// allow roughly one edit per three characters
+	maxDist := len(key)/3 + 1
+
+	best, bestDist := "", maxDist+1
+	for _, valid := range validKeys {
+		if strings.EqualFold(key, valid) {
+			return valid
+		}
+		if dist := editDistance(strings.ToLower(key), strings.ToLower(valid)); dist < bestDist {
+			best, bestDist = valid, dist
+		}
+	}
+
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,74 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateObjectStoreConfigKeys(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]string
+		expectedError string
+	}{
+		{
+			name:   "valid keys, including those added by velero",
+			config: map[string]string{storageAccountConfigKey: "sa", bucketConfigKey: "b", prefixConfigKey: "p"},
+		},
+		{
+			name:          "misspelled key",
+			config:        map[string]string{"storageAccout": "sa"},
+			expectedError: `config has invalid keys [storageAccout]; valid keys are [storageAccount resourceGroup bucket prefix caCert]; did you mean "storageAccount" instead of "storageAccout"?`,
+		},
+		{
+			name:          "wrong case",
+			config:        map[string]string{"resourcegroup": "rg"},
+			expectedError: `config has invalid keys [resourcegroup]; valid keys are [storageAccount resourceGroup bucket prefix caCert]; did you mean "resourceGroup" instead of "resourcegroup"?`,
+		},
+		{
+			name:          "unrelated key",
+			config:        map[string]string{"foo": "bar"},
+			expectedError: "config has invalid keys [foo]; valid keys are [storageAccount resourceGroup bucket prefix caCert]",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateObjectStoreConfigKeys(tc.config, storageAccountConfigKey, resourceGroupConfigKey)
+			if tc.expectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestValidateVolumeSnapshotterConfigKeys(t *testing.T) {
+	err := validateVolumeSnapshotterConfigKeys(map[string]string{"apiTimout": "5m"}, apiTimeoutConfigKey, snapsIncrementalConfigKey)
+	assert.EqualError(t, err, `config has invalid keys [apiTimout]; valid keys are [apiTimeout incremental]; did you mean "apiTimeout" instead of "apiTimout"?`)
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("abc", "abc"))
+	assert.Equal(t, 1, editDistance("storageAccout", "storageAccount"))
+	assert.Equal(t, 3, editDistance("kitten", "sitting"))
+	assert.Equal(t, 3, editDistance("", "abc"))
+}
@@ -0,0 +1,150 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+const (
+	storageConnectionStringEnvVar = "AZURE_STORAGE_CONNECTION_STRING"
+
+	storageAccountConnectionStringEnvVarConfigKey = "storageAccountConnectionStringEnvVar"
+)
+
+// storageConnectionString is a storage account connection string, e.g.
+// "DefaultEndpointsProtocol=https;AccountName=...;AccountKey=...;EndpointSuffix=core.windows.net",
+// as shown by the Azure portal.
+type storageConnectionString struct {
+	accountName    string
+	accountKey     string
+	sasToken       string
+	endpointSuffix string
+}
+
+// parseStorageConnectionString parses a connection string with either an
+// account key or a SAS. Blob endpoints are only supported in their default
+// form, "https://<account>.blob.<endpoint suffix>", since the storage client
+// is built from the account's name and the endpoint suffix.
+func parseStorageConnectionString(input string) (*storageConnectionString, error) {
+	parts := map[string]string{}
+	for _, pair := range strings.Split(input, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.IndexByte(pair, '=')
+		if i <= 0 {
+			// don't include the segment, it may be a secret
+			return nil, errors.New("invalid storage connection string: segments must be of the form <key>=<value>")
+		}
+		parts[strings.ToLower(strings.TrimSpace(pair[:i]))] = strings.TrimSpace(pair[i+1:])
+	}
+
+	cs := &storageConnectionString{
+		accountName:    parts["accountname"],
+		accountKey:     parts["accountkey"],
+		sasToken:       strings.TrimPrefix(parts["sharedaccesssignature"], "?"),
+		endpointSuffix: parts["endpointsuffix"],
+	}
+
+	if endpoint := parts["blobendpoint"]; endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid BlobEndpoint in storage connection string")
+		}
+		labels := strings.SplitN(u.Host, ".", 3)
+		if u.Scheme != "https" || len(labels) != 3 || labels[1] != "blob" || strings.Trim(u.Path, "/") != "" {
+			return nil, errors.Errorf("unsupported BlobEndpoint %s in storage connection string: only https://<account>.blob.<endpoint suffix> is supported", endpoint)
+		}
+		if cs.accountName == "" {
+			cs.accountName = labels[0]
+		}
+		if cs.endpointSuffix == "" {
+			cs.endpointSuffix = labels[2]
+		}
+	}
+
+	if cs.accountName == "" {
+		return nil, errors.New("storage connection string has no AccountName or BlobEndpoint")
+	}
+	if (cs.accountKey == "") == (cs.sasToken == "") {
+		return nil, errors.New("storage connection string must have either an AccountKey or a SharedAccessSignature")
+	}
+
+	return cs, nil
+}
+
+// getStorageConnectionString returns the connection string in the env var
+// named by config.storageAccountConnectionStringEnvVar, if set. Otherwise, if
+// no other storage account credential is configured, it returns the one in
+// AZURE_STORAGE_CONNECTION_STRING, if set.
+func getStorageConnectionString(config map[string]string) (*storageConnectionString, error) {
+	if envVar := config[storageAccountConnectionStringEnvVarConfigKey]; envVar != "" {
+		input := os.Getenv(envVar)
+		if input == "" {
+			return nil, errors.Errorf("no storage connection string found in env var %s", envVar)
+		}
+		return parseStorageConnectionString(input)
+	}
+
+	for _, key := range storageCredentialConfigKeys {
+		if config[key] != "" && (key != useAADConfigKey || boolConfig(config, key)) {
+			return nil, nil
+		}
+	}
+	if input := os.Getenv(storageConnectionStringEnvVar); input != "" {
+		return parseStorageConnectionString(input)
+	}
+	return nil, nil
+}
+
+// withConnectionStringEndpoint returns env with the connection string's
+// endpoint suffix, if it has one.
+func withConnectionStringEndpoint(env *azure.Environment, cs *storageConnectionString) *azure.Environment {
+	if cs.endpointSuffix == "" || cs.endpointSuffix == env.StorageEndpointSuffix {
+		return env
+	}
+
+	// env may be one of the azure package's clouds, which mustn't be modified
+	copied := *env
+	copied.StorageEndpointSuffix = cs.endpointSuffix
+	return &copied
+}
+
+// connectionStringCredentialProvider uses the account key or SAS of a
+// connection string.
+type connectionStringCredentialProvider struct {
+	connectionString *storageConnectionString
+	aad              credentialProvider
+}
+
+func (p *connectionStringCredentialProvider) GetStorageCredential(account storageAccount) (*storageCredential, error) {
+	if account.name != "" && !strings.EqualFold(account.name, p.connectionString.accountName) {
+		return nil, errors.Errorf("storage account %s doesn't match the storage connection string's account %s", account.name, p.connectionString.accountName)
+	}
+	return &storageCredential{accountKey: p.connectionString.accountKey, sasToken: p.connectionString.sasToken}, nil
+}
+
+func (p *connectionStringCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	return p.aad.GetARMToken(resource)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStorageConnectionString(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expected      *storageConnectionString
+		expectedError string
+	}{
+		{
+			name:     "account key",
+			input:    "DefaultEndpointsProtocol=https;AccountName=account;AccountKey=a2V5;EndpointSuffix=core.windows.net",
+			expected: &storageConnectionString{accountName: "account", accountKey: "a2V5", endpointSuffix: "core.windows.net"},
+		},
+		{
+			name:     "SAS with blob endpoint",
+			input:    "BlobEndpoint=https://account.blob.core.chinacloudapi.cn/;SharedAccessSignature=?sv=2019-02-02&sig=abc==;",
+			expected: &storageConnectionString{accountName: "account", sasToken: "sv=2019-02-02&sig=abc==", endpointSuffix: "core.chinacloudapi.cn"},
+		},
+		{
+			name:          "custom blob endpoint",
+			input:         "BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;AccountName=devstoreaccount1;AccountKey=a2V5",
+			expectedError: "unsupported BlobEndpoint http://127.0.0.1:10000/devstoreaccount1 in storage connection string: only https://<account>.blob.<endpoint suffix> is supported",
+		},
+		{
+			name:          "no account",
+			input:         "AccountKey=a2V5",
+			expectedError: "storage connection string has no AccountName or BlobEndpoint",
+		},
+		{
+			name:          "key and SAS",
+			input:         "AccountName=account;AccountKey=a2V5;SharedAccessSignature=sig=abc",
+			expectedError: "storage connection string must have either an AccountKey or a SharedAccessSignature",
+		},
+		{
+			name:          "malformed segments aren't echoed",
+			input:         "AccountName=account;a2V5",
+			expectedError: "invalid storage connection string: segments must be of the form <key>=<value>",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cs, err := parseStorageConnectionString(tc.input)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cs)
+		})
+	}
+}
+
+func TestConnectionStringCredentialProvider(t *testing.T) {
+	connectionString := "AccountName=account;AccountKey=a2V5;EndpointSuffix=core.example.com"
+
+	// the connection string in the credentials file is only used if no other
+	// credential is configured
+	defer setEnv(t, map[string]string{storageConnectionStringEnvVar: connectionString, "TEST_STORAGE_KEY": "a2V5"})()
+	provider, err := newCredentialProvider(map[string]string{}, &azure.PublicCloud)
+	require.NoError(t, err)
+	assert.IsType(t, &connectionStringCredentialProvider{}, provider)
+	provider, err = newCredentialProvider(map[string]string{storageAccountKeyEnvVarConfigKey: "TEST_STORAGE_KEY"}, &azure.PublicCloud)
+	require.NoError(t, err)
+	assert.IsType(t, &accountKeyCredentialProvider{}, provider)
+
+	// or one named by config
+	defer setEnv(t, map[string]string{"TEST_STORAGE_KEY": connectionString})()
+	provider, err = newCredentialProvider(map[string]string{storageAccountConnectionStringEnvVarConfigKey: "TEST_STORAGE_KEY"}, &azure.PublicCloud)
+	require.NoError(t, err)
+
+	credential, err := provider.GetStorageCredential(storageAccount{name: "Account"})
+	require.NoError(t, err)
+	assert.Equal(t, &storageCredential{accountKey: "a2V5"}, credential)
+	_, err = provider.GetStorageCredential(storageAccount{name: "other"})
+	assert.EqualError(t, err, "storage account other doesn't match the storage connection string's account account")
+
+	// the clouds of the azure package are left as they are
+	env := withConnectionStringEndpoint(&azure.PublicCloud, provider.(*connectionStringCredentialProvider).connectionString)
+	assert.Equal(t, "core.example.com", env.StorageEndpointSuffix)
+	assert.Equal(t, "core.windows.net", azure.PublicCloud.StorageEndpointSuffix)
+}
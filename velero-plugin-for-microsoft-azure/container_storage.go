@@ -0,0 +1,154 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// containerStorageClassesAnnotation is the restore annotation listing
+	// the storage classes of the target cluster backed by Azure Container
+	// Storage pools, as "<storage class>,...".
+	containerStorageClassesAnnotation = "azure.velero.io/container-storage-classes"
+
+	// Azure Container Storage names the storage class of each storage pool
+	// after the pool, with this prefix
+	containerStorageClassPrefix = "acstor-"
+)
+
+// volumeDeleter deletes disks created by CreateVolumeFromSnapshot. It's
+// implemented by VolumeSnapshotter.
+type volumeDeleter interface {
+	deleteVolume(volumeID string) error
+}
+
+// deleteVolume deletes the disk with the given name created by
+// CreateVolumeFromSnapshot.
+func (b *VolumeSnapshotter) deleteVolume(volumeID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), b.apiTimeout)
+	defer cancel()
+
+	future, err := b.disks.Delete(ctx, b.restoreDisksResourceGroup(), volumeID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(future.WaitForCompletionRef(ctx, b.disks.Client))
+}
+
+// isContainerStorageClass returns whether the given storage class is backed
+// by an Azure Container Storage pool, according to the restore's
+// azure.velero.io/container-storage-classes annotation or, if it isn't set,
+// Azure Container Storage's naming of storage classes.
+func isContainerStorageClass(storageClass, annotation string) bool {
+	if storageClass == "" {
+		return false
+	}
+	if annotation == "" {
+		return strings.HasPrefix(storageClass, containerStorageClassPrefix)
+	}
+	for _, class := range strings.Split(annotation, ",") {
+		if strings.TrimSpace(class) == storageClass {
+			return true
+		}
+	}
+	return false
+}
+
+// errContainerStoragePool is returned for persistent volumes that would be
+// restored from disk snapshots into Azure Container Storage pools.
+func errContainerStoragePool(pv, storageClass string) error {
+	return errors.Errorf("persistent volume %s can't be restored from a disk snapshot into storage class %s: "+
+		"it's backed by an Azure Container Storage pool, which can't adopt managed disks. "+
+		"Map the volume to an Azure Disk storage class, or back it up with file system backups instead", pv, storageClass)
+}
+
+// containerStorageRestoreAction fails the restore of persistent volumes
+// restored from disk snapshots into storage classes backed by Azure Container
+// Storage pools, and deletes their disks. Pools only provision volumes of
+// their own, so such volumes would never bind, and their disks would be left
+// orphaned.
+//
+// Velero restores volumes from snapshots before restore item actions run,
+// and runs its own actions, including the one mapping storage classes,
+// before those of plugins, so the target storage class is known by then.
+type containerStorageRestoreAction struct {
+	log        logrus.FieldLogger
+	newDeleter func() (volumeDeleter, error)
+}
+
+func newContainerStorageRestoreAction(log logrus.FieldLogger) *containerStorageRestoreAction {
+	return &containerStorageRestoreAction{
+		log: log,
+		newDeleter: func() (volumeDeleter, error) {
+			// disks are restored in the cluster's resource group, as
+			// configured by the credentials file
+			snapshotter := newVolumeSnapshotter(log)
+			if err := snapshotter.Init(map[string]string{}); err != nil {
+				return nil, err
+			}
+			return snapshotter, nil
+		},
+	}
+}
+
+func (a *containerStorageRestoreAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+func (a *containerStorageRestoreAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	output := velero.NewRestoreItemActionExecuteOutput(input.Item)
+
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if pv.Spec.AzureDisk == nil || !isContainerStorageClass(pv.Spec.StorageClassName, input.Restore.Annotations[containerStorageClassesAnnotation]) {
+		return output, nil
+	}
+
+	// only volumes restored from snapshots have disks of their own
+	original := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.ItemFromBackup.UnstructuredContent(), original); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if original.Spec.AzureDisk == nil || strings.EqualFold(pv.Spec.AzureDisk.DataDiskURI, original.Spec.AzureDisk.DataDiskURI) {
+		return output, nil
+	}
+
+	log := a.log.WithFields(logrus.Fields{"persistentVolume": original.Name, "storageClass": pv.Spec.StorageClassName, "diskName": pv.Spec.AzureDisk.DiskName})
+	log.Warn("Persistent volume was restored from a snapshot into an Azure Container Storage pool's storage class, deleting its disk")
+
+	deleter, err := a.newDeleter()
+	if err == nil {
+		err = deleter.deleteVolume(pv.Spec.AzureDisk.DiskName)
+	}
+	if err != nil {
+		log.WithError(err).Error("Error deleting disk restored for Azure Container Storage pool, delete it manually")
+	}
+
+	return nil, errContainerStoragePool(original.Name, pv.Spec.StorageClassName)
+}
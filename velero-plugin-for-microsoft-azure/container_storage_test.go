@@ -0,0 +1,161 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+type fakeVolumeDeleter struct {
+	deleted []string
+	err     error
+}
+
+func (d *fakeVolumeDeleter) deleteVolume(volumeID string) error {
+	d.deleted = append(d.deleted, volumeID)
+	return d.err
+}
+
+func TestIsContainerStorageClass(t *testing.T) {
+	tests := []struct {
+		name         string
+		storageClass string
+		annotation   string
+		want         bool
+	}{
+		{name: "no storage class", storageClass: "", want: false},
+		{name: "default naming", storageClass: "acstor-azuredisk", want: true},
+		{name: "other storage class", storageClass: "managed-premium", want: false},
+		{name: "listed", storageClass: "pool-1", annotation: "pool-0, pool-1", want: true},
+		{name: "annotation replaces default naming", storageClass: "acstor-azuredisk", annotation: "pool-1", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, isContainerStorageClass(test.storageClass, test.annotation))
+		})
+	}
+}
+
+func TestContainerStorageRestoreAction(t *testing.T) {
+	originalURI := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/original"
+	restoredURI := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/restore-0"
+
+	pv := func(storageClass, diskName, diskURI string) *unstructured.Unstructured {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+			Spec: v1.PersistentVolumeSpec{
+				StorageClassName: storageClass,
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					AzureDisk: &v1.AzureDiskVolumeSource{DiskName: diskName, DataDiskURI: diskURI},
+				},
+			},
+		})
+		require.NoError(t, err)
+		return &unstructured.Unstructured{Object: obj}
+	}
+
+	tests := []struct {
+		name            string
+		item            *unstructured.Unstructured
+		deleteErr       error
+		expectedDeleted []string
+	}{
+		{
+			name: "volumes of other storage classes are unchanged",
+			item: pv("managed-premium", "restore-0", restoredURI),
+		},
+		{
+			name: "volumes that weren't restored from snapshots are unchanged",
+			item: pv("acstor-azuredisk", "original", originalURI),
+		},
+		{
+			name:            "volumes restored from snapshots into pools fail and their disks are deleted",
+			item:            pv("acstor-azuredisk", "restore-0", restoredURI),
+			expectedDeleted: []string{"restore-0"},
+		},
+		{
+			name:            "failing to delete the disk still fails the volume",
+			item:            pv("acstor-azuredisk", "restore-0", restoredURI),
+			deleteErr:       errors.New("boom"),
+			expectedDeleted: []string{"restore-0"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			deleter := &fakeVolumeDeleter{err: tc.deleteErr}
+			action := &containerStorageRestoreAction{
+				log:        logrus.New(),
+				newDeleter: func() (volumeDeleter, error) { return deleter, nil },
+			}
+
+			out, err := action.Execute(&velero.RestoreItemActionExecuteInput{
+				Item:           tc.item,
+				ItemFromBackup: pv("managed-premium", "original", originalURI),
+				Restore:        &velerov1.Restore{},
+			})
+			assert.Equal(t, tc.expectedDeleted, deleter.deleted)
+			if tc.expectedDeleted != nil {
+				assert.EqualError(t, err, errContainerStoragePool("pv-1", "acstor-azuredisk").Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.item.Object, out.UpdatedItem.UnstructuredContent())
+		})
+	}
+}
+
+func TestBYOSnapshotRestoreActionRefusesContainerStoragePools(t *testing.T) {
+	originalURI := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/original"
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: "acstor-azuredisk",
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				AzureDisk: &v1.AzureDiskVolumeSource{DiskName: "original", DataDiskURI: originalURI},
+			},
+		},
+	})
+	require.NoError(t, err)
+	item := &unstructured.Unstructured{Object: obj}
+
+	restorer := &fakeVolumeRestorer{VolumeSnapshotter: &VolumeSnapshotter{}}
+	action := &byoSnapshotRestoreAction{
+		log:         logrus.New(),
+		newRestorer: func() (volumeRestorer, error) { return restorer, nil },
+	}
+
+	_, err = action.Execute(&velero.RestoreItemActionExecuteInput{
+		Item:           item,
+		ItemFromBackup: item,
+		Restore:        &velerov1.Restore{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{byoSnapshotsAnnotation: "pv-1=" + testBYOSnapshotID}}},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "", restorer.snapshotID)
+}
@@ -0,0 +1,210 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotCostReportConfigKey      = "snapshotCostReport"
+	snapshotCostPerGiBMonthConfigKey = "snapshotCostPerGiBMonth"
+
+	costCurrency = "USD"
+)
+
+// snapshotStandardLRSPrices are approximate pay-as-you-go list prices, in USD
+// per GiB per month, of Standard_LRS snapshot storage by region. Regions that
+// aren't listed use defaultSnapshotPrice.
+var snapshotStandardLRSPrices = map[string]float64{
+	"eastus":             0.05,
+	"eastus2":            0.05,
+	"centralus":          0.05,
+	"northcentralus":     0.05,
+	"southcentralus":     0.05,
+	"westus":             0.05,
+	"westus2":            0.05,
+	"westcentralus":      0.05,
+	"canadacentral":      0.055,
+	"northeurope":        0.05,
+	"westeurope":         0.055,
+	"uksouth":            0.055,
+	"francecentral":      0.058,
+	"germanywestcentral": 0.058,
+	"switzerlandnorth":   0.066,
+	"southeastasia":      0.055,
+	"eastasia":           0.066,
+	"japaneast":          0.06,
+	"koreacentral":       0.058,
+	"centralindia":       0.054,
+	"australiaeast":      0.06,
+	"brazilsouth":        0.085,
+	"southafricanorth":   0.062,
+}
+
+const defaultSnapshotPrice = 0.05
+
+// snapshotSkuPriceFactors are the prices of snapshot storage SKUs relative to
+// Standard_LRS.
+var snapshotSkuPriceFactors = map[disk.SnapshotStorageAccountTypes]float64{
+	disk.SnapshotStorageAccountTypesStandardLRS: 1,
+	disk.SnapshotStorageAccountTypesStandardZRS: 1.25,
+	disk.SnapshotStorageAccountTypesPremiumLRS:  2.4,
+}
+
+// snapshotCost is the estimated monthly cost of storing a snapshot.
+type snapshotCost struct {
+	Time             time.Time `json:"time"`
+	Backup           string    `json:"backup,omitempty"`
+	SnapshotID       string    `json:"snapshotID"`
+	DiskID           string    `json:"diskID"`
+	Location         string    `json:"location"`
+	SKU              string    `json:"sku"`
+	Incremental      bool      `json:"incremental"`
+	SizeGiB          int64     `json:"sizeGiB"`
+	PricePerGiBMonth float64   `json:"pricePerGiBMonth"`
+	MonthlyCost      float64   `json:"monthlyCost"`
+	Currency         string    `json:"currency"`
+}
+
+// snapshotCostEstimator estimates the monthly cost of the snapshots taken by
+// the volume snapshotter. Snapshots are billed for the data they store rather
+// than their disk's provisioned size, and incremental snapshots only for the
+// data that changed since their parent, neither of which ARM reports, so
+// estimates are based on the provisioned size and are upper bounds.
+type snapshotCostEstimator struct {
+	log   logrus.FieldLogger
+	store *metadataStore
+	// price overrides the embedded prices if it's not zero
+	price float64
+}
+
+// newSnapshotCostEstimator returns the estimator configured by
+// config.snapshotCostReport, or nil if it's not set. Estimates are written to
+// the given metadata store, if it's not nil.
+func newSnapshotCostEstimator(log logrus.FieldLogger, store *metadataStore, config map[string]string) (*snapshotCostEstimator, error) {
+	val := config[snapshotCostReportConfigKey]
+	if val == "" {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, snapshotCostReportConfigKey)
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	e := &snapshotCostEstimator{log: log, store: store}
+	if val := config[snapshotCostPerGiBMonthConfigKey]; val != "" {
+		if e.price, err = strconv.ParseFloat(val, 64); err != nil || e.price < 0 {
+			return nil, errors.Errorf("unable to parse value %q for config key %q (expected a non-negative number)", val, snapshotCostPerGiBMonthConfigKey)
+		}
+	}
+	return e, nil
+}
+
+// snapshotCostReportName returns the name of the cost report of the given
+// backup within the metadata store.
+func snapshotCostReportName(backup string) string {
+	return "costs/" + backup + ".jsonl"
+}
+
+// pricePerGiBMonth returns the price of storing a GiB of a snapshot with the
+// given SKU in the given location for a month. Incremental snapshots are
+// always stored on standard storage.
+func (e *snapshotCostEstimator) pricePerGiBMonth(location string, sku disk.SnapshotStorageAccountTypes, incremental bool) float64 {
+	if e.price != 0 {
+		return e.price
+	}
+
+	price, ok := snapshotStandardLRSPrices[strings.ToLower(strings.Replace(location, " ", "", -1))]
+	if !ok {
+		price = defaultSnapshotPrice
+	}
+	if incremental {
+		return price
+	}
+	if factor, ok := snapshotSkuPriceFactors[sku]; ok {
+		price *= factor
+	}
+	return price
+}
+
+// estimate returns the estimated cost of the given snapshot.
+func (e *snapshotCostEstimator) estimate(backup, snapshotID, diskID string, snap disk.Snapshot) snapshotCost {
+	cost := snapshotCost{
+		Time:       time.Now().UTC(),
+		Backup:     backup,
+		SnapshotID: snapshotID,
+		DiskID:     diskID,
+		SKU:        string(disk.SnapshotStorageAccountTypesStandardLRS),
+		Currency:   costCurrency,
+	}
+	if snap.Location != nil {
+		cost.Location = *snap.Location
+	}
+	if snap.Sku != nil && snap.Sku.Name != "" {
+		cost.SKU = string(snap.Sku.Name)
+	}
+	if props := snap.SnapshotProperties; props != nil {
+		cost.Incremental = props.Incremental != nil && *props.Incremental
+		if props.DiskSizeGB != nil {
+			cost.SizeGiB = int64(*props.DiskSizeGB)
+		}
+	}
+
+	cost.PricePerGiBMonth = e.pricePerGiBMonth(cost.Location, disk.SnapshotStorageAccountTypes(cost.SKU), cost.Incremental)
+	cost.MonthlyCost = math.Round(float64(cost.SizeGiB)*cost.PricePerGiBMonth*100) / 100
+	return cost
+}
+
+// record logs the estimated cost of the given snapshot, which is included in
+// the backup's logs, and appends it to the backup's cost report. Errors are
+// logged rather than returned, since the snapshot has already been taken.
+func (e *snapshotCostEstimator) record(backup, snapshotID, diskID string, snap disk.Snapshot) {
+	cost := e.estimate(backup, snapshotID, diskID, snap)
+
+	e.log.WithFields(logrus.Fields{
+		"snapshotID":       cost.SnapshotID,
+		"incremental":      cost.Incremental,
+		"sku":              cost.SKU,
+		"sizeGiB":          cost.SizeGiB,
+		"pricePerGiBMonth": cost.PricePerGiBMonth,
+	}).Infof("Estimated monthly cost of snapshot is at most %.2f %s", cost.MonthlyCost, cost.Currency)
+
+	if e.store == nil || backup == "" {
+		return
+	}
+
+	data, err := json.Marshal(cost)
+	if err != nil {
+		e.log.WithError(err).Warn("Error encoding snapshot cost")
+		return
+	}
+	if err := e.store.append(snapshotCostReportName(backup), append(data, '\n')); err != nil {
+		e.log.WithError(err).WithField("snapshotID", snapshotID).Warn("Error writing snapshot cost report")
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSnapshotCostEstimator(t *testing.T) {
+	e, err := newSnapshotCostEstimator(logrus.New(), nil, map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	e, err = newSnapshotCostEstimator(logrus.New(), nil, map[string]string{snapshotCostReportConfigKey: "false"})
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	e, err = newSnapshotCostEstimator(logrus.New(), nil, map[string]string{snapshotCostReportConfigKey: "true", snapshotCostPerGiBMonthConfigKey: "0.04"})
+	require.NoError(t, err)
+	assert.Equal(t, 0.04, e.price)
+
+	_, err = newSnapshotCostEstimator(logrus.New(), nil, map[string]string{snapshotCostReportConfigKey: "yes"})
+	assert.Error(t, err)
+
+	_, err = newSnapshotCostEstimator(logrus.New(), nil, map[string]string{snapshotCostReportConfigKey: "true", snapshotCostPerGiBMonthConfigKey: "-1"})
+	assert.EqualError(t, err, `unable to parse value "-1" for config key "snapshotCostPerGiBMonth" (expected a non-negative number)`)
+}
+
+func TestEstimateSnapshotCost(t *testing.T) {
+	snapshot := func(location string, sku disk.SnapshotStorageAccountTypes, incremental bool, sizeGB int32) disk.Snapshot {
+		snap := disk.Snapshot{
+			Location: stringPtr(location),
+			SnapshotProperties: &disk.SnapshotProperties{
+				Incremental: boolPtr(incremental),
+				DiskSizeGB:  &sizeGB,
+			},
+		}
+		if sku != "" {
+			snap.Sku = &disk.SnapshotSku{Name: sku}
+		}
+		return snap
+	}
+
+	tests := []struct {
+		name         string
+		snap         disk.Snapshot
+		price        float64
+		expectedSKU  string
+		expectedCost float64
+	}{
+		{
+			name:         "full snapshots default to Standard_LRS",
+			snap:         snapshot("eastus", "", false, 100),
+			expectedSKU:  "Standard_LRS",
+			expectedCost: 5,
+		},
+		{
+			name:         "full premium snapshots cost more",
+			snap:         snapshot("eastus", disk.SnapshotStorageAccountTypesPremiumLRS, false, 100),
+			expectedSKU:  "Premium_LRS",
+			expectedCost: 12,
+		},
+		{
+			name:         "incremental snapshots are always standard",
+			snap:         snapshot("eastus", disk.SnapshotStorageAccountTypesPremiumLRS, true, 100),
+			expectedSKU:  "Premium_LRS",
+			expectedCost: 5,
+		},
+		{
+			name:         "regional prices apply",
+			snap:         snapshot("Brazil South", "", false, 100),
+			expectedSKU:  "Standard_LRS",
+			expectedCost: 8.5,
+		},
+		{
+			name:         "unknown regions use the default price",
+			snap:         snapshot("mars", "", false, 10),
+			expectedSKU:  "Standard_LRS",
+			expectedCost: 0.5,
+		},
+		{
+			name:         "configured price overrides",
+			snap:         snapshot("brazilsouth", disk.SnapshotStorageAccountTypesPremiumLRS, false, 100),
+			price:        0.01,
+			expectedSKU:  "Premium_LRS",
+			expectedCost: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &snapshotCostEstimator{log: logrus.New(), price: tc.price}
+			cost := e.estimate("backup-1", "snap-1", "disk-1", tc.snap)
+			assert.Equal(t, tc.expectedSKU, cost.SKU)
+			assert.InDelta(t, tc.expectedCost, cost.MonthlyCost, 0.001)
+			assert.Equal(t, costCurrency, cost.Currency)
+		})
+	}
+}
+
+func TestRecordSnapshotCost(t *testing.T) {
+	store := &metadataStore{blobGetter: newMemBlobs(time.Now()), bucket: "bucket", prefix: "velero"}
+	e := &snapshotCostEstimator{log: logrus.New(), store: store}
+
+	size := int32(64)
+	snap := disk.Snapshot{Location: stringPtr("westus"), SnapshotProperties: &disk.SnapshotProperties{DiskSizeGB: &size}}
+	e.record("backup-1", "snap-1", "disk-1", snap)
+	e.record("backup-1", "snap-2", "disk-2", snap)
+	// snapshots outside of backups aren't reported
+	e.record("", "snap-3", "disk-3", snap)
+
+	data, err := store.get(snapshotCostReportName("backup-1"))
+	require.NoError(t, err)
+
+	var costs []snapshotCost
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var cost snapshotCost
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &cost))
+		costs = append(costs, cost)
+	}
+	require.Len(t, costs, 2)
+	assert.Equal(t, "snap-1", costs[0].SnapshotID)
+	assert.Equal(t, "snap-2", costs[1].SnapshotID)
+	assert.Equal(t, int64(64), costs[1].SizeGiB)
+	assert.InDelta(t, 3.2, costs[1].MonthlyCost, 0.001)
+}
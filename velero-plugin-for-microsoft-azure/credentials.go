@@ -0,0 +1,624 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	storagemgmt "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/pkg/errors"
+)
+
+const (
+	tenantIDEnvVar               = "AZURE_TENANT_ID"
+	clientIDEnvVar               = "AZURE_CLIENT_ID"
+	clientSecretEnvVar           = "AZURE_CLIENT_SECRET"
+	certificatePathEnvVar        = "AZURE_CERTIFICATE_PATH"
+	certificatePasswordEnvVar    = "AZURE_CERTIFICATE_PASSWORD"
+	usernameEnvVar               = "AZURE_USERNAME"
+	passwordEnvVar               = "AZURE_PASSWORD"
+	federatedTokenFileEnvVar     = "AZURE_FEDERATED_TOKEN_FILE"
+	authorityHostEnvVar          = "AZURE_AUTHORITY_HOST"
+	federatedTokenAudienceEnvVar = "AZURE_FEDERATED_TOKEN_AUDIENCE"
+	storageAccountSASEnvVar      = "AZURE_STORAGE_ACCOUNT_SAS"
+
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// federatedTokenAudiences are the audiences of the federated identity
+// credentials AAD exchanges federated tokens for by default in each cloud,
+// which the service account tokens projected into the Velero pod must be
+// issued for.
+// ref. https://azure.github.io/azure-workload-identity/docs/topics/federated-identity-credential.html
+var federatedTokenAudiences = map[string]string{
+	azure.PublicCloud.Name:       "api://AzureADTokenExchange",
+	azure.USGovernmentCloud.Name: "api://AzureADTokenExchangeUSGov",
+	azure.ChinaCloud.Name:        "api://AzureADTokenExchangeChina",
+}
+
+// storageAccount identifies a storage account by its ARM coordinates.
+type storageAccount struct {
+	subscriptionID string
+	resourceGroup  string
+	name           string
+	// apiVersion is the storage resource provider's API version to look up
+	// the account's key with, or "" for the SDK's
+	apiVersion string
+}
+
+// storageCredential holds the secret used to access a storage account's data
+// plane. Exactly one of its fields is set.
+type storageCredential struct {
+	accountKey string
+	sasToken   string
+	token      autorest.Authorizer
+}
+
+// sender returns a storage sender that authorizes requests with the
+// credential's AAD token, if it has one, before sending them with next.
+func (c *storageCredential) sender(next storage.Sender) storage.Sender {
+	if c.token == nil {
+		return next
+	}
+	return &tokenSender{authorizer: c.token, next: next}
+}
+
+// tokenSender attaches bearer tokens to storage requests, replacing the
+// shared key signature of the client, which can't be configured with a token.
+type tokenSender struct {
+	authorizer autorest.Authorizer
+	next       storage.Sender
+}
+
+func (s *tokenSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	req, err := autorest.Prepare(req, s.authorizer.WithAuthorization())
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting AAD token for storage request")
+	}
+	return s.next.Send(c, req)
+}
+
+// credentialProvider supplies the credentials the plugin uses to talk to
+// Azure: a data plane credential for the storage account holding backups,
+// and authorizers for ARM and other AAD-protected APIs.
+type credentialProvider interface {
+	// GetStorageCredential returns a credential for the given storage account.
+	GetStorageCredential(account storageAccount) (*storageCredential, error)
+
+	// GetARMToken returns an authorizer that attaches bearer tokens for the
+	// given resource (e.g. env.ResourceManagerEndpoint) to requests.
+	GetARMToken(resource string) (autorest.Authorizer, error)
+}
+
+// storageCredentialConfigKeys are the config keys that select the storage
+// account's credential, of which at most one may be set.
+var storageCredentialConfigKeys = []string{
+	useAADConfigKey,
+	storageAccountKeyEnvVarConfigKey,
+	storageAccountSASEnvVarConfigKey,
+	keyVaultNameConfigKey,
+	storageAccountConnectionStringEnvVarConfigKey,
+}
+
+// newCredentialProvider selects a credential provider based on the given config
+// and the environment, which must already have the credentials file loaded.
+// An explicitly configured storage account key or SAS is used for the storage
+// account, with AAD used for everything else; otherwise AAD is used for both,
+// either to look up the account's key or, with config.useAAD, to get tokens
+// for the account's data plane. config.clientId selects the user-assigned
+// managed identity to use when there are no other AAD credentials.
+func newCredentialProvider(config map[string]string, env *azure.Environment) (credentialProvider, error) {
+	aad := newAADCredentialProvider(env)
+	if msi, ok := aad.(*msiCredentialProvider); ok && config[clientIDConfigKey] != "" {
+		msi.clientID = config[clientIDConfigKey]
+	}
+
+	useAAD, err := getUseAAD(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the storage account's credential is configured by at most one key
+	var set []string
+	for _, key := range storageCredentialConfigKeys {
+		if config[key] != "" && (key != useAADConfigKey || useAAD) {
+			set = append(set, fmt.Sprintf("%q", key))
+		}
+	}
+	if len(set) > 1 {
+		return nil, errors.Errorf("config keys %s can't be set together", strings.Join(set, " and "))
+	}
+
+	if useAAD {
+		return &aadStorageCredentialProvider{env: env, aad: aad}, nil
+	}
+
+	if vaultName := config[keyVaultNameConfigKey]; vaultName != "" {
+		if config[keyVaultSecretNameConfigKey] == "" {
+			return nil, errors.Errorf("config key %q is required with %q", keyVaultSecretNameConfigKey, keyVaultNameConfigKey)
+		}
+		return &keyVaultCredentialProvider{env: env, vaultName: vaultName, secretName: config[keyVaultSecretNameConfigKey], aad: aad}, nil
+	}
+
+	if keyEnvVar := config[storageAccountKeyEnvVarConfigKey]; keyEnvVar != "" {
+		key := os.Getenv(keyEnvVar)
+		if key == "" {
+			return nil, errors.Errorf("no storage account key found in env var %s", keyEnvVar)
+		}
+		return &accountKeyCredentialProvider{key: key, aad: aad}, nil
+	}
+
+	if sasEnvVar := config[storageAccountSASEnvVarConfigKey]; sasEnvVar != "" {
+		sas := os.Getenv(sasEnvVar)
+		if sas == "" {
+			return nil, errors.Errorf("no storage account SAS found in env var %s", sasEnvVar)
+		}
+		return &sasCredentialProvider{token: sas, aad: aad}, nil
+	}
+
+	// the emulator's account has a well-known key
+	emulatorURI, err := getStorageEmulatorURI(config)
+	if err != nil {
+		return nil, err
+	}
+	if emulatorURI != nil {
+		return &accountKeyCredentialProvider{key: storage.StorageEmulatorAccountKey, aad: aad}, nil
+	}
+
+	connectionString, err := getStorageConnectionString(config)
+	if err != nil {
+		return nil, err
+	}
+	if connectionString != nil {
+		return &connectionStringCredentialProvider{connectionString: connectionString, aad: aad}, nil
+	}
+
+	if sas := os.Getenv(storageAccountSASEnvVar); sas != "" {
+		return &sasCredentialProvider{token: sas, aad: aad}, nil
+	}
+
+	return aad, nil
+}
+
+// newAADCredentialProvider returns an AAD credential provider based on the
+// environment, in the following order:
+// 1. workload identity (AZURE_TENANT_ID, AZURE_CLIENT_ID, AZURE_FEDERATED_TOKEN_FILE)
+// 2. client credentials (AZURE_TENANT_ID, AZURE_CLIENT_ID, AZURE_CLIENT_SECRET)
+// 3. client certificate (AZURE_CERTIFICATE_PATH, AZURE_CERTIFICATE_PASSWORD)
+// 4. username and password (AZURE_USERNAME, AZURE_PASSWORD)
+// 5. MSI (managed service identity)
+func newAADCredentialProvider(env *azure.Environment) credentialProvider {
+	tenantID, clientID := os.Getenv(tenantIDEnvVar), os.Getenv(clientIDEnvVar)
+
+	switch {
+	case os.Getenv(federatedTokenFileEnvVar) != "":
+		return &workloadIdentityCredentialProvider{
+			env:           env,
+			tenantID:      tenantID,
+			clientID:      clientID,
+			tokenFile:     os.Getenv(federatedTokenFileEnvVar),
+			authorityHost: os.Getenv(authorityHostEnvVar),
+			audience:      os.Getenv(federatedTokenAudienceEnvVar),
+		}
+	case os.Getenv(clientSecretEnvVar) != "":
+		return &servicePrincipalSecretCredentialProvider{
+			env:          env,
+			tenantID:     tenantID,
+			clientID:     clientID,
+			clientSecret: os.Getenv(clientSecretEnvVar),
+		}
+	case os.Getenv(certificatePathEnvVar) != "":
+		return &servicePrincipalCertCredentialProvider{
+			env:                 env,
+			tenantID:            tenantID,
+			clientID:            clientID,
+			certificatePath:     os.Getenv(certificatePathEnvVar),
+			certificatePassword: os.Getenv(certificatePasswordEnvVar),
+		}
+	case os.Getenv(usernameEnvVar) != "" && os.Getenv(passwordEnvVar) != "":
+		return &usernamePasswordCredentialProvider{
+			env:      env,
+			tenantID: tenantID,
+			clientID: clientID,
+			username: os.Getenv(usernameEnvVar),
+			password: os.Getenv(passwordEnvVar),
+		}
+	default:
+		return &msiCredentialProvider{env: env, clientID: clientID}
+	}
+}
+
+// getUseAAD returns whether config.useAAD is set.
+func getUseAAD(config map[string]string) (bool, error) {
+	val := config[useAADConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	useAAD, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, useAADConfigKey)
+	}
+	return useAAD, nil
+}
+
+// aadStorageCredentialProvider authorizes storage requests with AAD tokens
+// rather than the account's key, for storage accounts with shared key access
+// disabled. The identity needs a data plane role on the account, such as
+// Storage Blob Data Contributor.
+type aadStorageCredentialProvider struct {
+	env *azure.Environment
+	aad credentialProvider
+}
+
+func (p *aadStorageCredentialProvider) GetStorageCredential(storageAccount) (*storageCredential, error) {
+	if p.env.ResourceIdentifiers.Storage == "" {
+		return nil, errors.Errorf("config key %q isn't supported in %s, which doesn't accept AAD tokens for storage", useAADConfigKey, p.env.Name)
+	}
+	authorizer, err := p.aad.GetARMToken(p.env.ResourceIdentifiers.Storage)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting authorizer for storage from environment")
+	}
+	return &storageCredential{token: authorizer}, nil
+}
+
+func (p *aadStorageCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	return p.aad.GetARMToken(resource)
+}
+
+// accountKeyCredentialProvider uses a fixed storage account key.
+type accountKeyCredentialProvider struct {
+	key string
+	aad credentialProvider
+}
+
+func (p *accountKeyCredentialProvider) GetStorageCredential(storageAccount) (*storageCredential, error) {
+	return &storageCredential{accountKey: p.key}, nil
+}
+
+func (p *accountKeyCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	return p.aad.GetARMToken(resource)
+}
+
+// keyVaultCredentialProvider gets the storage account key from a Key Vault
+// secret, authorized by AAD. The secret's latest version is read every time
+// the object store is initialized, so keys rotated in the vault are picked up
+// without restarting Velero.
+type keyVaultCredentialProvider struct {
+	env        *azure.Environment
+	vaultName  string
+	secretName string
+	aad        credentialProvider
+}
+
+func (p *keyVaultCredentialProvider) GetStorageCredential(storageAccount) (*storageCredential, error) {
+	authorizer, err := p.aad.GetARMToken(strings.TrimSuffix(p.env.ResourceIdentifiers.KeyVault, "/"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting authorizer for Key Vault from environment")
+	}
+
+	client := keyvault.New()
+	client.Authorizer = authorizer
+
+	vaultURL := "https://" + p.vaultName + "." + p.env.KeyVaultDNSSuffix
+	secret, err := client.GetSecret(context.TODO(), vaultURL, p.secretName, "")
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting secret %s from Key Vault %s", p.secretName, p.vaultName)
+	}
+	if secret.Value == nil || *secret.Value == "" {
+		return nil, errors.Errorf("secret %s in Key Vault %s is empty", p.secretName, p.vaultName)
+	}
+
+	return &storageCredential{accountKey: strings.TrimSpace(*secret.Value)}, nil
+}
+
+func (p *keyVaultCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	return p.aad.GetARMToken(resource)
+}
+
+// sasCredentialProvider uses a fixed account or container SAS token. With a
+// container SAS, only the operations on that container are authorized, which
+// are all the object store needs.
+type sasCredentialProvider struct {
+	token string
+	aad   credentialProvider
+}
+
+func (p *sasCredentialProvider) GetStorageCredential(storageAccount) (*storageCredential, error) {
+	return &storageCredential{sasToken: strings.TrimPrefix(p.token, "?")}, nil
+}
+
+func (p *sasCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	return p.aad.GetARMToken(resource)
+}
+
+// servicePrincipalSecretCredentialProvider authenticates as a service principal
+// using a client secret.
+type servicePrincipalSecretCredentialProvider struct {
+	env          *azure.Environment
+	tenantID     string
+	clientID     string
+	clientSecret string
+}
+
+func (p *servicePrincipalSecretCredentialProvider) GetStorageCredential(account storageAccount) (*storageCredential, error) {
+	return listStorageAccountKey(p, p.env, account)
+}
+
+func (p *servicePrincipalSecretCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	config := auth.ClientCredentialsConfig{
+		ClientID:     p.clientID,
+		ClientSecret: p.clientSecret,
+		TenantID:     p.tenantID,
+		AADEndpoint:  p.env.ActiveDirectoryEndpoint,
+		Resource:     resource,
+	}
+	return config.Authorizer()
+}
+
+// servicePrincipalCertCredentialProvider authenticates as a service principal
+// using a client certificate.
+type servicePrincipalCertCredentialProvider struct {
+	env                 *azure.Environment
+	tenantID            string
+	clientID            string
+	certificatePath     string
+	certificatePassword string
+}
+
+func (p *servicePrincipalCertCredentialProvider) GetStorageCredential(account storageAccount) (*storageCredential, error) {
+	return listStorageAccountKey(p, p.env, account)
+}
+
+func (p *servicePrincipalCertCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	config := auth.ClientCertificateConfig{
+		ClientID:            p.clientID,
+		CertificatePath:     p.certificatePath,
+		CertificatePassword: p.certificatePassword,
+		TenantID:            p.tenantID,
+		AADEndpoint:         p.env.ActiveDirectoryEndpoint,
+		Resource:            resource,
+	}
+	return config.Authorizer()
+}
+
+// usernamePasswordCredentialProvider authenticates as a user.
+type usernamePasswordCredentialProvider struct {
+	env      *azure.Environment
+	tenantID string
+	clientID string
+	username string
+	password string
+}
+
+func (p *usernamePasswordCredentialProvider) GetStorageCredential(account storageAccount) (*storageCredential, error) {
+	return listStorageAccountKey(p, p.env, account)
+}
+
+func (p *usernamePasswordCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	config := auth.UsernamePasswordConfig{
+		ClientID:    p.clientID,
+		Username:    p.username,
+		Password:    p.password,
+		TenantID:    p.tenantID,
+		AADEndpoint: p.env.ActiveDirectoryEndpoint,
+		Resource:    resource,
+	}
+	return config.Authorizer()
+}
+
+// msiCredentialProvider authenticates as the system-assigned managed identity,
+// or the user-assigned one with the given client ID, with tokens from IMDS.
+type msiCredentialProvider struct {
+	env      *azure.Environment
+	clientID string
+}
+
+func (p *msiCredentialProvider) GetStorageCredential(account storageAccount) (*storageCredential, error) {
+	return listStorageAccountKey(p, p.env, account)
+}
+
+func (p *msiCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	msiEndpoint, err := adal.GetMSIEndpoint()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var token *adal.ServicePrincipalToken
+	if p.clientID == "" {
+		token, err = adal.NewServicePrincipalTokenFromMSI(msiEndpoint, resource)
+	} else {
+		token, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, resource, p.clientID)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting token from MSI")
+	}
+
+	// the sender retries token requests itself
+	token.MaxMSIRefreshAttempts = 1
+	token.SetSender(newIMDSSender(os.Getenv(managedIdentityTokenFileEnvVar)))
+	return autorest.NewBearerAuthorizer(token), nil
+}
+
+// workloadIdentityCredentialProvider authenticates as an AAD application by
+// exchanging a federated token, e.g. a projected Kubernetes service account
+// token, for an access token. The Azure AD Workload Identity webhook sets
+// AZURE_AUTHORITY_HOST along with the other variables, which takes precedence
+// over the cloud's AAD endpoint, unless it's the public cloud's in another
+// cloud: the webhook sets the public cloud's unless it's configured for the
+// cluster's cloud. The federated token must be for the audience in
+// AZURE_FEDERATED_TOKEN_AUDIENCE, if set, or the cloud's default one.
+type workloadIdentityCredentialProvider struct {
+	env           *azure.Environment
+	tenantID      string
+	clientID      string
+	tokenFile     string
+	authorityHost string
+	audience      string
+}
+
+func (p *workloadIdentityCredentialProvider) GetStorageCredential(account storageAccount) (*storageCredential, error) {
+	return listStorageAccountKey(p, p.env, account)
+}
+
+// authority returns the AAD endpoint to exchange the federated token at.
+func (p *workloadIdentityCredentialProvider) authority() string {
+	if p.authorityHost == "" {
+		return p.env.ActiveDirectoryEndpoint
+	}
+	if p.env.Name != azure.PublicCloud.Name && strings.TrimSuffix(p.authorityHost, "/") == strings.TrimSuffix(azure.PublicCloud.ActiveDirectoryEndpoint, "/") {
+		return p.env.ActiveDirectoryEndpoint
+	}
+	return p.authorityHost
+}
+
+func (p *workloadIdentityCredentialProvider) GetARMToken(resource string) (autorest.Authorizer, error) {
+	if p.tenantID == "" || p.clientID == "" {
+		return nil, errors.Errorf("%s and %s are required with %s", tenantIDEnvVar, clientIDEnvVar, federatedTokenFileEnvVar)
+	}
+
+	audience := p.audience
+	if audience == "" {
+		audience = federatedTokenAudiences[p.env.Name]
+	}
+
+	oauthConfig, err := adal.NewOAuthConfig(p.authority(), p.tenantID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	token, err := adal.NewServicePrincipalTokenWithSecret(*oauthConfig, p.clientID, resource, &federatedTokenSecret{tokenFile: p.tokenFile, audience: audience})
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting token from federated token")
+	}
+
+	return autorest.NewBearerAuthorizer(token), nil
+}
+
+// federatedTokenSecret authenticates token requests with a client assertion
+// read from a file. The file is re-read on every refresh since the token in
+// it is rotated before it expires. Tokens for another audience than audience,
+// if set, are rejected before AAD does, with an error that says why.
+type federatedTokenSecret struct {
+	tokenFile string
+	audience  string
+}
+
+func (s *federatedTokenSecret) SetAuthenticationValues(_ *adal.ServicePrincipalToken, values *url.Values) error {
+	token, err := ioutil.ReadFile(s.tokenFile)
+	if err != nil {
+		return errors.Wrapf(err, "error reading federated token file %s", s.tokenFile)
+	}
+
+	assertion := strings.TrimSpace(string(token))
+	if err := checkFederatedTokenAudience(assertion, s.audience); err != nil {
+		return errors.WithMessagef(err, "federated token in %s can't be exchanged", s.tokenFile)
+	}
+
+	values.Set("client_assertion_type", clientAssertionType)
+	values.Set("client_assertion", assertion)
+	return nil
+}
+
+// checkFederatedTokenAudience returns an error if the JWT isn't for the
+// given audience. Tokens that can't be parsed are left for AAD to reject.
+func checkFederatedTokenAudience(token, audience string) error {
+	parts := strings.Split(token, ".")
+	if audience == "" || len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	var claims struct {
+		Audience json.RawMessage `json:"aud"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+
+	// "aud" is either a string or an array of them
+	var audiences []string
+	if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		var single string
+		if err := json.Unmarshal(claims.Audience, &single); err != nil {
+			return nil
+		}
+		audiences = []string{single}
+	}
+	for _, a := range audiences {
+		if a == audience {
+			return nil
+		}
+	}
+
+	return errors.Errorf("it's for audience %s rather than %s, which AAD expects: issue the service account token projected into the pod for %s, or set %s to the audience of the application's federated identity credential", strings.Join(audiences, ", "), audience, audience, federatedTokenAudienceEnvVar)
+}
+
+// listStorageAccountKey gets a storage account key with full permissions from
+// the ARM API, authorized by the given provider.
+func listStorageAccountKey(provider credentialProvider, env *azure.Environment, account storageAccount) (*storageCredential, error) {
+	if account.subscriptionID == "" {
+		return nil, errors.New("azure subscription ID not found in object store's config or in environment variable")
+	}
+	if account.resourceGroup == "" || account.name == "" {
+		return nil, errors.Errorf("unable to get all required config values: %s and %s are required to look up the storage account key", resourceGroupConfigKey, storageAccountConfigKey)
+	}
+
+	authorizer, err := provider.GetARMToken(armResource(env))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting authorizer from environment")
+	}
+
+	storageAccountsClient := storagemgmt.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, account.subscriptionID)
+	storageAccountsClient.Authorizer = authorizer
+	withARMAPIVersion(&storageAccountsClient.Client, account.apiVersion)
+
+	res, err := storageAccountsClient.ListKeys(context.TODO(), account.resourceGroup, account.name, storagemgmt.Kerb)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if res.Keys == nil || len(*res.Keys) == 0 {
+		return nil, errors.New("No storage keys found")
+	}
+
+	for _, key := range *res.Keys {
+		// uppercase both strings for comparison because the ListKeys call returns e.g. "FULL" but
+		// the storagemgmt.Full constant in the SDK is defined as "Full".
+		if strings.ToUpper(string(key.Permissions)) == strings.ToUpper(string(storagemgmt.Full)) {
+			return &storageCredential{accountKey: *key.Value}, nil
+		}
+	}
+
+	return nil, errors.New("No storage key with Full permissions found")
+}
@@ -0,0 +1,352 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setEnv sets the given environment variables, unsetting any other
+// credential variables, and returns a func that restores them.
+func setEnv(t *testing.T, vars map[string]string) func() {
+	keys := []string{
+		tenantIDEnvVar, clientIDEnvVar, clientSecretEnvVar, certificatePathEnvVar, certificatePasswordEnvVar,
+		usernameEnvVar, passwordEnvVar, federatedTokenFileEnvVar, authorityHostEnvVar, federatedTokenAudienceEnvVar, storageAccountSASEnvVar, storageConnectionStringEnvVar, "TEST_STORAGE_KEY",
+	}
+
+	saved := map[string]string{}
+	for _, key := range keys {
+		if val, ok := os.LookupEnv(key); ok {
+			saved[key] = val
+		}
+		require.NoError(t, os.Unsetenv(key))
+	}
+	for key, val := range vars {
+		require.NoError(t, os.Setenv(key, val))
+	}
+
+	return func() {
+		for _, key := range keys {
+			os.Unsetenv(key)
+		}
+		for key, val := range saved {
+			os.Setenv(key, val)
+		}
+	}
+}
+
+func TestNewCredentialProvider(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        map[string]string
+		env           map[string]string
+		expected      credentialProvider
+		expectedError string
+	}{
+		{
+			name:     "storage account key from env var",
+			config:   map[string]string{storageAccountKeyEnvVarConfigKey: "TEST_STORAGE_KEY"},
+			env:      map[string]string{"TEST_STORAGE_KEY": "key"},
+			expected: &accountKeyCredentialProvider{},
+		},
+		{
+			name:          "storage account key env var is empty",
+			config:        map[string]string{storageAccountKeyEnvVarConfigKey: "TEST_STORAGE_KEY"},
+			expectedError: "no storage account key found in env var TEST_STORAGE_KEY",
+		},
+		{
+			name:     "AAD tokens for storage",
+			config:   map[string]string{useAADConfigKey: "true"},
+			env:      map[string]string{clientSecretEnvVar: "secret"},
+			expected: &aadStorageCredentialProvider{},
+		},
+		{
+			name:          "AAD tokens and storage account key",
+			config:        map[string]string{useAADConfigKey: "true", storageAccountKeyEnvVarConfigKey: "TEST_STORAGE_KEY"},
+			env:           map[string]string{"TEST_STORAGE_KEY": "key"},
+			expectedError: `config keys "useAAD" and "storageAccountKeyEnvVar" can't be set together`,
+		},
+		{
+			name:     "AAD tokens disabled and storage account key",
+			config:   map[string]string{useAADConfigKey: "false", storageAccountKeyEnvVarConfigKey: "TEST_STORAGE_KEY"},
+			env:      map[string]string{"TEST_STORAGE_KEY": "key"},
+			expected: &accountKeyCredentialProvider{},
+		},
+		{
+			name:     "SAS from configured env var",
+			config:   map[string]string{storageAccountSASEnvVarConfigKey: "TEST_STORAGE_KEY"},
+			env:      map[string]string{"TEST_STORAGE_KEY": "sv=2019-02-02&sr=c&sig=abc"},
+			expected: &sasCredentialProvider{},
+		},
+		{
+			name:          "configured SAS env var is empty",
+			config:        map[string]string{storageAccountSASEnvVarConfigKey: "TEST_STORAGE_KEY"},
+			expectedError: "no storage account SAS found in env var TEST_STORAGE_KEY",
+		},
+		{
+			name:          "SAS and storage account key",
+			config:        map[string]string{storageAccountSASEnvVarConfigKey: "TEST_STORAGE_KEY", storageAccountKeyEnvVarConfigKey: "TEST_STORAGE_KEY"},
+			env:           map[string]string{"TEST_STORAGE_KEY": "key"},
+			expectedError: `config keys "storageAccountKeyEnvVar" and "storageAccountSASEnvVar" can't be set together`,
+		},
+		{
+			name:          "invalid useAAD",
+			config:        map[string]string{useAADConfigKey: "yes please"},
+			expectedError: `unable to parse value "yes please" for config key "useAAD" (expected a boolean value): strconv.ParseBool: parsing "yes please": invalid syntax`,
+		},
+		{
+			name:     "storage account key from Key Vault",
+			config:   map[string]string{keyVaultNameConfigKey: "my-vault", keyVaultSecretNameConfigKey: "storage-key"},
+			expected: &keyVaultCredentialProvider{},
+		},
+		{
+			name:          "Key Vault without secret name",
+			config:        map[string]string{keyVaultNameConfigKey: "my-vault"},
+			expectedError: `config key "secretName" is required with "keyVaultName"`,
+		},
+		{
+			name:          "Key Vault and storage account key",
+			config:        map[string]string{keyVaultNameConfigKey: "my-vault", keyVaultSecretNameConfigKey: "storage-key", storageAccountKeyEnvVarConfigKey: "TEST_STORAGE_KEY"},
+			env:           map[string]string{"TEST_STORAGE_KEY": "key"},
+			expectedError: `config keys "storageAccountKeyEnvVar" and "keyVaultName" can't be set together`,
+		},
+		{
+			name:     "SAS",
+			env:      map[string]string{storageAccountSASEnvVar: "?sv=2019-02-02&sig=abc"},
+			expected: &sasCredentialProvider{},
+		},
+		{
+			name:     "workload identity takes precedence over client secret",
+			env:      map[string]string{federatedTokenFileEnvVar: "/token", clientSecretEnvVar: "secret"},
+			expected: &workloadIdentityCredentialProvider{},
+		},
+		{
+			name:     "client secret",
+			env:      map[string]string{clientSecretEnvVar: "secret"},
+			expected: &servicePrincipalSecretCredentialProvider{},
+		},
+		{
+			name:     "client certificate",
+			env:      map[string]string{certificatePathEnvVar: "/cert.pfx"},
+			expected: &servicePrincipalCertCredentialProvider{},
+		},
+		{
+			name:     "username and password",
+			env:      map[string]string{usernameEnvVar: "user", passwordEnvVar: "pass"},
+			expected: &usernamePasswordCredentialProvider{},
+		},
+		{
+			name:     "MSI",
+			expected: &msiCredentialProvider{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			defer setEnv(t, tc.env)()
+
+			provider, err := newCredentialProvider(tc.config, &azure.PublicCloud)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.IsType(t, tc.expected, provider)
+		})
+	}
+}
+
+func TestNewCredentialProviderClientID(t *testing.T) {
+	defer setEnv(t, map[string]string{clientIDEnvVar: "env-client-id"})()
+
+	provider, err := newCredentialProvider(map[string]string{}, &azure.PublicCloud)
+	require.NoError(t, err)
+	assert.Equal(t, "env-client-id", provider.(*msiCredentialProvider).clientID)
+
+	provider, err = newCredentialProvider(map[string]string{clientIDConfigKey: "config-client-id", useAADConfigKey: "true"}, &azure.PublicCloud)
+	require.NoError(t, err)
+	assert.Equal(t, "config-client-id", provider.(*aadStorageCredentialProvider).aad.(*msiCredentialProvider).clientID)
+
+	// the client ID is only for managed identities
+	defer setEnv(t, map[string]string{clientIDEnvVar: "env-client-id", clientSecretEnvVar: "secret"})()
+	provider, err = newCredentialProvider(map[string]string{clientIDConfigKey: "config-client-id"}, &azure.PublicCloud)
+	require.NoError(t, err)
+	assert.Equal(t, "env-client-id", provider.(*servicePrincipalSecretCredentialProvider).clientID)
+}
+
+func TestStaticStorageCredentials(t *testing.T) {
+	credential, err := (&accountKeyCredentialProvider{key: "key"}).GetStorageCredential(storageAccount{})
+	require.NoError(t, err)
+	assert.Equal(t, &storageCredential{accountKey: "key"}, credential)
+
+	credential, err = (&sasCredentialProvider{token: "?sv=2019-02-02&sig=abc"}).GetStorageCredential(storageAccount{})
+	require.NoError(t, err)
+	assert.Equal(t, &storageCredential{sasToken: "sv=2019-02-02&sig=abc"}, credential)
+}
+
+type recordingSender struct {
+	requests []*http.Request
+}
+
+func (s *recordingSender) Send(_ *storage.Client, req *http.Request) (*http.Response, error) {
+	s.requests = append(s.requests, req)
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestTokenStorageCredential(t *testing.T) {
+	credential := &storageCredential{token: autorest.NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"Authorization": "Bearer token"})}
+	client, err := newStorageClient("account", credential, &azure.PublicCloud, "")
+	require.NoError(t, err)
+	next := new(recordingSender)
+	client.Sender = credential.sender(next)
+
+	blobService := client.GetBlobService()
+	_, err = blobService.GetContainerReference("container").GetBlobReference("blob").Exists()
+	require.NoError(t, err)
+
+	// the client's shared key signature is replaced by the token
+	require.Len(t, next.requests, 1)
+	assert.Equal(t, []string{"Bearer token"}, next.requests[0].Header["Authorization"])
+
+	// credentials without tokens leave the sender as it is
+	assert.Equal(t, next, (&storageCredential{accountKey: "key"}).sender(next))
+}
+
+func TestNewStorageClientAPIVersion(t *testing.T) {
+	for version, expected := range map[string]string{"": storage.DefaultAPIVersion, "2017-11-09": "2017-11-09"} {
+		client, err := newStorageClient("account", &storageCredential{accountKey: "a2V5"}, &azure.PublicCloud, version)
+		require.NoError(t, err)
+		sender := new(recordingSender)
+		client.Sender = sender
+
+		blobService := client.GetBlobService()
+		_, err = blobService.GetContainerReference("container").GetBlobReference("blob").Exists()
+		require.NoError(t, err)
+		require.Len(t, sender.requests, 1)
+		assert.Equal(t, []string{expected}, sender.requests[0].Header["x-ms-version"])
+	}
+}
+
+func TestListStorageAccountKeyRequiresAccount(t *testing.T) {
+	provider := &msiCredentialProvider{env: &azure.PublicCloud}
+
+	_, err := provider.GetStorageCredential(storageAccount{})
+	assert.EqualError(t, err, "azure subscription ID not found in object store's config or in environment variable")
+
+	_, err = provider.GetStorageCredential(storageAccount{subscriptionID: "sub"})
+	assert.EqualError(t, err, "unable to get all required config values: resourceGroup and storageAccount are required to look up the storage account key")
+}
+
+func TestFederatedTokenSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	secret := &federatedTokenSecret{tokenFile: tokenFile}
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token-1\n"), 0600))
+	values := url.Values{}
+	require.NoError(t, secret.SetAuthenticationValues(nil, &values))
+	assert.Equal(t, clientAssertionType, values.Get("client_assertion_type"))
+	assert.Equal(t, "token-1", values.Get("client_assertion"))
+
+	// the file is re-read on every token refresh
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("token-2"), 0600))
+	require.NoError(t, secret.SetAuthenticationValues(nil, &values))
+	assert.Equal(t, "token-2", values.Get("client_assertion"))
+
+	require.NoError(t, os.Remove(tokenFile))
+	assert.Error(t, secret.SetAuthenticationValues(nil, &values))
+}
+
+func TestWorkloadIdentityCredentialProvider(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		federatedTokenFileEnvVar: "/token",
+		tenantIDEnvVar:           "tenant",
+		clientIDEnvVar:           "client",
+		authorityHostEnvVar:      "https://login.example.com/",
+	})()
+
+	provider := newAADCredentialProvider(&azure.PublicCloud)
+	assert.Equal(t, &workloadIdentityCredentialProvider{
+		env:           &azure.PublicCloud,
+		tenantID:      "tenant",
+		clientID:      "client",
+		tokenFile:     "/token",
+		authorityHost: "https://login.example.com/",
+	}, provider)
+
+	// tokens are only requested when they're first used
+	_, err := provider.GetARMToken(azure.PublicCloud.ResourceManagerEndpoint)
+	require.NoError(t, err)
+
+	_, err = (&workloadIdentityCredentialProvider{env: &azure.PublicCloud, tokenFile: "/token"}).GetARMToken(azure.PublicCloud.ResourceManagerEndpoint)
+	assert.EqualError(t, err, "AZURE_TENANT_ID and AZURE_CLIENT_ID are required with AZURE_FEDERATED_TOKEN_FILE")
+}
+
+func TestWorkloadIdentityClouds(t *testing.T) {
+	jwt := func(aud string) string {
+		return "e30." + base64.RawURLEncoding.EncodeToString([]byte(`{"aud":`+aud+`}`)) + ".sig"
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+
+	// tokens must be for the audience AAD expects in the cloud
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte(jwt(`"api://AzureADTokenExchange"`)), 0600))
+	values := url.Values{}
+	require.NoError(t, (&federatedTokenSecret{tokenFile: tokenFile, audience: federatedTokenAudiences[azure.PublicCloud.Name]}).SetAuthenticationValues(nil, &values))
+	err = (&federatedTokenSecret{tokenFile: tokenFile, audience: federatedTokenAudiences[azure.ChinaCloud.Name]}).SetAuthenticationValues(nil, &values)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "api://AzureADTokenExchangeChina")
+	assert.Contains(t, err.Error(), federatedTokenAudienceEnvVar)
+
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte(jwt(`["other","api://AzureADTokenExchangeUSGov"]`)), 0600))
+	require.NoError(t, (&federatedTokenSecret{tokenFile: tokenFile, audience: federatedTokenAudiences[azure.USGovernmentCloud.Name]}).SetAuthenticationValues(nil, &values))
+
+	// the public cloud's authority host, which the webhook sets by default,
+	// isn't used in other clouds
+	for _, test := range []struct {
+		env           *azure.Environment
+		authorityHost string
+		expected      string
+	}{
+		{env: &azure.PublicCloud, expected: azure.PublicCloud.ActiveDirectoryEndpoint},
+		{env: &azure.PublicCloud, authorityHost: "https://login.example.com/", expected: "https://login.example.com/"},
+		{env: &azure.ChinaCloud, authorityHost: "https://login.microsoftonline.com", expected: azure.ChinaCloud.ActiveDirectoryEndpoint},
+		{env: &azure.ChinaCloud, authorityHost: "https://login.example.com/", expected: "https://login.example.com/"},
+	} {
+		provider := &workloadIdentityCredentialProvider{env: test.env, authorityHost: test.authorityHost}
+		assert.Equal(t, test.expected, provider.authority())
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	customerProvidedKeyEnvVarConfigKey = "customerProvidedKeyEnvVar"
+
+	// customerProvidedKeyAPIVersion is the first storage API version that
+	// supports customer-provided keys
+	customerProvidedKeyAPIVersion = "2019-02-02"
+)
+
+// customerProvidedKey is an AES-256 key the storage service encrypts and
+// decrypts blobs with, without storing it.
+type customerProvidedKey struct {
+	key    string
+	sha256 string
+}
+
+// getCustomerProvidedKey returns the base64-encoded AES-256 key in the env
+// var named by config.customerProvidedKeyEnvVar, e.g. one set in
+// $AZURE_CREDENTIALS_FILE, or nil if it isn't set.
+func getCustomerProvidedKey(config map[string]string) (*customerProvidedKey, error) {
+	envVar := config[customerProvidedKeyEnvVarConfigKey]
+	if envVar == "" {
+		return nil, nil
+	}
+	encoded := os.Getenv(envVar)
+	if encoded == "" {
+		return nil, errors.Errorf("no customer-provided key found in env var %s", envVar)
+	}
+
+	// don't include the key in errors, it's a secret
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Errorf("customer-provided key in env var %s isn't base64-encoded", envVar)
+	}
+	if len(key) != 32 {
+		return nil, errors.Errorf("customer-provided key in env var %s is %d bytes long, AES-256 keys are 32 bytes long", envVar, len(key))
+	}
+
+	sum := sha256.Sum256(key)
+	return &customerProvidedKey{key: encoded, sha256: base64.StdEncoding.EncodeToString(sum[:])}, nil
+}
+
+// takesCustomerProvidedKey returns whether req is for an operation that
+// writes or reads a blob's content or metadata, which must be given the key
+// the blob is encrypted with. Other operations, e.g. Delete Blob or Copy
+// Blob, don't take a key.
+// ref. https://docs.microsoft.com/en-us/azure/storage/blobs/encryption-customer-provided-keys#blob-storage-operations-supporting-customer-provided-keys
+func takesCustomerProvidedKey(req *http.Request) bool {
+	query := req.URL.Query()
+	if query.Get("restype") != "" || getHeader(req.Header, "x-ms-copy-source") != "" {
+		return false
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		switch query.Get("comp") {
+		case "", "metadata":
+			return true
+		}
+	case http.MethodPut:
+		switch query.Get("comp") {
+		case "", "block", "blocklist", "metadata", "appendblock", "snapshot":
+			return true
+		}
+	}
+	return false
+}
+
+// customerProvidedKeySender adds a customer-provided key to the requests of
+// a storage client that take one, since the client can't set their headers.
+type customerProvidedKeySender struct {
+	key        *customerProvidedKey
+	account    string
+	accountKey string
+	next       storage.Sender
+}
+
+func (s *customerProvidedKeySender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	if !takesCustomerProvidedKey(req) {
+		return s.next.Send(c, req)
+	}
+
+	err := setClientRequestHeaders(req, s.account, s.accountKey, customerProvidedKeyAPIVersion, map[string]string{
+		"x-ms-encryption-key":        s.key.key,
+		"x-ms-encryption-key-sha256": s.key.sha256,
+		"x-ms-encryption-algorithm":  "AES256",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.next.Send(c, req)
+}
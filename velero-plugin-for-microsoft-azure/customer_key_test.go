@@ -0,0 +1,127 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetCustomerProvidedKey(t *testing.T) {
+	key, err := getCustomerProvidedKey(map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, key)
+
+	setEnv(t, map[string]string{
+		"CPK":       "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		"SHORT_CPK": "a2V5",
+		"BAD_CPK":   "not base64!",
+	})
+
+	key, err = getCustomerProvidedKey(map[string]string{customerProvidedKeyEnvVarConfigKey: "CPK"})
+	require.NoError(t, err)
+	assert.Equal(t, &customerProvidedKey{
+		key:    "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		sha256: "PrG9Q5lH63YpmOVmzMLgmceREYsvQFecxPfaK1Bht/k=",
+	}, key)
+
+	for _, envVar := range []string{"MISSING_CPK", "SHORT_CPK", "BAD_CPK"} {
+		_, err := getCustomerProvidedKey(map[string]string{customerProvidedKeyEnvVarConfigKey: envVar})
+		require.Error(t, err)
+		assert.NotContains(t, err.Error(), "a2V5")
+	}
+}
+
+// methodStatusSender records requests and answers them with the status the
+// storage client expects for their method.
+type methodStatusSender struct {
+	recordingSender
+}
+
+func (s *methodStatusSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	s.recordingSender.Send(c, req)
+	status := http.StatusOK
+	switch req.Method {
+	case http.MethodPut:
+		status = http.StatusCreated
+	case http.MethodDelete:
+		status = http.StatusAccepted
+	}
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestCustomerProvidedKeySender(t *testing.T) {
+	key := &customerProvidedKey{key: "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", sha256: "PrG9Q5lH63YpmOVmzMLgmceREYsvQFecxPfaK1Bht/k="}
+	client, err := storage.NewBasicClient("account", "a2V5")
+	require.NoError(t, err)
+	next := new(methodStatusSender)
+	client.Sender = &customerProvidedKeySender{key: key, account: "account", accountKey: "a2V5", next: next}
+
+	blobService := client.GetBlobService()
+	container := blobService.GetContainerReference("b")
+	blob := container.GetBlobReference("backups/b1/b1.tar.gz")
+	require.NoError(t, blob.PutBlock("00000000", []byte("data"), nil))
+	_, err = blob.Exists()
+	require.NoError(t, err)
+	require.NoError(t, blob.Delete(nil))
+	_, err = container.Exists()
+	require.NoError(t, err)
+	require.Len(t, next.requests, 4)
+
+	// blob reads and writes carry the key, at an API version that supports it
+	for _, req := range next.requests[:2] {
+		assert.Equal(t, []string{key.key}, req.Header["X-Ms-Encryption-Key"])
+		assert.Equal(t, []string{key.sha256}, req.Header["X-Ms-Encryption-Key-Sha256"])
+		assert.Equal(t, []string{"AES256"}, req.Header["X-Ms-Encryption-Algorithm"])
+		assert.Equal(t, []string{customerProvidedKeyAPIVersion}, req.Header["X-Ms-Version"])
+		assert.Empty(t, req.Header["x-ms-version"])
+
+		// and are signed again, the way the storage client signs requests
+		signed := req.Header.Get("Authorization")
+		expected := req.Clone(req.Context())
+		require.NoError(t, signSharedKey(expected, "account", "a2V5"))
+		assert.Equal(t, expected.Header.Get("Authorization"), signed)
+	}
+
+	// other requests are left as they are
+	for _, req := range next.requests[2:] {
+		assert.Equal(t, "", getHeader(req.Header, "x-ms-encryption-key"))
+		assert.Equal(t, storage.DefaultAPIVersion, getHeader(req.Header, "x-ms-version"))
+	}
+}
+
+func TestSignSharedKeyWithBody(t *testing.T) {
+	// requests with bodies are signed the way the storage client signs them
+	client, err := storage.NewBasicClient("account", "a2V5")
+	require.NoError(t, err)
+	next := new(methodStatusSender)
+	client.Sender = next
+	blobService := client.GetBlobService()
+	blob := blobService.GetContainerReference("b").GetBlobReference("k")
+	require.NoError(t, blob.PutBlockList([]storage.Block{{ID: "00000000", Status: storage.BlockStatusLatest}}, nil))
+
+	req := next.requests[0]
+	signed := req.Header.Get("Authorization")
+	require.NoError(t, signSharedKey(req, "account", "a2V5"))
+	assert.Equal(t, signed, req.Header.Get("Authorization"))
+}
@@ -0,0 +1,167 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2016-09-01/locks"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+const (
+	deleteLockWaitConfigKey = "deleteLockWait"
+
+	deleteRetryInterval = 30 * time.Second
+	scopeLockedCode     = "ScopeLocked"
+)
+
+// armErrorCode returns the HTTP status and ARM error code of err, if any.
+func armErrorCode(err error) (int, string) {
+	switch e := errors.Cause(err).(type) {
+	case autorest.DetailedError:
+		status, code := 0, ""
+		if e.StatusCode != nil {
+			status, _ = e.StatusCode.(int)
+		}
+		if e.Original != nil {
+			var originalStatus int
+			originalStatus, code = armErrorCode(e.Original)
+			if status == 0 {
+				status = originalStatus
+			}
+		}
+		return status, code
+	case *azure.RequestError:
+		if e.ServiceError != nil {
+			return armErrorStatus(e.DetailedError), e.ServiceError.Code
+		}
+		return armErrorStatus(e.DetailedError), ""
+	case azure.RequestError:
+		if e.ServiceError != nil {
+			return armErrorStatus(e.DetailedError), e.ServiceError.Code
+		}
+		return armErrorStatus(e.DetailedError), ""
+	case *azure.ServiceError:
+		return 0, e.Code
+	}
+	return 0, ""
+}
+
+func armErrorStatus(err autorest.DetailedError) int {
+	status, _ := err.StatusCode.(int)
+	return status
+}
+
+// isDeleteBlocked returns whether err means that a resource couldn't be
+// deleted because it's locked or in use.
+func isDeleteBlocked(err error) bool {
+	_, code := armErrorCode(err)
+	return isDiskTransitionConflict(err) || code == scopeLockedCode
+}
+
+// lockLister lists the management locks that apply to a resource, including
+// those inherited from its resource group and subscription.
+type lockLister interface {
+	listLocks(ctx context.Context, subscription, resourceGroup, resourceType, name string) ([]locks.ManagementLockObject, error)
+}
+
+// armLockLister lists management locks using the ARM API.
+type armLockLister struct {
+	env        *azure.Environment
+	authorizer autorest.Authorizer
+}
+
+func (l *armLockLister) listLocks(ctx context.Context, subscription, resourceGroup, resourceType, name string) ([]locks.ManagementLockObject, error) {
+	client := locks.NewManagementLocksClientWithBaseURI(l.env.ResourceManagerEndpoint, subscription)
+	client.Authorizer = l.authorizer
+
+	var result []locks.ManagementLockObject
+	iter, err := client.ListAtResourceLevelComplete(ctx, resourceGroup, "Microsoft.Compute", "", resourceType, name, "")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, iter.Value())
+	}
+	return result, nil
+}
+
+// describeLocks returns a description of the given locks, e.g.
+// "CanNotDelete lock \"keep\" (/subscriptions/.../locks/keep)".
+func describeLocks(found []locks.ManagementLockObject) string {
+	var descriptions []string
+	for _, lock := range found {
+		var name, id string
+		var level locks.LockLevel
+		if lock.Name != nil {
+			name = *lock.Name
+		}
+		if lock.ID != nil {
+			id = *lock.ID
+		}
+		if lock.ManagementLockProperties != nil {
+			level = lock.ManagementLockProperties.Level
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s lock %q (%s)", level, name, id))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// explainDeleteFailure returns err annotated with what blocked the deletion
+// of the given compute resource: the management locks that apply to it, or
+// the VM it's attached to (managedBy), if any.
+func explainDeleteFailure(ctx context.Context, lister lockLister, subscription, resourceGroup, resourceType, name, managedBy string, err error) error {
+	if !isDeleteBlocked(err) {
+		return err
+	}
+
+	if _, code := armErrorCode(err); code == scopeLockedCode && lister != nil {
+		found, listErr := lister.listLocks(ctx, subscription, resourceGroup, resourceType, name)
+		switch {
+		case listErr != nil:
+			return errors.Wrapf(err, "%s is locked, and listing its locks failed (%v)", name, listErr)
+		case len(found) > 0:
+			return errors.Wrapf(err, "%s is locked by %s", name, describeLocks(found))
+		}
+		return errors.Wrapf(err, "%s is locked", name)
+	}
+
+	if managedBy != "" {
+		return errors.Wrapf(err, "%s is attached to %s", name, managedBy)
+	}
+	return errors.Wrapf(err, "%s is in use, e.g. exported with a SAS or being copied", name)
+}
+
+// retryBlockedDelete calls del until it succeeds, fails for a reason other
+// than the resource being locked or in use, or wait has elapsed.
+func retryBlockedDelete(wait time.Duration, sleep func(time.Duration), del func() error) error {
+	err := del()
+	for waited := time.Duration(0); err != nil && isDeleteBlocked(err) && waited < wait; waited += deleteRetryInterval {
+		sleep(deleteRetryInterval)
+		err = del()
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2016-09-01/locks"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLockLister struct {
+	locks []locks.ManagementLockObject
+	err   error
+}
+
+func (f *fakeLockLister) listLocks(_ context.Context, _, _, _, _ string) ([]locks.ManagementLockObject, error) {
+	return f.locks, f.err
+}
+
+func scopeLockedError() error {
+	return errors.WithStack(autorest.DetailedError{
+		StatusCode: http.StatusConflict,
+		Original:   &azure.RequestError{ServiceError: &azure.ServiceError{Code: scopeLockedCode}},
+	})
+}
+
+func TestArmErrorCode(t *testing.T) {
+	status, code := armErrorCode(scopeLockedError())
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, scopeLockedCode, code)
+
+	status, code = armErrorCode(errors.New("error"))
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "", code)
+}
+
+func TestExplainDeleteFailure(t *testing.T) {
+	lock := locks.ManagementLockObject{
+		Name:                     stringPtr("keep"),
+		ID:                       stringPtr("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Authorization/locks/keep"),
+		ManagementLockProperties: &locks.ManagementLockProperties{Level: locks.CanNotDelete},
+	}
+
+	tests := []struct {
+		name      string
+		err       error
+		lister    lockLister
+		managedBy string
+		expected  string
+	}{
+		{
+			name:     "other errors are unchanged",
+			err:      errors.New("forbidden"),
+			expected: "forbidden",
+		},
+		{
+			name:     "locks are reported",
+			err:      scopeLockedError(),
+			lister:   &fakeLockLister{locks: []locks.ManagementLockObject{lock}},
+			expected: `snap-1 is locked by CanNotDelete lock "keep" (/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Authorization/locks/keep)`,
+		},
+		{
+			name:     "failing to list locks is reported",
+			err:      scopeLockedError(),
+			lister:   &fakeLockLister{err: errors.New("forbidden")},
+			expected: "snap-1 is locked, and listing its locks failed (forbidden)",
+		},
+		{
+			name:      "attached disks are reported",
+			err:       autorest.DetailedError{StatusCode: http.StatusConflict},
+			managedBy: testNodeID,
+			expected:  "snap-1 is attached to " + testNodeID,
+		},
+		{
+			name:     "conflicts are reported as use",
+			err:      autorest.DetailedError{StatusCode: http.StatusConflict},
+			expected: "snap-1 is in use",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := explainDeleteFailure(context.Background(), tc.lister, "sub", "rg", snapshotsResource, "snap-1", tc.managedBy, tc.err)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
+
+func TestRetryBlockedDelete(t *testing.T) {
+	var sleeps int
+	sleep := func(time.Duration) { sleeps++ }
+
+	var calls int
+	err := retryBlockedDelete(time.Minute, sleep, func() error {
+		calls++
+		if calls < 3 {
+			return scopeLockedError()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, 2, sleeps)
+
+	// without a wait, blocked deletes aren't retried
+	calls = 0
+	err = retryBlockedDelete(0, sleep, func() error {
+		calls++
+		return scopeLockedError()
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	// nor are other errors
+	calls = 0
+	err = retryBlockedDelete(time.Minute, sleep, func() error {
+		calls++
+		return errors.New("forbidden")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
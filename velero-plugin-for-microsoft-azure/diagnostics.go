@@ -0,0 +1,336 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	recordDiagnosticsConfigKey = "recordDiagnostics"
+
+	// the number of recent error responses and log entries each plugin
+	// process keeps for support bundles
+	diagnosticsErrorLimit = 100
+	diagnosticsLogLimit   = 500
+
+	diagnosticsFlushInterval = 30 * time.Second
+	diagnosticsFilePrefix    = "diagnostics-"
+
+	// each plugin process writes its own file, and Velero starts a process
+	// per operation, so the files of stopped processes are pruned once
+	// they're this old, or once there are more than this many newer ones
+	diagnosticsRetention = 7 * 24 * time.Hour
+	diagnosticsMaxFiles  = 50
+)
+
+// errorResponse is a failed storage request.
+type errorResponse struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	RequestID  string    `json:"requestID,omitempty"`
+	ErrorCode  string    `json:"errorCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// endpointLatency summarizes the latency of the requests to an endpoint.
+type endpointLatency struct {
+	Requests     int64   `json:"requests"`
+	TotalSeconds float64 `json:"totalSeconds"`
+	MaxSeconds   float64 `json:"maxSeconds"`
+}
+
+func (l *endpointLatency) add(other endpointLatency) {
+	l.Requests += other.Requests
+	l.TotalSeconds += other.TotalSeconds
+	if other.MaxSeconds > l.MaxSeconds {
+		l.MaxSeconds = other.MaxSeconds
+	}
+}
+
+// logRecord is a log entry, with its secrets redacted.
+type logRecord struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// processDiagnostics are the diagnostics of a plugin process.
+type processDiagnostics struct {
+	PID       int                         `json:"pid"`
+	UpdatedAt time.Time                   `json:"updatedAt"`
+	Errors    []errorResponse             `json:"errors"`
+	Latencies map[string]*endpointLatency `json:"latencies"`
+	Logs      []logRecord                 `json:"logs"`
+}
+
+// diagnosticsRecorder keeps the recent error responses and log entries of the
+// plugin process and the latencies of its storage endpoints, and writes them
+// to a file for the support-bundle command. Velero runs its plugins in its
+// own container, so the command, run with kubectl exec, can read them.
+type diagnosticsRecorder struct {
+	redactor *logRedactor
+
+	lock      sync.Mutex
+	errors    []errorResponse
+	latencies map[string]*endpointLatency
+	logs      []logRecord
+}
+
+// diagnostics records the diagnostics of the plugin process.
+var diagnostics = newDiagnosticsRecorder()
+
+func newDiagnosticsRecorder() *diagnosticsRecorder {
+	// the default patterns are known to compile
+	redactor, _ := newLogRedactor(nil, map[string]string{})
+
+	return &diagnosticsRecorder{
+		redactor:  redactor,
+		latencies: map[string]*endpointLatency{},
+	}
+}
+
+// diagnosticsDir returns the directory plugin processes write their
+// diagnostics to.
+func diagnosticsDir() string {
+	return filepath.Join(os.TempDir(), "velero-plugin-for-microsoft-azure")
+}
+
+// getRecordDiagnostics returns whether config.recordDiagnostics is set, which
+// it is by default.
+func getRecordDiagnostics(config map[string]string) (bool, error) {
+	val := config[recordDiagnosticsConfigKey]
+	if val == "" {
+		return true, nil
+	}
+
+	record, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, recordDiagnosticsConfigKey)
+	}
+
+	return record, nil
+}
+
+// startDiagnostics records the log entries of the given logger, and starts
+// writing the process's diagnostics periodically. It's started at most once
+// per plugin process.
+func startDiagnostics(log logrus.FieldLogger) {
+	startBackgroundTask("diagnostics", func() {
+		switch logger := log.(type) {
+		case *logrus.Logger:
+			logger.AddHook(diagnostics)
+		case *logrus.Entry:
+			logger.Logger.AddHook(diagnostics)
+		}
+
+		dir := diagnosticsDir()
+		for {
+			time.Sleep(diagnosticsFlushInterval)
+			if err := diagnostics.flush(dir, time.Now()); err != nil {
+				log.WithError(err).Debug("Unable to write plugin diagnostics")
+			}
+		}
+	})
+}
+
+// recordRequest records the latency of a storage request and, if it failed,
+// its response. Query strings are left out, since they may hold SAS tokens.
+func (d *diagnosticsRecorder) recordRequest(req *http.Request, resp *http.Response, err error, elapsed time.Duration, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	latency := d.latencies[req.URL.Host]
+	if latency == nil {
+		latency = new(endpointLatency)
+		d.latencies[req.URL.Host] = latency
+	}
+	latency.add(endpointLatency{Requests: 1, TotalSeconds: elapsed.Seconds(), MaxSeconds: elapsed.Seconds()})
+
+	if err == nil && resp != nil && resp.StatusCode < http.StatusBadRequest {
+		return
+	}
+
+	record := errorResponse{
+		Time:   now.UTC(),
+		Method: req.Method,
+		Host:   req.URL.Host,
+		Path:   req.URL.Path,
+	}
+	if err != nil {
+		record.Error, _ = d.redactor.redactLine(err.Error())
+	}
+	if resp != nil {
+		record.StatusCode = resp.StatusCode
+		record.RequestID = resp.Header.Get("x-ms-request-id")
+		record.ErrorCode = resp.Header.Get("x-ms-error-code")
+	}
+
+	d.errors = append(d.errors, record)
+	if len(d.errors) > diagnosticsErrorLimit {
+		d.errors = d.errors[len(d.errors)-diagnosticsErrorLimit:]
+	}
+}
+
+func (d *diagnosticsRecorder) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}
+}
+
+// Fire records a log entry, with its secrets redacted.
+func (d *diagnosticsRecorder) Fire(entry *logrus.Entry) error {
+	record := logRecord{
+		Time:  entry.Time.UTC(),
+		Level: entry.Level.String(),
+	}
+	record.Message, _ = d.redactor.redactLine(entry.Message)
+	if len(entry.Data) > 0 {
+		record.Fields = map[string]string{}
+		for key, val := range entry.Data {
+			record.Fields[key], _ = d.redactor.redactLine(fmt.Sprint(val))
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.logs = append(d.logs, record)
+	if len(d.logs) > diagnosticsLogLimit {
+		d.logs = d.logs[len(d.logs)-diagnosticsLogLimit:]
+	}
+	return nil
+}
+
+// snapshot returns a copy of the recorded diagnostics.
+func (d *diagnosticsRecorder) snapshot(now time.Time) processDiagnostics {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	diags := processDiagnostics{
+		PID:       os.Getpid(),
+		UpdatedAt: now.UTC(),
+		Errors:    append([]errorResponse{}, d.errors...),
+		Latencies: map[string]*endpointLatency{},
+		Logs:      append([]logRecord{}, d.logs...),
+	}
+	for host, latency := range d.latencies {
+		copied := *latency
+		diags.Latencies[host] = &copied
+	}
+	return diags
+}
+
+// flush writes the recorded diagnostics to the process's file in dir, and
+// prunes the files of other processes.
+func (d *diagnosticsRecorder) flush(dir string, now time.Time) error {
+	data, err := json.Marshal(d.snapshot(now))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// write to a temporary file first, so readers never see a partial file
+	name := filepath.Join(dir, fmt.Sprintf("%s%d.json", diagnosticsFilePrefix, os.Getpid()))
+	if err := ioutil.WriteFile(name+".tmp", data, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return pruneDiagnostics(dir, filepath.Base(name), now)
+}
+
+// pruneDiagnostics deletes the diagnostics files in dir, other than the named
+// one, that are older than diagnosticsRetention or aren't among the
+// diagnosticsMaxFiles most recently written.
+func pruneDiagnostics(dir, keep string, now time.Time) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var candidates []os.FileInfo
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), diagnosticsFilePrefix) && file.Name() != keep {
+			candidates = append(candidates, file)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ModTime().After(candidates[j].ModTime()) })
+
+	for i, file := range candidates {
+		// the kept file counts towards the limit
+		if i+1 < diagnosticsMaxFiles && now.Sub(file.ModTime()) < diagnosticsRetention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// readDiagnostics reads the diagnostics the plugin processes wrote to dir,
+// including those of processes that have since stopped.
+func readDiagnostics(dir string) ([]processDiagnostics, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var all []processDiagnostics
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), diagnosticsFilePrefix) || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var diags processDiagnostics
+		if err := json.Unmarshal(data, &diags); err != nil {
+			return nil, errors.Wrapf(err, "error parsing diagnostics file %s", file.Name())
+		}
+		all = append(all, diags)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].UpdatedAt.Before(all[j].UpdatedAt) })
+	return all, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnosticsRecordRequest(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	d := newDiagnosticsRecorder()
+
+	req, err := http.NewRequest(http.MethodPut, "https://sa.blob.core.windows.net/velero/backups/b1?comp=block&sig=c2VjcmV0", nil)
+	require.NoError(t, err)
+
+	d.recordRequest(req, &http.Response{StatusCode: http.StatusCreated, Header: http.Header{}}, nil, time.Second, now)
+	d.recordRequest(req, &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{
+		"X-Ms-Request-Id": []string{"req-1"},
+		"X-Ms-Error-Code": []string{"ServerBusy"},
+	}}, nil, 3*time.Second, now)
+	d.recordRequest(req, nil, errors.New("dial tcp: i/o timeout"), 2*time.Second, now)
+
+	diags := d.snapshot(now)
+	assert.Equal(t, &endpointLatency{Requests: 3, TotalSeconds: 6, MaxSeconds: 3}, diags.Latencies["sa.blob.core.windows.net"])
+	assert.Equal(t, []errorResponse{
+		{Time: now, Method: http.MethodPut, Host: "sa.blob.core.windows.net", Path: "/velero/backups/b1", StatusCode: http.StatusServiceUnavailable, RequestID: "req-1", ErrorCode: "ServerBusy"},
+		{Time: now, Method: http.MethodPut, Host: "sa.blob.core.windows.net", Path: "/velero/backups/b1", Error: "dial tcp: i/o timeout"},
+	}, diags.Errors)
+}
+
+func TestDiagnosticsKeepRecentErrors(t *testing.T) {
+	d := newDiagnosticsRecorder()
+	req, err := http.NewRequest(http.MethodGet, "https://sa.blob.core.windows.net/velero", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < diagnosticsErrorLimit+10; i++ {
+		d.recordRequest(req, &http.Response{StatusCode: http.StatusInternalServerError, Header: http.Header{}}, nil, time.Millisecond, start.Add(time.Duration(i)*time.Second))
+	}
+
+	diags := d.snapshot(time.Now())
+	require.Len(t, diags.Errors, diagnosticsErrorLimit)
+	assert.Equal(t, start.Add(10*time.Second).UTC(), diags.Errors[0].Time)
+}
+
+func TestDiagnosticsRecordLogs(t *testing.T) {
+	d := newDiagnosticsRecorder()
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(d)
+
+	logger.WithField("url", "https://sa.blob.core.windows.net/velero/b1?sv=2019&sig=c2VjcmV0").Warn("Error downloading object")
+	logger.Debug("Not recorded")
+
+	diags := d.snapshot(time.Now())
+	require.Len(t, diags.Logs, 1)
+	assert.Equal(t, "warning", diags.Logs[0].Level)
+	assert.Equal(t, "Error downloading object", diags.Logs[0].Message)
+	assert.Equal(t, "https://sa.blob.core.windows.net/velero/b1?sv=2019&sig=REDACTED", diags.Logs[0].Fields["url"])
+}
+
+func TestDiagnosticsFlushAndRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diagnostics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	diags, err := readDiagnostics(filepath.Join(dir, "missing"))
+	require.NoError(t, err)
+	assert.Empty(t, diags)
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	d := newDiagnosticsRecorder()
+	d.logs = []logRecord{{Time: now, Level: "info", Message: "hello"}}
+	require.NoError(t, d.flush(dir, now))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "unrelated.txt"), []byte("x"), 0600))
+
+	diags, err = readDiagnostics(dir)
+	require.NoError(t, err)
+	require.Len(t, diags, 1)
+	assert.Equal(t, os.Getpid(), diags[0].PID)
+	assert.Equal(t, now, diags[0].UpdatedAt)
+	assert.Equal(t, d.logs, diags[0].Logs)
+}
+
+func TestDiagnosticsFlushPrunesOldFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diagnostics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	write := func(name string, age time.Duration) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0600))
+		require.NoError(t, os.Chtimes(path, now.Add(-age), now.Add(-age)))
+	}
+	write("diagnostics-old.json", diagnosticsRetention+time.Hour)
+	write("diagnostics-old.json.tmp", diagnosticsRetention+time.Hour)
+	for i := 0; i < diagnosticsMaxFiles; i++ {
+		write(fmt.Sprintf("diagnostics-recent-%d.json", i), time.Duration(i)*time.Minute)
+	}
+	write("unrelated.txt", diagnosticsRetention+time.Hour)
+
+	require.NoError(t, newDiagnosticsRecorder().flush(dir, now))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	// the process's own file and the most recent others are kept, up to
+	// the limit
+	assert.Len(t, names, diagnosticsMaxFiles+1)
+	assert.Contains(t, names, fmt.Sprintf("diagnostics-%d.json", os.Getpid()))
+	assert.Contains(t, names, "diagnostics-recent-0.json")
+	assert.Contains(t, names, "unrelated.txt")
+	assert.NotContains(t, names, "diagnostics-old.json")
+	assert.NotContains(t, names, "diagnostics-old.json.tmp")
+	assert.NotContains(t, names, fmt.Sprintf("diagnostics-recent-%d.json", diagnosticsMaxFiles-1))
+}
+
+func TestGetRecordDiagnostics(t *testing.T) {
+	record, err := getRecordDiagnostics(map[string]string{})
+	require.NoError(t, err)
+	assert.True(t, record)
+
+	record, err = getRecordDiagnostics(map[string]string{recordDiagnosticsConfigKey: "false"})
+	require.NoError(t, err)
+	assert.False(t, record)
+
+	_, err = getRecordDiagnostics(map[string]string{recordDiagnosticsConfigKey: "sometimes"})
+	assert.Error(t, err)
+}
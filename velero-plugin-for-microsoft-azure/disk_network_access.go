@@ -0,0 +1,139 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/pkg/errors"
+)
+
+const (
+	restoredDiskNetworkAccessPolicyConfigKey = "restoredDiskNetworkAccessPolicy"
+	restoredDiskAccessIDConfigKey            = "restoredDiskAccessId"
+
+	// diskNetworkAccessAPIVersion is the first compute API version with
+	// disks' network access policies, which the SDK's doesn't have
+	diskNetworkAccessAPIVersion = "2020-05-01"
+
+	allowPrivateNetworkAccess = "AllowPrivate"
+)
+
+// diskNetworkAccessPolicies are the network access policies of disks, which
+// govern exporting them, e.g. with a SAS.
+var diskNetworkAccessPolicies = []string{"AllowAll", allowPrivateNetworkAccess, "DenyAll"}
+
+// diskNetworkAccess is the network access policy and, for AllowPrivate, the
+// disk access resource that restored disks are created with.
+type diskNetworkAccess struct {
+	policy       string
+	diskAccessID string
+}
+
+// parseDiskNetworkAccess parses config.restoredDiskNetworkAccessPolicy and
+// config.restoredDiskAccessId, returning nil if neither is set. A disk access
+// resource implies AllowPrivate, which requires one.
+func parseDiskNetworkAccess(config map[string]string) (*diskNetworkAccess, error) {
+	access := &diskNetworkAccess{diskAccessID: config[restoredDiskAccessIDConfigKey]}
+
+	if val := config[restoredDiskNetworkAccessPolicyConfigKey]; val != "" {
+		for _, policy := range diskNetworkAccessPolicies {
+			if strings.EqualFold(val, policy) {
+				access.policy = policy
+			}
+		}
+		if access.policy == "" {
+			return nil, errors.Errorf("invalid value %q for config key %q (expected one of %s)", val, restoredDiskNetworkAccessPolicyConfigKey, strings.Join(diskNetworkAccessPolicies, ", "))
+		}
+	} else if access.diskAccessID != "" {
+		access.policy = allowPrivateNetworkAccess
+	}
+
+	switch {
+	case access.policy == "":
+		return nil, nil
+	case access.policy == allowPrivateNetworkAccess && access.diskAccessID == "":
+		return nil, errors.Errorf("config key %q is required with network access policy %s", restoredDiskAccessIDConfigKey, allowPrivateNetworkAccess)
+	case access.policy != allowPrivateNetworkAccess && access.diskAccessID != "":
+		return nil, errors.Errorf("config key %q can only be used with network access policy %s", restoredDiskAccessIDConfigKey, allowPrivateNetworkAccess)
+	}
+
+	return access, nil
+}
+
+// createDisk creates the given disk with the network access policy, or
+// without one if access is nil. The SDK's disk model doesn't have network
+// access policies, so they're added to its request, which is made with a
+// compute API version that has them.
+func (access *diskNetworkAccess) createDisk(ctx context.Context, client *disk.DisksClient, resourceGroup, name string, d disk.Disk) (disk.DisksCreateOrUpdateFuture, error) {
+	if access == nil {
+		return client.CreateOrUpdate(ctx, resourceGroup, name, d)
+	}
+
+	req, err := client.CreateOrUpdatePreparer(ctx, resourceGroup, name, d)
+	if err != nil {
+		return disk.DisksCreateOrUpdateFuture{}, errors.WithStack(err)
+	}
+	if err := access.prepare(req); err != nil {
+		return disk.DisksCreateOrUpdateFuture{}, err
+	}
+
+	future, err := client.CreateOrUpdateSender(req)
+	return future, errors.WithStack(err)
+}
+
+// prepare adds the network access policy to the given request to create a
+// disk.
+func (access *diskNetworkAccess) prepare(req *http.Request) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Body.Close()
+
+	var d map[string]interface{}
+	if err := json.Unmarshal(body, &d); err != nil {
+		return errors.WithStack(err)
+	}
+	properties, _ := d["properties"].(map[string]interface{})
+	if properties == nil {
+		properties = map[string]interface{}{}
+		d["properties"] = properties
+	}
+	properties["networkAccessPolicy"] = access.policy
+	if access.diskAccessID != "" {
+		properties["diskAccessId"] = access.diskAccessID
+	}
+
+	if body, err = json.Marshal(d); err != nil {
+		return errors.WithStack(err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	query := req.URL.Query()
+	query.Set("api-version", diskNetworkAccessAPIVersion)
+	req.URL.RawQuery = query.Encode()
+
+	return nil
+}
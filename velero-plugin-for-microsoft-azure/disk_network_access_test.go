@@ -0,0 +1,84 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDiskNetworkAccess(t *testing.T) {
+	diskAccessID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/diskAccesses/da"
+
+	tests := []struct {
+		name    string
+		config  map[string]string
+		want    *diskNetworkAccess
+		wantErr bool
+	}{
+		{name: "unset", config: map[string]string{}},
+		{name: "deny all", config: map[string]string{restoredDiskNetworkAccessPolicyConfigKey: "denyall"}, want: &diskNetworkAccess{policy: "DenyAll"}},
+		{name: "disk access implies allow private", config: map[string]string{restoredDiskAccessIDConfigKey: diskAccessID}, want: &diskNetworkAccess{policy: "AllowPrivate", diskAccessID: diskAccessID}},
+		{name: "allow private without disk access", config: map[string]string{restoredDiskNetworkAccessPolicyConfigKey: "AllowPrivate"}, wantErr: true},
+		{name: "disk access with deny all", config: map[string]string{restoredDiskNetworkAccessPolicyConfigKey: "DenyAll", restoredDiskAccessIDConfigKey: diskAccessID}, wantErr: true},
+		{name: "invalid", config: map[string]string{restoredDiskNetworkAccessPolicyConfigKey: "Private"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			access, err := parseDiskNetworkAccess(test.config)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, access)
+		})
+	}
+}
+
+func TestDiskNetworkAccessPrepare(t *testing.T) {
+	client := disk.NewDisksClient("sub")
+	req, err := client.CreateOrUpdatePreparer(context.Background(), "rg", "restore-1", disk.Disk{
+		Location:       stringPtr("westus"),
+		DiskProperties: &disk.DiskProperties{CreationData: &disk.CreationData{CreateOption: disk.Copy}},
+	})
+	require.NoError(t, err)
+
+	access := &diskNetworkAccess{policy: "AllowPrivate", diskAccessID: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/diskAccesses/da"}
+	require.NoError(t, access.prepare(req))
+	assert.Equal(t, diskNetworkAccessAPIVersion, req.URL.Query().Get("api-version"))
+
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(body)), req.ContentLength)
+
+	var d map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &d))
+	assert.Equal(t, "westus", d["location"])
+	assert.Equal(t, map[string]interface{}{
+		"creationData":        map[string]interface{}{"createOption": "Copy"},
+		"networkAccessPolicy": "AllowPrivate",
+		"diskAccessId":        access.diskAccessID,
+	}, d["properties"])
+}
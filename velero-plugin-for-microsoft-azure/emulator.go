@@ -0,0 +1,86 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	useEmulatorConfigKey       = "useEmulator"
+	storageAccountURIConfigKey = "storageAccountURI"
+
+	// defaultEmulatorURI is Azurite's blob endpoint when it runs alongside
+	// Velero with its default settings
+	defaultEmulatorURI = "http://127.0.0.1:10000/" + storage.StorageEmulatorAccountName
+)
+
+// getStorageEmulatorURI returns the blob endpoint of the storage emulator,
+// e.g. Azurite, to use instead of a storage account: config.storageAccountURI
+// if set, or Azurite's default endpoint if config.useEmulator is set, or nil
+// if neither is. The storage client only addresses the emulator's well-known
+// account by path, so that's the only account supported.
+func getStorageEmulatorURI(config map[string]string) (*url.URL, error) {
+	uri := config[storageAccountURIConfigKey]
+	if val := config[useEmulatorConfigKey]; val != "" && uri == "" {
+		useEmulator, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, useEmulatorConfigKey)
+		}
+		if useEmulator {
+			uri = defaultEmulatorURI
+		}
+	}
+	if uri == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid value %q for config key %q (expected an http or https URI)", uri, storageAccountURIConfigKey)
+	}
+	if account := strings.Trim(u.Path, "/"); account != storage.StorageEmulatorAccountName {
+		return nil, errors.Errorf("unsupported storage account %q in config key %q: only the emulator's account, %s, is supported", account, storageAccountURIConfigKey, storage.StorageEmulatorAccountName)
+	}
+	if name := config[storageAccountConfigKey]; name != "" && name != storage.StorageEmulatorAccountName {
+		return nil, errors.Errorf("storage account %s can't be used with a storage emulator, only %s", name, storage.StorageEmulatorAccountName)
+	}
+
+	return u, nil
+}
+
+// emulatorSender sends the requests of a storage client for the emulator's
+// account, which are addressed to Azurite's default endpoint, to the
+// emulator's actual endpoint. Requests are signed without their host, so
+// their signatures remain valid.
+type emulatorSender struct {
+	uri  *url.URL
+	next storage.Sender
+}
+
+func (s *emulatorSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = s.uri.Scheme
+	req.URL.Host = s.uri.Host
+	req.Host = s.uri.Host
+	return s.next.Send(c, req)
+}
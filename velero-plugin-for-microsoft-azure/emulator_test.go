@@ -0,0 +1,71 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStorageEmulatorURI(t *testing.T) {
+	uri, err := getStorageEmulatorURI(map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, uri)
+
+	uri, err = getStorageEmulatorURI(map[string]string{useEmulatorConfigKey: "true"})
+	require.NoError(t, err)
+	assert.Equal(t, defaultEmulatorURI, uri.String())
+
+	uri, err = getStorageEmulatorURI(map[string]string{storageAccountURIConfigKey: "http://azurite.velero.svc:10000/devstoreaccount1/"})
+	require.NoError(t, err)
+	assert.Equal(t, "azurite.velero.svc:10000", uri.Host)
+
+	_, err = getStorageEmulatorURI(map[string]string{storageAccountURIConfigKey: "http://azurite:10000/myaccount"})
+	assert.EqualError(t, err, `unsupported storage account "myaccount" in config key "storageAccountURI": only the emulator's account, devstoreaccount1, is supported`)
+	_, err = getStorageEmulatorURI(map[string]string{storageAccountURIConfigKey: "azurite:10000"})
+	assert.Error(t, err)
+	_, err = getStorageEmulatorURI(map[string]string{useEmulatorConfigKey: "true", storageAccountConfigKey: "myaccount"})
+	assert.EqualError(t, err, "storage account myaccount can't be used with a storage emulator, only devstoreaccount1")
+	_, err = getStorageEmulatorURI(map[string]string{useEmulatorConfigKey: "maybe"})
+	assert.Error(t, err)
+}
+
+func TestObjectStoreWithEmulator(t *testing.T) {
+	defer setEnv(t, nil)()
+
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey devstoreaccount1:"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	o := newObjectStore(logrus.New())
+	require.NoError(t, o.Init(map[string]string{storageAccountURIConfigKey: server.URL + "/devstoreaccount1"}))
+
+	exists, err := o.ObjectExists("bucket", "backups/b1/velero-backup.json")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Contains(t, paths, "/devstoreaccount1/bucket/backups/b1/velero-backup.json")
+}
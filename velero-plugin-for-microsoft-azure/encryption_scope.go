@@ -0,0 +1,92 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	storageEncryptionScopeConfigKey = "storageEncryptionScope"
+
+	// encryptionScopeAPIVersion is the first storage API version that
+	// supports encryption scopes
+	encryptionScopeAPIVersion = "2019-07-07"
+)
+
+// ref. https://docs.microsoft.com/en-us/azure/storage/blobs/encryption-scope-overview
+var encryptionScopeName = regexp.MustCompile(`^[a-zA-Z0-9-]{3,63}$`)
+
+// getStorageEncryptionScope returns the encryption scope objects are written
+// with, or "" if they're encrypted with the container's default scope.
+func getStorageEncryptionScope(config map[string]string) (string, error) {
+	scope := config[storageEncryptionScopeConfigKey]
+	if scope == "" {
+		return "", nil
+	}
+	if !encryptionScopeName.MatchString(scope) {
+		return "", errors.Errorf("invalid value %q for config key %q (expected the name of an encryption scope, 3 to 63 letters, digits and hyphens)", scope, storageEncryptionScopeConfigKey)
+	}
+	if config[customerProvidedKeyEnvVarConfigKey] != "" {
+		return "", errors.Errorf("config keys %q and %q can't both be set, objects are encrypted either with a customer-provided key or with an encryption scope", storageEncryptionScopeConfigKey, customerProvidedKeyEnvVarConfigKey)
+	}
+	return scope, nil
+}
+
+// writesBlobContent returns whether req is for an operation that writes a
+// blob's content, which is encrypted with the request's encryption scope.
+// Copies aren't, since the scope belongs to the destination's account.
+func writesBlobContent(req *http.Request) bool {
+	query := req.URL.Query()
+	if req.Method != http.MethodPut || query.Get("restype") != "" || getHeader(req.Header, "x-ms-copy-source") != "" {
+		return false
+	}
+
+	switch query.Get("comp") {
+	case "", "block", "blocklist", "appendblock":
+		return true
+	}
+	return false
+}
+
+// encryptionScopeSender adds an encryption scope to the requests of a
+// storage client that write blob content, since the client can't set their
+// header.
+type encryptionScopeSender struct {
+	scope      string
+	account    string
+	accountKey string
+	next       storage.Sender
+}
+
+func (s *encryptionScopeSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	if !writesBlobContent(req) {
+		return s.next.Send(c, req)
+	}
+
+	err := setClientRequestHeaders(req, s.account, s.accountKey, encryptionScopeAPIVersion, map[string]string{
+		"x-ms-encryption-scope": s.scope,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.next.Send(c, req)
+}
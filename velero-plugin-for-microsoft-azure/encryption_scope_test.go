@@ -0,0 +1,79 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStorageEncryptionScope(t *testing.T) {
+	scope, err := getStorageEncryptionScope(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, "", scope)
+
+	scope, err = getStorageEncryptionScope(map[string]string{storageEncryptionScopeConfigKey: "workload-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "workload-1", scope)
+
+	_, err = getStorageEncryptionScope(map[string]string{storageEncryptionScopeConfigKey: "a"})
+	assert.Error(t, err)
+	_, err = getStorageEncryptionScope(map[string]string{storageEncryptionScopeConfigKey: "workload/1"})
+	assert.Error(t, err)
+
+	// scopes and customer-provided keys are exclusive
+	_, err = getStorageEncryptionScope(map[string]string{storageEncryptionScopeConfigKey: "workload-1", customerProvidedKeyEnvVarConfigKey: "CPK"})
+	assert.Error(t, err)
+}
+
+func TestEncryptionScopeSender(t *testing.T) {
+	client, err := storage.NewBasicClient("account", "a2V5")
+	require.NoError(t, err)
+	next := new(methodStatusSender)
+	client.Sender = &encryptionScopeSender{scope: "workload-1", account: "account", accountKey: "a2V5", next: next}
+
+	blobService := client.GetBlobService()
+	blob := blobService.GetContainerReference("b").GetBlobReference("backups/b1/b1.tar.gz")
+	require.NoError(t, blob.PutBlock("00000000", []byte("data"), nil))
+	require.NoError(t, blob.PutBlockList([]storage.Block{{ID: "00000000", Status: storage.BlockStatusLatest}}, nil))
+	_, err = blob.Get(nil)
+	require.NoError(t, err)
+	require.NoError(t, blob.Delete(nil))
+	require.Len(t, next.requests, 4)
+
+	// writes are encrypted with the scope, at an API version that supports it
+	for _, req := range next.requests[:2] {
+		assert.Equal(t, http.MethodPut, req.Method)
+		assert.Equal(t, []string{"workload-1"}, req.Header["X-Ms-Encryption-Scope"])
+		assert.Equal(t, encryptionScopeAPIVersion, getHeader(req.Header, "x-ms-version"))
+
+		signed := req.Header.Get("Authorization")
+		expected := req.Clone(req.Context())
+		require.NoError(t, signSharedKey(expected, "account", "a2V5"))
+		assert.Equal(t, expected.Header.Get("Authorization"), signed)
+	}
+
+	// reads and deletes are left as they are
+	for _, req := range next.requests[2:] {
+		assert.Equal(t, "", getHeader(req.Header, "x-ms-encryption-scope"))
+		assert.Equal(t, storage.DefaultAPIVersion, getHeader(req.Header, "x-ms-version"))
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+const (
+	storageEndpointIPsConfigKey = "storageEndpointIPs"
+	dnsServerConfigKey          = "dnsServer"
+
+	insecureSkipTLSVerifyConfigKey = "insecureSkipTLSVerify"
+
+	blobDomainConfigKey = "blobDomain"
+
+	proxyURLConfigKey = "proxyURL"
+
+	endpointDialTimeout = 30 * time.Second
+)
+
+// azureStorageEndpointSuffixes are the storage endpoint suffixes of the
+// Azure clouds, whose certificates are always verified.
+var azureStorageEndpointSuffixes = []string{
+	azure.PublicCloud.StorageEndpointSuffix,
+	azure.USGovernmentCloud.StorageEndpointSuffix,
+	azure.ChinaCloud.StorageEndpointSuffix,
+	azure.GermanCloud.StorageEndpointSuffix,
+}
+
+// getInsecureSkipTLSVerify returns whether config.insecureSkipTLSVerify is
+// set. It's only meant for emulators with self-signed certificates, such as
+// Azurite, so it's refused for the storage endpoints of the Azure clouds.
+func getInsecureSkipTLSVerify(config map[string]string, host string) (bool, error) {
+	val := config[insecureSkipTLSVerifyConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	insecure, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, insecureSkipTLSVerifyConfigKey)
+	}
+	if !insecure {
+		return false, nil
+	}
+
+	host = strings.ToLower(host)
+	for _, suffix := range azureStorageEndpointSuffixes {
+		if strings.HasSuffix(host, "."+strings.ToLower(suffix)) {
+			return false, errors.Errorf("config key %q is not allowed for Azure storage endpoint %s, only for emulators", insecureSkipTLSVerifyConfigKey, host)
+		}
+	}
+
+	return true, nil
+}
+
+// getBlobDomain returns config.blobDomain, the domain of the storage
+// account's blob endpoint in place of "blob.<endpoint suffix>", e.g.
+// "privatelink.blob.core.windows.net" or a custom DNS zone, or "" if unset.
+func getBlobDomain(config map[string]string) (string, error) {
+	domain := strings.ToLower(strings.Trim(strings.TrimSpace(config[blobDomainConfigKey]), "."))
+	if domain == "" {
+		return "", nil
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || strings.ContainsAny(label, "/:@?#") {
+			return "", errors.Errorf("invalid value %q for config key %q (expected a domain name, e.g. privatelink.blob.core.windows.net)", config[blobDomainConfigKey], blobDomainConfigKey)
+		}
+	}
+
+	return domain, nil
+}
+
+// getProxyURL returns config.proxyURL, the HTTP proxy to send requests to the
+// storage account through, e.g. "http://proxy.corp:3128", or nil if unset.
+// Its value isn't included in errors since it may have credentials.
+func getProxyURL(config map[string]string) (*url.URL, error) {
+	val := config[proxyURLConfigKey]
+	if val == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(val)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid value for config key %q (expected an http or https URL, e.g. http://proxy.corp:3128)", proxyURLConfigKey)
+	}
+	return u, nil
+}
+
+// blobDomainSender sends the requests of a storage client, which are
+// addressed to "<account>.blob.<endpoint suffix>", to the account's host in
+// config.blobDomain instead. Requests are signed without their host, so
+// their signatures remain valid.
+type blobDomainSender struct {
+	host string
+	next storage.Sender
+}
+
+func (s *blobDomainSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	req.URL.Host = s.host
+	req.Host = s.host
+	return s.next.Send(c, req)
+}
+
+// endpointDialer dials connections to the storage account, optionally
+// connecting to a fixed set of IPs for its host or resolving names with a
+// specific DNS server. This is useful with private endpoints when the
+// cluster's DNS resolves the storage account to public IPs that are
+// blocked by the firewall.
+type endpointDialer struct {
+	dialer *net.Dialer
+	host   string
+	ips    []string
+}
+
+func (d *endpointDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || len(d.ips) == 0 || !strings.EqualFold(host, d.host) {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+
+	// try each pinned IP in turn, returning the last error if none work
+	for _, ip := range d.ips {
+		var conn net.Conn
+		if conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// newEndpointHTTPClient returns an HTTP client that pins the given storage
+// host according to config.storageEndpointIPs and config.dnsServer, sends
+// requests through config.proxyURL, and skips certificate verification
+// according to config.insecureSkipTLSVerify, or nil if none is set, in which
+// case requests go through the proxy in the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY env vars, if any.
+func newEndpointHTTPClient(config map[string]string, host string) (*http.Client, error) {
+	var ips []string
+	for _, val := range strings.Split(config[storageEndpointIPsConfigKey], ",") {
+		if val = strings.TrimSpace(val); val == "" {
+			continue
+		}
+		if net.ParseIP(val) == nil {
+			return nil, errors.Errorf("invalid IP address %q in config key %q", val, storageEndpointIPsConfigKey)
+		}
+		ips = append(ips, val)
+	}
+
+	insecure, err := getInsecureSkipTLSVerify(config, host)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := getProxyURL(config)
+	if err != nil {
+		return nil, err
+	}
+	// the proxy connects to the storage account, so its IPs can't be pinned
+	if proxy != nil && len(ips) > 0 {
+		return nil, errors.Errorf("config keys %q and %q can't be used together", proxyURLConfigKey, storageEndpointIPsConfigKey)
+	}
+
+	dnsServer := config[dnsServerConfigKey]
+	if len(ips) == 0 && dnsServer == "" && !insecure && proxy == nil {
+		return nil, nil
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   endpointDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if dnsServer != "" {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: endpointDialTimeout}).DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&endpointDialer{dialer: dialer, host: host, ips: ips}).DialContext
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
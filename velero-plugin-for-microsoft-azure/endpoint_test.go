@@ -0,0 +1,182 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEndpointHTTPClient(t *testing.T) {
+	client, err := newEndpointHTTPClient(map[string]string{}, "sa.blob.core.windows.net")
+	require.NoError(t, err)
+	assert.Nil(t, client)
+
+	_, err = newEndpointHTTPClient(map[string]string{storageEndpointIPsConfigKey: "10.0.0.1,foo"}, "sa.blob.core.windows.net")
+	assert.EqualError(t, err, `invalid IP address "foo" in config key "storageEndpointIPs"`)
+}
+
+func TestEndpointIPPinning(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+
+	// nothing listens on the first IP, so the second one is used
+	client, err := newEndpointHTTPClient(map[string]string{storageEndpointIPsConfigKey: "127.0.0.2, 127.0.0.1"}, "sa.blob.core.windows.net")
+	require.NoError(t, err)
+	require.NotNil(t, client)
+
+	res, err := client.Get("http://sa.blob.core.windows.net:" + port + "/")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	// the request still addresses the storage account by name
+	assert.Equal(t, "sa.blob.core.windows.net:"+port, string(body))
+}
+
+func TestEndpointProxy(t *testing.T) {
+	// a proxy receives requests with absolute URIs
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied " + r.URL.String() + " " + r.Header.Get("Proxy-Authorization")))
+	}))
+	defer proxy.Close()
+
+	client, err := newEndpointHTTPClient(map[string]string{proxyURLConfigKey: "http://user:pass@" + proxy.Listener.Addr().String()}, "sa.blob.core.windows.net")
+	require.NoError(t, err)
+	require.NotNil(t, client)
+
+	res, err := client.Get("http://sa.blob.core.windows.net/b/key")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "proxied http://sa.blob.core.windows.net/b/key Basic dXNlcjpwYXNz", string(body))
+
+	// the value isn't in errors, it may have credentials
+	_, err = newEndpointHTTPClient(map[string]string{proxyURLConfigKey: "user:secret@proxy"}, "sa.blob.core.windows.net")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+
+	_, err = newEndpointHTTPClient(map[string]string{proxyURLConfigKey: "http://proxy:3128", storageEndpointIPsConfigKey: "10.0.0.1"}, "sa.blob.core.windows.net")
+	assert.Error(t, err)
+}
+
+func TestGetInsecureSkipTLSVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		val     string
+		host    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "unset", host: "sa.blob.core.windows.net"},
+		{name: "false", val: "false", host: "sa.blob.core.windows.net"},
+		{name: "emulator", val: "true", host: "sa.blob.azurite.lab", want: true},
+		{name: "public cloud", val: "true", host: "sa.blob.core.windows.net", wantErr: true},
+		{name: "public cloud mixed case", val: "true", host: "SA.Blob.Core.Windows.Net", wantErr: true},
+		{name: "china cloud", val: "true", host: "sa.blob.core.chinacloudapi.cn", wantErr: true},
+		{name: "invalid", val: "maybe", host: "sa.blob.azurite.lab", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			insecure, err := getInsecureSkipTLSVerify(map[string]string{insecureSkipTLSVerifyConfigKey: test.val}, test.host)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, insecure)
+		})
+	}
+}
+
+func TestInsecureSkipTLSVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	url := "https://sa.blob.azurite.lab:" + port + "/"
+
+	// the server's certificate is self-signed, so it's rejected by default
+	client, err := newEndpointHTTPClient(map[string]string{storageEndpointIPsConfigKey: "127.0.0.1"}, "sa.blob.azurite.lab")
+	require.NoError(t, err)
+	_, err = client.Get(url)
+	require.Error(t, err)
+
+	client, err = newEndpointHTTPClient(map[string]string{storageEndpointIPsConfigKey: "127.0.0.1", insecureSkipTLSVerifyConfigKey: "true"}, "sa.blob.azurite.lab")
+	require.NoError(t, err)
+	res, err := client.Get(url)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	_, err = newEndpointHTTPClient(map[string]string{insecureSkipTLSVerifyConfigKey: "true"}, "sa.blob.core.windows.net")
+	assert.Error(t, err)
+}
+
+func TestGetBlobDomain(t *testing.T) {
+	domain, err := getBlobDomain(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, "", domain)
+
+	domain, err = getBlobDomain(map[string]string{blobDomainConfigKey: " PrivateLink.Blob.Core.Windows.Net. "})
+	require.NoError(t, err)
+	assert.Equal(t, "privatelink.blob.core.windows.net", domain)
+
+	for _, val := range []string{"https://blob.contoso.com", "blob..contoso.com", "blob.contoso.com:443"} {
+		_, err = getBlobDomain(map[string]string{blobDomainConfigKey: val})
+		assert.Error(t, err, val)
+	}
+}
+
+func TestBlobDomainSender(t *testing.T) {
+	client, err := storage.NewBasicClient("account", "a2V5")
+	require.NoError(t, err)
+	next := new(recordingSender)
+	client.Sender = &blobDomainSender{host: "account.privatelink.blob.core.windows.net", next: next}
+
+	blobClient := client.GetBlobService()
+	_, err = blobClient.GetContainerReference("bucket").GetBlobReference("key").Exists()
+	require.NoError(t, err)
+	require.Len(t, next.requests, 1)
+	assert.Equal(t, "https://account.privatelink.blob.core.windows.net/bucket/key", next.requests[0].URL.String())
+	assert.Equal(t, "account.privatelink.blob.core.windows.net", next.requests[0].Host)
+
+	// signed URLs are issued for the same host
+	o := &ObjectStore{blobDomain: "privatelink.blob.core.windows.net"}
+	uri, err := o.withBlobDomain("https://account.blob.core.windows.net/bucket/key?sig=x")
+	require.NoError(t, err)
+	assert.Equal(t, "https://account.privatelink.blob.core.windows.net/bucket/key?sig=x", uri)
+}
@@ -0,0 +1,430 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	failureSummariesConfigKey = "failureSummaries"
+
+	failureSummarySuffix = "-failure-summary.json"
+
+	// maxBackupMetadataSize bounds how much of a backup's metadata file is
+	// kept while it's uploaded, to read its status
+	maxBackupMetadataSize = 1 << 20
+
+	// the number of examples kept for each category of error, and the number
+	// of affected keys and volumes listed
+	failureSummaryExamples = 5
+	failureSummaryAffected = 50
+)
+
+// failureCategories are the categories of errors in failure summaries, in
+// the order they're matched, with the substrings of error messages that
+// match them and what to do about them.
+var failureCategories = []struct {
+	name        string
+	patterns    []string
+	remediation string
+}{
+	{
+		name:        "permissions",
+		patterns:    []string{"authorizationfailed", "authenticationfailed", "authorizationpermissionmismatch", "linkedauthorizationfailed", "statuscode=401", "statuscode=403", "status code 401", "status code 403"},
+		remediation: "Check the storage account's key or SAS, that the SAS hasn't expired, and the role assignments of Velero's identity on the storage account and the disks' and snapshots' resource groups.",
+	},
+	{
+		name:        "throttling",
+		patterns:    []string{"toomanyrequests", "serverbusy", "throttl", "statuscode=429", "status code 429"},
+		remediation: "Requests were throttled. Spread backups out, lower their concurrency, or allow more retries with storageMaxTries and storageRetryDelay.",
+	},
+	{
+		name:        "quota",
+		patterns:    []string{"quotaexceeded", "quota", "limitexceeded"},
+		remediation: "A subscription or storage account limit was reached. Delete expired snapshots or request a quota increase.",
+	},
+	{
+		name:        "notFound",
+		patterns:    []string{"notfound", "containernotfound", "blobnotfound", "statuscode=404", "status code 404"},
+		remediation: "A container, disk or snapshot doesn't exist. Check the location's bucket, resourceGroup and subscriptionId, and that the volume's disk wasn't deleted during the backup.",
+	},
+	{
+		name:        "network",
+		patterns:    []string{"no such host", "connection refused", "connection reset", "i/o timeout", "context deadline exceeded", "tls handshake", "eof"},
+		remediation: "Requests didn't complete. Check DNS, firewall rules and private endpoints (see storageEndpointIPs, dnsServer and blobDomain), or allow longer tries with storageTryTimeout.",
+	},
+	{
+		name:        "server",
+		patterns:    []string{"internalservererror", "internalerror", "statuscode=500", "statuscode=502", "statuscode=503", "statuscode=504", "status code 5"},
+		remediation: "Azure failed to complete requests. Retry the backup, and check Azure status for the region.",
+	},
+}
+
+const otherFailureRemediation = "See the examples, and the backup's log for context."
+
+// failureCategory counts the errors of a category.
+type failureCategory struct {
+	Category    string   `json:"category"`
+	Count       int      `json:"count"`
+	Remediation string   `json:"remediation"`
+	Examples    []string `json:"examples"`
+}
+
+// failureSummary is a concise summary of why a backup failed, written next to
+// it so that it can be investigated after the Velero pod's logs are gone.
+type failureSummary struct {
+	Backup          string             `json:"backup"`
+	Phase           string             `json:"phase"`
+	FailureReason   string             `json:"failureReason,omitempty"`
+	Errors          int                `json:"errors"`
+	Warnings        int                `json:"warnings"`
+	StartedAt       *time.Time         `json:"startedAt,omitempty"`
+	GeneratedAt     time.Time          `json:"generatedAt"`
+	Categories      []*failureCategory `json:"categories"`
+	AffectedVolumes []string           `json:"affectedVolumes,omitempty"`
+	AffectedKeys    []string           `json:"affectedKeys,omitempty"`
+}
+
+// add categorizes an error message, recording the volume and key it
+// affected, if any.
+func (s *failureSummary) add(message, volume, key string) {
+	message, _ = diagnostics.redactor.redactLine(message)
+	lower := strings.ToLower(message)
+
+	name, remediation := "other", otherFailureRemediation
+	for _, category := range failureCategories {
+		for _, pattern := range category.patterns {
+			if strings.Contains(lower, pattern) {
+				name, remediation = category.name, category.remediation
+				break
+			}
+		}
+		if name != "other" {
+			break
+		}
+	}
+
+	var category *failureCategory
+	for _, c := range s.Categories {
+		if c.Category == name {
+			category = c
+		}
+	}
+	if category == nil {
+		category = &failureCategory{Category: name, Remediation: remediation, Examples: []string{}}
+		s.Categories = append(s.Categories, category)
+	}
+	category.Count++
+	if len(category.Examples) < failureSummaryExamples && !containsString(category.Examples, message) {
+		category.Examples = append(category.Examples, message)
+	}
+
+	if volume != "" && len(s.AffectedVolumes) < failureSummaryAffected && !containsString(s.AffectedVolumes, volume) {
+		s.AffectedVolumes = append(s.AffectedVolumes, volume)
+	}
+	if key != "" && len(s.AffectedKeys) < failureSummaryAffected && !containsString(s.AffectedKeys, key) {
+		s.AffectedKeys = append(s.AffectedKeys, key)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// backupStatus is the part of a backup's metadata file that failure
+// summaries need.
+type backupStatus struct {
+	Status struct {
+		Phase          string     `json:"phase"`
+		FailureReason  string     `json:"failureReason"`
+		StartTimestamp *time.Time `json:"startTimestamp"`
+		Errors         int        `json:"errors"`
+		Warnings       int        `json:"warnings"`
+	} `json:"status"`
+}
+
+// failureSummarizer writes a failure summary next to each backup whose
+// metadata file is uploaded with a Failed or PartiallyFailed phase, from the
+// errors in the backup's log, which Velero uploads first, and the storage
+// requests of the plugin processes that failed while it ran.
+type failureSummarizer struct {
+	log        logrus.FieldLogger
+	blobGetter blobGetter
+	prefix     string
+	// readDiagnostics returns the diagnostics of the plugin processes
+	readDiagnostics func() ([]processDiagnostics, error)
+	now             func() time.Time
+}
+
+func getFailureSummaries(config map[string]string) (bool, error) {
+	val := config[failureSummariesConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, failureSummariesConfigKey)
+	}
+	return enabled, nil
+}
+
+// readPluginDiagnostics returns the diagnostics of this plugin process and
+// of the others that wrote theirs to the diagnostics directory.
+func readPluginDiagnostics() ([]processDiagnostics, error) {
+	others, err := readDiagnostics(diagnosticsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	all := []processDiagnostics{diagnostics.snapshot(time.Now())}
+	for _, diags := range others {
+		if diags.PID != os.Getpid() {
+			all = append(all, diags)
+		}
+	}
+	return all, nil
+}
+
+// metadataBuffer returns a buffer to keep a copy of the body of the upload
+// to key in, if key is a backup metadata file, or nil.
+func (f *failureSummarizer) metadataBuffer(key string) *limitedBuffer {
+	if _, ok := backupNameFromMetadataKey(f.prefix, key); !ok {
+		return nil
+	}
+	return &limitedBuffer{limit: maxBackupMetadataSize}
+}
+
+// recordPut writes a failure summary for the backup whose metadata file was
+// uploaded to key, with the given content, if the backup failed.
+func (f *failureSummarizer) recordPut(bucket, key string, metadata *limitedBuffer) {
+	backup, ok := backupNameFromMetadataKey(f.prefix, key)
+	if !ok || metadata == nil || metadata.truncated {
+		return
+	}
+
+	var status backupStatus
+	if err := json.Unmarshal(metadata.Bytes(), &status); err != nil {
+		f.log.WithError(err).WithField("backup", backup).Warn("Unable to read the status of the backup for its failure summary")
+		return
+	}
+	if status.Status.Phase != "Failed" && status.Status.Phase != "PartiallyFailed" {
+		return
+	}
+
+	summary := &failureSummary{
+		Backup:        backup,
+		Phase:         status.Status.Phase,
+		FailureReason: status.Status.FailureReason,
+		Errors:        status.Status.Errors,
+		Warnings:      status.Status.Warnings,
+		StartedAt:     status.Status.StartTimestamp,
+		GeneratedAt:   f.now().UTC(),
+		Categories:    []*failureCategory{},
+	}
+
+	dir := strings.TrimSuffix(key, backupMetadataFile)
+	log := f.log.WithField("backup", backup)
+	if err := f.addBackupLogErrors(summary, bucket, dir+backup+logsObjectSuffix); err != nil {
+		log.WithError(err).Warn("Unable to read the backup's log for its failure summary")
+	}
+	if err := f.addFailedRequests(summary); err != nil {
+		log.WithError(err).Warn("Unable to read the plugin's failed requests for the backup's failure summary")
+	}
+	sort.SliceStable(summary.Categories, func(i, j int) bool { return summary.Categories[i].Count > summary.Categories[j].Count })
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		log.WithError(err).Warn("Unable to write the backup's failure summary")
+		return
+	}
+	blob, err := f.blobGetter.getBlob(bucket, dir+backup+failureSummarySuffix)
+	if err == nil {
+		err = blob.CreateBlockBlobFromReader(bytes.NewReader(data), nil)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Unable to write the backup's failure summary")
+		return
+	}
+	log.Info("Wrote the backup's failure summary")
+}
+
+// addBackupLogErrors adds the errors in the backup's gzipped log, stored at
+// key, to the summary.
+func (f *failureSummarizer) addBackupLogErrors(summary *failureSummary, bucket, key string) error {
+	blob, err := f.blobGetter.getBlob(bucket, key)
+	if err != nil {
+		return err
+	}
+	body, err := blob.Get(nil)
+	if err != nil {
+		if storageErrorStatusCode(err) == http.StatusNotFound {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	defer body.Close()
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := parseLogLine(scanner.Text())
+		if fields["level"] != "error" && fields["level"] != "fatal" {
+			continue
+		}
+
+		message := fields["msg"]
+		if fields["error"] != "" {
+			message += ": " + fields["error"]
+		}
+		volume := fields["persistentVolume"]
+		if volume == "" {
+			volume = fields["volumeID"]
+		}
+		summary.add(message, volume, fields["key"])
+	}
+	return errors.WithStack(scanner.Err())
+}
+
+// addFailedRequests adds the storage requests that failed since the backup
+// started to the summary. Requests for objects that don't exist are left
+// out, since Velero checks for objects that don't exist yet.
+func (f *failureSummarizer) addFailedRequests(summary *failureSummary) error {
+	all, err := f.readDiagnostics()
+	if err != nil {
+		return err
+	}
+
+	for _, diags := range all {
+		for _, failed := range diags.Errors {
+			if failed.StatusCode == http.StatusNotFound || (summary.StartedAt != nil && failed.Time.Before(*summary.StartedAt)) {
+				continue
+			}
+
+			message := failed.Method + " " + failed.Host + failed.Path
+			switch {
+			case failed.Error != "":
+				message += ": " + failed.Error
+			case failed.ErrorCode != "":
+				message += ": " + failed.ErrorCode + " (StatusCode=" + strconv.Itoa(failed.StatusCode) + ")"
+			default:
+				message += ": StatusCode=" + strconv.Itoa(failed.StatusCode)
+			}
+			summary.add(message, "", strings.TrimPrefix(failed.Path, "/"))
+		}
+	}
+	return nil
+}
+
+// parseLogLine returns the fields of a log line in logrus's text format, e.g.
+// `time="..." level=error msg="..." error="..."`, or in its JSON format.
+func parseLogLine(line string) map[string]string {
+	fields := map[string]string{}
+
+	if strings.HasPrefix(line, "{") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err == nil {
+			for k, v := range entry {
+				if s, ok := v.(string); ok {
+					fields[k] = s
+				}
+			}
+		}
+		return fields
+	}
+
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			break
+		}
+		key, rest := line[:eq], line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				end = len(rest) - 1
+			}
+			quoted := rest[:end+1]
+			if unquoted, err := strconv.Unquote(quoted); err == nil {
+				value = unquoted
+			} else {
+				value = strings.Trim(quoted, `"`)
+			}
+			rest = rest[end+1:]
+		} else if sp := strings.IndexByte(rest, ' '); sp >= 0 {
+			value, rest = rest[:sp], rest[sp:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		fields[key] = value
+		line = rest
+	}
+	return fields
+}
+
+// limitedBuffer keeps up to limit bytes written to it, noting whether more
+// were written.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
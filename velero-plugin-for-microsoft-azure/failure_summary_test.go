@@ -0,0 +1,129 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogLine(t *testing.T) {
+	fields := parseLogLine(`time="2020-10-15T00:00:00Z" level=error msg="Error backing up item" backup=velero/b1 error="rpc error: code = Unknown desc = \"quoted\"" persistentVolume=pvc-1`)
+	assert.Equal(t, "error", fields["level"])
+	assert.Equal(t, "Error backing up item", fields["msg"])
+	assert.Equal(t, `rpc error: code = Unknown desc = "quoted"`, fields["error"])
+	assert.Equal(t, "pvc-1", fields["persistentVolume"])
+
+	fields = parseLogLine(`{"level":"error","msg":"Error backing up item","error":"boom"}`)
+	assert.Equal(t, "error", fields["level"])
+	assert.Equal(t, "boom", fields["error"])
+}
+
+func TestFailureSummarizer(t *testing.T) {
+	started := time.Date(2020, 10, 15, 0, 0, 0, 0, time.UTC)
+
+	var log bytes.Buffer
+	gz := gzip.NewWriter(&log)
+	gz.Write([]byte(`time="2020-10-15T00:01:00Z" level=info msg="Backing up item" backup=velero/b1
+time="2020-10-15T00:02:00Z" level=error msg="Error taking snapshot of volume" backup=velero/b1 error="compute.SnapshotsClient#CreateOrUpdate: StatusCode=403 -- Original Error: Code=\"AuthorizationFailed\"" persistentVolume=pvc-1
+time="2020-10-15T00:03:00Z" level=error msg="Error taking snapshot of volume" backup=velero/b1 error="Code=\"OperationNotAllowed\" Message=\"quota exceeded\"" persistentVolume=pvc-2
+`))
+	require.NoError(t, gz.Close())
+
+	blobGetter := new(mockBlobGetter)
+	defer blobGetter.AssertExpectations(t)
+	logBlob, summaryBlob := new(mockBlob), new(mockBlob)
+	blobGetter.On("getBlob", "bucket", "cluster-a/backups/b1/b1-logs.gz").Return(logBlob, nil)
+	blobGetter.On("getBlob", "bucket", "cluster-a/backups/b1/b1-failure-summary.json").Return(summaryBlob, nil)
+	logBlob.On("Get", mock.Anything).Return(ioutil.NopCloser(&log), nil)
+
+	var summary failureSummary
+	summaryBlob.On("CreateBlockBlobFromReader", mock.Anything, (*storage.PutBlobOptions)(nil)).
+		Run(func(args mock.Arguments) {
+			require.NoError(t, json.NewDecoder(args.Get(0).(io.Reader)).Decode(&summary))
+		}).
+		Return(nil).Once()
+
+	f := &failureSummarizer{
+		log:        logrus.New(),
+		blobGetter: blobGetter,
+		prefix:     "cluster-a",
+		readDiagnostics: func() ([]processDiagnostics, error) {
+			return []processDiagnostics{{Errors: []errorResponse{
+				// before the backup started
+				{Time: started.Add(-time.Hour), Method: "PUT", Host: "sa.blob.core.windows.net", Path: "/bucket/old", StatusCode: http.StatusServiceUnavailable},
+				// existence checks
+				{Time: started.Add(time.Minute), Method: "HEAD", Host: "sa.blob.core.windows.net", Path: "/bucket/cluster-a/backups/b1/velero-backup.json", StatusCode: http.StatusNotFound},
+				{Time: started.Add(time.Minute), Method: "PUT", Host: "sa.blob.core.windows.net", Path: "/bucket/cluster-a/backups/b1/b1.tar.gz", StatusCode: http.StatusServiceUnavailable, ErrorCode: "ServerBusy"},
+			}}}, nil
+		},
+		now: func() time.Time { return started.Add(time.Hour) },
+	}
+
+	key := "cluster-a/backups/b1/velero-backup.json"
+	metadata := f.metadataBuffer(key)
+	require.NotNil(t, metadata)
+	metadata.Write([]byte(`{"status":{"phase":"PartiallyFailed","startTimestamp":"2020-10-15T00:00:00Z","errors":2}}`))
+	f.recordPut("bucket", key, metadata)
+	summaryBlob.AssertExpectations(t)
+
+	assert.Equal(t, "b1", summary.Backup)
+	assert.Equal(t, "PartiallyFailed", summary.Phase)
+	assert.Equal(t, 2, summary.Errors)
+	assert.Equal(t, []string{"pvc-1", "pvc-2"}, summary.AffectedVolumes)
+	assert.Equal(t, []string{"bucket/cluster-a/backups/b1/b1.tar.gz"}, summary.AffectedKeys)
+
+	categories := map[string]int{}
+	for _, category := range summary.Categories {
+		categories[category.Category] = category.Count
+		assert.NotEmpty(t, category.Remediation)
+		assert.NotEmpty(t, category.Examples)
+	}
+	assert.Equal(t, map[string]int{"permissions": 1, "quota": 1, "throttling": 1}, categories)
+
+	// completed backups and other objects get no summary
+	metadata = f.metadataBuffer(key)
+	metadata.Write([]byte(`{"status":{"phase":"Completed"}}`))
+	f.recordPut("bucket", key, metadata)
+	assert.Nil(t, f.metadataBuffer("cluster-a/backups/b1/b1.tar.gz"))
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{limit: 4}
+	n, err := b.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.False(t, b.truncated)
+
+	n, err = b.Write([]byte("def"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.True(t, b.truncated)
+	assert.Equal(t, "abcd", b.String())
+}
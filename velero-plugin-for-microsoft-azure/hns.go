@@ -0,0 +1,108 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// hierarchicalNamespaceAPIVersion is the storage API version of the requests
+// for directories, the first that reports whether an account has a
+// hierarchical namespace.
+const hierarchicalNamespaceAPIVersion = "2019-12-12"
+
+// directoryDeleter deletes directories, on storage accounts with a
+// hierarchical namespace (Data Lake Storage Gen2).
+type directoryDeleter interface {
+	// deleteDirectory deletes the directory and everything in it, returning
+	// false, with the error checking it if any, if the account has no
+	// hierarchical namespace, and so no directories.
+	deleteDirectory(bucket, dir string) (bool, error)
+}
+
+// azureDirectoryDeleter deletes directories with Path - Delete requests to
+// the account's Data Lake Storage endpoint, which delete a whole directory in
+// one call rather than one call per blob.
+type azureDirectoryDeleter struct {
+	account string
+	service *lazyBlobService
+
+	lock    sync.Mutex
+	checked bool
+	hns     bool
+}
+
+// hierarchical returns whether the account has a hierarchical namespace,
+// which can't change once the account is created, so it's only checked once.
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/get-account-information
+func (d *azureDirectoryDeleter) hierarchical(bucket string) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.checked {
+		return d.hns, nil
+	}
+
+	resp, err := d.service.do(d.account, blobRequest{
+		method:     http.MethodHead,
+		bucket:     bucket,
+		query:      url.Values{"restype": {"account"}, "comp": {"properties"}},
+		apiVersion: hierarchicalNamespaceAPIVersion,
+	})
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	d.checked = true
+	d.hns = strings.EqualFold(resp.Header.Get("x-ms-is-hns-enabled"), "true")
+	return d.hns, nil
+}
+
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/datalakestoragegen2/path/delete
+func (d *azureDirectoryDeleter) deleteDirectory(bucket, dir string) (bool, error) {
+	hns, err := d.hierarchical(bucket)
+	if err != nil || !hns {
+		return false, err
+	}
+
+	// directories with many paths are deleted over several requests, each
+	// continuing where the previous one stopped
+	query := url.Values{"recursive": {"true"}}
+	for {
+		resp, err := d.service.do(d.account, blobRequest{
+			method:     http.MethodDelete,
+			bucket:     bucket,
+			key:        strings.TrimSuffix(dir, "/"),
+			dfs:        true,
+			query:      query,
+			apiVersion: hierarchicalNamespaceAPIVersion,
+		})
+		if err != nil {
+			return true, err
+		}
+		resp.Body.Close()
+
+		continuation := resp.Header.Get("x-ms-continuation")
+		if continuation == "" {
+			return true, nil
+		}
+		query.Set("continuation", continuation)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedSender records requests and answers them with the given
+// responses' headers, in order.
+type scriptedSender struct {
+	requests []*http.Request
+	headers  []http.Header
+}
+
+func (s *scriptedSender) Send(_ *storage.Client, req *http.Request) (*http.Response, error) {
+	s.requests = append(s.requests, req)
+	header := s.headers[0]
+	s.headers = s.headers[1:]
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestAzureDirectoryDeleter(t *testing.T) {
+	deleter := func(sender storage.Sender) *azureDirectoryDeleter {
+		credential := &storageCredential{accountKey: "a2V5"}
+		return &azureDirectoryDeleter{account: "account", service: newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+			client, err := newStorageClient("account", credential, &azure.PublicCloud, "")
+			require.NoError(t, err)
+			client.Sender = sender
+			return &client, credential, nil
+		})}
+	}
+
+	// directories are deleted over as many requests as the service needs
+	sender := &scriptedSender{headers: []http.Header{
+		{"X-Ms-Is-Hns-Enabled": {"true"}},
+		{"X-Ms-Continuation": {"token-1"}},
+		{},
+		{},
+	}}
+	d := deleter(sender)
+	deleted, err := d.deleteDirectory("b", "restic/ns-1/")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	require.Len(t, sender.requests, 3)
+	assert.Equal(t, "https://account.blob.core.windows.net/b?comp=properties&restype=account", sender.requests[0].URL.String())
+	assert.Equal(t, "https://account.dfs.core.windows.net/b/restic/ns-1?recursive=true", sender.requests[1].URL.String())
+	assert.Equal(t, "https://account.dfs.core.windows.net/b/restic/ns-1?continuation=token-1&recursive=true", sender.requests[2].URL.String())
+	assert.Equal(t, http.MethodDelete, sender.requests[2].Method)
+
+	// the account's namespace is only checked once
+	_, err = d.deleteDirectory("b", "restic/ns-2/")
+	require.NoError(t, err)
+	assert.Len(t, sender.requests, 4)
+
+	// accounts without a hierarchical namespace have no directories
+	sender = &scriptedSender{headers: []http.Header{{}}}
+	deleted, err = deleter(sender).deleteDirectory("b", "restic/ns-1/")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+	assert.Len(t, sender.requests, 1)
+}
+
+type fakeDirectoryDeleter struct {
+	hns     bool
+	deleted []string
+}
+
+func (d *fakeDirectoryDeleter) deleteDirectory(bucket, dir string) (bool, error) {
+	if !d.hns {
+		return false, nil
+	}
+	d.deleted = append(d.deleted, dir)
+	return true, nil
+}
+
+func TestDeleteObjectDirectory(t *testing.T) {
+	blobs := newMemBlobs(time.Now())
+	blobs.put("restic/ns-1/", "", time.Now())
+	blobs.put("restic/ns-1/config", "config", time.Now())
+
+	// prefixes are deleted as directories on accounts with a hierarchical namespace
+	directories := &fakeDirectoryDeleter{hns: true}
+	o := &ObjectStore{log: logrus.New(), blobGetter: blobs, directories: directories}
+	require.NoError(t, o.DeleteObject("b", "restic/ns-1/"))
+	require.NoError(t, o.DeleteObject("b", "restic/ns-1/config"))
+	assert.Equal(t, []string{"restic/ns-1/"}, directories.deleted)
+	assert.Len(t, blobs.data, 1)
+	assert.Contains(t, blobs.data, "restic/ns-1/")
+
+	// and as blobs otherwise
+	directories.hns = false
+	require.NoError(t, o.DeleteObject("b", "restic/ns-1/"))
+	assert.Empty(t, blobs.data)
+}
+
+func TestDeleteObjectDirectoryRecordsObjects(t *testing.T) {
+	blobs := newMemBlobs(time.Now())
+	blobs.put("velero/backups/b1/velero-azure-replication.json", "{}", time.Now())
+	blobs.put("velero/backups/b2/b2-volumesnapshots.json.gz", "", time.Now())
+	blobs.put("velero/plugins/azure/resource-graph/b2.json", "{}", time.Now())
+
+	// the objects of a deleted directory are removed from the replicator's
+	// cache like objects deleted one by one
+	r := &replicator{
+		log:       logrus.New(),
+		prefix:    "velero",
+		states:    map[string]cachedReplicationState{"velero/backups/b1/": {state: &replicationState{}, readAt: time.Now()}},
+		rewritten: map[string]time.Time{},
+	}
+	o := &ObjectStore{
+		log:             logrus.New(),
+		blobGetter:      blobs,
+		containerGetter: blobs,
+		directories:     &fakeDirectoryDeleter{hns: true},
+		replicator:      r,
+	}
+	require.NoError(t, o.DeleteObject("b", "velero/backups/b1/"))
+	assert.Empty(t, r.states)
+
+	// and from the resource graph records
+	o = &ObjectStore{
+		log:             logrus.New(),
+		blobGetter:      blobs,
+		containerGetter: blobs,
+		directories:     &fakeDirectoryDeleter{hns: true},
+		resourceGraph: &resourceGraphRecorder{
+			log:    logrus.New(),
+			store:  &metadataStore{blobGetter: blobs, bucket: "b", prefix: "velero"},
+			prefix: "velero",
+		},
+	}
+	require.NoError(t, o.DeleteObject("b", "velero/backups/b2/"))
+	assert.NotContains(t, blobs.data, "velero/plugins/azure/resource-graph/b2.json")
+}
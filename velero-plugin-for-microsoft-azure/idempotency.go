@@ -0,0 +1,108 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	deterministicSnapshotNamesConfigKey = "deterministicSnapshotNames"
+
+	// snapshotAdoptionWindow is how long after its creation a snapshot with a
+	// deterministic name is adopted by a later attempt to take it. Older
+	// snapshots with the same name are left over from an earlier backup with
+	// the same name, e.g. one whose deletion failed.
+	snapshotAdoptionWindow = 24 * time.Hour
+)
+
+type snapshotGetter interface {
+	Get(ctx context.Context, resourceGroupName string, snapshotName string) (disk.Snapshot, error)
+}
+
+// snapshotNameWithSuffix returns the name of a snapshot of the given volume
+// ending with suffix. Snapshot names must be at most 80 characters long.
+func snapshotNameWithSuffix(volumeID, suffix string) string {
+	if len(volumeID) <= (80 - len(suffix)) {
+		return volumeID + suffix
+	}
+	return volumeID[0:80-len(suffix)] + suffix
+}
+
+// deterministicSnapshotName returns the name of the snapshot of the given
+// disk for the given backup and persistent volume, which is the same for
+// every attempt to take it.
+func deterministicSnapshotName(volumeID, diskID, backup, pv string) string {
+	sum := sha256.Sum256([]byte(backup + "/" + pv + "/" + strings.ToLower(diskID)))
+	return snapshotNameWithSuffix(volumeID, "-"+hex.EncodeToString(sum[:16]))
+}
+
+// adoptableSnapshot returns whether the given snapshot, found under the
+// deterministic name of a snapshot of diskID for backup, was created by an
+// earlier attempt to take that snapshot.
+func adoptableSnapshot(snap disk.Snapshot, diskID, backup string, now time.Time) bool {
+	if snap.SnapshotProperties == nil || snap.CreationData == nil || snap.CreationData.SourceResourceID == nil {
+		return false
+	}
+	if !strings.EqualFold(*snap.CreationData.SourceResourceID, diskID) {
+		return false
+	}
+	if tag, ok := snap.Tags[veleroBackupTag]; !ok || tag == nil || *tag != backup {
+		return false
+	}
+	return snap.TimeCreated != nil && now.Sub(snap.TimeCreated.Time) < snapshotAdoptionWindow
+}
+
+// idempotentSnapshotName returns the deterministic name of the snapshot of
+// the given disk for the backup and persistent volume in tags, so that if a
+// previous attempt to take it timed out after the snapshot was created, it's
+// adopted rather than duplicated: creating a snapshot that already exists
+// only updates it. It returns "" if the snapshot isn't for a backup, or if a
+// snapshot that wasn't created by an earlier attempt already has the name.
+func idempotentSnapshotName(ctx context.Context, log logrus.FieldLogger, snaps snapshotGetter, resourceGroup, volumeID, diskID string, tags map[string]string, now time.Time) (string, error) {
+	backup, pv := tags["velero.io/backup"], tags["velero.io/pv"]
+	if backup == "" || pv == "" {
+		return "", nil
+	}
+	name := deterministicSnapshotName(volumeID, diskID, backup, pv)
+
+	existing, err := snaps.Get(ctx, resourceGroup, name)
+	if status, _ := armErrorCode(err); status == http.StatusNotFound {
+		return name, nil
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	log = log.WithField("snapshotName", name)
+	if !adoptableSnapshot(existing, diskID, backup, now) {
+		log.Warn("A snapshot that wasn't created for this backup already has the snapshot's name, using a unique name instead")
+		return "", nil
+	}
+
+	log.Info("Snapshot was created by an earlier attempt, adopting it")
+	return name, nil
+}
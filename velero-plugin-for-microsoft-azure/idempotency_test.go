@@ -0,0 +1,134 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIdempotentDiskID = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk-1"
+
+type fakeSnapshotGetter struct {
+	snapshot disk.Snapshot
+	err      error
+}
+
+func (g *fakeSnapshotGetter) Get(_ context.Context, _ string, _ string) (disk.Snapshot, error) {
+	return g.snapshot, g.err
+}
+
+func TestDeterministicSnapshotName(t *testing.T) {
+	name := deterministicSnapshotName("disk-1", testIdempotentDiskID, "backup-1", "pv-1")
+	assert.Equal(t, name, deterministicSnapshotName("disk-1", strings.ToUpper(testIdempotentDiskID), "backup-1", "pv-1"))
+	assert.NotEqual(t, name, deterministicSnapshotName("disk-1", testIdempotentDiskID, "backup-2", "pv-1"))
+	assert.NotEqual(t, name, deterministicSnapshotName("disk-1", testIdempotentDiskID, "backup-1", "pv-2"))
+	assert.True(t, strings.HasPrefix(name, "disk-1-"))
+
+	long := deterministicSnapshotName(strings.Repeat("a", 100), testIdempotentDiskID, "backup-1", "pv-1")
+	assert.Len(t, long, 80)
+}
+
+func TestIdempotentSnapshotName(t *testing.T) {
+	now := time.Now()
+	tags := map[string]string{"velero.io/backup": "backup-1", "velero.io/pv": "pv-1"}
+	expected := deterministicSnapshotName("disk-1", testIdempotentDiskID, "backup-1", "pv-1")
+
+	existing := func(source, backup string, age time.Duration) disk.Snapshot {
+		return disk.Snapshot{
+			SnapshotProperties: &disk.SnapshotProperties{
+				CreationData: &disk.CreationData{SourceResourceID: stringPtr(source)},
+				TimeCreated:  &date.Time{Time: now.Add(-age)},
+			},
+			Tags: map[string]*string{veleroBackupTag: stringPtr(backup)},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		tags          map[string]string
+		getter        *fakeSnapshotGetter
+		expected      string
+		expectedError bool
+	}{
+		{
+			name:     "snapshots outside of backups are named uniquely",
+			tags:     map[string]string{},
+			getter:   &fakeSnapshotGetter{},
+			expected: "",
+		},
+		{
+			name:     "new snapshots are named deterministically",
+			tags:     tags,
+			getter:   &fakeSnapshotGetter{err: autorest.DetailedError{StatusCode: http.StatusNotFound}},
+			expected: expected,
+		},
+		{
+			name:     "snapshots created by earlier attempts are adopted",
+			tags:     tags,
+			getter:   &fakeSnapshotGetter{snapshot: existing(testIdempotentDiskID, "backup-1", time.Minute)},
+			expected: expected,
+		},
+		{
+			name:     "old snapshots aren't adopted",
+			tags:     tags,
+			getter:   &fakeSnapshotGetter{snapshot: existing(testIdempotentDiskID, "backup-1", 48*time.Hour)},
+			expected: "",
+		},
+		{
+			name:     "snapshots of other disks aren't adopted",
+			tags:     tags,
+			getter:   &fakeSnapshotGetter{snapshot: existing("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk-2", "backup-1", time.Minute)},
+			expected: "",
+		},
+		{
+			name:     "snapshots for other backups aren't adopted",
+			tags:     tags,
+			getter:   &fakeSnapshotGetter{snapshot: existing(testIdempotentDiskID, "backup-2", time.Minute)},
+			expected: "",
+		},
+		{
+			name:          "other errors are returned",
+			tags:          tags,
+			getter:        &fakeSnapshotGetter{err: errors.New("forbidden")},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			name, err := idempotentSnapshotName(context.Background(), logrus.New(), tc.getter, "rg", "disk-1", testIdempotentDiskID, tc.tags, now)
+			if tc.expectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, name)
+		})
+	}
+}
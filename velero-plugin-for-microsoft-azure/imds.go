@@ -0,0 +1,157 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/pkg/errors"
+)
+
+const (
+	// managedIdentityTokenFileEnvVar names a file with a managed identity
+	// token, as returned by IMDS, to use when IMDS can't be reached, e.g. one
+	// kept up to date by a sidecar on clusters whose pods can't reach it.
+	managedIdentityTokenFileEnvVar = "AZURE_MANAGED_IDENTITY_TOKEN_FILE"
+
+	// requests to IMDS are retried with exponential backoff, following
+	// https://docs.microsoft.com/en-us/azure/active-directory/managed-identities-azure-resources/how-to-use-vm-token#retry-guidance,
+	// and each attempt times out quickly, since IMDS is on the node and
+	// requests blocked by a NetworkPolicy would otherwise take the dialer's
+	// default timeout to fail.
+	imdsMaxAttempts    = 5
+	imdsInitialBackoff = time.Second
+	imdsMaxBackoff     = 30 * time.Second
+	imdsAttemptTimeout = 10 * time.Second
+)
+
+// isRetryableIMDSStatus returns whether IMDS may answer a request with the
+// given status successfully when it's retried.
+func isRetryableIMDSStatus(status int) bool {
+	switch status {
+	case http.StatusNotFound, http.StatusGone, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= 500
+}
+
+// imdsSender sends the token requests of a managed identity to IMDS, retrying
+// them itself. If IMDS can't be reached, the token in the token file, if set,
+// is returned instead, and otherwise an error that explains what may be
+// blocking IMDS rather than just the network error.
+type imdsSender struct {
+	client    *http.Client
+	tokenFile string
+	attempts  int
+	backoff   time.Duration
+	sleep     func(time.Duration)
+	now       func() time.Time
+}
+
+func newIMDSSender(tokenFile string) *imdsSender {
+	return &imdsSender{
+		client: &http.Client{
+			Timeout: imdsAttemptTimeout,
+			Transport: &http.Transport{
+				// IMDS is link-local, so it can't be reached through a proxy,
+				// and it rejects the requests proxies forward
+				Proxy:       nil,
+				DialContext: (&net.Dialer{Timeout: imdsAttemptTimeout}).DialContext,
+			},
+		},
+		tokenFile: tokenFile,
+		attempts:  imdsMaxAttempts,
+		backoff:   imdsInitialBackoff,
+		sleep:     time.Sleep,
+		now:       time.Now,
+	}
+}
+
+func (s *imdsSender) Do(req *http.Request) (*http.Response, error) {
+	var (
+		resp    *http.Response
+		err     error
+		backoff = s.backoff
+	)
+	for attempt := 1; ; attempt++ {
+		resp, err = s.client.Do(req)
+		if err == nil && !isRetryableIMDSStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		if attempt == s.attempts || req.Context().Err() != nil {
+			break
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		s.sleep(backoff)
+		if backoff *= 2; backoff > imdsMaxBackoff {
+			backoff = imdsMaxBackoff
+		}
+	}
+
+	// IMDS answered, so the token request's error is its response's
+	if err == nil {
+		return resp, nil
+	}
+
+	if s.tokenFile != "" {
+		tokenResp, fileErr := s.readTokenFile(req.URL.Query().Get("resource"))
+		if fileErr == nil {
+			return tokenResp, nil
+		}
+		return nil, errors.Errorf("unable to reach IMDS at %s after %d attempts (%v), and unable to use the token in %s instead: %v", req.URL.Host, s.attempts, err, s.tokenFile, fileErr)
+	}
+	return nil, errors.Errorf("unable to reach IMDS at %s after %d attempts (%v): the Velero pod must be able to reach it to authenticate with a managed identity, so check that no NetworkPolicy or firewall blocks its egress to %s, and that the node's network forwards the pod's requests to it, or set %s in $AZURE_CREDENTIALS_FILE to a file with a token to use instead", req.URL.Host, s.attempts, err, req.URL.Host, managedIdentityTokenFileEnvVar)
+}
+
+// readTokenFile returns the token in the token file as the response of IMDS
+// to a token request for resource.
+func (s *imdsSender) readTokenFile(resource string) (*http.Response, error) {
+	data, err := ioutil.ReadFile(s.tokenFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// don't include the file's content in errors, it's a secret
+	var token adal.Token
+	if err := json.Unmarshal(data, &token); err != nil || token.AccessToken == "" {
+		return nil, errors.New("the file doesn't have a token in the JSON format IMDS returns them in")
+	}
+	if !strings.EqualFold(strings.TrimSuffix(token.Resource, "/"), strings.TrimSuffix(resource, "/")) {
+		return nil, errors.Errorf("its token is for %s rather than %s", token.Resource, resource)
+	}
+	if !token.Expires().After(s.now()) {
+		return nil, errors.Errorf("its token expired at %s", token.Expires().Format(time.RFC3339))
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
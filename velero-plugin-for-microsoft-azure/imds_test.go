@@ -0,0 +1,112 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIMDSSenderRetries(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"token"}`)
+	}))
+	defer server.Close()
+
+	var sleeps []time.Duration
+	sender := newIMDSSender("")
+	sender.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/metadata/identity/oauth2/token", nil)
+	require.NoError(t, err)
+	resp, err := sender.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, sleeps)
+
+	// once the attempts are exhausted, IMDS's last response is returned
+	requests, sleeps = -10, nil
+	resp, err = sender.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Len(t, sleeps, imdsMaxAttempts-1)
+}
+
+func TestIMDSSenderUnreachable(t *testing.T) {
+	// a closed server's address refuses connections
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+
+	now := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+	newSender := func(tokenFile string) *imdsSender {
+		sender := newIMDSSender(tokenFile)
+		sender.sleep = func(time.Duration) {}
+		sender.now = func() time.Time { return now }
+		return sender
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/metadata/identity/oauth2/token?resource=https%3A%2F%2Fmanagement.azure.com%2F", nil)
+	require.NoError(t, err)
+
+	// the error explains what may block IMDS
+	_, err = newSender("").Do(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "NetworkPolicy")
+	assert.Contains(t, err.Error(), managedIdentityTokenFileEnvVar)
+
+	// the token file is used instead, if it has a token for the resource
+	token := fmt.Sprintf(`{"access_token":"secret-token","resource":"https://management.azure.com","expires_on":"%d"}`, now.Add(time.Hour).Unix())
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte(token), 0600))
+	resp, err := newSender(tokenFile).Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, token, string(body))
+
+	for _, token := range []string{
+		`{"access_token":"secret-token","resource":"https://vault.azure.net","expires_on":"9999999999"}`,
+		fmt.Sprintf(`{"access_token":"secret-token","resource":"https://management.azure.com/","expires_on":"%d"}`, now.Add(-time.Minute).Unix()),
+		`secret-token`,
+	} {
+		require.NoError(t, ioutil.WriteFile(tokenFile, []byte(token), 0600))
+		_, err := newSender(tokenFile).Do(req)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), tokenFile)
+		assert.NotContains(t, err.Error(), "secret-token")
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	immutabilityPeriodDaysConfigKey  = "immutabilityPeriodDays"
+	immutabilityPolicyModeConfigKey  = "immutabilityPolicyMode"
+	legalHoldConfigKey               = "legalHold"
+	requireImmutableStorageConfigKey = "requireImmutableStorage"
+
+	// immutabilityAPIVersion is the storage API version of immutability
+	// requests, the first that reports whether containers support
+	// version-level immutability
+	immutabilityAPIVersion = "2020-10-02"
+
+	unlockedImmutabilityPolicyMode = "Unlocked"
+	lockedImmutabilityPolicyMode   = "Locked"
+)
+
+// immutabilitySettings are the write-once-read-many protections applied to
+// uploaded objects.
+type immutabilitySettings struct {
+	// period is how long objects can't be modified or deleted after they're
+	// uploaded, or 0 for no time-based retention
+	period time.Duration
+	// mode is the mode of the objects' time-based retention policies.
+	// Locked policies can't be shortened or removed.
+	mode      string
+	legalHold bool
+}
+
+// getImmutabilitySettings returns the configured immutability settings, or
+// nil if uploaded objects aren't protected.
+func getImmutabilitySettings(config map[string]string) (*immutabilitySettings, error) {
+	settings := &immutabilitySettings{mode: unlockedImmutabilityPolicyMode}
+
+	if val := config[immutabilityPeriodDaysConfigKey]; val != "" {
+		days, err := strconv.Atoi(val)
+		if err != nil || days <= 0 {
+			return nil, errors.Errorf("unable to parse value %q for config key %q (expected a positive integer)", val, immutabilityPeriodDaysConfigKey)
+		}
+		settings.period = time.Duration(days) * 24 * time.Hour
+	}
+
+	switch val := config[immutabilityPolicyModeConfigKey]; {
+	case val == "":
+	case settings.period == 0:
+		return nil, errors.Errorf("config key %q requires config key %q", immutabilityPolicyModeConfigKey, immutabilityPeriodDaysConfigKey)
+	case strings.EqualFold(val, unlockedImmutabilityPolicyMode):
+		settings.mode = unlockedImmutabilityPolicyMode
+	case strings.EqualFold(val, lockedImmutabilityPolicyMode):
+		settings.mode = lockedImmutabilityPolicyMode
+	default:
+		return nil, errors.Errorf("invalid value %q for config key %q (expected %s or %s)", val, immutabilityPolicyModeConfigKey, unlockedImmutabilityPolicyMode, lockedImmutabilityPolicyMode)
+	}
+
+	if val := config[legalHoldConfigKey]; val != "" {
+		legalHold, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, legalHoldConfigKey)
+		}
+		settings.legalHold = legalHold
+	}
+
+	if settings.period == 0 && !settings.legalHold {
+		return nil, nil
+	}
+	return settings, nil
+}
+
+// apply protects the uploaded object with the given key.
+func (s *immutabilitySettings) apply(blobs immutableBlobs, bucket, key string, now time.Time) error {
+	if s.period > 0 {
+		if err := blobs.setImmutabilityPolicy(bucket, key, now.Add(s.period), s.mode); err != nil {
+			return errors.Wrapf(err, "error setting immutability policy of object %s", key)
+		}
+	}
+	if s.legalHold {
+		if err := blobs.setLegalHold(bucket, key); err != nil {
+			return errors.Wrapf(err, "error setting legal hold of object %s", key)
+		}
+	}
+	return nil
+}
+
+// containerImmutability is the immutability configured on a container.
+type containerImmutability struct {
+	// versionLevel is whether the container supports version-level
+	// immutability, so that its blobs can be protected one by one
+	versionLevel bool
+	// policy and legalHold are whether the container has a container-level
+	// time-based retention policy or legal hold, which protect all its blobs
+	policy    bool
+	legalHold bool
+}
+
+// immutableBlobs protects blobs in containers with version-level
+// immutability support.
+type immutableBlobs interface {
+	getContainerImmutability(bucket string) (containerImmutability, error)
+	setImmutabilityPolicy(bucket, key string, until time.Time, mode string) error
+	setLegalHold(bucket, key string) error
+}
+
+// azureImmutableBlobs protects blobs with requests the storage client has no
+// operations for.
+type azureImmutableBlobs struct {
+	account string
+	service *lazyBlobService
+}
+
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/get-container-properties
+func (b *azureImmutableBlobs) getContainerImmutability(bucket string) (containerImmutability, error) {
+	resp, err := b.service.do(b.account, blobRequest{
+		method:     http.MethodHead,
+		bucket:     bucket,
+		query:      url.Values{"restype": {"container"}},
+		apiVersion: immutabilityAPIVersion,
+	})
+	if err != nil {
+		return containerImmutability{}, err
+	}
+	resp.Body.Close()
+	return containerImmutability{
+		versionLevel: strings.EqualFold(resp.Header.Get("x-ms-immutable-storage-with-versioning-enabled"), "true"),
+		policy:       strings.EqualFold(resp.Header.Get("x-ms-has-immutability-policy"), "true"),
+		legalHold:    strings.EqualFold(resp.Header.Get("x-ms-has-legal-hold"), "true"),
+	}, nil
+}
+
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/set-blob-immutability-policy
+func (b *azureImmutableBlobs) setImmutabilityPolicy(bucket, key string, until time.Time, mode string) error {
+	resp, err := b.service.do(b.account, blobRequest{
+		method: http.MethodPut,
+		bucket: bucket,
+		key:    key,
+		query:  url.Values{"comp": {"immutabilityPolicies"}},
+		headers: map[string]string{
+			"x-ms-immutability-policy-until-date": until.UTC().Format(http.TimeFormat),
+			"x-ms-immutability-policy-mode":       mode,
+		},
+		apiVersion: immutabilityAPIVersion,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/set-blob-legal-hold
+func (b *azureImmutableBlobs) setLegalHold(bucket, key string) error {
+	resp, err := b.service.do(b.account, blobRequest{
+		method:     http.MethodPut,
+		bucket:     bucket,
+		key:        key,
+		query:      url.Values{"comp": {"legalhold"}},
+		headers:    map[string]string{"x-ms-legal-hold": "true"},
+		apiVersion: immutabilityAPIVersion,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// checkImmutabilitySupport returns an error if the container doesn't support
+// version-level immutability, without which uploads can't be protected.
+func checkImmutabilitySupport(blobs immutableBlobs, bucket string) error {
+	immutability, err := blobs.getContainerImmutability(bucket)
+	if err != nil {
+		return errors.Wrapf(err, "error getting properties of container %s", bucket)
+	}
+	if !immutability.versionLevel {
+		return errors.Errorf("container %s doesn't have version-level immutability support enabled, so config.%s and config.%s can't be applied to its objects, and uploads will fail",
+			bucket, immutabilityPeriodDaysConfigKey, legalHoldConfigKey)
+	}
+	return nil
+}
+
+// getRequireImmutableStorage returns whether config.requireImmutableStorage
+// is set.
+func getRequireImmutableStorage(config map[string]string) (bool, error) {
+	val := config[requireImmutableStorageConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	required, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, requireImmutableStorageConfigKey)
+	}
+
+	return required, nil
+}
+
+// checkImmutableStorage returns an error if the container's blobs aren't
+// protected from being modified or deleted: either by a container-level
+// retention policy or legal hold, or by the version-level protections the
+// plugin applies with the given settings, if any.
+func checkImmutableStorage(blobs immutableBlobs, bucket string, settings *immutabilitySettings) error {
+	immutability, err := blobs.getContainerImmutability(bucket)
+	if err != nil {
+		return errors.Wrapf(err, "error getting properties of container %s to check config.%s", bucket, requireImmutableStorageConfigKey)
+	}
+	if immutability.policy || immutability.legalHold {
+		return nil
+	}
+	if !immutability.versionLevel {
+		return errors.Errorf("container %s has no immutability policy or legal hold, nor version-level immutability support, and config.%s is set; "+
+			"configure immutable storage for the container, or use another container", bucket, requireImmutableStorageConfigKey)
+	}
+	if settings == nil {
+		return errors.Errorf("container %s has version-level immutability support but no immutability policy or legal hold, and config.%s is set; "+
+			"set config.%s or config.%s to protect uploaded objects, or configure a default policy for the container", bucket, requireImmutableStorageConfigKey, immutabilityPeriodDaysConfigKey, legalHoldConfigKey)
+	}
+	return nil
+}
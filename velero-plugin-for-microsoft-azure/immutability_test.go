@@ -0,0 +1,193 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetImmutabilitySettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   map[string]string
+		expected *immutabilitySettings
+		err      bool
+	}{
+		{name: "none", config: map[string]string{}},
+		{name: "no legal hold", config: map[string]string{legalHoldConfigKey: "false"}},
+		{
+			name:     "period",
+			config:   map[string]string{immutabilityPeriodDaysConfigKey: "30"},
+			expected: &immutabilitySettings{period: 30 * 24 * time.Hour, mode: unlockedImmutabilityPolicyMode},
+		},
+		{
+			name:     "locked period and legal hold",
+			config:   map[string]string{immutabilityPeriodDaysConfigKey: "7", immutabilityPolicyModeConfigKey: "locked", legalHoldConfigKey: "true"},
+			expected: &immutabilitySettings{period: 7 * 24 * time.Hour, mode: lockedImmutabilityPolicyMode, legalHold: true},
+		},
+		{
+			name:     "legal hold",
+			config:   map[string]string{legalHoldConfigKey: "true"},
+			expected: &immutabilitySettings{mode: unlockedImmutabilityPolicyMode, legalHold: true},
+		},
+		{name: "invalid period", config: map[string]string{immutabilityPeriodDaysConfigKey: "0"}, err: true},
+		{name: "invalid mode", config: map[string]string{immutabilityPeriodDaysConfigKey: "1", immutabilityPolicyModeConfigKey: "Frozen"}, err: true},
+		{name: "mode without period", config: map[string]string{immutabilityPolicyModeConfigKey: "Locked"}, err: true},
+		{name: "invalid legal hold", config: map[string]string{legalHoldConfigKey: "yes please"}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := getImmutabilitySettings(test.config)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, settings)
+		})
+	}
+}
+
+type fakeImmutableBlobs struct {
+	container containerImmutability
+	policies  map[string]string
+	holds     []string
+	err       error
+}
+
+func (f *fakeImmutableBlobs) getContainerImmutability(bucket string) (containerImmutability, error) {
+	return f.container, f.err
+}
+
+func (f *fakeImmutableBlobs) setImmutabilityPolicy(bucket, key string, until time.Time, mode string) error {
+	f.policies[key] = until.Format(time.RFC3339) + " " + mode
+	return f.err
+}
+
+func (f *fakeImmutableBlobs) setLegalHold(bucket, key string) error {
+	f.holds = append(f.holds, key)
+	return f.err
+}
+
+func TestCheckImmutabilitySupport(t *testing.T) {
+	assert.NoError(t, checkImmutabilitySupport(&fakeImmutableBlobs{container: containerImmutability{versionLevel: true}}, "b"))
+	assert.Error(t, checkImmutabilitySupport(&fakeImmutableBlobs{}, "b"))
+	assert.Error(t, checkImmutabilitySupport(&fakeImmutableBlobs{container: containerImmutability{versionLevel: true}, err: errors.New("boom")}, "b"))
+}
+
+func TestCheckImmutableStorage(t *testing.T) {
+	settings := &immutabilitySettings{period: 24 * time.Hour, mode: unlockedImmutabilityPolicyMode}
+	tests := []struct {
+		name      string
+		container containerImmutability
+		settings  *immutabilitySettings
+		err       error
+		wantErr   bool
+	}{
+		{name: "container policy", container: containerImmutability{policy: true}},
+		{name: "container legal hold", container: containerImmutability{legalHold: true}},
+		{name: "version-level with the plugin's protections", container: containerImmutability{versionLevel: true}, settings: settings},
+		{name: "version-level without protections", container: containerImmutability{versionLevel: true}, wantErr: true},
+		{name: "mutable", settings: settings, wantErr: true},
+		{name: "unknown", container: containerImmutability{policy: true}, err: errors.New("boom"), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkImmutableStorage(&fakeImmutableBlobs{container: test.container, err: test.err}, "b", test.settings)
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPutObjectImmutability(t *testing.T) {
+	for _, setErr := range []error{nil, errors.New("boom")} {
+		blobGetter := new(mockBlobGetter)
+		blob := new(mockBlob)
+		blobGetter.On("getBlob", "b", "backups/b1/b1.tar.gz").Return(blob, nil)
+		blob.On("PutBlock", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+		blob.On("PutBlockList", mock.Anything, mock.Anything).Return(nil)
+
+		blobs := &fakeImmutableBlobs{policies: map[string]string{}, err: setErr}
+		o := &ObjectStore{
+			log:            logrus.New(),
+			blobGetter:     blobGetter,
+			blockSize:      4,
+			immutability:   &immutabilitySettings{period: 24 * time.Hour, mode: lockedImmutabilityPolicyMode, legalHold: true},
+			immutableBlobs: blobs,
+		}
+
+		err := o.PutObject("b", "backups/b1/b1.tar.gz", strings.NewReader("contents"))
+		assert.Contains(t, blobs.policies["backups/b1/b1.tar.gz"], " Locked")
+		if setErr != nil {
+			// objects that can't be protected fail their upload
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, []string{"backups/b1/b1.tar.gz"}, blobs.holds)
+	}
+}
+
+func TestAzureImmutableBlobs(t *testing.T) {
+	credential := &storageCredential{accountKey: "a2V5"}
+	sender := &respondingSender{resp: &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Ms-Immutable-Storage-With-Versioning-Enabled": []string{"true"}, "X-Ms-Has-Legal-Hold": []string{"false"}},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}}
+	service := newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+		client, err := newStorageClient("account", credential, &azure.PublicCloud, "")
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		client.Sender = sender
+		return &client, credential, nil
+	})
+	blobs := &azureImmutableBlobs{account: "account", service: service}
+
+	immutability, err := blobs.getContainerImmutability("b")
+	require.NoError(t, err)
+	assert.Equal(t, containerImmutability{versionLevel: true}, immutability)
+	assert.Equal(t, "https://account.blob.core.windows.net/b?restype=container", sender.requests[0].URL.String())
+
+	until := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, blobs.setImmutabilityPolicy("b", "backups/b1/b1.tar.gz", until, lockedImmutabilityPolicyMode))
+	assert.Equal(t, "https://account.blob.core.windows.net/b/backups/b1/b1.tar.gz?comp=immutabilityPolicies", sender.requests[1].URL.String())
+	assert.Equal(t, "Wed, 01 Jul 2020 12:00:00 GMT", sender.requests[1].Header.Get("x-ms-immutability-policy-until-date"))
+	assert.Equal(t, "Locked", sender.requests[1].Header.Get("x-ms-immutability-policy-mode"))
+
+	require.NoError(t, blobs.setLegalHold("b", "backups/b1/b1.tar.gz"))
+	assert.Equal(t, "https://account.blob.core.windows.net/b/backups/b1/b1.tar.gz?comp=legalhold", sender.requests[2].URL.String())
+	assert.Equal(t, "true", sender.requests[2].Header.Get("x-ms-legal-hold"))
+}
@@ -0,0 +1,315 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/vmware-tanzu/velero/pkg/volume"
+)
+
+// inventoryStore is the part of the object store that inventory
+// reconciliation reads backups with.
+type inventoryStore interface {
+	ObjectExists(bucket, key string) (bool, error)
+	GetObject(bucket, key string) (io.ReadCloser, error)
+	ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error)
+}
+
+// inventorySnapshot is a snapshot referenced by a backup.
+type inventorySnapshot struct {
+	PersistentVolume string `json:"persistentVolume"`
+	SnapshotID       string `json:"snapshotID"`
+}
+
+// inventoryBackup is a backup whose metadata references objects or
+// snapshots that don't exist, or that couldn't be checked.
+type inventoryBackup struct {
+	Backup           string              `json:"backup"`
+	MissingObjects   []string            `json:"missingObjects,omitempty"`
+	MissingSnapshots []inventorySnapshot `json:"missingSnapshots,omitempty"`
+	Errors           []string            `json:"errors,omitempty"`
+}
+
+// inventoryReport is the result of reconciling a location's backups against
+// the blobs and snapshots they reference.
+type inventoryReport struct {
+	StartedAt   time.Time         `json:"startedAt"`
+	CompletedAt time.Time         `json:"completedAt"`
+	Backups     int               `json:"backups"`
+	Snapshots   int               `json:"snapshots"`
+	Dangling    []inventoryBackup `json:"dangling"`
+	Passed      bool              `json:"passed"`
+}
+
+// inventoryReconciler cross-references the backups in a location with the
+// blobs and snapshots their metadata references, so that dangling
+// references are found before a restore needs them.
+type inventoryReconciler struct {
+	log        logrus.FieldLogger
+	store      inventoryStore
+	bucket     string
+	prefix     string
+	snapshots  func(subscription string) snapshotGetter
+	apiTimeout time.Duration
+}
+
+func (r *inventoryReconciler) key(parts ...string) string {
+	if r.prefix == "" {
+		return strings.Join(parts, "/")
+	}
+	return r.prefix + "/" + strings.Join(parts, "/")
+}
+
+// reconcile checks every backup in the location, or only the named one.
+func (r *inventoryReconciler) reconcile(backup string) (*inventoryReport, error) {
+	report := &inventoryReport{StartedAt: time.Now().UTC(), Dangling: []inventoryBackup{}}
+
+	backups := []string{backup}
+	if backup == "" {
+		dirs, err := r.store.ListCommonPrefixes(r.bucket, r.key("backups")+"/", "/")
+		if err != nil {
+			return nil, err
+		}
+		backups = nil
+		for _, dir := range dirs {
+			backups = append(backups, strings.TrimSuffix(dir[strings.LastIndex(strings.TrimSuffix(dir, "/"), "/")+1:], "/"))
+		}
+	}
+
+	for _, name := range backups {
+		result, snapshots := r.reconcileBackup(name)
+		report.Backups++
+		report.Snapshots += snapshots
+		if len(result.MissingObjects) > 0 || len(result.MissingSnapshots) > 0 || len(result.Errors) > 0 {
+			report.Dangling = append(report.Dangling, *result)
+			r.log.WithField("backup", name).Warn("Backup references objects or snapshots that don't exist")
+		}
+	}
+
+	report.CompletedAt = time.Now().UTC()
+	report.Passed = len(report.Dangling) == 0
+	return report, nil
+}
+
+// reconcileBackup checks that the backup's contents and snapshots exist,
+// returning the result and the number of snapshots checked.
+func (r *inventoryReconciler) reconcileBackup(backup string) (*inventoryBackup, int) {
+	result := &inventoryBackup{Backup: backup}
+
+	metadata, err := r.store.GetObject(r.bucket, r.key("backups", backup, backupMetadataFile))
+	if err != nil {
+		if isNotFound(err) {
+			result.MissingObjects = append(result.MissingObjects, r.key("backups", backup, backupMetadataFile))
+		} else {
+			result.Errors = append(result.Errors, err.Error())
+		}
+		return result, 0
+	}
+	var status backupStatus
+	err = json.NewDecoder(metadata).Decode(&status)
+	metadata.Close()
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("unable to read %s: %v", backupMetadataFile, err))
+		return result, 0
+	}
+
+	// failed backups aren't restorable, so their references don't matter
+	if status.Status.Phase != "Completed" && status.Status.Phase != "PartiallyFailed" {
+		return result, 0
+	}
+
+	contents := r.key("backups", backup, backup+".tar.gz")
+	if exists, err := r.store.ObjectExists(r.bucket, contents); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+	} else if !exists {
+		result.MissingObjects = append(result.MissingObjects, contents)
+	}
+
+	snapshots, err := r.readSnapshots(backup)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, 0
+	}
+
+	checked := 0
+	for _, snap := range snapshots {
+		if snap.Status.Phase != volume.SnapshotPhaseCompleted || snap.Status.ProviderSnapshotID == "" {
+			continue
+		}
+		// snapshots of other providers can't be checked
+		id, err := parseFullSnapshotName(snap.Status.ProviderSnapshotID)
+		if err != nil {
+			continue
+		}
+
+		checked++
+		ctx, cancel := context.WithTimeout(context.Background(), r.apiTimeout)
+		_, err = r.snapshots(id.subscription).Get(ctx, id.resourceGroup, id.name)
+		cancel()
+		if status, _ := armErrorCode(err); status == http.StatusNotFound {
+			result.MissingSnapshots = append(result.MissingSnapshots, inventorySnapshot{
+				PersistentVolume: snap.Spec.PersistentVolumeName,
+				SnapshotID:       snap.Status.ProviderSnapshotID,
+			})
+		} else if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("error getting snapshot %s: %v", snap.Status.ProviderSnapshotID, err))
+		}
+	}
+
+	return result, checked
+}
+
+// readSnapshots reads the volume snapshots Velero recorded for the backup,
+// if any.
+func (r *inventoryReconciler) readSnapshots(backup string) ([]*volume.Snapshot, error) {
+	res, err := r.store.GetObject(r.bucket, r.key("backups", backup, backup+"-volumesnapshots.json.gz"))
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	gz, err := gzip.NewReader(res)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read the backup's volume snapshots")
+	}
+	defer gz.Close()
+
+	var snapshots []*volume.Snapshot
+	if err := json.NewDecoder(gz).Decode(&snapshots); err != nil {
+		return nil, errors.Wrap(err, "unable to read the backup's volume snapshots")
+	}
+	return snapshots, nil
+}
+
+// publishInventoryReport writes the report to the metadata store, both under
+// a unique name and as the latest report.
+func publishInventoryReport(store *metadataStore, report *inventoryReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if store == nil {
+		fmt.Println(string(data))
+		return nil
+	}
+
+	name := fmt.Sprintf("reconciliations/%s.json", report.StartedAt.Format("20060102150405"))
+	if err := store.put(name, data); err != nil {
+		return err
+	}
+	return store.put("reconciliations/latest.json", data)
+}
+
+func runReconcileInventory(log logrus.FieldLogger, args []string) error {
+	var (
+		config       map[string]string
+		backup       string
+		interval     time.Duration
+		apiTimeout   time.Duration
+		resultConfig map[string]string
+	)
+
+	flags := pflag.NewFlagSet("reconcile-inventory", pflag.ContinueOnError)
+	flags.StringToStringVar(&config, "config", nil, fmt.Sprintf("The location's config, as key=value pairs, along with its container as %s and its prefix as %s", bucketConfigKey, prefixConfigKey))
+	flags.StringVar(&backup, "backup", "", "The backup to reconcile (defaults to all backups in the location)")
+	flags.DurationVar(&interval, "interval", 0, "Reconcile repeatedly at this interval rather than once")
+	flags.DurationVar(&apiTimeout, "api-timeout", 2*time.Minute, "Timeout for getting each snapshot")
+	flags.StringToStringVar(&resultConfig, "result-config", nil, fmt.Sprintf("Metadata store config to publish reports to, e.g. %s=...,%s=...", metadataStorageAccountConfigKey, metadataBucketConfigKey))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	bucket := config[bucketConfigKey]
+	if bucket == "" {
+		return errors.Errorf("--config %s is required", bucketConfigKey)
+	}
+	// the object store doesn't take the container and prefix as config
+	locationConfig := map[string]string{}
+	for k, v := range config {
+		if k != bucketConfigKey && k != prefixConfigKey {
+			locationConfig[k] = v
+		}
+	}
+
+	authorizer, env, err := commandAuthorizer()
+	if err != nil {
+		return err
+	}
+
+	var results *metadataStore
+	if len(resultConfig) > 0 {
+		if results, err = newMetadataStore(resultConfig, env); err != nil {
+			return err
+		}
+	}
+
+	store := newObjectStore(log)
+	if err := store.Init(locationConfig); err != nil {
+		return err
+	}
+
+	r := &inventoryReconciler{
+		log:    log,
+		store:  store,
+		bucket: bucket,
+		prefix: config[prefixConfigKey],
+		snapshots: func(subscription string) snapshotGetter {
+			client := disk.NewSnapshotsClientWithBaseURI(env.ResourceManagerEndpoint, subscription)
+			client.Authorizer = authorizer
+			return client
+		},
+		apiTimeout: apiTimeout,
+	}
+
+	for {
+		report, err := r.reconcile(backup)
+		if err != nil {
+			log.WithError(err).Error("Error reconciling backup inventory")
+		} else if err := publishInventoryReport(results, report); err != nil {
+			log.WithError(err).Error("Error publishing backup inventory report")
+		} else {
+			log.WithFields(logrus.Fields{"backups": report.Backups, "dangling": len(report.Dangling)}).Info("Backup inventory reconciliation complete")
+		}
+
+		if interval == 0 {
+			if err != nil {
+				return err
+			}
+			if !report.Passed {
+				return errors.New("backups reference objects or snapshots that don't exist")
+			}
+			return nil
+		}
+		time.Sleep(interval)
+	}
+}
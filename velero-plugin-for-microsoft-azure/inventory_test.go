@@ -0,0 +1,138 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/volume"
+)
+
+// fakeInventoryStore holds objects in memory.
+type fakeInventoryStore map[string][]byte
+
+func (s fakeInventoryStore) ObjectExists(_, key string) (bool, error) {
+	_, ok := s[key]
+	return ok, nil
+}
+
+func (s fakeInventoryStore) GetObject(_, key string) (io.ReadCloser, error) {
+	data, ok := s[key]
+	if !ok {
+		return nil, storage.AzureStorageServiceError{StatusCode: http.StatusNotFound}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s fakeInventoryStore) ListCommonPrefixes(_, prefix, delimiter string) ([]string, error) {
+	seen := map[string]bool{}
+	var prefixes []string
+	for key := range s {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, delimiter); i >= 0 && !seen[rest[:i]] {
+			seen[rest[:i]] = true
+			prefixes = append(prefixes, prefix+rest[:i+1])
+		}
+	}
+	return prefixes, nil
+}
+
+// fakeSnapshotsByName has the snapshots with the given names.
+type fakeSnapshotsByName map[string]bool
+
+func (s fakeSnapshotsByName) Get(_ context.Context, _ string, name string) (disk.Snapshot, error) {
+	if !s[name] {
+		return disk.Snapshot{}, autorest.DetailedError{StatusCode: http.StatusNotFound}
+	}
+	return disk.Snapshot{Name: &name}, nil
+}
+
+func TestInventoryReconciler(t *testing.T) {
+	snapshotsFile := func(ids ...string) []byte {
+		var snapshots []*volume.Snapshot
+		for i, id := range ids {
+			snapshots = append(snapshots, &volume.Snapshot{
+				Spec:   volume.SnapshotSpec{PersistentVolumeName: "pv-" + string(rune('a'+i))},
+				Status: volume.SnapshotStatus{ProviderSnapshotID: id, Phase: volume.SnapshotPhaseCompleted},
+			})
+		}
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		require.NoError(t, json.NewEncoder(gz).Encode(snapshots))
+		require.NoError(t, gz.Close())
+		return buf.Bytes()
+	}
+	snapshotID := func(name string) string {
+		return "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/" + name
+	}
+	completed := []byte(`{"status":{"phase":"Completed"}}`)
+
+	store := fakeInventoryStore{
+		// intact
+		"cluster-a/backups/b1/velero-backup.json":         completed,
+		"cluster-a/backups/b1/b1.tar.gz":                  nil,
+		"cluster-a/backups/b1/b1-volumesnapshots.json.gz": snapshotsFile(snapshotID("snap-1")),
+		// a snapshot and the contents are gone
+		"cluster-a/backups/b2/velero-backup.json":         completed,
+		"cluster-a/backups/b2/b2-volumesnapshots.json.gz": snapshotsFile(snapshotID("snap-2"), snapshotID("snap-3"), "aws-snap-4"),
+		// failed backups aren't restorable
+		"cluster-a/backups/b3/velero-backup.json": []byte(`{"status":{"phase":"Failed"}}`),
+	}
+
+	r := &inventoryReconciler{
+		log:        logrus.New(),
+		store:      store,
+		bucket:     "bucket",
+		prefix:     "cluster-a",
+		snapshots:  func(string) snapshotGetter { return fakeSnapshotsByName{"snap-1": true, "snap-2": true} },
+		apiTimeout: time.Minute,
+	}
+
+	report, err := r.reconcile("")
+	require.NoError(t, err)
+	assert.False(t, report.Passed)
+	assert.Equal(t, 3, report.Backups)
+	assert.Equal(t, 3, report.Snapshots)
+	assert.Equal(t, []inventoryBackup{{
+		Backup:           "b2",
+		MissingObjects:   []string{"cluster-a/backups/b2/b2.tar.gz"},
+		MissingSnapshots: []inventorySnapshot{{PersistentVolume: "pv-b", SnapshotID: snapshotID("snap-3")}},
+	}}, report.Dangling)
+
+	report, err = r.reconcile("b1")
+	require.NoError(t, err)
+	assert.True(t, report.Passed)
+	assert.Equal(t, 1, report.Backups)
+}
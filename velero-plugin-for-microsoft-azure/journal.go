@@ -0,0 +1,375 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	operationJournalConfigKey = "operationJournal"
+
+	journalPrefix        = pluginObjectsPrefix + "journal/"
+	journalSchemaVersion = 1
+
+	journalKindUpload       = "upload"
+	journalKindSnapshot     = "snapshot"
+	journalKindSnapshotTags = "snapshotTags"
+
+	// entries are heartbeated while their operation is in progress, and
+	// recovered once they haven't been for journalStaleAfter, i.e. once
+	// the plugin process running the operation has stopped.
+	journalHeartbeatInterval = time.Minute
+	journalStaleAfter        = 10 * time.Minute
+)
+
+// journalEntry records an operation in progress.
+type journalEntry struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	ID            string    `json:"id"`
+	Kind          string    `json:"kind"`
+	Target        string    `json:"target"`
+	Owner         string    `json:"owner"`
+	StartedAt     time.Time `json:"startedAt"`
+	HeartbeatAt   time.Time `json:"heartbeatAt"`
+	// Tags are the tags to apply to the target of a snapshotTags entry.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// operationJournal records the uploads and snapshots in progress as objects
+// under journalPrefix in a metadata store, so that those left unfinished by a
+// plugin process that stopped, e.g. because the Velero pod restarted, can be
+// recovered by another. Each operation has its own object, so that processes
+// never update the same object.
+type operationJournal struct {
+	log   logrus.FieldLogger
+	store *metadataStore
+	owner string
+	now   func() time.Time
+
+	lock         sync.Mutex
+	active       map[string]journalEntry
+	heartbeating bool
+}
+
+// getOperationJournal returns whether config.operationJournal is set.
+func getOperationJournal(config map[string]string) (bool, error) {
+	val := config[operationJournalConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	journal, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, operationJournalConfigKey)
+	}
+
+	return journal, nil
+}
+
+func newOperationJournal(log logrus.FieldLogger, store *metadataStore) *operationJournal {
+	hostname, _ := os.Hostname()
+
+	return &operationJournal{
+		log:    log,
+		store:  store,
+		owner:  fmt.Sprintf("%s/%d", hostname, os.Getpid()),
+		now:    time.Now,
+		active: map[string]journalEntry{},
+	}
+}
+
+func journalEntryName(id string) string {
+	return journalPrefix + id + ".json"
+}
+
+func (j *operationJournal) write(entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return j.store.put(journalEntryName(entry.ID), data)
+}
+
+// begin records the start of an operation of the given kind on target, and
+// returns the ID of its entry.
+func (j *operationJournal) begin(kind, target string) (string, error) {
+	now := j.now().UTC()
+	entry := journalEntry{
+		SchemaVersion: journalSchemaVersion,
+		ID:            uuid.NewV4().String(),
+		Kind:          kind,
+		Target:        target,
+		Owner:         j.owner,
+		StartedAt:     now,
+		HeartbeatAt:   now,
+	}
+	if err := j.write(entry); err != nil {
+		return "", errors.Wrap(err, "error writing operation journal entry")
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.active[entry.ID] = entry
+	if !j.heartbeating {
+		j.heartbeating = true
+		go j.heartbeat()
+	}
+
+	return entry.ID, nil
+}
+
+// schedule records an operation of the given kind on target to be run by
+// reconcile rather than by this process, e.g. one that failed and is worth
+// retrying. Its entry is never heartbeated, so it's recovered the next time
+// the journal is reconciled, and again after each failure.
+func (j *operationJournal) schedule(kind, target string, tags map[string]string) error {
+	now := j.now().UTC()
+	entry := journalEntry{
+		SchemaVersion: journalSchemaVersion,
+		ID:            uuid.NewV4().String(),
+		Kind:          kind,
+		Target:        target,
+		Owner:         j.owner,
+		StartedAt:     now,
+		HeartbeatAt:   now.Add(-journalStaleAfter),
+		Tags:          tags,
+	}
+	return errors.Wrap(j.write(entry), "error writing operation journal entry")
+}
+
+// end records that the operation with the given entry finished.
+func (j *operationJournal) end(id string) error {
+	j.release(id)
+	return errors.Wrap(j.store.delete(journalEntryName(id)), "error deleting operation journal entry")
+}
+
+// supersede deletes the entries of earlier operations of the same kind on
+// the same target as the given active entry, so that they're not recovered
+// once it ends, e.g. when a snapshot left unfinished by a stopped process was
+// adopted by a retry.
+func (j *operationJournal) supersede(id string) error {
+	j.lock.Lock()
+	entry, ok := j.active[id]
+	j.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	names, entries, err := j.entries()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		other := entries[name]
+		if other.ID == id || other.Kind != entry.Kind || other.Target != entry.Target || !other.StartedAt.Before(entry.StartedAt) {
+			continue
+		}
+		if err := j.store.delete(name); err != nil && !isNotFound(err) {
+			return errors.Wrap(err, "error deleting operation journal entry")
+		}
+	}
+	return nil
+}
+
+// abandon stops heartbeating the given entry without deleting it, so that
+// the operation is recovered as if this process had stopped. It's used for
+// failed operations that may have left resources behind.
+func (j *operationJournal) abandon(id string) {
+	j.release(id)
+}
+
+func (j *operationJournal) release(id string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.active, id)
+}
+
+// heartbeat updates the entries of the operations in progress until there
+// are none left.
+func (j *operationJournal) heartbeat() {
+	for {
+		time.Sleep(journalHeartbeatInterval)
+
+		j.lock.Lock()
+		if len(j.active) == 0 {
+			j.heartbeating = false
+			j.lock.Unlock()
+			return
+		}
+		now := j.now().UTC()
+		var entries []journalEntry
+		for id, entry := range j.active {
+			entry.HeartbeatAt = now
+			j.active[id] = entry
+			entries = append(entries, entry)
+		}
+		j.lock.Unlock()
+
+		for _, entry := range entries {
+			if err := j.write(entry); err != nil {
+				j.log.WithError(err).WithField("target", entry.Target).Warn("Error updating operation journal entry")
+			}
+		}
+	}
+}
+
+// entries returns the names of the readable entries in the journal, and the
+// entries by name.
+func (j *operationJournal) entries() ([]string, map[string]journalEntry, error) {
+	names, err := j.store.list(journalPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var readable []string
+	entries := make(map[string]journalEntry, len(names))
+	for _, name := range names {
+		data, err := j.store.get(name)
+		if err != nil {
+			if !isNotFound(err) {
+				j.log.WithError(err).WithField("entry", name).Warn("Error reading operation journal entry")
+			}
+			continue
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.SchemaVersion != journalSchemaVersion {
+			j.log.WithField("entry", name).Warn("Ignoring unreadable operation journal entry")
+			continue
+		}
+		readable = append(readable, name)
+		entries[name] = entry
+	}
+
+	return readable, entries, nil
+}
+
+// claimedLater returns whether an operation of the same kind on the same
+// target as the given entry was started after it.
+func claimedLater(entries map[string]journalEntry, entry journalEntry) bool {
+	for _, other := range entries {
+		if other.ID != entry.ID && other.Kind == entry.Kind && other.Target == entry.Target && other.StartedAt.After(entry.StartedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcile recovers the operations whose entries are stale with the given
+// functions, by kind, deleting the entries of those recovered. Entries of
+// other kinds, e.g. those of a volume snapshot location sharing the store,
+// are left alone.
+func (j *operationJournal) reconcile(recoverers map[string]func(journalEntry) error) error {
+	names, entries, err := j.entries()
+	if err != nil {
+		return err
+	}
+
+	now := j.now()
+	for _, name := range names {
+		entry := entries[name]
+
+		recover, ok := recoverers[entry.Kind]
+		if !ok || now.Sub(entry.HeartbeatAt) < journalStaleAfter {
+			continue
+		}
+
+		log := j.log.WithFields(logrus.Fields{"kind": entry.Kind, "target": entry.Target, "owner": entry.Owner, "startedAt": entry.StartedAt})
+
+		// a snapshot with a deterministic name may have been adopted by a
+		// later attempt to take it, which decides whether it's kept, and a
+		// blob may be being written by a later attempt to upload it
+		if claimedLater(entries, entry) {
+			log.Info("Leaving unfinished operation to a later attempt at it")
+			if err := j.store.delete(name); err != nil {
+				log.WithError(err).Warn("Error deleting operation journal entry")
+			}
+			continue
+		}
+
+		log.Info("Recovering operation left unfinished by a stopped plugin process")
+		if err := recover(entry); err != nil {
+			log.WithError(err).Warn("Error recovering unfinished operation")
+			continue
+		}
+		if err := j.store.delete(name); err != nil {
+			log.WithError(err).Warn("Error deleting operation journal entry")
+		}
+	}
+
+	return nil
+}
+
+// run reconciles the journal periodically, for as long as the process runs.
+func (j *operationJournal) run(recoverers map[string]func(journalEntry) error) {
+	for {
+		if err := j.reconcile(recoverers); err != nil {
+			j.log.WithError(err).Warn("Error reconciling operation journal")
+		}
+		time.Sleep(journalStaleAfter)
+	}
+}
+
+// recoverUpload reports the blocks staged by an unfinished upload of the
+// given blob. Discarding them takes committing a block list, which would
+// replace the blob's content, or that of a blob another process is writing,
+// so they're left for the storage service to discard, which it does a week
+// after they were staged.
+func recoverUpload(log logrus.FieldLogger, blobGetter blobGetter, bucket, key string) error {
+	blob, err := blobGetter.getBlob(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	blocks, err := blob.GetBlockList(storage.BlockListTypeUncommitted, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var size int64
+	for _, block := range blocks.UncommittedBlocks {
+		size += block.Size
+	}
+	if size > 0 {
+		log.WithFields(logrus.Fields{"key": key, "blocks": len(blocks.UncommittedBlocks), "bytes": size}).Info("Leaving the blocks staged by an unfinished upload for the storage service to discard within a week")
+	}
+	return nil
+}
+
+// splitUploadTarget returns the bucket and key of an upload's journal target.
+func splitUploadTarget(target string) (string, string, error) {
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid upload target %q", target)
+	}
+	return parts[0], parts[1], nil
+}
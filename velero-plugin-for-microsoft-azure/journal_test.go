@@ -0,0 +1,241 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestOperationJournal(blobs *memBlobs, now time.Time) *operationJournal {
+	journal := newOperationJournal(logrus.New(), &metadataStore{containers: blobs, blobGetter: blobs, bucket: "bucket", prefix: "velero"})
+	journal.now = func() time.Time { return now }
+	return journal
+}
+
+func TestGetOperationJournal(t *testing.T) {
+	journal, err := getOperationJournal(map[string]string{})
+	require.NoError(t, err)
+	assert.False(t, journal)
+
+	journal, err = getOperationJournal(map[string]string{operationJournalConfigKey: "true"})
+	require.NoError(t, err)
+	assert.True(t, journal)
+
+	_, err = getOperationJournal(map[string]string{operationJournalConfigKey: "maybe"})
+	assert.Error(t, err)
+}
+
+func TestOperationJournalBeginEnd(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	blobs := newMemBlobs(now)
+	journal := newTestOperationJournal(blobs, now)
+
+	id, err := journal.begin(journalKindUpload, "bucket/backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+
+	key := "velero/" + journalEntryName(id)
+	require.Contains(t, blobs.data, key)
+	var entry journalEntry
+	require.NoError(t, json.Unmarshal(blobs.data[key], &entry))
+	assert.Equal(t, journalEntry{
+		SchemaVersion: journalSchemaVersion,
+		ID:            id,
+		Kind:          journalKindUpload,
+		Target:        "bucket/backups/b1/b1.tar.gz",
+		Owner:         journal.owner,
+		StartedAt:     now,
+		HeartbeatAt:   now,
+	}, entry)
+
+	require.NoError(t, journal.end(id))
+	assert.NotContains(t, blobs.data, key)
+	assert.Empty(t, journal.active)
+}
+
+func TestOperationJournalAbandonKeepsEntry(t *testing.T) {
+	now := time.Now()
+	blobs := newMemBlobs(now)
+	journal := newTestOperationJournal(blobs, now)
+
+	id, err := journal.begin(journalKindSnapshot, "snapshot-id")
+	require.NoError(t, err)
+
+	journal.abandon(id)
+	assert.Contains(t, blobs.data, "velero/"+journalEntryName(id))
+	assert.Empty(t, journal.active)
+}
+
+func TestOperationJournalSchedule(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	blobs := newMemBlobs(now)
+	journal := newTestOperationJournal(blobs, now)
+
+	require.NoError(t, journal.schedule(journalKindSnapshotTags, "snapshot-id", map[string]string{"velero.io/backup": "b1"}))
+	assert.Empty(t, journal.active)
+
+	// scheduled operations are run by the next reconciliation, and again
+	// until they succeed
+	var tags []map[string]string
+	recoverers := map[string]func(journalEntry) error{
+		journalKindSnapshotTags: func(entry journalEntry) error {
+			tags = append(tags, entry.Tags)
+			if len(tags) == 1 {
+				return errors.New("boom")
+			}
+			return nil
+		},
+	}
+	require.NoError(t, journal.reconcile(recoverers))
+	require.NoError(t, journal.reconcile(recoverers))
+	assert.Equal(t, []map[string]string{{"velero.io/backup": "b1"}, {"velero.io/backup": "b1"}}, tags)
+	assert.Empty(t, blobs.data)
+}
+
+func TestOperationJournalReconcile(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	blobs := newMemBlobs(now)
+
+	putEntry := func(id, kind, target string, heartbeat time.Time) {
+		data, err := json.Marshal(journalEntry{SchemaVersion: journalSchemaVersion, ID: id, Kind: kind, Target: target, HeartbeatAt: heartbeat})
+		require.NoError(t, err)
+		blobs.put("velero/"+journalEntryName(id), string(data), heartbeat)
+	}
+	putEntry("stale", journalKindUpload, "bucket/stale", now.Add(-journalStaleAfter))
+	putEntry("fresh", journalKindUpload, "bucket/fresh", now.Add(-time.Minute))
+	putEntry("failing", journalKindUpload, "bucket/failing", now.Add(-time.Hour))
+	putEntry("other-kind", journalKindSnapshot, "snapshot-id", now.Add(-time.Hour))
+	blobs.put("velero/"+journalEntryName("garbage"), "not json", now)
+
+	var recovered []string
+	journal := newTestOperationJournal(blobs, now)
+	require.NoError(t, journal.reconcile(map[string]func(journalEntry) error{
+		journalKindUpload: func(entry journalEntry) error {
+			recovered = append(recovered, entry.Target)
+			if entry.ID == "failing" {
+				return errors.New("boom")
+			}
+			return nil
+		},
+	}))
+
+	assert.ElementsMatch(t, []string{"bucket/stale", "bucket/failing"}, recovered)
+	assert.NotContains(t, blobs.data, "velero/"+journalEntryName("stale"))
+	for _, id := range []string{"fresh", "failing", "other-kind", "garbage"} {
+		assert.Contains(t, blobs.data, "velero/"+journalEntryName(id), id)
+	}
+}
+
+func TestOperationJournalReconcileLeavesClaimedOperations(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	blobs := newMemBlobs(now)
+
+	putEntry := func(id, kind, target string, started time.Time) {
+		data, err := json.Marshal(journalEntry{SchemaVersion: journalSchemaVersion, ID: id, Kind: kind, Target: target, StartedAt: started, HeartbeatAt: started})
+		require.NoError(t, err)
+		blobs.put("velero/"+journalEntryName(id), string(data), started)
+	}
+	putEntry("crashed", journalKindSnapshot, "adopted-snapshot", now.Add(-time.Hour))
+	putEntry("retry", journalKindSnapshot, "adopted-snapshot", now.Add(-time.Minute))
+	putEntry("abandoned", journalKindSnapshot, "abandoned-snapshot", now.Add(-time.Hour))
+	putEntry("crashed-upload", journalKindUpload, "bucket/retried", now.Add(-time.Hour))
+	putEntry("retried-upload", journalKindUpload, "bucket/retried", now.Add(-time.Minute))
+
+	var recovered []string
+	record := func(entry journalEntry) error {
+		recovered = append(recovered, entry.Target)
+		return nil
+	}
+	journal := newTestOperationJournal(blobs, now)
+	require.NoError(t, journal.reconcile(map[string]func(journalEntry) error{
+		journalKindSnapshot: record,
+		journalKindUpload:   record,
+	}))
+
+	// a blob may be being written by the retry, so it's left alone too
+	assert.Equal(t, []string{"abandoned-snapshot"}, recovered)
+	assert.NotContains(t, blobs.data, "velero/"+journalEntryName("crashed"))
+	assert.NotContains(t, blobs.data, "velero/"+journalEntryName("crashed-upload"))
+	assert.Contains(t, blobs.data, "velero/"+journalEntryName("retry"))
+	assert.Contains(t, blobs.data, "velero/"+journalEntryName("retried-upload"))
+}
+
+func TestOperationJournalSupersede(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	blobs := newMemBlobs(now)
+
+	putEntry := func(id, kind, target string, started time.Time) {
+		data, err := json.Marshal(journalEntry{SchemaVersion: journalSchemaVersion, ID: id, Kind: kind, Target: target, StartedAt: started, HeartbeatAt: started})
+		require.NoError(t, err)
+		blobs.put("velero/"+journalEntryName(id), string(data), started)
+	}
+	putEntry("crashed", journalKindSnapshot, "snapshot-id", now.Add(-time.Hour))
+	putEntry("other-target", journalKindSnapshot, "other-snapshot-id", now.Add(-time.Hour))
+	putEntry("other-kind", journalKindUpload, "snapshot-id", now.Add(-time.Hour))
+
+	journal := newTestOperationJournal(blobs, now)
+	id, err := journal.begin(journalKindSnapshot, "snapshot-id")
+	require.NoError(t, err)
+	require.NoError(t, journal.supersede(id))
+	require.NoError(t, journal.end(id))
+
+	assert.NotContains(t, blobs.data, "velero/"+journalEntryName("crashed"))
+	for _, id := range []string{"other-target", "other-kind"} {
+		assert.Contains(t, blobs.data, "velero/"+journalEntryName(id), id)
+	}
+}
+
+func TestRecoverUpload(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	defer blobGetter.AssertExpectations(t)
+
+	// the staged blocks are only reported, since the blob may be being
+	// written by a retried upload
+	staged := new(mockBlob)
+	defer staged.AssertExpectations(t)
+	staged.On("GetBlockList", storage.BlockListTypeUncommitted, (*storage.GetBlockListOptions)(nil)).Return(storage.BlockListResponse{
+		UncommittedBlocks: []storage.BlockResponse{{Name: "a", Size: 4}, {Name: "b", Size: 2}},
+	}, nil)
+	blobGetter.On("getBlob", "bucket", "backups/b1/b1.tar.gz").Return(staged, nil)
+	require.NoError(t, recoverUpload(logrus.New(), blobGetter, "bucket", "backups/b1/b1.tar.gz"))
+
+	// a blob without a staged block has nothing to report
+	missing := new(mockBlob)
+	missing.On("GetBlockList", storage.BlockListTypeUncommitted, (*storage.GetBlockListOptions)(nil)).Return(storage.BlockListResponse{}, storage.AzureStorageServiceError{StatusCode: http.StatusNotFound})
+	blobGetter.On("getBlob", "bucket", "backups/b2/b2.tar.gz").Return(missing, nil)
+	require.NoError(t, recoverUpload(logrus.New(), blobGetter, "bucket", "backups/b2/b2.tar.gz"))
+}
+
+func TestSplitUploadTarget(t *testing.T) {
+	bucket, key, err := splitUploadTarget("bucket/backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, "bucket", bucket)
+	assert.Equal(t, "backups/b1/b1.tar.gz", key)
+
+	for _, target := range []string{"", "bucket", "bucket/", "/key"} {
+		_, _, err := splitUploadTarget(target)
+		assert.Error(t, err, target)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	latencyBaselineConfigKey = "latencyBaseline"
+
+	heartbeatObjectName    = pluginObjectsPrefix + "heartbeat.json"
+	latencyProbeName       = pluginObjectsPrefix + "latency-probe"
+	latencyProbeSize       = 4 * 1024
+	heartbeatSchemaVersion = 1
+
+	// a latency deviates from its baseline when it's more than
+	// latencyDeviationFactor times the baseline, and more than
+	// minLatencyDeviation above it, so that jitter in very short requests
+	// isn't reported
+	latencyDeviationFactor = 3
+	minLatencyDeviation    = 100 * time.Millisecond
+
+	// latencyBaselineWeight is the weight of each measurement that doesn't
+	// deviate in the baseline, so that the baseline follows gradual changes
+	// but not sudden ones.
+	latencyBaselineWeight = 0.1
+)
+
+// latencySample is the latency of a round trip to the storage service, and
+// of the upload and download of a small object, in seconds.
+type latencySample struct {
+	RTTSeconds float64 `json:"rttSeconds"`
+	PutSeconds float64 `json:"putSeconds"`
+	GetSeconds float64 `json:"getSeconds"`
+}
+
+// heartbeat is the content of the heartbeat object.
+type heartbeat struct {
+	SchemaVersion int           `json:"schemaVersion"`
+	UpdatedAt     time.Time     `json:"updatedAt"`
+	Baseline      latencySample `json:"baseline"`
+	Latest        latencySample `json:"latest"`
+}
+
+// getLatencyBaseline returns whether config.latencyBaseline is set.
+func getLatencyBaseline(config map[string]string) (bool, error) {
+	val := config[latencyBaselineConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, latencyBaselineConfigKey)
+	}
+
+	return enabled, nil
+}
+
+// latencyBaseline measures the latency of the storage service and compares
+// it with the baseline kept in the location's heartbeat object, so that a
+// location that suddenly became slower is reported when the plugin starts.
+type latencyBaseline struct {
+	log   logrus.FieldLogger
+	store *metadataStore
+	now   func() time.Time
+}
+
+// timed returns how long fn took to run, in seconds.
+func (b *latencyBaseline) timed(fn func() error) (float64, error) {
+	start := b.now()
+	err := fn()
+	return b.now().Sub(start).Seconds(), err
+}
+
+// measure returns the current latency of the storage service: that of
+// checking whether the probe object exists, then of uploading and
+// downloading it.
+func (b *latencyBaseline) measure() (latencySample, error) {
+	var sample latencySample
+
+	probe, err := b.store.blobGetter.getBlob(b.store.bucket, b.store.key(latencyProbeName))
+	if err != nil {
+		return sample, err
+	}
+	if sample.RTTSeconds, err = b.timed(func() error {
+		_, err := probe.Exists()
+		return errors.WithStack(err)
+	}); err != nil {
+		return sample, err
+	}
+
+	data := bytes.Repeat([]byte{'0'}, latencyProbeSize)
+	if sample.PutSeconds, err = b.timed(func() error {
+		return b.store.put(latencyProbeName, data)
+	}); err != nil {
+		return sample, err
+	}
+	if sample.GetSeconds, err = b.timed(func() error {
+		_, err := b.store.get(latencyProbeName)
+		return err
+	}); err != nil {
+		return sample, err
+	}
+
+	return sample, nil
+}
+
+// latencyDeviations returns a description of each latency in current that
+// deviates from its baseline.
+func latencyDeviations(baseline, current latencySample) []string {
+	var deviations []string
+	check := func(name string, baseline, current float64) {
+		if current > baseline*latencyDeviationFactor && current-baseline > minLatencyDeviation.Seconds() {
+			deviations = append(deviations, fmt.Sprintf("%s took %.3fs, baseline %.3fs", name, current, baseline))
+		}
+	}
+	check("round trip", baseline.RTTSeconds, current.RTTSeconds)
+	check("small object upload", baseline.PutSeconds, current.PutSeconds)
+	check("small object download", baseline.GetSeconds, current.GetSeconds)
+	return deviations
+}
+
+// blend returns baseline moved towards current by latencyBaselineWeight.
+func (s latencySample) blend(current latencySample) latencySample {
+	mix := func(baseline, current float64) float64 {
+		return baseline*(1-latencyBaselineWeight) + current*latencyBaselineWeight
+	}
+	return latencySample{
+		RTTSeconds: mix(s.RTTSeconds, current.RTTSeconds),
+		PutSeconds: mix(s.PutSeconds, current.PutSeconds),
+		GetSeconds: mix(s.GetSeconds, current.GetSeconds),
+	}
+}
+
+// check measures the current latency, warns if it deviates from the
+// baseline, and records it in the heartbeat object. The first measurement
+// becomes the baseline, and later ones that don't deviate are blended into
+// it.
+func (b *latencyBaseline) check() error {
+	current, err := b.measure()
+	if err != nil {
+		return err
+	}
+
+	beat := heartbeat{Baseline: current}
+	data, err := b.store.get(heartbeatObjectName)
+	switch {
+	case err == nil:
+		var previous heartbeat
+		if err := json.Unmarshal(data, &previous); err != nil {
+			b.log.WithError(err).Warn("Unable to parse the heartbeat object, resetting the latency baseline")
+			break
+		}
+		if deviations := latencyDeviations(previous.Baseline, current); len(deviations) > 0 {
+			for _, deviation := range deviations {
+				b.log.WithField("since", previous.UpdatedAt).Warnf("Storage latency deviates from its baseline: %s", deviation)
+			}
+			beat.Baseline = previous.Baseline
+		} else {
+			beat.Baseline = previous.Baseline.blend(current)
+		}
+	case !isNotFound(err):
+		return err
+	}
+
+	b.log.WithFields(logrus.Fields{
+		"rttSeconds": current.RTTSeconds,
+		"putSeconds": current.PutSeconds,
+		"getSeconds": current.GetSeconds,
+	}).Debug("Measured storage latency")
+
+	beat.SchemaVersion = heartbeatSchemaVersion
+	beat.UpdatedAt = b.now().UTC()
+	beat.Latest = current
+	data, err = json.Marshal(beat)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return b.store.put(heartbeatObjectName, data)
+}
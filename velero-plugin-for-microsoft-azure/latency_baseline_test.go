@@ -0,0 +1,84 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyBaselineCheck(t *testing.T) {
+	blobs := newMemBlobs(time.Now())
+	log, hook := test.NewNullLogger()
+
+	// each request takes step, since the clock is read before and after it
+	now, step := time.Date(2020, 10, 15, 0, 0, 0, 0, time.UTC), 50*time.Millisecond
+	baseline := &latencyBaseline{
+		log:   log,
+		store: &metadataStore{blobGetter: blobs, bucket: "bucket", prefix: "velero"},
+		now: func() time.Time {
+			now = now.Add(step)
+			return now
+		},
+	}
+	read := func() heartbeat {
+		var beat heartbeat
+		require.NoError(t, json.Unmarshal(blobs.data["velero/"+heartbeatObjectName], &beat))
+		return beat
+	}
+
+	// the first measurement is the baseline
+	require.NoError(t, baseline.check())
+	assert.Len(t, blobs.data["velero/"+latencyProbeName], latencyProbeSize)
+	beat := read()
+	assert.InDelta(t, 0.05, beat.Baseline.RTTSeconds, 1e-9)
+	assert.Equal(t, beat.Baseline, beat.Latest)
+	assert.Empty(t, hook.AllEntries())
+
+	// measurements that don't deviate are blended into the baseline
+	step = 100 * time.Millisecond
+	require.NoError(t, baseline.check())
+	beat = read()
+	assert.InDelta(t, 0.055, beat.Baseline.PutSeconds, 1e-9)
+	assert.InDelta(t, 0.1, beat.Latest.PutSeconds, 1e-9)
+	assert.Empty(t, hook.AllEntries())
+
+	// those that deviate are reported, and leave the baseline as it was
+	step = time.Second
+	require.NoError(t, baseline.check())
+	beat = read()
+	assert.InDelta(t, 0.055, beat.Baseline.GetSeconds, 1e-9)
+	assert.InDelta(t, 1, beat.Latest.GetSeconds, 1e-9)
+	require.Len(t, hook.AllEntries(), 3)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Equal(t, "Storage latency deviates from its baseline: small object download took 1.000s, baseline 0.055s", hook.LastEntry().Message)
+}
+
+func TestLatencyDeviations(t *testing.T) {
+	baseline := latencySample{RTTSeconds: 0.01, PutSeconds: 0.2, GetSeconds: 0.1}
+
+	// short requests that are slower by less than minLatencyDeviation don't deviate
+	assert.Empty(t, latencyDeviations(baseline, latencySample{RTTSeconds: 0.1, PutSeconds: 0.5, GetSeconds: 0.25}))
+	assert.Equal(t, []string{"round trip took 0.200s, baseline 0.010s", "small object upload took 0.700s, baseline 0.200s"},
+		latencyDeviations(baseline, latencySample{RTTSeconds: 0.2, PutSeconds: 0.7, GetSeconds: 0.1}))
+}
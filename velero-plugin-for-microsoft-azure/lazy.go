@@ -0,0 +1,157 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// authenticationFailedCode is the storage error code of requests whose
+// signature doesn't match the account's current keys.
+const authenticationFailedCode = "AuthenticationFailed"
+
+// lazyBlobService connects to a storage account's blob service on first use
+// rather than when a plugin is initialized. Looking up the account's key takes
+// AAD and ARM round trips, and Velero initializes plugins for every operation,
+// and every location at startup.
+type lazyBlobService struct {
+	connect func() (*storage.Client, *storageCredential, error)
+
+	lock       sync.Mutex
+	client     *storage.Client
+	service    *storage.BlobStorageClient
+	credential *storageCredential
+}
+
+func newLazyBlobService(connect func() (*storage.Client, *storageCredential, error)) *lazyBlobService {
+	return &lazyBlobService{connect: connect}
+}
+
+// get returns the blob service and the credential it's authorized with,
+// connecting if it hasn't yet. Failures aren't remembered, so the next call
+// tries again.
+func (s *lazyBlobService) get() (*storage.BlobStorageClient, *storageCredential, error) {
+	_, service, credential, err := s.connected()
+	return service, credential, err
+}
+
+// getClient returns the storage client the blob service was made from, for
+// requests the blob service has no operation for, and the credential it's
+// authorized with, connecting if it hasn't yet.
+func (s *lazyBlobService) getClient() (*storage.Client, *storageCredential, error) {
+	client, _, credential, err := s.connected()
+	return client, credential, err
+}
+
+func (s *lazyBlobService) connected() (*storage.Client, *storage.BlobStorageClient, *storageCredential, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.service == nil {
+		client, credential, err := s.connect()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		service := client.GetBlobService()
+		s.client, s.service, s.credential = client, &service, credential
+	}
+	return s.client, s.service, s.credential, nil
+}
+
+// invalidate discards the connection authorized with the given credential, so
+// that the next call to get connects again with a fresh credential. Calls for
+// credentials that were already replaced are ignored.
+func (s *lazyBlobService) invalidate(credential *storageCredential) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.credential == credential {
+		s.client, s.service, s.credential = nil, nil, nil
+	}
+}
+
+// staleKeySender returns a storage sender that invalidates the connection when
+// a request signed with the credential's account key is rejected as
+// unauthenticated, e.g. because the key was rotated, so that the following
+// requests are signed with the key looked up again. Credentials without
+// account keys are left to next.
+func (s *lazyBlobService) staleKeySender(log logrus.FieldLogger, credential *storageCredential, next storage.Sender) storage.Sender {
+	if credential.accountKey == "" {
+		return next
+	}
+	return &staleKeySender{
+		next: next,
+		onStaleKey: func() {
+			log.Warn("Storage account key was rejected, it may have been rotated. Looking it up again for the next requests")
+			s.invalidate(credential)
+		},
+	}
+}
+
+type staleKeySender struct {
+	next       storage.Sender
+	onStaleKey func()
+}
+
+func (s *staleKeySender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	resp, err := s.next.Send(c, req)
+	if resp != nil && resp.StatusCode == http.StatusForbidden && resp.Header.Get("x-ms-error-code") == authenticationFailedCode {
+		s.onStaleKey()
+	}
+	return resp, err
+}
+
+// warmUp connects in the background, so that plugins for many locations
+// connect concurrently rather than one after another, and the first
+// operation doesn't wait for the whole connection.
+func (s *lazyBlobService) warmUp(log logrus.FieldLogger) {
+	go func() {
+		if _, _, err := s.get(); err != nil {
+			log.WithError(err).Debug("Unable to connect to the storage account ahead of use")
+		}
+	}()
+}
+
+// lazyBlobGetter gets blobs from a lazily connected blob service.
+type lazyBlobGetter struct {
+	service *lazyBlobService
+}
+
+func (g *lazyBlobGetter) getBlob(bucket, key string) (blob, error) {
+	service, _, err := g.service.get()
+	if err != nil {
+		return nil, err
+	}
+	return (&azureBlobGetter{blobService: service}).getBlob(bucket, key)
+}
+
+// lazyContainerGetter gets containers from a lazily connected blob service.
+type lazyContainerGetter struct {
+	service *lazyBlobService
+}
+
+func (g *lazyContainerGetter) getContainer(bucket string) (container, error) {
+	service, _, err := g.service.get()
+	if err != nil {
+		return nil, err
+	}
+	return (&azureContainerGetter{blobService: service}).getContainer(bucket)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLazyBlobService(t *testing.T) {
+	client, err := storage.NewBasicClient("account", "a2V5")
+	require.NoError(t, err)
+
+	var (
+		lock  sync.Mutex
+		calls int
+		fail  = true
+	)
+	service := newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		if fail {
+			return nil, nil, errors.New("no key")
+		}
+		return &client, &storageCredential{accountKey: "a2V5"}, nil
+	})
+
+	// nothing is connected until first use
+	assert.Equal(t, 0, calls)
+
+	// failures are returned, and not remembered
+	_, err = (&lazyBlobGetter{service: service}).getBlob("b", "key")
+	assert.EqualError(t, err, "no key")
+	_, err = (&lazyContainerGetter{service: service}).getContainer("b")
+	assert.EqualError(t, err, "no key")
+	assert.Equal(t, 2, calls)
+
+	// concurrent first uses connect once
+	fail = false
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := (&lazyBlobGetter{service: service}).getBlob("b", "key")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 3, calls)
+
+	_, credential, err := service.get()
+	require.NoError(t, err)
+	assert.Equal(t, "a2V5", credential.accountKey)
+	assert.Equal(t, 3, calls)
+}
+
+type stubSender struct {
+	resp *http.Response
+}
+
+func (s *stubSender) Send(_ *storage.Client, _ *http.Request) (*http.Response, error) {
+	return s.resp, nil
+}
+
+func TestLazyBlobServiceStaleKey(t *testing.T) {
+	client, err := storage.NewBasicClient("account", "a2V5")
+	require.NoError(t, err)
+
+	calls := 0
+	service := newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+		calls++
+		return &client, &storageCredential{accountKey: "a2V5"}, nil
+	})
+	_, credential, err := service.get()
+	require.NoError(t, err)
+
+	forbidden := func(code string) *http.Response {
+		return &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{"X-Ms-Error-Code": []string{code}}}
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://account.blob.core.windows.net/b/key", nil)
+	require.NoError(t, err)
+
+	// other authorization failures keep the connection
+	_, err = service.staleKeySender(logrus.New(), credential, &stubSender{resp: forbidden("AuthorizationPermissionMismatch")}).Send(&client, req)
+	require.NoError(t, err)
+	_, _, err = service.get()
+	require.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	// a rejected key is looked up again by the next request
+	_, err = service.staleKeySender(logrus.New(), credential, &stubSender{resp: forbidden(authenticationFailedCode)}).Send(&client, req)
+	require.NoError(t, err)
+	_, fresh, err := service.get()
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.False(t, credential == fresh)
+
+	// requests of replaced connections don't invalidate the current one
+	service.invalidate(credential)
+	_, _, err = service.get()
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	// credentials without keys aren't affected
+	next := &stubSender{}
+	assert.Equal(t, next, service.staleKeySender(logrus.New(), &storageCredential{sasToken: "sig=abc"}, next))
+}
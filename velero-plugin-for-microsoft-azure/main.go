@@ -17,16 +17,24 @@ limitations under the License.
 package main
 
 import (
+	"os"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
 )
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
 	veleroplugin.NewServer().
 		BindFlags(pflag.CommandLine).
 		RegisterObjectStore("velero.io/azure", newAzureObjectStore).
 		RegisterVolumeSnapshotter("velero.io/azure", newAzureVolumeSnapshotter).
+		RegisterRestoreItemAction("velero.io/azure-byo-snapshot", newAzureBYOSnapshotRestoreAction).
+		RegisterRestoreItemAction("velero.io/azure-container-storage", newAzureContainerStorageRestoreAction).
 		Serve()
 }
 
@@ -37,3 +45,11 @@ func newAzureObjectStore(logger logrus.FieldLogger) (interface{}, error) {
 func newAzureVolumeSnapshotter(logger logrus.FieldLogger) (interface{}, error) {
 	return newVolumeSnapshotter(logger), nil
 }
+
+func newAzureBYOSnapshotRestoreAction(logger logrus.FieldLogger) (interface{}, error) {
+	return newBYOSnapshotRestoreAction(logger), nil
+}
+
+func newAzureContainerStorageRestoreAction(logger logrus.FieldLogger) (interface{}, error) {
+	return newContainerStorageRestoreAction(logger), nil
+}
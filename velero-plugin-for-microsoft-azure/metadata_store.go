@@ -0,0 +1,194 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+)
+
+const (
+	metadataStorageAccountConfigKey          = "metadataStorageAccount"
+	metadataStorageAccountKeyEnvVarConfigKey = "metadataStorageAccountKeyEnvVar"
+	metadataResourceGroupConfigKey           = "metadataResourceGroup"
+	metadataBucketConfigKey                  = "metadataBucket"
+	metadataPrefixConfigKey                  = "metadataPrefix"
+)
+
+// metadataStore is a blob container the volume snapshotter writes supplementary
+// metadata to, typically the container of the backup storage location.
+type metadataStore struct {
+	containers containerGetter
+	blobGetter blobGetter
+	bucket     string
+	prefix     string
+}
+
+// newMetadataStore returns the metadata store configured in the volume
+// snapshot location's config, or nil if none is configured.
+func newMetadataStore(config map[string]string, env *azure.Environment) (*metadataStore, error) {
+	bucket := config[metadataBucketConfigKey]
+	if bucket == "" {
+		return nil, nil
+	}
+	if _, err := getRequiredValues(mapLookup(config), metadataStorageAccountConfigKey); err != nil {
+		return nil, errors.Wrapf(err, "unable to get all required config values for config.%s", metadataBucketConfigKey)
+	}
+
+	// translate the metadata keys to their object store equivalents so the
+	// storage account is accessed the same way a backup storage location would
+	objectStoreConfig := map[string]string{
+		storageAccountConfigKey:          config[metadataStorageAccountConfigKey],
+		storageAccountKeyEnvVarConfigKey: config[metadataStorageAccountKeyEnvVarConfigKey],
+		resourceGroupConfigKey:           config[metadataResourceGroupConfigKey],
+	}
+
+	credentials, err := newCredentialProvider(objectStoreConfig, env)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key may have to be looked up using the ARM API, so connect on first
+	// use rather than for every operation
+	blobService := newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+		credential, err := getStorageAccountCredential(credentials, objectStoreConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		storageClient, err := newStorageClient(objectStoreConfig[storageAccountConfigKey], credential, env, "")
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error getting metadata storage client")
+		}
+		return &storageClient, credential, nil
+	})
+
+	return &metadataStore{
+		containers: &lazyContainerGetter{service: blobService},
+		blobGetter: &lazyBlobGetter{service: blobService},
+		bucket:     bucket,
+		prefix:     config[metadataPrefixConfigKey],
+	}, nil
+}
+
+func (s *metadataStore) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *metadataStore) put(name string, data []byte) error {
+	blob, err := s.blobGetter.getBlob(s.bucket, s.key(name))
+	if err != nil {
+		return err
+	}
+
+	return errors.WithStack(blob.CreateBlockBlobFromReader(bytes.NewReader(data), nil))
+}
+
+func (s *metadataStore) get(name string) ([]byte, error) {
+	blob, err := s.blobGetter.getBlob(s.bucket, s.key(name))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := blob.Get(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer res.Close()
+
+	data, err := ioutil.ReadAll(res)
+	return data, errors.WithStack(err)
+}
+
+// list returns the names of the objects whose names start with prefix,
+// relative to the store's prefix.
+func (s *metadataStore) list(prefix string) ([]string, error) {
+	container, err := s.containers.getContainer(s.bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	base := s.key("")
+	if base != "" {
+		base += "/"
+	}
+	params := storage.ListBlobsParameters{Prefix: base + prefix}
+
+	var names []string
+	for {
+		res, err := container.ListBlobs(params)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, blob := range res.Blobs {
+			names = append(names, strings.TrimPrefix(blob.Name, base))
+		}
+		if res.NextMarker == "" {
+			break
+		}
+		params.Marker = res.NextMarker
+	}
+	return names, nil
+}
+
+// delete removes the named object, ignoring objects that don't exist.
+func (s *metadataStore) delete(name string) error {
+	blob, err := s.blobGetter.getBlob(s.bucket, s.key(name))
+	if err != nil {
+		return err
+	}
+
+	if err := blob.Delete(nil); err != nil && !isNotFound(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// append appends data to the named append blob, creating it if it doesn't
+// exist.
+func (s *metadataStore) append(name string, data []byte) error {
+	blob, err := s.blobGetter.getBlob(s.bucket, s.key(name))
+	if err != nil {
+		return err
+	}
+
+	err = blob.AppendBlock(data, nil)
+	if !isNotFound(err) {
+		return errors.WithStack(err)
+	}
+
+	// don't replace a blob created concurrently by another writer
+	if err := blob.PutAppendBlob(&storage.PutBlobOptions{IfNoneMatch: "*"}); err != nil && !isAppendConflict(err) {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(blob.AppendBlock(data, nil))
+}
+
+// isAppendConflict returns whether err means that an append blob already
+// exists.
+func isAppendConflict(err error) bool {
+	code := storageErrorStatusCode(err)
+	return code == http.StatusConflict || code == http.StatusPreconditionFailed
+}
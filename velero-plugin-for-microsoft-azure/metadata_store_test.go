@@ -0,0 +1,62 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMetadataStoreNotConfigured(t *testing.T) {
+	store, err := newMetadataStore(map[string]string{}, &azure.PublicCloud)
+	require.NoError(t, err)
+	assert.Nil(t, store)
+
+	_, err = newMetadataStore(map[string]string{metadataBucketConfigKey: "bucket"}, &azure.PublicCloud)
+	assert.EqualError(t, err, "unable to get all required config values for config.metadataBucket: the following keys do not have values: metadataStorageAccount")
+}
+
+func TestMetadataStore(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	defer blobGetter.AssertExpectations(t)
+
+	store := &metadataStore{blobGetter: blobGetter, bucket: "bucket", prefix: "velero"}
+
+	blob := new(mockBlob)
+	defer blob.AssertExpectations(t)
+	blobGetter.On("getBlob", "bucket", "velero/snapshots/snap.json").Return(blob, nil)
+
+	blob.On("CreateBlockBlobFromReader", mock.Anything, (*storage.PutBlobOptions)(nil)).Return(nil)
+	require.NoError(t, store.put("snapshots/snap.json", []byte("data")))
+
+	blob.On("Get", mock.Anything).Return(ioutil.NopCloser(strings.NewReader("data")), nil)
+	data, err := store.get("snapshots/snap.json")
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	// deleting an object that doesn't exist isn't an error
+	blob.On("Delete", mock.Anything).Return(storage.AzureStorageServiceError{StatusCode: http.StatusNotFound})
+	require.NoError(t, store.delete("snapshots/snap.json"))
+}
@@ -0,0 +1,143 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	metricsBindAddressConfigKey = "metricsBindAddress"
+
+	uploadStageRead       = "read"
+	uploadStageStageBlock = "stageBlock"
+	uploadStageCommit     = "commit"
+
+	// uploads larger than this report their progress, once per
+	// uploadProgressInterval, so slow uploads can be told from hung ones
+	uploadProgressThreshold = 1024 * 1024 * 1024
+	uploadProgressInterval  = time.Minute
+)
+
+// plugin metrics, published in expvar format at /debug/vars on the
+// metrics bind address
+var (
+	uploadStageSeconds = expvar.NewMap("azure_upload_stage_seconds")
+	uploadBytes        = expvar.NewInt("azure_upload_bytes")
+	uploadBlocks       = expvar.NewInt("azure_upload_blocks")
+	uploadObjects      = expvar.NewInt("azure_upload_objects")
+
+	// the bytes uploaded so far by each large upload in progress, by object
+	uploadInProgressBytes = expvar.NewMap("azure_upload_in_progress_bytes")
+)
+
+// startMetricsServer serves the plugin's metrics on the given address. It's
+// started at most once per address per plugin process.
+func startMetricsServer(log logrus.FieldLogger, addr string) {
+	startBackgroundTask("metrics-server/"+addr, func() {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+
+		log.Infof("Serving metrics on %s/debug/vars", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.WithError(err).Error("Error serving metrics")
+		}
+	})
+}
+
+// uploadTimings accumulates the time a single PutObject spends in each stage
+// of the upload, to tell whether throughput is limited by the producer of the
+// data (read), the network and storage service (stageBlock) or the final
+// commit of the block list.
+type uploadTimings struct {
+	stages map[string]time.Duration
+	bytes  int64
+	blocks int64
+
+	started      time.Time
+	lastProgress time.Time
+	progress     *expvar.Int
+}
+
+func newUploadTimings() *uploadTimings {
+	now := time.Now()
+	return &uploadTimings{stages: map[string]time.Duration{}, started: now, lastProgress: now}
+}
+
+// reportProgress publishes the progress of the upload of the given object
+// once it's larger than uploadProgressThreshold, and logs it at most once per
+// uploadProgressInterval.
+func (t *uploadTimings) reportProgress(log logrus.FieldLogger, object string, now time.Time) {
+	if t.bytes < uploadProgressThreshold {
+		return
+	}
+
+	if t.progress == nil {
+		t.progress = new(expvar.Int)
+		uploadInProgressBytes.Set(object, t.progress)
+	}
+	t.progress.Set(t.bytes)
+
+	if now.Sub(t.lastProgress) < uploadProgressInterval {
+		return
+	}
+	t.lastProgress = now
+
+	elapsed := now.Sub(t.started)
+	log.WithFields(logrus.Fields{
+		"bytes":        t.bytes,
+		"elapsed":      elapsed.Round(time.Second).String(),
+		"mibPerSecond": float64(t.bytes) / (1024 * 1024) / elapsed.Seconds(),
+	}).Info("Upload in progress")
+}
+
+// done removes the upload of the given object from the uploads in progress.
+func (t *uploadTimings) done(object string) {
+	if t.progress != nil {
+		uploadInProgressBytes.Delete(object)
+	}
+}
+
+// time runs fn, adding its duration to the given stage.
+func (t *uploadTimings) time(stage string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	t.stages[stage] += time.Since(start)
+	return err
+}
+
+// record publishes the timings of a completed upload to the plugin's metrics
+// and logs them at debug level.
+func (t *uploadTimings) record(log logrus.FieldLogger) {
+	fields := logrus.Fields{
+		"bytes":  t.bytes,
+		"blocks": t.blocks,
+	}
+	for stage, d := range t.stages {
+		uploadStageSeconds.AddFloat(stage, d.Seconds())
+		fields[stage] = d.String()
+	}
+	uploadBytes.Add(t.bytes)
+	uploadBlocks.Add(t.blocks)
+	uploadObjects.Add(1)
+
+	log.WithFields(fields).Debug("Upload stage timings")
+}
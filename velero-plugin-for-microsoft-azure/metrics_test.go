@@ -0,0 +1,74 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadTimings(t *testing.T) {
+	bytesBefore, objectsBefore := uploadBytes.Value(), uploadObjects.Value()
+
+	timings := newUploadTimings()
+	assert.NoError(t, timings.time(uploadStageRead, func() error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}))
+	assert.EqualError(t, timings.time(uploadStageStageBlock, func() error { return errors.New("bad") }), "bad")
+	timings.bytes, timings.blocks = 10, 1
+
+	assert.True(t, timings.stages[uploadStageRead] >= time.Millisecond)
+	assert.Contains(t, timings.stages, uploadStageStageBlock)
+
+	timings.record(logrus.New())
+	assert.Equal(t, bytesBefore+10, uploadBytes.Value())
+	assert.Equal(t, objectsBefore+1, uploadObjects.Value())
+	assert.NotNil(t, uploadStageSeconds.Get(uploadStageRead))
+}
+
+func TestUploadProgress(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	timings := newUploadTimings()
+	object := "bucket/progress"
+
+	// small uploads don't report progress
+	timings.bytes = uploadProgressThreshold - 1
+	timings.reportProgress(log, object, timings.started.Add(time.Hour))
+	assert.Nil(t, uploadInProgressBytes.Get(object))
+	assert.Empty(t, hook.AllEntries())
+
+	timings.bytes = uploadProgressThreshold
+	timings.reportProgress(log, object, timings.started.Add(time.Second))
+	assert.Equal(t, "1073741824", uploadInProgressBytes.Get(object).String())
+	assert.Empty(t, hook.AllEntries())
+
+	timings.bytes *= 2
+	timings.reportProgress(log, object, timings.started.Add(uploadProgressInterval))
+	assert.Equal(t, "2147483648", uploadInProgressBytes.Get(object).String())
+	if assert.Len(t, hook.AllEntries(), 1) {
+		assert.Equal(t, int64(2*uploadProgressThreshold), hook.LastEntry().Data["bytes"])
+	}
+
+	timings.done(object)
+	assert.Nil(t, uploadInProgressBytes.Get(object))
+}
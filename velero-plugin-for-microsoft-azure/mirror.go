@@ -0,0 +1,359 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	mirrorLocationsConfigKey                = "mirrorLocations"
+	mirrorStorageAccountKeyEnvVarsConfigKey = "mirrorStorageAccountKeyEnvVars"
+
+	mirrorQueueSize     = 10000
+	mirrorAttempts      = 3
+	mirrorRetryInterval = 10 * time.Second
+
+	// the queue only lives in memory, so the targets are reconciled with
+	// the primary container this often, and when the mirror is started, to
+	// catch up on the copies that were dropped or lost with the process
+	mirrorReconcileInterval = time.Hour
+
+	// mirrorLagWarning is how far behind a mirror may fall before each
+	// mirrored object is logged as a warning
+	mirrorLagWarning = 15 * time.Minute
+)
+
+// mirror metrics, published alongside the upload metrics
+var (
+	mirrorLagSeconds = expvar.NewMap("azure_mirror_lag_seconds")
+	mirrorPending    = expvar.NewInt("azure_mirror_pending")
+	mirrorFailures   = expvar.NewMap("azure_mirror_failures")
+)
+
+type mirrorOperation int
+
+const (
+	mirrorPut mirrorOperation = iota
+	mirrorDelete
+)
+
+type mirrorTask struct {
+	operation mirrorOperation
+	bucket    string
+	key       string
+	queuedAt  time.Time
+}
+
+// mirrorTarget is a container objects are mirrored to.
+type mirrorTarget struct {
+	name       string
+	bucket     string
+	blobs      blobGetter
+	containers containerGetter
+}
+
+// parseMirrorLocations parses config.mirrorLocations, a comma-separated list
+// of storage account and container pairs, e.g. "account1/container1".
+func parseMirrorLocations(val string) ([][2]string, error) {
+	var locations [][2]string
+	for _, location := range strings.Split(val, ",") {
+		if location = strings.TrimSpace(location); location == "" {
+			continue
+		}
+		parts := strings.Split(location, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid value %q in config key %q (expected <storage account>/<container>)", location, mirrorLocationsConfigKey)
+		}
+		locations = append(locations, [2]string{parts[0], parts[1]})
+	}
+	return locations, nil
+}
+
+// parseMirrorKeyEnvVars parses config.mirrorStorageAccountKeyEnvVars, a
+// comma-separated list of storage account and environment variable pairs,
+// e.g. "account1=ACCOUNT1_KEY".
+func parseMirrorKeyEnvVars(val string) (map[string]string, error) {
+	envVars := map[string]string{}
+	for _, pair := range strings.Split(val, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid value %q in config key %q (expected <storage account>=<env var>)", pair, mirrorStorageAccountKeyEnvVarsConfigKey)
+		}
+		envVars[parts[0]] = parts[1]
+	}
+	return envVars, nil
+}
+
+// newMirrorTargets returns the containers configured in config.mirrorLocations,
+// accessed with the same kind of credentials as the primary storage account.
+func newMirrorTargets(config map[string]string) ([]mirrorTarget, error) {
+	locations, err := parseMirrorLocations(config[mirrorLocationsConfigKey])
+	if err != nil || len(locations) == 0 {
+		return nil, err
+	}
+	keyEnvVars, err := parseMirrorKeyEnvVars(config[mirrorStorageAccountKeyEnvVarsConfigKey])
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []mirrorTarget
+	for _, location := range locations {
+		account, bucket := location[0], location[1]
+
+		targetConfig := map[string]string{}
+		for k, v := range config {
+			targetConfig[k] = v
+		}
+		targetConfig[storageAccountConfigKey] = account
+		if envVar, ok := keyEnvVars[account]; ok {
+			targetConfig[storageAccountKeyEnvVarConfigKey] = envVar
+		}
+
+		blobClient, err := newSecondaryBlobClient(targetConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting storage client for mirror %s/%s", account, bucket)
+		}
+
+		targets = append(targets, mirrorTarget{
+			name:       account + "/" + bucket,
+			bucket:     bucket,
+			blobs:      &azureBlobGetter{blobService: &blobClient},
+			containers: &azureContainerGetter{blobService: &blobClient},
+		})
+	}
+
+	return targets, nil
+}
+
+// fanOutMirror asynchronously mirrors the objects written to, and deleted
+// from, the primary container to each of its targets. Objects are copied
+// server-side from the primary, so PutObject doesn't wait for the mirrors.
+type fanOutMirror struct {
+	log              logrus.FieldLogger
+	source           blobGetter
+	sourceContainers containerGetter
+	prefix           string
+	targets          []mirrorTarget
+	queue            chan mirrorTask
+	sleep            func(time.Duration)
+}
+
+var (
+	fanOutMirrorsLock sync.Mutex
+	fanOutMirrors     = map[string]*fanOutMirror{}
+)
+
+// getFanOutMirror returns the process's mirror for the given key, creating it
+// and starting its worker and reconciliation of the given bucket and prefix
+// with newTargets if there's none yet, since plugins are initialized
+// repeatedly and the mirror's queue must outlive each Init.
+func getFanOutMirror(log logrus.FieldLogger, key string, source blobGetter, sourceContainers containerGetter, bucket, prefix string, newTargets func() ([]mirrorTarget, error)) (*fanOutMirror, error) {
+	fanOutMirrorsLock.Lock()
+	defer fanOutMirrorsLock.Unlock()
+
+	if m, ok := fanOutMirrors[key]; ok {
+		return m, nil
+	}
+
+	targets, err := newTargets()
+	if err != nil || len(targets) == 0 {
+		return nil, err
+	}
+
+	m := &fanOutMirror{
+		log:              log,
+		source:           source,
+		sourceContainers: sourceContainers,
+		prefix:           prefix,
+		targets:          targets,
+		queue:            make(chan mirrorTask, mirrorQueueSize),
+		sleep:            time.Sleep,
+	}
+	go m.run()
+	go m.runReconcile(bucket)
+	fanOutMirrors[key] = m
+
+	return m, nil
+}
+
+// enqueue queues the given operation for mirroring. If the queue is full the
+// operation is dropped and counted as a failure for every target, rather
+// than blocking the backup.
+func (m *fanOutMirror) enqueue(operation mirrorOperation, bucket, key string) {
+	select {
+	case m.queue <- mirrorTask{operation: operation, bucket: bucket, key: key, queuedAt: time.Now()}:
+		mirrorPending.Add(1)
+	default:
+		m.log.WithField("key", key).Error("Mirror queue is full, object will not be mirrored")
+		for _, target := range m.targets {
+			mirrorFailures.Add(target.name, 1)
+		}
+	}
+}
+
+func (m *fanOutMirror) run() {
+	for task := range m.queue {
+		m.process(task, time.Now)
+		mirrorPending.Add(-1)
+	}
+}
+
+func (m *fanOutMirror) runReconcile(bucket string) {
+	for {
+		if err := m.reconcile(bucket); err != nil {
+			m.log.WithError(err).Warn("Error reconciling mirrors")
+		}
+		time.Sleep(mirrorReconcileInterval)
+	}
+}
+
+// reconcile copies the objects under the prefix that are missing from each
+// target, or were modified in the primary since they were copied. Objects
+// the primary doesn't have are left alone: a listing can't tell an object
+// that was deleted from one that was written to the target some other way,
+// so only deletions made through DeleteObject are mirrored.
+func (m *fanOutMirror) reconcile(bucket string) error {
+	var prefix string
+	if m.prefix != "" {
+		prefix = strings.TrimSuffix(m.prefix, "/") + "/"
+	}
+
+	container, err := m.sourceContainers.getContainer(bucket)
+	if err != nil {
+		return err
+	}
+	blobs, _, err := listAllBlobs(container, storage.ListBlobsParameters{Prefix: prefix})
+	if err != nil {
+		return err
+	}
+	source := make(map[string]time.Time, len(blobs))
+	for _, blob := range blobs {
+		source[blob.Name] = time.Time(blob.Properties.LastModified)
+	}
+
+	for _, target := range m.targets {
+		log := m.log.WithField("mirror", target.name)
+
+		container, err := target.containers.getContainer(target.bucket)
+		if err != nil {
+			log.WithError(err).Warn("Error reconciling mirror")
+			continue
+		}
+		blobs, _, err := listAllBlobs(container, storage.ListBlobsParameters{Prefix: prefix})
+		if err != nil {
+			log.WithError(err).Warn("Error reconciling mirror")
+			continue
+		}
+		mirrored := make(map[string]time.Time, len(blobs))
+		for _, blob := range blobs {
+			mirrored[blob.Name] = time.Time(blob.Properties.LastModified)
+		}
+
+		var tasks []mirrorTask
+		for key, modified := range source {
+			if copied, ok := mirrored[key]; !ok || copied.Before(modified) {
+				tasks = append(tasks, mirrorTask{operation: mirrorPut, bucket: bucket, key: key})
+			}
+		}
+
+		var failed int
+		for _, task := range tasks {
+			if err := m.apply(target, task); err != nil {
+				log.WithError(err).WithField("key", task.key).Error("Error mirroring object")
+				mirrorFailures.Add(target.name, 1)
+				failed++
+			}
+		}
+		if len(tasks) > 0 {
+			log.WithField("failed", failed).Infof("Reconciled %d out-of-date objects", len(tasks))
+		}
+	}
+
+	return nil
+}
+
+func (m *fanOutMirror) process(task mirrorTask, now func() time.Time) {
+	for _, target := range m.targets {
+		log := m.log.WithFields(logrus.Fields{"mirror": target.name, "key": task.key})
+
+		var err error
+		for attempt := 1; attempt <= mirrorAttempts; attempt++ {
+			if err = m.apply(target, task); err == nil {
+				break
+			}
+			if attempt < mirrorAttempts {
+				m.sleep(mirrorRetryInterval)
+			}
+		}
+		if err != nil {
+			log.WithError(err).Error("Error mirroring object")
+			mirrorFailures.Add(target.name, 1)
+			continue
+		}
+
+		lag := now().Sub(task.queuedAt)
+		lagSeconds := new(expvar.Float)
+		lagSeconds.Set(lag.Seconds())
+		mirrorLagSeconds.Set(target.name, lagSeconds)
+		if lag > mirrorLagWarning {
+			log.WithField("lag", lag.Round(time.Second).String()).Warn("Mirror is falling behind")
+		}
+	}
+}
+
+func (m *fanOutMirror) apply(target mirrorTarget, task mirrorTask) error {
+	dest, err := target.blobs.getBlob(target.bucket, task.key)
+	if err != nil {
+		return err
+	}
+
+	if task.operation == mirrorDelete {
+		if err := dest.Delete(nil); err != nil && !isNotFound(err) {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+
+	source, err := m.source.getBlob(task.bucket, task.key)
+	if err != nil {
+		return err
+	}
+	sourceURL, err := source.GetSASURI(&storage.BlobSASOptions{
+		SASOptions: storage.SASOptions{
+			Expiry: time.Now().Add(replicationSASExpiry),
+		},
+		BlobServiceSASPermissions: storage.BlobServiceSASPermissions{
+			Read: true,
+		},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(dest.Copy(sourceURL, nil))
+}
@@ -0,0 +1,189 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMirrorLocations(t *testing.T) {
+	locations, err := parseMirrorLocations("account1/container1, account2/container2,")
+	require.NoError(t, err)
+	assert.Equal(t, [][2]string{{"account1", "container1"}, {"account2", "container2"}}, locations)
+
+	for _, val := range []string{"account1", "account1/", "/container1", "account1/container1/extra"} {
+		_, err := parseMirrorLocations(val)
+		assert.Error(t, err, val)
+	}
+}
+
+func TestParseMirrorKeyEnvVars(t *testing.T) {
+	envVars, err := parseMirrorKeyEnvVars("account1=KEY1,account2=KEY2")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"account1": "KEY1", "account2": "KEY2"}, envVars)
+
+	_, err = parseMirrorKeyEnvVars("account1")
+	assert.Error(t, err)
+}
+
+func TestMirrorProcess(t *testing.T) {
+	queuedAt := time.Now()
+	now := func() time.Time { return queuedAt.Add(time.Minute) }
+
+	t.Run("put is copied to every target", func(t *testing.T) {
+		sourceBlobs := new(mockBlobGetter)
+		defer sourceBlobs.AssertExpectations(t)
+		source := new(mockBlob)
+		source.On("GetSASURI", mock.Anything).Return("https://source/key?sas", nil)
+		sourceBlobs.On("getBlob", "bucket", "key").Return(source, nil)
+
+		var targets []mirrorTarget
+		for _, name := range []string{"account1/mirror", "account2/mirror"} {
+			dest := new(mockBlob)
+			defer dest.AssertExpectations(t)
+			dest.On("Copy", "https://source/key?sas", (*storage.CopyOptions)(nil)).Return(nil)
+			destBlobs := new(mockBlobGetter)
+			destBlobs.On("getBlob", "mirror", "key").Return(dest, nil)
+			targets = append(targets, mirrorTarget{name: name, bucket: "mirror", blobs: destBlobs})
+		}
+
+		m := &fanOutMirror{log: logrus.New(), source: sourceBlobs, targets: targets}
+		m.process(mirrorTask{operation: mirrorPut, bucket: "bucket", key: "key", queuedAt: queuedAt}, now)
+
+		assert.Equal(t, "60", mirrorLagSeconds.Get("account1/mirror").String())
+		assert.Equal(t, "60", mirrorLagSeconds.Get("account2/mirror").String())
+	})
+
+	t.Run("delete of a missing object succeeds", func(t *testing.T) {
+		dest := new(mockBlob)
+		defer dest.AssertExpectations(t)
+		dest.On("Delete", (*storage.DeleteBlobOptions)(nil)).Return(storage.AzureStorageServiceError{StatusCode: 404})
+		destBlobs := new(mockBlobGetter)
+		destBlobs.On("getBlob", "mirror", "key").Return(dest, nil)
+
+		m := &fanOutMirror{log: logrus.New(), targets: []mirrorTarget{{name: "account3/mirror", bucket: "mirror", blobs: destBlobs}}}
+		m.process(mirrorTask{operation: mirrorDelete, bucket: "bucket", key: "key", queuedAt: queuedAt}, now)
+
+		assert.Nil(t, mirrorFailures.Get("account3/mirror"))
+	})
+
+	t.Run("failed copies are retried and counted", func(t *testing.T) {
+		sourceBlobs := new(mockBlobGetter)
+		source := new(mockBlob)
+		source.On("GetSASURI", mock.Anything).Return("https://source/key?sas", nil)
+		sourceBlobs.On("getBlob", "bucket", "key").Return(source, nil)
+
+		dest := new(mockBlob)
+		defer dest.AssertExpectations(t)
+		dest.On("Copy", "https://source/key?sas", (*storage.CopyOptions)(nil)).Return(errors.New("unavailable")).Times(mirrorAttempts)
+		destBlobs := new(mockBlobGetter)
+		destBlobs.On("getBlob", "mirror", "key").Return(dest, nil)
+
+		var sleeps int
+		m := &fanOutMirror{
+			log:     logrus.New(),
+			source:  sourceBlobs,
+			targets: []mirrorTarget{{name: "account4/mirror", bucket: "mirror", blobs: destBlobs}},
+			sleep:   func(time.Duration) { sleeps++ },
+		}
+		m.process(mirrorTask{operation: mirrorPut, bucket: "bucket", key: "key", queuedAt: queuedAt}, now)
+
+		assert.Equal(t, mirrorAttempts-1, sleeps)
+		assert.Equal(t, "1", mirrorFailures.Get("account4/mirror").String())
+		assert.Nil(t, mirrorLagSeconds.Get("account4/mirror"))
+	})
+}
+
+func TestMirrorReconcile(t *testing.T) {
+	now := time.Now()
+	at := func(age time.Duration) storage.BlobProperties {
+		return storage.BlobProperties{LastModified: storage.TimeRFC1123(now.Add(-age))}
+	}
+
+	sourceContainer := new(mockContainer)
+	sourceContainer.On("ListBlobs", storage.ListBlobsParameters{Prefix: "velero/"}).Return(storage.BlobListResponse{
+		Blobs: []storage.Blob{
+			{Name: "velero/backups/b1/b1.tar.gz", Properties: at(2 * time.Hour)},
+			{Name: "velero/backups/b2/b2.tar.gz", Properties: at(2 * time.Hour)},
+			{Name: "velero/backups/b3/b3.tar.gz", Properties: at(time.Hour)},
+		},
+	}, nil)
+	sourceContainers := new(mockContainerGetter)
+	sourceContainers.On("getContainer", "bucket").Return(sourceContainer, nil)
+
+	targetContainer := new(mockContainer)
+	targetContainer.On("ListBlobs", storage.ListBlobsParameters{Prefix: "velero/"}).Return(storage.BlobListResponse{
+		Blobs: []storage.Blob{
+			// up to date
+			{Name: "velero/backups/b1/b1.tar.gz", Properties: at(time.Hour)},
+			// copied before the primary object was rewritten
+			{Name: "velero/backups/b3/b3.tar.gz", Properties: at(2 * time.Hour)},
+			// missing from the primary, which is left alone
+			{Name: "velero/backups/b0/b0.tar.gz", Properties: at(time.Hour)},
+		},
+	}, nil)
+	targetContainers := new(mockContainerGetter)
+	targetContainers.On("getContainer", "mirror").Return(targetContainer, nil)
+
+	sourceBlobs := new(mockBlobGetter)
+	defer sourceBlobs.AssertExpectations(t)
+	targetBlobs := new(mockBlobGetter)
+	defer targetBlobs.AssertExpectations(t)
+	for _, key := range []string{"velero/backups/b2/b2.tar.gz", "velero/backups/b3/b3.tar.gz"} {
+		source := new(mockBlob)
+		source.On("GetSASURI", mock.Anything).Return("https://source/"+key+"?sas", nil)
+		sourceBlobs.On("getBlob", "bucket", key).Return(source, nil)
+
+		dest := new(mockBlob)
+		defer dest.AssertExpectations(t)
+		dest.On("Copy", "https://source/"+key+"?sas", (*storage.CopyOptions)(nil)).Return(nil)
+		targetBlobs.On("getBlob", "mirror", key).Return(dest, nil)
+	}
+
+	m := &fanOutMirror{
+		log:              logrus.New(),
+		source:           sourceBlobs,
+		sourceContainers: sourceContainers,
+		prefix:           "velero",
+		targets:          []mirrorTarget{{name: "account6/mirror", bucket: "mirror", blobs: targetBlobs, containers: targetContainers}},
+	}
+	require.NoError(t, m.reconcile("bucket"))
+
+	assert.Nil(t, mirrorFailures.Get("account6/mirror"))
+}
+
+func TestMirrorEnqueueWhenFull(t *testing.T) {
+	m := &fanOutMirror{
+		log:     logrus.New(),
+		targets: []mirrorTarget{{name: "account5/mirror"}},
+		queue:   make(chan mirrorTask, 1),
+	}
+
+	m.enqueue(mirrorPut, "bucket", "key1")
+	m.enqueue(mirrorPut, "bucket", "key2")
+
+	assert.Len(t, m.queue, 1)
+	assert.Equal(t, "1", mirrorFailures.Get("account5/mirror").String())
+}
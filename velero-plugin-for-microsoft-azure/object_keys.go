@@ -0,0 +1,75 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// maxBlobNameLength is the longest blob name, in characters, the storage
+// service accepts.
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/naming-and-referencing-containers--blobs--and-metadata#blob-names
+const maxBlobNameLength = 1024
+
+// errEmptyObjectKey is returned for operations on the empty key, which
+// addresses the container rather than an object.
+var errEmptyObjectKey = errors.New("object key can't be empty")
+
+// validateObjectKey returns an error if the given key can't be written as a
+// blob that can be read and deleted again by the same key. Keys are checked
+// before anything is uploaded, since the service would otherwise fail the
+// upload only once its blocks are staged, or accept blobs that can't be
+// addressed later.
+func validateObjectKey(key string) error {
+	if key == "" {
+		return errEmptyObjectKey
+	}
+	if !utf8.ValidString(key) {
+		return errors.Errorf("object key %q isn't valid UTF-8", key)
+	}
+	if n := utf8.RuneCountInString(key); n > maxBlobNameLength {
+		return errors.Errorf("object key %.64q... is %d characters long, longer than the %d characters blob names can have", key, n, maxBlobNameLength)
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return errors.Errorf("object key %q has control characters, which blob names can't have", key)
+		}
+	}
+
+	// proxies and the service normalize URLs, so blobs named with "." or ".."
+	// segments, or a trailing dot, or with backslashes, which some clients
+	// turn into slashes, would be read and deleted under other names.
+	// Trailing slashes name directories on accounts with a hierarchical
+	// namespace.
+	if strings.ContainsRune(key, '\\') {
+		return errors.Errorf("object key %q has backslashes, which blob names shouldn't have", key)
+	}
+	if strings.HasSuffix(key, "/") || strings.HasSuffix(key, ".") {
+		return errors.Errorf("object key %q ends with a slash or dot, which blob names shouldn't", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return errors.Errorf("object key %q has a %q segment, which blob names shouldn't have", key, segment)
+		}
+	}
+
+	return nil
+}
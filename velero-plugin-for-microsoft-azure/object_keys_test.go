@@ -0,0 +1,106 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateObjectKey(t *testing.T) {
+	valid := []string{
+		"backups/b1/velero-backup.json",
+		"cluster-1//backups/b1/b1.tar.gz",
+		"backups/b1/..tar.gz",
+		"バックアップ/b1/b1-logs.gz",
+		strings.Repeat("é", maxBlobNameLength),
+	}
+	for _, key := range valid {
+		assert.NoError(t, validateObjectKey(key), key)
+	}
+
+	invalid := []string{
+		"",
+		"backups/b1/",
+		"backups/b1.",
+		"backups/./b1.tar.gz",
+		"backups/../b1.tar.gz",
+		`backups\b1.tar.gz`,
+		"backups/b1\n.tar.gz",
+		"backups/\xff.tar.gz",
+		strings.Repeat("é", maxBlobNameLength+1),
+	}
+	for _, key := range invalid {
+		assert.Error(t, validateObjectKey(key), key)
+	}
+}
+
+func TestPutObjectKeys(t *testing.T) {
+	// invalid keys are refused before anything is uploaded
+	blobGetter := new(mockBlobGetter)
+	o := &ObjectStore{log: logrus.New(), blobGetter: blobGetter, blockSize: 4}
+	assert.Error(t, o.PutObject("b", "backups/b1/", strings.NewReader("data")))
+	blobGetter.AssertNotCalled(t, "getBlob", mock.Anything, mock.Anything)
+
+	// zero-byte objects are committed with no blocks, creating an empty blob
+	blob := new(mockBlob)
+	blobGetter.On("getBlob", "b", "backups/b1/b1-podvolumebackups.json.gz").Return(blob, nil)
+	blob.On("PutBlockList", []storage.Block(nil), mock.Anything).Return(nil)
+	require.NoError(t, o.PutObject("b", "backups/b1/b1-podvolumebackups.json.gz", strings.NewReader("")))
+	blob.AssertNotCalled(t, "PutBlock", mock.Anything, mock.Anything, mock.Anything)
+	blob.AssertCalled(t, "PutBlockList", []storage.Block(nil), mock.Anything)
+}
+
+func TestEmptyObjectKey(t *testing.T) {
+	// the empty key addresses the container, so it's refused rather than
+	// read, checked or deleted as if it were an object
+	o := &ObjectStore{log: logrus.New(), blobGetter: new(mockBlobGetter)}
+
+	_, err := o.ObjectExists("b", "")
+	assert.Equal(t, errEmptyObjectKey, err)
+	_, err = o.GetObject("b", "")
+	assert.Equal(t, errEmptyObjectKey, err)
+	assert.Equal(t, errEmptyObjectKey, o.DeleteObject("b", ""))
+	_, err = o.CreateSignedURL("b", "", time.Hour)
+	assert.Equal(t, errEmptyObjectKey, err)
+}
+
+func TestUnicodeObjectKey(t *testing.T) {
+	// blob names are escaped in request URLs, so any Unicode key addresses
+	// its own blob
+	credential := &storageCredential{accountKey: "a2V5"}
+	client, err := newStorageClient("account", credential, &azure.PublicCloud, "")
+	require.NoError(t, err)
+	sender := &recordingSender{}
+	client.Sender = sender
+	service := client.GetBlobService()
+
+	b, err := (&azureBlobGetter{blobService: &service}).getBlob("b", "バックアップ/b 1#?.json")
+	require.NoError(t, err)
+	_, err = b.Exists()
+	require.NoError(t, err)
+	require.Len(t, sender.requests, 1)
+	assert.Equal(t, "/b/%E3%83%90%E3%83%83%E3%82%AF%E3%82%A2%E3%83%83%E3%83%97/b%201%23%3F.json", sender.requests[0].URL.EscapedPath())
+}
@@ -17,29 +17,44 @@ limitations under the License.
 package main
 
 import (
-	"context"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	storagemgmt "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
 	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/Azure/go-autorest/autorest/azure"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-
-	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
 )
 
 const (
 	storageAccountConfigKey          = "storageAccount"
 	storageAccountKeyEnvVarConfigKey = "storageAccountKeyEnvVar"
+	storageAccountSASEnvVarConfigKey = "storageAccountSASEnvVar"
 	subscriptionIDConfigKey          = "subscriptionId"
 	blockSizeConfigKey               = "blockSizeInBytes"
+	inlineLogURLsConfigKey           = "inlineLogURLs"
+	maxObjectSizeConfigKey           = "maxObjectSizeGiB"
+	useAADConfigKey                  = "useAAD"
+	clientIDConfigKey                = "clientId"
+	storageAPIVersionConfigKey       = "storageAPIVersion"
+	keyVaultNameConfigKey            = "keyVaultName"
+	keyVaultSecretNameConfigKey      = "secretName"
+
+	// velero adds the location's bucket and prefix to every object store's config
+	bucketConfigKey = "bucket"
+	prefixConfigKey = "prefix"
+
+	// tokenPlaceholderAccountKey is the key of storage clients authorized
+	// with AAD tokens. It's valid base64, as the client requires, and never
+	// used to sign requests that are sent.
+	tokenPlaceholderAccountKey = "dG9rZW4="
 
 	// blocks must be less than/equal to 100MB in size
 	// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/put-block#uri-parameters
@@ -104,10 +119,19 @@ func (bg *azureBlobGetter) getBlob(bucket, key string) (blob, error) {
 type blob interface {
 	PutBlock(blockID string, chunk []byte, options *storage.PutBlockOptions) error
 	PutBlockList(blocks []storage.Block, options *storage.PutBlockListOptions) error
+	GetBlockList(blockType storage.BlockListType, options *storage.GetBlockListOptions) (storage.BlockListResponse, error)
+	CreateBlockBlobFromReader(blob io.Reader, options *storage.PutBlobOptions) error
+	PutAppendBlob(options *storage.PutBlobOptions) error
+	AppendBlock(chunk []byte, options *storage.AppendBlockOptions) error
 	Exists() (bool, error)
 	Get(options *storage.GetBlobOptions) (io.ReadCloser, error)
+	GetRange(options *storage.GetBlobRangeOptions) (io.ReadCloser, error)
 	Delete(options *storage.DeleteBlobOptions) error
 	GetSASURI(options *storage.BlobSASOptions) (string, error)
+	Copy(sourceBlob string, options *storage.CopyOptions) error
+	GetProperties(options *storage.GetBlobPropertiesOptions) error
+	Properties() storage.BlobProperties
+	SetMetadata(metadata storage.BlobMetadata, options *storage.SetBlobMetadataOptions) error
 }
 
 type azureBlob struct {
@@ -121,6 +145,22 @@ func (b *azureBlob) PutBlockList(blocks []storage.Block, options *storage.PutBlo
 	return b.blob.PutBlockList(blocks, options)
 }
 
+func (b *azureBlob) GetBlockList(blockType storage.BlockListType, options *storage.GetBlockListOptions) (storage.BlockListResponse, error) {
+	return b.blob.GetBlockList(blockType, options)
+}
+
+func (b *azureBlob) CreateBlockBlobFromReader(blob io.Reader, options *storage.PutBlobOptions) error {
+	return b.blob.CreateBlockBlobFromReader(blob, options)
+}
+
+func (b *azureBlob) PutAppendBlob(options *storage.PutBlobOptions) error {
+	return b.blob.PutAppendBlob(options)
+}
+
+func (b *azureBlob) AppendBlock(chunk []byte, options *storage.AppendBlockOptions) error {
+	return b.blob.AppendBlock(chunk, options)
+}
+
 func (b *azureBlob) Exists() (bool, error) {
 	return b.blob.Exists()
 }
@@ -129,6 +169,10 @@ func (b *azureBlob) Get(options *storage.GetBlobOptions) (io.ReadCloser, error)
 	return b.blob.Get(options)
 }
 
+func (b *azureBlob) GetRange(options *storage.GetBlobRangeOptions) (io.ReadCloser, error) {
+	return b.blob.GetRange(options)
+}
+
 func (b *azureBlob) Delete(options *storage.DeleteBlobOptions) error {
 	return b.blob.Delete(options)
 }
@@ -137,11 +181,110 @@ func (b *azureBlob) GetSASURI(options *storage.BlobSASOptions) (string, error) {
 	return b.blob.GetSASURI(*options)
 }
 
+func (b *azureBlob) Copy(sourceBlob string, options *storage.CopyOptions) error {
+	return b.blob.Copy(sourceBlob, options)
+}
+
+func (b *azureBlob) GetProperties(options *storage.GetBlobPropertiesOptions) error {
+	return b.blob.GetProperties(options)
+}
+
+// Properties returns the blob's properties as of the last call that
+// retrieved them (e.g. Get or GetProperties).
+func (b *azureBlob) Properties() storage.BlobProperties {
+	return b.blob.Properties
+}
+
+// SetMetadata replaces the blob's metadata with the given metadata.
+func (b *azureBlob) SetMetadata(metadata storage.BlobMetadata, options *storage.SetBlobMetadataOptions) error {
+	b.blob.Metadata = metadata
+	return b.blob.SetMetadata(options)
+}
+
+// listAllBlobs returns every blob and blob prefix matching params,
+// following continuation markers until the listing is complete.
+func listAllBlobs(container container, params storage.ListBlobsParameters) ([]storage.Blob, []string, error) {
+	var (
+		blobs    []storage.Blob
+		prefixes []string
+	)
+	for {
+		res, err := container.ListBlobs(params)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		blobs = append(blobs, res.Blobs...)
+		prefixes = append(prefixes, res.BlobPrefixes...)
+		if res.NextMarker == "" {
+			break
+		}
+		params.Marker = res.NextMarker
+	}
+
+	return blobs, prefixes, nil
+}
+
+// storageErrorStatusCode returns the HTTP status code of the given storage
+// service error, or 0 if err isn't one.
+func storageErrorStatusCode(err error) int {
+	switch e := errors.Cause(err).(type) {
+	case storage.AzureStorageServiceError:
+		return e.StatusCode
+	case storage.UnexpectedStatusCodeError:
+		return e.Got()
+	}
+	return 0
+}
+
+// storageErrorCode returns the error code of the given storage service
+// error, e.g. "BlobArchived", or "" if err isn't one.
+func storageErrorCode(err error) string {
+	if e, ok := errors.Cause(err).(storage.AzureStorageServiceError); ok {
+		return e.Code
+	}
+	return ""
+}
+
 type ObjectStore struct {
-	log             logrus.FieldLogger
-	containerGetter containerGetter
-	blobGetter      blobGetter
-	blockSize       int
+	log               logrus.FieldLogger
+	containerGetter   containerGetter
+	blobGetter        blobGetter
+	blobService       *lazyBlobService
+	operationTimeout  time.Duration
+	blockSize         int
+	uploadConcurrency int
+	uploadBuffers     int
+	controlKey        string
+	maxObjectSize     int64
+	prefetcher        *prefetcher
+	catalog           *catalogIndex
+	replicator        *replicator
+	readFromReplica   bool
+	readCache         *readCache
+	packer            *packer
+	audit             *auditLog
+	journal           *operationJournal
+	mirror            *fanOutMirror
+	redactor          *logRedactor
+	inlineLogURLs     bool
+	sasAccessPolicy   string
+	useAAD            bool
+	blobDomain        string
+	delegationSigner  *userDelegationSigner
+	failures          *failureSummarizer
+	resourceGraph     *resourceGraphRecorder
+	accessTier        string
+	tierSetter        accessTierSetter
+	archived          archivedBlobs
+	rehydratePriority string
+	immutability      *immutabilitySettings
+	immutableBlobs    immutableBlobs
+	reuseBlocks       bool
+	labeler           *uploadLabeler
+	customerKey       *customerProvidedKey
+	encryptionScope   string
+	directories       directoryDeleter
+	existsCalls       coalescer
 }
 
 func newObjectStore(logger logrus.FieldLogger) *ObjectStore {
@@ -158,83 +301,139 @@ func getSubscriptionID(config map[string]string) string {
 	return os.Getenv(subscriptionIDEnvVar)
 }
 
-func getStorageAccountKey(config map[string]string) (string, *azure.Environment, error) {
+// getCredentialProvider loads the credentials file and returns the credential
+// provider for the configured storage account, along with the Azure
+// environment. It doesn't make any requests.
+func getCredentialProvider(config map[string]string) (credentialProvider, *azure.Environment, error) {
 	credentialsFile, err := selectCredentialsFile(config)
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
 	}
 
 	if err := loadCredentialsIntoEnv(credentialsFile); err != nil {
-		return "", nil, err
+		return nil, nil, err
 	}
 
-	// get Azure cloud from AZURE_CLOUD_NAME, if it exists. If the env var does not
-	// exist, parseAzureEnvironment will return azure.PublicCloud.
-	env, err := parseAzureEnvironment(os.Getenv(cloudNameEnvVar))
+	env, err := getAzureEnvironment(config)
 	if err != nil {
-		return "", nil, errors.Wrap(err, "unable to parse azure cloud name environment variable")
+		return nil, nil, err
 	}
 
-	// get storage account key from env var whose name is in config[storageAccountKeyEnvVarConfigKey].
-	// If the config does not exist, continue obtaining the storage key using API
-	if secretKeyEnvVar := config[storageAccountKeyEnvVarConfigKey]; secretKeyEnvVar != "" {
-		storageKey := os.Getenv(secretKeyEnvVar)
-		if storageKey == "" {
-			return "", env, errors.Errorf("no storage account key found in env var %s", secretKeyEnvVar)
-		}
-
-		return storageKey, env, nil
+	// use the storage account key from the env var whose name is in
+	// config[storageAccountKeyEnvVarConfigKey] if set, otherwise obtain
+	// the key using the ARM API
+	credentials, err := newCredentialProvider(config, env)
+	if err != nil {
+		return nil, env, err
 	}
 
-	// get subscription ID from object store config or AZURE_SUBSCRIPTION_ID environment variable
-	subscriptionID := getSubscriptionID(config)
-	if subscriptionID == "" {
-		return "", nil, errors.New("azure subscription ID not found in object store's config or in environment variable")
+	// a connection string may be for another cloud's endpoint, e.g. Azure Stack
+	if p, ok := credentials.(*connectionStringCredentialProvider); ok {
+		env = withConnectionStringEndpoint(env, p.connectionString)
 	}
 
-	// we need config["resourceGroup"], config["storageAccount"]
-	if _, err := getRequiredValues(mapLookup(config), resourceGroupConfigKey, storageAccountConfigKey); err != nil {
-		return "", env, errors.Wrap(err, "unable to get all required config values")
+	return credentials, env, nil
+}
+
+// getStorageAccountCredential returns the credential for the configured
+// storage account from the given provider.
+func getStorageAccountCredential(credentials credentialProvider, config map[string]string) (*storageCredential, error) {
+	return credentials.GetStorageCredential(storageAccount{
+		subscriptionID: getSubscriptionID(config),
+		resourceGroup:  config[resourceGroupConfigKey],
+		name:           config[storageAccountConfigKey],
+		apiVersion:     config[storageManagementAPIVersionConfigKey],
+	})
+}
+
+// getStorageCredential loads the credentials file and returns the credential
+// for the configured storage account, along with the credential provider it
+// was obtained from and the Azure environment.
+func getStorageCredential(config map[string]string) (*storageCredential, credentialProvider, *azure.Environment, error) {
+	credentials, env, err := getCredentialProvider(config)
+	if err != nil {
+		return nil, nil, env, err
 	}
 
-	// get authorizer from environment in the following order:
-	// 1. client credentials (AZURE_TENANT_ID, AZURE_CLIENT_ID, AZURE_CLIENT_SECRET)
-	// 2. client certificate (AZURE_CERTIFICATE_PATH, AZURE_CERTIFICATE_PASSWORD)
-	// 3. username and password (AZURE_USERNAME, AZURE_PASSWORD)
-	// 4. MSI (managed service identity)
-	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	credential, err := getStorageAccountCredential(credentials, config)
 	if err != nil {
-		return "", nil, errors.Wrap(err, "error getting authorizer from environment")
+		return nil, nil, env, err
 	}
 
-	// get storageAccountsClient
-	storageAccountsClient := storagemgmt.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
-	storageAccountsClient.Authorizer = authorizer
+	return credential, credentials, env, nil
+}
 
-	// get storage key
-	res, err := storageAccountsClient.ListKeys(context.TODO(), config[resourceGroupConfigKey], config[storageAccountConfigKey], storagemgmt.Kerb)
-	if err != nil {
-		return "", env, errors.WithStack(err)
+// newStorageClient returns a storage client for the given account authorized
+// with the given credential, using the given storage API version, or the
+// storage SDK's if empty. Clients authorized with a SAS use the SAS's version.
+func newStorageClient(accountName string, credential *storageCredential, env *azure.Environment, apiVersion string) (storage.Client, error) {
+	if apiVersion == "" {
+		apiVersion = storage.DefaultAPIVersion
 	}
-	if res.Keys == nil || len(*res.Keys) == 0 {
-		return "", env, errors.New("No storage keys found")
+
+	// the emulator's account is addressed by path, at Azurite's default
+	// endpoint, over HTTP
+	baseURL, useHTTPS := env.StorageEndpointSuffix, true
+	if accountName == storage.StorageEmulatorAccountName {
+		baseURL, useHTTPS = storage.DefaultBaseURL, false
 	}
 
-	var storageKey string
-	for _, key := range *res.Keys {
-		// uppercase both strings for comparison because the ListKeys call returns e.g. "FULL" but
-		// the storagemgmt.Full constant in the SDK is defined as "Full".
-		if strings.ToUpper(string(key.Permissions)) == strings.ToUpper(string(storagemgmt.Full)) {
-			storageKey = *key.Value
-			break
+	if credential.sasToken != "" {
+		sas, err := url.ParseQuery(credential.sasToken)
+		if err != nil {
+			return storage.Client{}, errors.Wrap(err, "unable to parse storage account SAS")
 		}
+		return storage.NewAccountSASClient(accountName, sas, *env), nil
+	}
+
+	// the client can only sign requests with a key, so with a token it gets a
+	// placeholder key, whose signature credential.sender replaces
+	if credential.token != nil {
+		return storage.NewClient(accountName, tokenPlaceholderAccountKey, baseURL, apiVersion, useHTTPS)
+	}
+
+	return storage.NewClient(accountName, credential.accountKey, baseURL, apiVersion, useHTTPS)
+}
+
+// newSecondaryBlobClient returns a blob client for a storage account other
+// than the location's, such as a mirror's or a replica's, whose account and
+// credential are set in config. The account is reached like the location's,
+// with the same retries, blob domain and endpoint settings.
+func newSecondaryBlobClient(config map[string]string) (storage.BlobStorageClient, error) {
+	account := config[storageAccountConfigKey]
+
+	credential, _, env, err := getStorageCredential(config)
+	if err != nil {
+		return storage.BlobStorageClient{}, err
+	}
+	client, err := newStorageClient(account, credential, env, config[storageAPIVersionConfigKey])
+	if err != nil {
+		return storage.BlobStorageClient{}, err
 	}
+	quirks, err := quirksFor(env).withStorageRetryConfig(config)
+	if err != nil {
+		return storage.BlobStorageClient{}, err
+	}
+	client.Sender = credential.sender(quirks.storageSender())
 
-	if storageKey == "" {
-		return "", env, errors.New("No storage key with Full permissions found")
+	blobDomain, err := getBlobDomain(config)
+	if err != nil {
+		return storage.BlobStorageClient{}, err
+	}
+	endpointHost := account + ".blob." + env.StorageEndpointSuffix
+	if blobDomain != "" {
+		endpointHost = account + "." + blobDomain
+		client.Sender = &blobDomainSender{host: endpointHost, next: client.Sender}
+	}
+	httpClient, err := newEndpointHTTPClient(config, endpointHost)
+	if err != nil {
+		return storage.BlobStorageClient{}, err
+	}
+	if httpClient != nil {
+		client.HTTPClient = httpClient
 	}
 
-	return storageKey, env, nil
+	return client.GetBlobService(), nil
 }
 
 func mapLookup(data map[string]string) func(string) string {
@@ -244,45 +443,655 @@ func mapLookup(data map[string]string) func(string) string {
 }
 
 func (o *ObjectStore) Init(config map[string]string) error {
-	if err := veleroplugin.ValidateObjectStoreConfigKeys(config,
+	if err := validateObjectStoreConfigKeys(config,
 		resourceGroupConfigKey,
 		storageAccountConfigKey,
 		subscriptionIDConfigKey,
 		blockSizeConfigKey,
+		uploadConcurrencyConfigKey,
+		maxUploadBuffersConfigKey,
+		controlPollIntervalConfigKey,
 		storageAccountKeyEnvVarConfigKey,
+		storageAccountSASEnvVarConfigKey,
+		storageAccountConnectionStringEnvVarConfigKey,
 		credentialsFileConfigKey,
+		resourceManagerEndpointConfigKey,
+		cloudNameConfigKey,
+		storageAPIVersionConfigKey,
+		storageManagementAPIVersionConfigKey,
+		useEmulatorConfigKey,
+		storageAccountURIConfigKey,
+		blobDomainConfigKey,
+		blockBlobAccessTierConfigKey,
+		rehydrateArchivedObjectsConfigKey,
+		rehydratePriorityConfigKey,
+		immutabilityPeriodDaysConfigKey,
+		immutabilityPolicyModeConfigKey,
+		legalHoldConfigKey,
+		requireImmutableStorageConfigKey,
+		reuseUnchangedBlocksConfigKey,
+		labelUploadsConfigKey,
+		blobTagTemplatesConfigKey,
+		customerProvidedKeyEnvVarConfigKey,
+		storageEncryptionScopeConfigKey,
+		failureSummariesConfigKey,
+		prefetchObjectsConfigKey,
+		enforceDataProtectionConfigKey,
+		catalogIndexConfigKey,
+		clusterNameConfigKey,
+		replicationStorageAccountConfigKey,
+		replicationStorageAccountKeyEnvVarConfigKey,
+		replicationBucketConfigKey,
+		replicationBackupPrefixesConfigKey,
+		readFromReplicaConfigKey,
+		readCacheURLConfigKey,
+		storageEndpointIPsConfigKey,
+		dnsServerConfigKey,
+		proxyURLConfigKey,
+		bandwidthScheduleConfigKey,
+		insecureSkipTLSVerifyConfigKey,
+		metricsBindAddressConfigKey,
+		maxObjectSizeConfigKey,
+		packSmallObjectsConfigKey,
+		detectConfigDriftConfigKey,
+		auditLogConfigKey,
+		mirrorLocationsConfigKey,
+		mirrorStorageAccountKeyEnvVarsConfigKey,
+		redactLogSecretsConfigKey,
+		logRedactionPatternsConfigKey,
+		circuitBreakerFailuresConfigKey,
+		circuitBreakerCooldownConfigKey,
+		storageMaxTriesConfigKey,
+		storageTryTimeoutConfigKey,
+		operationTimeoutConfigKey,
+		storageRetryDelayConfigKey,
+		storageMaxRetryDelayConfigKey,
+		inlineLogURLsConfigKey,
+		sasAccessPolicyConfigKey,
+		operationJournalConfigKey,
+		latencyBaselineConfigKey,
+		resourceGraphQueriesConfigKey,
+		useAADConfigKey,
+		clientIDConfigKey,
+		keyVaultNameConfigKey,
+		keyVaultSecretNameConfigKey,
+		profileConfigKey,
+		recordDiagnosticsConfigKey,
 	); err != nil {
 		return err
 	}
 
-	storageAccountKey, env, err := getStorageAccountKey(config)
+	config, err := withPerformanceProfile(config, objectStoreKind)
+	if err != nil {
+		return err
+	}
+
+	// keep recent errors, logs and latencies for the support-bundle command,
+	// unless config["recordDiagnostics"] is false
+	recordDiagnostics, err := getRecordDiagnostics(config)
+	if err != nil {
+		return err
+	}
+	if recordDiagnostics {
+		startDiagnostics(o.log)
+	}
+
+	// locations sharing their objects with another location must share its
+	// settings too
+	if err := checkSharedLocation(o.log, config); err != nil {
+		return err
+	}
+
+	enforceDataProtection, err := getEnforceDataProtection(config)
+	if err != nil {
+		return err
+	}
+
+	credentials, env, err := getCredentialProvider(config)
+	if err != nil {
+		return err
+	}
+	// config.useAAD was validated by getCredentialProvider
+	o.useAAD = boolConfig(config, useAADConfigKey)
+
+	if val := config[storageAPIVersionConfigKey]; val != "" {
+		if _, err := time.Parse("2006-01-02", val); err != nil {
+			return errors.Errorf("unable to parse value %q for config key %q (expected a storage API version, e.g. 2017-11-09)", val, storageAPIVersionConfigKey)
+		}
+	}
+	if _, err := getARMAPIVersion(config, storageManagementAPIVersionConfigKey); err != nil {
+		return err
+	}
+
+	// if config["storageAccountURI"] or config["useEmulator"] is set, a
+	// storage emulator is used instead of a storage account
+	emulatorURI, err := getStorageEmulatorURI(config)
 	if err != nil {
 		return err
 	}
 
+	// a connection string or an emulator also names the storage account
+	var accountName string
+	if p, ok := credentials.(*connectionStringCredentialProvider); ok {
+		accountName = p.connectionString.accountName
+	} else if emulatorURI != nil {
+		accountName = storage.StorageEmulatorAccountName
+	}
+	if accountName != "" && config[storageAccountConfigKey] == "" {
+		withAccount := map[string]string{storageAccountConfigKey: accountName}
+		for k, v := range config {
+			if k != storageAccountConfigKey {
+				withAccount[k] = v
+			}
+		}
+		config = withAccount
+	}
+
 	// 6. get storageClient and blobClient
 	if _, err := getRequiredValues(mapLookup(config), storageAccountConfigKey); err != nil {
 		return errors.Wrap(err, "unable to get all required config values")
 	}
 
-	storageClient, err := storage.NewBasicClientOnSovereignCloud(config[storageAccountConfigKey], storageAccountKey, *env)
+	breakers, err := getCircuitBreakers(o.log, config)
+	if err != nil {
+		return err
+	}
+
+	quirks, err := quirksFor(env).withStorageRetryConfig(config)
+	if err != nil {
+		return err
+	}
+
+	if o.blobDomain, err = getBlobDomain(config); err != nil {
+		return err
+	}
+	if o.blobDomain != "" && emulatorURI != nil {
+		return errors.Errorf("config key %q can't be used with a storage emulator", blobDomainConfigKey)
+	}
+
+	endpointHost := config[storageAccountConfigKey] + ".blob." + env.StorageEndpointSuffix
+	if o.blobDomain != "" {
+		endpointHost = config[storageAccountConfigKey] + "." + o.blobDomain
+	}
+	if emulatorURI != nil {
+		endpointHost = emulatorURI.Hostname()
+	}
+	httpClient, err := newEndpointHTTPClient(config, endpointHost)
 	if err != nil {
-		return errors.Wrap(err, "error getting storage client")
+		return err
+	}
+	// if config["bandwidthSchedule"] is set, the bandwidth of the storage
+	// account's requests is limited according to the time of day
+	schedule, err := getBandwidthSchedule(config)
+	if err != nil {
+		return err
+	}
+	if schedule != nil {
+		limiter := getBandwidthLimiter(config[storageAccountConfigKey]+"/"+config[bucketConfigKey]+"/"+config[prefixConfigKey], schedule)
+		httpClient = withBandwidthLimit(httpClient, limiter)
+	}
+	if boolConfig(config, insecureSkipTLSVerifyConfigKey) {
+		o.log.Warn("TLS certificate verification is disabled for the storage endpoint, which is only safe for emulators")
+	}
+
+	// if config["customerProvidedKeyEnvVar"] is set, blobs are encrypted
+	// with the key in that env var rather than with the account's keys
+	if o.customerKey, err = getCustomerProvidedKey(config); err != nil {
+		return err
+	}
+	// if config["storageEncryptionScope"] is set, blobs are written with that
+	// encryption scope rather than with the container's default one
+	if o.encryptionScope, err = getStorageEncryptionScope(config); err != nil {
+		return err
+	}
+
+	// the storage account's key may have to be looked up using the ARM API,
+	// so connect on first use, warming up in the background in the meantime
+	var blobService *lazyBlobService
+	blobService = newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+		credential, err := getStorageAccountCredential(credentials, config)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		storageClient, err := newStorageClient(config[storageAccountConfigKey], credential, env, config[storageAPIVersionConfigKey])
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error getting storage client")
+		}
+		storageClient.Sender = blobService.staleKeySender(o.log, credential, credential.sender(withCircuitBreakers(quirks.storageSender(), breakers)))
+		if httpClient != nil {
+			storageClient.HTTPClient = httpClient
+		}
+		if emulatorURI != nil {
+			storageClient.Sender = &emulatorSender{uri: emulatorURI, next: storageClient.Sender}
+		}
+		if o.blobDomain != "" {
+			storageClient.Sender = &blobDomainSender{host: endpointHost, next: storageClient.Sender}
+		}
+		if o.customerKey != nil {
+			storageClient.Sender = &customerProvidedKeySender{
+				key:        o.customerKey,
+				account:    config[storageAccountConfigKey],
+				accountKey: credential.accountKey,
+				next:       storageClient.Sender,
+			}
+		}
+		if o.encryptionScope != "" {
+			storageClient.Sender = &encryptionScopeSender{
+				scope:      o.encryptionScope,
+				account:    config[storageAccountConfigKey],
+				accountKey: credential.accountKey,
+				next:       storageClient.Sender,
+			}
+		}
+
+		return &storageClient, credential, nil
+	})
+	blobService.warmUp(o.log)
+
+	// inspecting the account's data protection settings requires ARM access, so
+	// it's only possible when the account's subscription and resource group are known
+	if subscriptionID := getSubscriptionID(config); subscriptionID != "" && config[resourceGroupConfigKey] != "" {
+		resourceGroup, storageAccount := config[resourceGroupConfigKey], config[storageAccountConfigKey]
+		check := func() error {
+			client, err := newBlobServicePropertiesClient(credentials, env, subscriptionID)
+			if err != nil {
+				return err
+			}
+			return checkDataProtection(o.log, client, resourceGroup, storageAccount, enforceDataProtection)
+		}
+
+		if enforceDataProtection {
+			if err := check(); err != nil {
+				return errors.Wrap(err, "unable to enforce data protection settings")
+			}
+		} else {
+			// the check is advisory, so run it once per process in the background
+			// rather than making every operation depend on ARM being reachable
+			log := o.log
+			startBackgroundTask("data-protection-check/"+subscriptionID+"/"+resourceGroup+"/"+storageAccount, func() {
+				if err := check(); err != nil {
+					log.WithError(err).Warn("Unable to check the storage account's data protection settings")
+				}
+			})
+		}
+
+		log := o.log
+		startBackgroundTask("account-suitability-check/"+subscriptionID+"/"+resourceGroup+"/"+storageAccount, func() {
+			client, err := newAccountPropertiesClient(credentials, env, subscriptionID)
+			if err == nil {
+				err = checkAccountSuitability(log, client, resourceGroup, storageAccount)
+			}
+			if err != nil {
+				log.WithError(err).Warn("Unable to check the storage account's suitability for backups")
+			}
+		})
+	} else if enforceDataProtection {
+		return errors.Errorf("config.%s requires the storage account's subscription and resource group", enforceDataProtectionConfigKey)
 	}
 
-	blobClient := storageClient.GetBlobService()
-	o.containerGetter = &azureContainerGetter{
-		blobService: &blobClient,
+	o.containerGetter = &lazyContainerGetter{service: blobService}
+	o.blobGetter = &lazyBlobGetter{service: blobService}
+	o.blobService = blobService
+	if o.operationTimeout, err = getOperationTimeout(config); err != nil {
+		return err
 	}
-	o.blobGetter = &azureBlobGetter{
-		blobService: &blobClient,
+
+	// with AAD tokens, there's no account key to sign URLs with, so they're
+	// signed with user delegation keys instead
+	if o.useAAD {
+		o.delegationSigner = newUserDelegationSigner(config[storageAccountConfigKey], blobService)
+	}
+
+	// the storage client's requests are only redirected to the account's blob
+	// endpoint, so directories are only deleted on accounts in Azure
+	if emulatorURI == nil && o.blobDomain == "" {
+		o.directories = &azureDirectoryDeleter{account: config[storageAccountConfigKey], service: blobService}
 	}
 
 	o.blockSize = getBlockSize(o.log, config)
+	if o.uploadConcurrency, o.uploadBuffers, err = getUploadConcurrency(config); err != nil {
+		return err
+	}
+
+	if o.reuseBlocks, err = getReuseUnchangedBlocks(config); err != nil {
+		return err
+	}
+
+	if o.accessTier, err = getBlockBlobAccessTier(config); err != nil {
+		return err
+	}
+	if o.rehydratePriority, err = getRehydratePriority(config); err != nil {
+		return err
+	}
+	// uploads are only tiered if o.accessTier is set, but objects are also
+	// tiered by the tier-old-backups command, and may have been archived by
+	// lifecycle management policies, so archived objects are recognized
+	// whatever the location's tier
+	tiers := &azureAccessTierSetter{account: config[storageAccountConfigKey], service: blobService}
+	o.tierSetter = tiers
+	o.archived = tiers
+
+	if o.labeler, err = newUploadLabeler(o.log, config, &azureBlobTagger{account: config[storageAccountConfigKey], service: blobService}); err != nil {
+		return err
+	}
+
+	if o.immutability, err = getImmutabilitySettings(config); err != nil {
+		return err
+	}
+	if o.immutability != nil {
+		o.immutableBlobs = &azureImmutableBlobs{account: config[storageAccountConfigKey], service: blobService}
+		log, immutableBlobs, bucket := o.log, o.immutableBlobs, config[bucketConfigKey]
+		startBackgroundTask("immutability-check/"+config[storageAccountConfigKey]+"/"+bucket, func() {
+			if err := checkImmutabilitySupport(immutableBlobs, bucket); err != nil {
+				log.WithError(err).Warn("Unable to verify the container's immutability support")
+			}
+		})
+	}
+
+	// locations required to be immutable refuse to run on containers whose
+	// objects could be modified or deleted
+	requireImmutableStorage, err := getRequireImmutableStorage(config)
+	if err != nil {
+		return err
+	}
+	if requireImmutableStorage {
+		immutableBlobs := o.immutableBlobs
+		if immutableBlobs == nil {
+			immutableBlobs = &azureImmutableBlobs{account: config[storageAccountConfigKey], service: blobService}
+		}
+		if err := checkImmutableStorage(immutableBlobs, config[bucketConfigKey], o.immutability); err != nil {
+			return err
+		}
+	}
+
+	if o.maxObjectSize, err = getMaxObjectSize(config); err != nil {
+		return err
+	}
+
+	window, err := getPrefetchWindow(config)
+	if err != nil {
+		return err
+	}
+	if window > 0 {
+		o.prefetcher = newPrefetcher(o.log, o.blobGetter, window)
+	}
+
+	if val := config[catalogIndexConfigKey]; val != "" {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, catalogIndexConfigKey)
+		}
+		if enabled {
+			if config[clusterNameConfigKey] == "" {
+				return errors.Errorf("config.%s is required when config.%s is enabled", clusterNameConfigKey, catalogIndexConfigKey)
+			}
+			o.catalog = &catalogIndex{
+				log:        o.log,
+				blobGetter: o.blobGetter,
+				cluster:    config[clusterNameConfigKey],
+				prefix:     config[prefixConfigKey],
+			}
+		}
+	}
+
+	failureSummaries, err := getFailureSummaries(config)
+	if err != nil {
+		return err
+	}
+	if failureSummaries {
+		o.failures = &failureSummarizer{
+			log:             o.log,
+			blobGetter:      o.blobGetter,
+			prefix:          config[prefixConfigKey],
+			readDiagnostics: readPluginDiagnostics,
+			now:             time.Now,
+		}
+	}
+
+	resourceGraphQueries, err := getResourceGraphQueries(config)
+	if err != nil {
+		return err
+	}
+	if resourceGraphQueries {
+		o.resourceGraph = &resourceGraphRecorder{
+			log: o.log,
+			store: &metadataStore{
+				blobGetter: o.blobGetter,
+				bucket:     config[bucketConfigKey],
+				prefix:     config[prefixConfigKey],
+			},
+			prefix: config[prefixConfigKey],
+			now:    time.Now,
+		}
+	}
+
+	readFromReplica, err := getReadFromReplica(config)
+	if err != nil {
+		return err
+	}
+
+	replicator, err := newReplicator(o.log, config, o.containerGetter, o.blobGetter)
+	if err != nil {
+		return err
+	}
+	if replicator != nil {
+		o.replicator = replicator
+		o.readFromReplica = readFromReplica
+		startBackgroundTask("replication/"+config[storageAccountConfigKey]+"/"+config[bucketConfigKey]+"/"+config[prefixConfigKey], func() {
+			replicator.run(config[bucketConfigKey])
+		})
+	} else if readFromReplica {
+		return errors.Errorf("config.%s requires config.%s", readFromReplicaConfigKey, replicationStorageAccountConfigKey)
+	}
+
+	// if config["readCacheURL"] is set, objects are read through that CDN or
+	// Front Door endpoint with signed URLs
+	readCacheURL, err := getReadCacheURL(config)
+	if err != nil {
+		return err
+	}
+	if readCacheURL != nil {
+		if !signedURLsAvailable(config) {
+			return errors.Errorf("config.%s requires signed URLs, which can't be created with this location's credentials or encryption", readCacheURLConfigKey)
+		}
+		o.readCache = newReadCache(readCacheURL, o.signURL)
+	}
+
+	packSmallObjects, err := getPackSmallObjects(config)
+	if err != nil {
+		return err
+	}
+	if packSmallObjects {
+		packer := &packer{
+			log:        o.log,
+			containers: o.containerGetter,
+			blobs:      o.blobGetter,
+			prefix:     config[prefixConfigKey],
+		}
+		o.packer = packer
+		startBackgroundTask("pack/"+config[storageAccountConfigKey]+"/"+config[bucketConfigKey]+"/"+config[prefixConfigKey], func() {
+			packer.run(config[bucketConfigKey])
+		})
+	}
+
+	if config[mirrorLocationsConfigKey] != "" {
+		// objects are copied from URLs signed with the location's account key,
+		// and the storage service can't reach an emulator to copy from it
+		if !accountSASAvailable(config) {
+			return errors.Errorf("config.%s requires the location's storage account key, since objects are mirrored from URLs signed with it", mirrorLocationsConfigKey)
+		}
+		if emulatorURI != nil {
+			return errors.Errorf("config.%s can't be used with a storage emulator", mirrorLocationsConfigKey)
+		}
+
+		mirror, err := getFanOutMirror(o.log, "mirror/"+config[storageAccountConfigKey]+"/"+config[bucketConfigKey]+"/"+config[prefixConfigKey]+"/"+config[mirrorLocationsConfigKey], o.blobGetter, o.containerGetter, config[bucketConfigKey], config[prefixConfigKey], func() ([]mirrorTarget, error) {
+			return newMirrorTargets(config)
+		})
+		if err != nil {
+			return err
+		}
+		o.mirror = mirror
+	}
+
+	if val := config[inlineLogURLsConfigKey]; val != "" {
+		if o.inlineLogURLs, err = strconv.ParseBool(val); err != nil {
+			return errors.Errorf("unable to parse value %q for config key %q (expected a boolean value)", val, inlineLogURLsConfigKey)
+		}
+	}
+
+	// if config["sasAccessPolicy"] is set, signed URLs reference that stored
+	// access policy, so they can be revoked by deleting it
+	if o.sasAccessPolicy, err = getSASAccessPolicy(config); err != nil {
+		return err
+	}
+	// stored access policies only apply to URLs signed with the account's key
+	if o.sasAccessPolicy != "" && o.useAAD {
+		return errors.Errorf("config key %q can't be combined with %q, since URLs are then signed with a user delegation key", sasAccessPolicyConfigKey, useAADConfigKey)
+	}
+
+	redactLogSecrets, err := getRedactLogSecrets(config)
+	if err != nil {
+		return err
+	}
+	if redactLogSecrets {
+		if o.redactor, err = newLogRedactor(o.log, config); err != nil {
+			return err
+		}
+	}
+
+	auditLog, err := getAuditLog(config)
+	if err != nil {
+		return err
+	}
+	if auditLog {
+		o.audit = newAuditLog(o.log, &metadataStore{
+			blobGetter: o.blobGetter,
+			bucket:     config[bucketConfigKey],
+			prefix:     config[prefixConfigKey],
+		}, config)
+	}
+
+	// if config["operationJournal"] is set, uploads in progress are recorded
+	// in the container, and the blocks staged by those a stopped plugin
+	// process left unfinished are discarded
+	operationJournal, err := getOperationJournal(config)
+	if err != nil {
+		return err
+	}
+	if operationJournal {
+		o.journal = newOperationJournal(o.log, &metadataStore{
+			containers: o.containerGetter,
+			blobGetter: o.blobGetter,
+			bucket:     config[bucketConfigKey],
+			prefix:     config[prefixConfigKey],
+		})
+		log, journal, blobGetter := o.log, o.journal, o.blobGetter
+		startBackgroundTask("journal/uploads/"+config[storageAccountConfigKey]+"/"+config[bucketConfigKey]+"/"+config[prefixConfigKey], func() {
+			journal.run(map[string]func(journalEntry) error{
+				journalKindUpload: func(entry journalEntry) error {
+					bucket, key, err := splitUploadTarget(entry.Target)
+					if err != nil {
+						return err
+					}
+					return recoverUpload(log, blobGetter, bucket, key)
+				},
+			})
+		})
+	}
+
+	// if config["controlPollInterval"] is set, the location's control object
+	// adjusts the plugin while it runs
+	controlPollInterval, err := getControlPollInterval(config)
+	if err != nil {
+		return err
+	}
+	if controlPollInterval > 0 {
+		o.controlKey = config[storageAccountConfigKey] + "/" + config[bucketConfigKey] + "/" + config[prefixConfigKey]
+		poller := newControlPoller(o.log, &metadataStore{
+			blobGetter: o.blobGetter,
+			bucket:     config[bucketConfigKey],
+			prefix:     config[prefixConfigKey],
+		}, o.controlKey)
+		startBackgroundTask("runtime-control/"+o.controlKey, func() {
+			poller.run(controlPollInterval)
+		})
+	}
+
+	// if config["latencyBaseline"] is set, the storage service's latency is
+	// compared with the baseline in the location's heartbeat object
+	latencyBaselineEnabled, err := getLatencyBaseline(config)
+	if err != nil {
+		return err
+	}
+	if latencyBaselineEnabled {
+		baseline := &latencyBaseline{
+			log: o.log,
+			store: &metadataStore{
+				blobGetter: o.blobGetter,
+				bucket:     config[bucketConfigKey],
+				prefix:     config[prefixConfigKey],
+			},
+			now: time.Now,
+		}
+		log := o.log
+		startBackgroundTask("latency-baseline/"+config[storageAccountConfigKey]+"/"+config[bucketConfigKey]+"/"+config[prefixConfigKey], func() {
+			if err := baseline.check(); err != nil {
+				log.WithError(err).Warn("Unable to compare the storage latency with its baseline")
+			}
+		})
+	}
+
+	detectConfigDrift, err := getDetectConfigDrift(config)
+	if err != nil {
+		return err
+	}
+	if detectConfigDrift {
+		log, blobGetter := o.log, o.blobGetter
+		startBackgroundTask("config-drift/"+config[storageAccountConfigKey]+"/"+config[bucketConfigKey]+"/"+config[prefixConfigKey]+"/"+settingsDigest(sharedSettings(config)), func() {
+			_, credential, err := blobService.get()
+			if err == nil {
+				err = newConfigDriftDetector(log, blobGetter, config, credential.accountKey).check(config, time.Now())
+			}
+			if err != nil {
+				log.WithError(err).Warn("Unable to check the location's config for drift")
+			}
+		})
+	}
+
+	if addr := config[metricsBindAddressConfigKey]; addr != "" {
+		startMetricsServer(o.log, addr)
+	}
+
+	logCapabilities(o.log, objectStoreKind, objectStoreCapabilities(config))
 
 	return nil
 }
 
+// getMaxObjectSize returns the configured maximum object size in bytes, or 0
+// if there's no maximum.
+func getMaxObjectSize(config map[string]string) (int64, error) {
+	val := config[maxObjectSizeConfigKey]
+	if val == "" {
+		return 0, nil
+	}
+
+	size, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, errors.Errorf("unable to parse value %q for config key %q (expected a positive integer)", val, maxObjectSizeConfigKey)
+	}
+
+	return size << 30, nil
+}
+
+// errObjectTooLarge returns the error for an upload that would exceed the
+// configured maximum object size.
+func errObjectTooLarge(key string, maxObjectSize int64) error {
+	return errors.Errorf("object %s is larger than config.%s (%d GiB), aborting upload; "+
+		"back up large volumes with snapshots or file system backup, which splits "+
+		"volume data into small objects, or exclude them from the backup", key, maxObjectSizeConfigKey, maxObjectSize>>30)
+}
+
 func getBlockSize(log logrus.FieldLogger, config map[string]string) int {
 	val, ok := config[blockSizeConfigKey]
 	if !ok {
@@ -305,37 +1114,157 @@ func getBlockSize(log logrus.FieldLogger, config map[string]string) int {
 }
 
 func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) error {
-	blob, err := o.blobGetter.getBlob(bucket, key)
+	if err := validateObjectKey(key); err != nil {
+		return err
+	}
+
+	// contents prefetched before the object was written are stale, whether
+	// or not the write succeeds
+	if o.prefetcher != nil {
+		defer o.prefetcher.invalidate(bucket, key)
+	}
+
+	blobGetter, _ := o.operationGetters()
+	blob, err := blobGetter.getBlob(bucket, key)
 	if err != nil {
 		return err
 	}
 
+	// when the body's size is known up front, reject it before uploading anything
+	if sized, ok := body.(interface{ Len() int }); ok && o.maxObjectSize > 0 && int64(sized.Len()) > o.maxObjectSize {
+		return errObjectTooLarge(key, o.maxObjectSize)
+	}
+
+	if o.redactor != nil && strings.HasSuffix(key, logsObjectSuffix) {
+		redactedBody := o.redactor.redact(key, body)
+		defer redactedBody.Close()
+		body = redactedBody
+	}
+
+	// keep a copy of backup metadata files to read the backup's status,
+	// schedule and expiration
+	var metadata *limitedBuffer
+	if o.failures != nil {
+		metadata = o.failures.metadataBuffer(key)
+	}
+	if metadata == nil && o.labeler != nil {
+		metadata = o.labeler.metadataBuffer(key)
+	}
+	if metadata != nil {
+		body = io.TeeReader(body, metadata)
+	}
+
+	// and of volume snapshots files, to list the backup's snapshots
+	var snapshots *limitedBuffer
+	if o.resourceGraph != nil {
+		snapshots = o.resourceGraph.snapshotsBuffer(key)
+	}
+	if snapshots != nil {
+		body = io.TeeReader(body, snapshots)
+	}
+
 	// Azure requires a blob/object to be chunked if it's larger than 256MB. Since we
 	// don't know ahead of time if the body is over this limit or not, and it would
 	// require reading the entire object into memory to determine the size, we use the
 	// chunking approach for all objects.
+	//
+	// Staged blocks aren't visible until the block list is committed, which
+	// replaces the blob's content atomically, so readers never observe a
+	// partially written object, such as velero-backup.json, on accounts with
+	// or without a hierarchical namespace.
+
+	if o.journal != nil {
+		id, err := o.journal.begin(journalKindUpload, bucket+"/"+key)
+		if err != nil {
+			o.log.WithError(err).WithField("key", key).Warn("Unable to record upload in the operation journal")
+		} else {
+			defer func() {
+				if err := o.journal.end(id); err != nil {
+					o.log.WithError(err).WithField("key", key).Warn("Unable to record the end of upload in the operation journal")
+				}
+			}()
+		}
+	}
+
+	// restore results may be uploaded by concurrent retries, so guard
+	// their uploads against each other
+	var guard *guardedUpload
+	if isRestoreResultsKey(key) {
+		if guard, err = newGuardedUpload(blob); err != nil {
+			return err
+		}
+	}
 
 	var (
-		block    = make([]byte, o.blockSize)
-		blockIDs []storage.Block
+		blockIDs      []storage.Block
+		commitOptions *storage.PutBlockListOptions
+		timings       = newUploadTimings()
 	)
+	if guard != nil {
+		commitOptions = guard.commit
+	}
+	defer timings.done(bucket + "/" + key)
+
+	// blocks are identified by their content, so that those the object
+	// already has don't have to be uploaded again. Guarded uploads have
+	// blocks of their own
+	var committed map[string]bool
+	if o.reuseBlocks && guard == nil {
+		if committed, err = committedBlocks(blob); err != nil {
+			o.log.WithError(err).WithField("key", key).Warn("Unable to get the object's blocks to reuse, uploading every block")
+		}
+	}
+
+	concurrency, buffers := o.uploadSettings()
+	stager := newBlockStager(blob, timings, o.blockSize, concurrency, buffers)
+	defer stager.wait()
 
 	for {
-		n, err := body.Read(block)
+		var n int
+		block := stager.buffer()
+		err := timings.time(uploadStageRead, func() error {
+			var err error
+			n, err = body.Read(block)
+			return err
+		})
 		if n > 0 {
+			// the staged blocks are never committed, so the service discards them
+			if o.maxObjectSize > 0 && timings.bytes+int64(n) > o.maxObjectSize {
+				stager.release(block)
+				return errObjectTooLarge(key, o.maxObjectSize)
+			}
+
 			// blockID needs to be the same length for all blocks, so use a fixed width.
 			// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/put-block#uri-parameters
 			blockID := fmt.Sprintf("%08d", len(blockIDs))
+			if guard != nil {
+				blockID = guard.blockID(len(blockIDs))
+			} else if o.reuseBlocks {
+				blockID = contentBlockID(block[0:n])
+			}
 
-			o.log.Debugf("Putting block (id=%s) of length %d", blockID, n)
-			if putErr := blob.PutBlock(blockID, block[0:n], nil); putErr != nil {
-				return errors.Wrapf(putErr, "error putting block %s", blockID)
+			status := storage.BlockStatusLatest
+			if committed[blockID] {
+				o.log.Debugf("Reusing committed block (id=%s) of length %d", blockID, n)
+				status = storage.BlockStatusCommitted
+				uploadReusedBytes.Add(int64(n))
+				stager.release(block)
+			} else {
+				o.log.Debugf("Putting block (id=%s) of length %d", blockID, n)
+				if putErr := stager.stage(blockID, block[0:n]); putErr != nil {
+					return putErr
+				}
 			}
 
 			blockIDs = append(blockIDs, storage.Block{
 				ID:     blockID,
-				Status: storage.BlockStatusLatest,
+				Status: status,
 			})
+			timings.bytes += int64(n)
+			timings.blocks++
+			timings.reportProgress(o.log.WithField("key", key), bucket+"/"+key, time.Now())
+		} else {
+			stager.release(block)
 		}
 
 		// got an io.EOF: we're done reading chunks from the body
@@ -348,16 +1277,94 @@ func (o *ObjectStore) PutObject(bucket, key string, body io.Reader) error {
 		}
 	}
 
+	if err := stager.wait(); err != nil {
+		return err
+	}
+
 	o.log.Debugf("Putting block list %v", blockIDs)
-	if err := blob.PutBlockList(blockIDs, nil); err != nil {
+	if err := timings.time(uploadStageCommit, func() error {
+		return blob.PutBlockList(blockIDs, commitOptions)
+	}); err != nil {
+		if guard != nil && isAppendConflict(err) {
+			// a concurrent retry committed its complete version first
+			o.log.WithField("key", key).Info("Object was written concurrently by a retried operation, keeping that version")
+			return nil
+		}
 		return errors.Wrap(err, "error putting block list")
 	}
 
+	timings.record(o.log)
+
+	// labels are set first, since metadata can't be changed once the object
+	// is protected
+	if o.labeler != nil {
+		o.labeler.label(blob, bucket, key, metadata)
+	}
+
+	// backups that can't be protected mustn't look like they are, so failing
+	// to protect an object fails its upload
+	if o.immutability != nil {
+		if err := o.immutability.apply(o.immutableBlobs, bucket, key, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	// the blob is tiered once it's committed, since the storage API version the
+	// client uses can't set a tier on commit. Failing to tier it doesn't lose
+	// any data, so it doesn't fail the upload
+	if tier := accessTierFor(o.accessTier, key); tier != "" {
+		err := o.tierSetter.setAccessTier(bucket, key, tier)
+		if err != nil {
+			o.log.WithError(err).WithFields(logrus.Fields{"key": key, "tier": tier}).Warn("Unable to move object to its access tier, it stays in the storage account's default tier")
+		}
+		if o.audit != nil {
+			o.audit.recordAccessTier(bucket+"/"+key, tier, err)
+		}
+	}
+
+	if o.catalog != nil {
+		o.catalog.recordPut(bucket, key)
+	}
+
+	if o.failures != nil {
+		o.failures.recordPut(bucket, key, metadata)
+	}
+
+	if o.resourceGraph != nil {
+		o.resourceGraph.recordPut(key, snapshots)
+	}
+
+	if o.mirror != nil {
+		o.mirror.enqueue(mirrorPut, bucket, key)
+	}
+
+	if o.replicator != nil {
+		o.replicator.written(key)
+	}
+
 	return nil
 }
 
 func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
-	blob, err := o.blobGetter.getBlob(bucket, key)
+	// the empty key addresses the container, which isn't an object
+	if key == "" {
+		return false, errEmptyObjectKey
+	}
+
+	// Velero checks the same objects from several goroutines at once, e.g.
+	// while syncing backups, so identical checks share a single request
+	exists, err := o.existsCalls.do(bucket+"/"+key, func() (interface{}, error) {
+		return o.objectExists(bucket, key)
+	})
+	if err != nil {
+		return false, err
+	}
+	return exists.(bool), nil
+}
+
+func (o *ObjectStore) objectExists(bucket, key string) (bool, error) {
+	blobGetter, _ := o.operationGetters()
+	blob, err := blobGetter.getBlob(bucket, key)
 	if err != nil {
 		return false, err
 	}
@@ -367,21 +1374,64 @@ func (o *ObjectStore) ObjectExists(bucket, key string) (bool, error) {
 		return false, errors.WithStack(err)
 	}
 
+	if !exists && o.packer != nil {
+		return o.packer.exists(bucket, key)
+	}
+
 	return exists, nil
 }
 
 func (o *ObjectStore) GetObject(bucket, key string) (io.ReadCloser, error) {
-	blob, err := o.blobGetter.getBlob(bucket, key)
+	if key == "" {
+		return nil, errEmptyObjectKey
+	}
+
+	if o.prefetcher != nil {
+		if data, ok := o.prefetcher.take(bucket, key); ok {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+
+	if o.readCache != nil {
+		res, err := o.readCache.get(bucket, key)
+		if err == nil {
+			return res, nil
+		}
+		if !isNotFound(err) {
+			o.log.WithError(err).WithField("key", key).Warn("Error reading object through the read cache, falling back to the storage account")
+		}
+	}
+
+	if o.readFromReplica {
+		res, err := o.replicator.get(bucket, key)
+		if err == nil {
+			return res, nil
+		}
+		if err != errNotReplicated && !isNotFound(err) {
+			o.log.WithError(err).WithField("key", key).Warn("Error reading object from replica, falling back to primary")
+		}
+	}
+
+	blobGetter, _ := o.operationGetters()
+	blob, err := blobGetter.getBlob(bucket, key)
 	if err != nil {
 		return nil, err
 	}
 
 	res, err := blob.Get(nil)
+	if isNotFound(err) && o.packer != nil {
+		if res, packErr := o.packer.get(bucket, key); !isNotFound(packErr) {
+			return res, packErr
+		}
+	}
+	if storageErrorCode(err) == blobArchivedCode && o.archived != nil {
+		return nil, archivedObject(o.archived, bucket, key, o.rehydratePriority, time.Now())
+	}
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	return res, nil
+	return newResumingReader(o.log.WithField("key", key), blob, res), nil
 }
 
 func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]string, error) {
@@ -412,7 +1462,8 @@ func (o *ObjectStore) ListCommonPrefixes(bucket, prefix, delimiter string) ([]st
 }
 
 func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
-	container, err := o.containerGetter.getContainer(bucket)
+	_, containerGetter := o.operationGetters()
+	container, err := containerGetter.getContainer(bucket)
 	if err != nil {
 		return nil, err
 	}
@@ -421,7 +1472,10 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 		Prefix: prefix,
 	}
 
-	var objects []string
+	var (
+		objects []string
+		blobs   []storage.Blob
+	)
 	for {
 		res, err := container.ListBlobs(params)
 		if err != nil {
@@ -430,28 +1484,135 @@ func (o *ObjectStore) ListObjects(bucket, prefix string) ([]string, error) {
 		for _, blob := range res.Blobs {
 			objects = append(objects, blob.Name)
 		}
+		blobs = append(blobs, res.Blobs...)
 		if res.NextMarker == "" {
 			break
 		}
 		params.Marker = res.NextMarker
 	}
 
+	if o.packer != nil {
+		if objects, err = o.packer.list(bucket, prefix, objects); err != nil {
+			return nil, err
+		}
+	}
+
+	// start downloading the listed objects in the background, since
+	// they're likely to be requested next
+	if o.prefetcher != nil {
+		o.prefetcher.reset(bucket, blobs)
+	}
+
 	return objects, nil
 }
 
 func (o *ObjectStore) DeleteObject(bucket string, key string) error {
-	blob, err := o.blobGetter.getBlob(bucket, key)
+	err := o.deleteObject(bucket, key)
+
+	if o.audit != nil {
+		o.audit.record(auditDeleteObject, bucket+"/"+key, err)
+	}
+
+	return err
+}
+
+func (o *ObjectStore) deleteObject(bucket string, key string) error {
+	if key == "" {
+		return errEmptyObjectKey
+	}
+
+	if o.prefetcher != nil {
+		defer o.prefetcher.invalidate(bucket, key)
+	}
+
+	// on accounts with a hierarchical namespace, prefixes are directories,
+	// which are deleted with everything in them at once
+	if strings.HasSuffix(key, "/") && o.directories != nil {
+		// the objects in the directory are listed first, since they're gone
+		// once it's deleted and what keeps track of them has to be told
+		var keys []string
+		if o.catalog != nil || o.resourceGraph != nil || o.mirror != nil || o.replicator != nil {
+			_, containerGetter := o.operationGetters()
+			container, err := containerGetter.getContainer(bucket)
+			if err != nil {
+				return err
+			}
+			blobs, _, err := listAllBlobs(container, storage.ListBlobsParameters{Prefix: key})
+			if err != nil {
+				return err
+			}
+			for _, b := range blobs {
+				keys = append(keys, b.Name)
+			}
+		}
+
+		deleted, err := o.directories.deleteDirectory(bucket, key)
+		if deleted {
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			for _, k := range keys {
+				o.recordDeleted(bucket, k)
+			}
+			return nil
+		}
+		if err != nil {
+			o.log.WithError(err).Debug("Unable to tell whether the storage account has a hierarchical namespace, deleting the key as a blob")
+		}
+	}
+
+	blobGetter, _ := o.operationGetters()
+	blob, err := blobGetter.getBlob(bucket, key)
 	if err != nil {
 		return err
 	}
 
-	return errors.WithStack(blob.Delete(nil))
+	if err := blob.Delete(nil); err != nil {
+		if !isNotFound(err) || o.packer == nil {
+			return errors.WithStack(err)
+		}
+		if packErr := o.packer.delete(bucket, key); packErr != nil {
+			if isNotFound(packErr) {
+				return errors.WithStack(err)
+			}
+			return packErr
+		}
+	}
+
+	o.recordDeleted(bucket, key)
+
+	return nil
+}
+
+// recordDeleted updates everything that keeps track of the location's
+// objects after the object at key was deleted.
+func (o *ObjectStore) recordDeleted(bucket, key string) {
+	if o.catalog != nil {
+		o.catalog.recordDelete(bucket, key)
+	}
+
+	if o.resourceGraph != nil {
+		o.resourceGraph.recordDelete(key)
+	}
+
+	if o.mirror != nil {
+		o.mirror.enqueue(mirrorDelete, bucket, key)
+	}
+
+	if o.replicator != nil {
+		o.replicator.remove(key)
+	}
 }
 
 func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (string, error) {
-	blob, err := o.blobGetter.getBlob(bucket, key)
-	if err != nil {
-		return "", err
+	if key == "" {
+		return "", errEmptyObjectKey
+	}
+
+	// reads of blobs encrypted with a customer-provided key must carry the key
+	// in their headers, which signed URLs can't
+	if o.customerKey != nil {
+		return "", errors.Errorf("signed URLs can't be created with config key %q set, since objects can only be read with their key", customerProvidedKeyEnvVarConfigKey)
 	}
 
 	opts := storage.BlobSASOptions{
@@ -463,5 +1624,69 @@ func (o *ObjectStore) CreateSignedURL(bucket, key string, ttl time.Duration) (st
 		},
 	}
 
-	return blob.GetSASURI(&opts)
+	// have the service return logs as gzip-encoded text, so browsers
+	// decompress and display them inline rather than downloading them
+	if o.inlineLogURLs && strings.HasSuffix(key, logsObjectSuffix) {
+		opts.OverrideHeaders = storage.OverrideHeaders{
+			ContentEncoding:    "gzip",
+			ContentType:        "text/plain; charset=utf-8",
+			ContentDisposition: "inline",
+		}
+	}
+
+	return o.signURL(bucket, key, opts)
+}
+
+// signURL returns the URL of the given blob, signed with the location's
+// credential for opts.
+func (o *ObjectStore) signURL(bucket, key string, opts storage.BlobSASOptions) (string, error) {
+	if o.delegationSigner != nil {
+		uri, err := o.delegationSigner.signURL(bucket, key, opts.Expiry, opts.OverrideHeaders)
+		if err != nil {
+			return "", err
+		}
+		return o.withBlobDomain(uri)
+	}
+
+	blob, err := o.blobGetter.getBlob(bucket, key)
+	if err != nil {
+		return "", err
+	}
+
+	// with a stored access policy, the policy grants the permissions, so
+	// that deleting it revokes every URL issued for it
+	if o.sasAccessPolicy != "" {
+		opts.Identifier = o.sasAccessPolicy
+		opts.BlobServiceSASPermissions = storage.BlobServiceSASPermissions{}
+
+		uri, err := blob.GetSASURI(&opts)
+		if err != nil {
+			return "", err
+		}
+		if uri, err = o.withBlobDomain(uri); err != nil {
+			return "", err
+		}
+		return withStoredAccessPolicy(uri, o.sasAccessPolicy)
+	}
+
+	uri, err := blob.GetSASURI(&opts)
+	if err != nil {
+		return "", err
+	}
+	return o.withBlobDomain(uri)
+}
+
+// withBlobDomain returns the given blob URI with its host in
+// config.blobDomain, if set.
+func (o *ObjectStore) withBlobDomain(uri string) (string, error) {
+	if o.blobDomain == "" {
+		return uri, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	u.Host = strings.SplitN(u.Host, ".", 2)[0] + "." + o.blobDomain
+	return u.String(), nil
 }
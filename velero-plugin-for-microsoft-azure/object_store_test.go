@@ -17,11 +17,17 @@ limitations under the License.
 package main
 
 import (
+	"encoding/base64"
 	"io"
+	"net/url"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -95,6 +101,90 @@ func TestObjectExists(t *testing.T) {
 	}
 }
 
+func TestPutObjectMaxObjectSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          io.Reader
+		expectedPuts  int
+		expectedError bool
+	}{
+		{
+			name:         "under the maximum",
+			body:         io.MultiReader(strings.NewReader("123456")),
+			expectedPuts: 2,
+		},
+		{
+			name:          "unknown size over the maximum",
+			body:          io.MultiReader(strings.NewReader("1234567")),
+			expectedPuts:  1,
+			expectedError: true,
+		},
+		{
+			name:          "known size over the maximum",
+			body:          strings.NewReader("1234567"),
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			blobGetter := new(mockBlobGetter)
+			blob := new(mockBlob)
+			blobGetter.On("getBlob", "b", "k").Return(blob, nil)
+			blob.On("PutBlock", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+			blob.On("PutBlockList", mock.Anything, mock.Anything).Return(nil)
+
+			o := &ObjectStore{
+				log:           logrus.New(),
+				blobGetter:    blobGetter,
+				blockSize:     4,
+				maxObjectSize: 6,
+			}
+
+			err := o.PutObject("b", "k", tc.body)
+			if tc.expectedError {
+				assert.Contains(t, err.Error(), maxObjectSizeConfigKey)
+				blob.AssertNotCalled(t, "PutBlockList", mock.Anything, mock.Anything)
+			} else {
+				assert.NoError(t, err)
+			}
+			blob.AssertNumberOfCalls(t, "PutBlock", tc.expectedPuts)
+		})
+	}
+}
+
+func TestGetMaxObjectSize(t *testing.T) {
+	size, err := getMaxObjectSize(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	size, err = getMaxObjectSize(map[string]string{maxObjectSizeConfigKey: "2"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2<<30), size)
+
+	_, err = getMaxObjectSize(map[string]string{maxObjectSizeConfigKey: "0"})
+	assert.Error(t, err)
+}
+
+func TestInitDoesNotRequireARMWithStorageKey(t *testing.T) {
+	defer setEnv(t, map[string]string{"TEST_STORAGE_KEY": "a2V5"})()
+
+	o := newObjectStore(logrus.New())
+
+	// the data protection check needs ARM, but is advisory so it doesn't block
+	// (or fail) Init when ARM is unreachable
+	start := time.Now()
+	require.NoError(t, o.Init(map[string]string{
+		storageAccountConfigKey:          "veleroexample",
+		storageAccountKeyEnvVarConfigKey: "TEST_STORAGE_KEY",
+		resourceGroupConfigKey:           "rg",
+		subscriptionIDConfigKey:          "sub",
+		bucketConfigKey:                  "bucket",
+	}))
+	assert.True(t, time.Since(start) < postureCheckTimeout)
+	assert.NotNil(t, o.blobGetter)
+}
+
 type mockBlobGetter struct {
 	mock.Mock
 }
@@ -117,6 +207,31 @@ func (m *mockBlob) PutBlockList(blocks []storage.Block, options *storage.PutBloc
 	return args.Error(0)
 }
 
+func (m *mockBlob) SetMetadata(metadata storage.BlobMetadata, options *storage.SetBlobMetadataOptions) error {
+	args := m.Called(metadata, options)
+	return args.Error(0)
+}
+
+func (m *mockBlob) GetBlockList(blockType storage.BlockListType, options *storage.GetBlockListOptions) (storage.BlockListResponse, error) {
+	args := m.Called(blockType, options)
+	return args.Get(0).(storage.BlockListResponse), args.Error(1)
+}
+
+func (m *mockBlob) CreateBlockBlobFromReader(blob io.Reader, options *storage.PutBlobOptions) error {
+	args := m.Called(blob, options)
+	return args.Error(0)
+}
+
+func (m *mockBlob) PutAppendBlob(options *storage.PutBlobOptions) error {
+	args := m.Called(options)
+	return args.Error(0)
+}
+
+func (m *mockBlob) AppendBlock(chunk []byte, options *storage.AppendBlockOptions) error {
+	args := m.Called(chunk, options)
+	return args.Error(0)
+}
+
 func (m *mockBlob) Exists() (bool, error) {
 	args := m.Called()
 	return args.Bool(0), args.Error(1)
@@ -132,11 +247,31 @@ func (m *mockBlob) Delete(options *storage.DeleteBlobOptions) error {
 	return args.Error(0)
 }
 
+func (m *mockBlob) GetRange(options *storage.GetBlobRangeOptions) (io.ReadCloser, error) {
+	args := m.Called(options)
+	return args.Get(0).(io.ReadCloser), args.Error(1)
+}
+
 func (m *mockBlob) GetSASURI(options *storage.BlobSASOptions) (string, error) {
 	args := m.Called(options)
 	return args.String(0), args.Error(1)
 }
 
+func (m *mockBlob) Copy(sourceBlob string, options *storage.CopyOptions) error {
+	args := m.Called(sourceBlob, options)
+	return args.Error(0)
+}
+
+func (m *mockBlob) GetProperties(options *storage.GetBlobPropertiesOptions) error {
+	args := m.Called(options)
+	return args.Error(0)
+}
+
+func (m *mockBlob) Properties() storage.BlobProperties {
+	args := m.Called()
+	return args.Get(0).(storage.BlobProperties)
+}
+
 type mockContainerGetter struct {
 	mock.Mock
 }
@@ -154,3 +289,144 @@ func (m *mockContainer) ListBlobs(params storage.ListBlobsParameters) (storage.B
 	args := m.Called(params)
 	return args.Get(0).(storage.BlobListResponse), args.Error(1)
 }
+
+func TestCreateSignedURLInlineLogs(t *testing.T) {
+	tests := []struct {
+		name          string
+		inlineLogURLs bool
+		key           string
+		expected      storage.OverrideHeaders
+	}{
+		{
+			name:          "logs are served inline when enabled",
+			inlineLogURLs: true,
+			key:           "backups/b1/b1-logs.gz",
+			expected: storage.OverrideHeaders{
+				ContentEncoding:    "gzip",
+				ContentType:        "text/plain; charset=utf-8",
+				ContentDisposition: "inline",
+			},
+		},
+		{
+			name:          "other objects are unchanged",
+			inlineLogURLs: true,
+			key:           "backups/b1/b1.tar.gz",
+		},
+		{
+			name: "logs are unchanged when disabled",
+			key:  "backups/b1/b1-logs.gz",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			blobGetter := new(mockBlobGetter)
+			blob := new(mockBlob)
+			blobGetter.On("getBlob", "b", tc.key).Return(blob, nil)
+			blob.On("GetSASURI", mock.MatchedBy(func(opts *storage.BlobSASOptions) bool {
+				return opts.Read && opts.OverrideHeaders == tc.expected
+			})).Return("https://url", nil)
+
+			o := &ObjectStore{
+				log:           logrus.New(),
+				blobGetter:    blobGetter,
+				inlineLogURLs: tc.inlineLogURLs,
+			}
+
+			url, err := o.CreateSignedURL("b", tc.key, time.Hour)
+			require.NoError(t, err)
+			assert.Equal(t, "https://url", url)
+			blob.AssertExpectations(t)
+		})
+	}
+}
+
+func TestPutObjectFailedReadIsNotCommitted(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	blob := new(mockBlob)
+	blobGetter.On("getBlob", "b", "backups/b1/velero-backup.json").Return(blob, nil)
+	blob.On("PutBlock", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	o := &ObjectStore{
+		log:        logrus.New(),
+		blobGetter: blobGetter,
+		blockSize:  4,
+	}
+
+	body := io.MultiReader(strings.NewReader("{\"kind\":"), iotest.TimeoutReader(strings.NewReader("\"Backup\"}")))
+	err := o.PutObject("b", "backups/b1/velero-backup.json", body)
+	require.Error(t, err)
+
+	// the staged blocks are never committed, so the partial object isn't visible
+	blob.AssertNotCalled(t, "PutBlockList", mock.Anything, mock.Anything)
+}
+
+func TestListCommonPrefixes(t *testing.T) {
+	containerGetter := new(mockContainerGetter)
+	container := new(mockContainer)
+	containerGetter.On("getContainer", "b").Return(container, nil)
+
+	// the delimiter is passed to the service, and results are paged by marker
+	container.On("ListBlobs", storage.ListBlobsParameters{Prefix: "cluster-1/backups/", Delimiter: "/"}).Return(storage.BlobListResponse{
+		BlobPrefixes: []string{"cluster-1/backups/b1/", "cluster-1/backups/b2/"},
+		NextMarker:   "marker-1",
+	}, nil)
+	container.On("ListBlobs", storage.ListBlobsParameters{Prefix: "cluster-1/backups/", Delimiter: "/", Marker: "marker-1"}).Return(storage.BlobListResponse{
+		Blobs:        []storage.Blob{{Name: "cluster-1/backups/stray.json"}},
+		BlobPrefixes: []string{"cluster-1/backups/b3/"},
+	}, nil)
+
+	o := &ObjectStore{log: logrus.New(), containerGetter: containerGetter}
+	prefixes, err := o.ListCommonPrefixes("b", "cluster-1/backups/", "/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cluster-1/backups/b1/", "cluster-1/backups/b2/", "cluster-1/backups/b3/"}, prefixes)
+	container.AssertExpectations(t)
+}
+
+func TestListObjects(t *testing.T) {
+	containerGetter := new(mockContainerGetter)
+	container := new(mockContainer)
+	containerGetter.On("getContainer", "b").Return(container, nil)
+
+	// the prefix is filtered by the service rather than the plugin, so only
+	// matching pages are listed
+	container.On("ListBlobs", storage.ListBlobsParameters{Prefix: "cluster-1/backups/b1/"}).Return(storage.BlobListResponse{
+		Blobs:      []storage.Blob{{Name: "cluster-1/backups/b1/b1.tar.gz"}},
+		NextMarker: "marker-1",
+	}, nil)
+	container.On("ListBlobs", storage.ListBlobsParameters{Prefix: "cluster-1/backups/b1/", Marker: "marker-1"}).Return(storage.BlobListResponse{
+		Blobs: []storage.Blob{{Name: "cluster-1/backups/b1/velero-backup.json"}},
+	}, nil)
+
+	o := &ObjectStore{log: logrus.New(), containerGetter: containerGetter}
+	objects, err := o.ListObjects("b", "cluster-1/backups/b1/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cluster-1/backups/b1/b1.tar.gz", "cluster-1/backups/b1/velero-backup.json"}, objects)
+	container.AssertExpectations(t)
+}
+
+func TestCreateSignedURLIsReadOnlyAndExpiresAfterTTL(t *testing.T) {
+	client, err := storage.NewBasicClient("account", base64.StdEncoding.EncodeToString([]byte("key")))
+	require.NoError(t, err)
+	blobService := client.GetBlobService()
+
+	o := &ObjectStore{log: logrus.New(), blobGetter: &azureBlobGetter{blobService: &blobService}}
+
+	before := time.Now()
+	signedURL, err := o.CreateSignedURL("b", "backups/b1/b1.tar.gz", 10*time.Minute)
+	require.NoError(t, err)
+
+	u, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	assert.Equal(t, "account.blob.core.windows.net", u.Host)
+	assert.Equal(t, "/b/backups/b1/b1.tar.gz", u.Path)
+
+	query := u.Query()
+	assert.Equal(t, "r", query.Get("sp"))
+	assert.Equal(t, "b", query.Get("sr"))
+	assert.NotEmpty(t, query.Get("sig"))
+
+	expiry, err := time.Parse(time.RFC3339, query.Get("se"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, before.Add(10*time.Minute), expiry, 2*time.Second)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+)
+
+const operationTimeoutConfigKey = "operationTimeout"
+
+// getOperationTimeout returns the time config.operationTimeout allows each
+// object store operation, or 0 if operations aren't bounded.
+func getOperationTimeout(config map[string]string) (time.Duration, error) {
+	val := config[operationTimeoutConfigKey]
+	if val == "" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(val)
+	if err != nil || timeout <= 0 {
+		return 0, errors.Errorf("invalid value %q for config key %q (expected a positive duration string)", val, operationTimeoutConfigKey)
+	}
+	return timeout, nil
+}
+
+// deadlineSender sends the requests of a storage client with a context that
+// expires at the deadline of the operation they're made for, so that a hung
+// connection fails the operation rather than stalling it. The retry senders
+// derive their tries' contexts from the request's, so they stop retrying at
+// the deadline too.
+type deadlineSender struct {
+	deadline time.Time
+	timeout  time.Duration
+	next     storage.Sender
+}
+
+func (s *deadlineSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithDeadline(req.Context(), s.deadline)
+	req = req.WithContext(ctx)
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	if s.next != nil {
+		resp, err = s.next.Send(c, req)
+	} else {
+		resp, err = c.HTTPClient.Do(req)
+	}
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			return resp, errors.Wrapf(err, "operation didn't complete within config.%s (%s)", operationTimeoutConfigKey, s.timeout)
+		}
+		return resp, err
+	}
+
+	// the deadline applies until the response is read
+	resp.Body = &cancelingReadCloser{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// deadlineBlobService gets the blobs and containers of a single operation
+// from a blob service whose requests expire at the operation's deadline.
+type deadlineBlobService struct {
+	service  *lazyBlobService
+	deadline time.Time
+	timeout  time.Duration
+}
+
+func (s *deadlineBlobService) get() (*storage.BlobStorageClient, error) {
+	client, _, err := s.service.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// the client is shared by every operation, so it mustn't be modified
+	copied := *client
+	copied.Sender = &deadlineSender{deadline: s.deadline, timeout: s.timeout, next: client.Sender}
+	service := copied.GetBlobService()
+	return &service, nil
+}
+
+func (s *deadlineBlobService) getBlob(bucket, key string) (blob, error) {
+	service, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	return (&azureBlobGetter{blobService: service}).getBlob(bucket, key)
+}
+
+func (s *deadlineBlobService) getContainer(bucket string) (container, error) {
+	service, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	return (&azureContainerGetter{blobService: service}).getContainer(bucket)
+}
+
+// operationGetters returns the blob and container getters for an operation
+// starting now, whose requests expire after config.operationTimeout, if set.
+func (o *ObjectStore) operationGetters() (blobGetter, containerGetter) {
+	if o.operationTimeout <= 0 || o.blobService == nil {
+		return o.blobGetter, o.containerGetter
+	}
+
+	s := &deadlineBlobService{service: o.blobService, deadline: time.Now().Add(o.operationTimeout), timeout: o.operationTimeout}
+	return s, s
+}
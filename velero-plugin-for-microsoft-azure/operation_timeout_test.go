@@ -0,0 +1,87 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hangingSender never responds, like a hung connection, until its request's
+// context is done.
+type hangingSender struct{}
+
+func (s *hangingSender) Send(c *storage.Client, req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestGetOperationTimeout(t *testing.T) {
+	timeout, err := getOperationTimeout(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), timeout)
+
+	timeout, err = getOperationTimeout(map[string]string{operationTimeoutConfigKey: "15m"})
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, timeout)
+
+	_, err = getOperationTimeout(map[string]string{operationTimeoutConfigKey: "0s"})
+	assert.Error(t, err)
+	_, err = getOperationTimeout(map[string]string{operationTimeoutConfigKey: "forever"})
+	assert.Error(t, err)
+}
+
+func TestOperationTimeout(t *testing.T) {
+	service := newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+		credential := &storageCredential{accountKey: "a2V5"}
+		client, err := newStorageClient("account", credential, &azure.PublicCloud, "")
+		require.NoError(t, err)
+		client.Sender = &hangingSender{}
+		return &client, credential, nil
+	})
+	blobGetter, containerGetter := &lazyBlobGetter{service: service}, &lazyContainerGetter{service: service}
+
+	// without a timeout, operations use the location's getters
+	o := &ObjectStore{log: logrus.New(), blobGetter: blobGetter, containerGetter: containerGetter, blobService: service}
+	gotBlobs, gotContainers := o.operationGetters()
+	assert.Equal(t, blobGetter, gotBlobs)
+	assert.Equal(t, containerGetter, gotContainers)
+
+	// with one, hung requests fail at the operation's deadline
+	o.operationTimeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := o.ListObjects("b", "backups/")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "operationTimeout")
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+	_, err = o.objectExists("b", "backups/b1/velero-backup.json")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "operationTimeout")
+
+	// the shared client isn't modified
+	client, _, err := service.getClient()
+	require.NoError(t, err)
+	assert.IsType(t, &hangingSender{}, client.Sender)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// restoreIDTag is added to every disk created by a restore, with a value
+	// unique to the disk, and removed once the disk has been created and is
+	// handed to Velero, so that disks left behind by failed restores can be
+	// identified.
+	restoreIDTag = "velero.io-restore-id"
+
+	defaultOrphanedDiskAge = 24 * time.Hour
+)
+
+// findOrphanedDisks returns the disks created by restores that still have their
+// restore ID, are unattached and are older than minAge. The restore ID is only
+// removed once the disk is handed to Velero, so such disks have never been
+// attached and were left behind by failed or aborted restores.
+func findOrphanedDisks(disks []disk.Disk, now time.Time, minAge time.Duration) []disk.Disk {
+	var orphaned []disk.Disk
+	for _, d := range disks {
+		if _, ok := d.Tags[restoreIDTag]; !ok {
+			continue
+		}
+		if d.ManagedBy != nil || d.DiskProperties == nil || d.DiskState != disk.Unattached {
+			continue
+		}
+		if d.TimeCreated == nil || now.Sub(d.TimeCreated.Time) < minAge {
+			continue
+		}
+		orphaned = append(orphaned, d)
+	}
+
+	return orphaned
+}
+
+func runCleanupOrphanedDisks(log logrus.FieldLogger, args []string) error {
+	var (
+		resourceGroup string
+		minAge        time.Duration
+		yes           bool
+	)
+
+	flags := pflag.NewFlagSet("cleanup-orphaned-disks", pflag.ContinueOnError)
+	flags.StringVar(&resourceGroup, "resource-group", "", "Resource group containing the restored disks (defaults to $AZURE_RESOURCE_GROUP)")
+	flags.DurationVar(&minAge, "older-than", defaultOrphanedDiskAge, "Only delete disks created at least this long ago")
+	flags.BoolVar(&yes, "yes", false, "Delete the disks without asking for confirmation")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	authorizer, env, err := commandAuthorizer()
+	if err != nil {
+		return err
+	}
+
+	if resourceGroup == "" {
+		resourceGroup = os.Getenv(resourceGroupEnvVar)
+	}
+	if _, err := getRequiredValues(os.Getenv, subscriptionIDEnvVar); err != nil {
+		return errors.Wrap(err, "unable to get all required environment variables")
+	}
+	if resourceGroup == "" {
+		return errors.Errorf("--resource-group or %s is required", resourceGroupEnvVar)
+	}
+
+	disksClient := disk.NewDisksClientWithBaseURI(env.ResourceManagerEndpoint, os.Getenv(subscriptionIDEnvVar))
+	disksClient.Authorizer = authorizer
+	disksClient.PollingDelay = quirksFor(env).pollingDelay
+	locks := &armLockLister{env: env, authorizer: authorizer}
+
+	ctx := context.Background()
+
+	var disks []disk.Disk
+	iter, err := disksClient.ListByResourceGroupComplete(ctx, resourceGroup)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		disks = append(disks, iter.Value())
+	}
+
+	orphaned := findOrphanedDisks(disks, time.Now(), minAge)
+	if len(orphaned) == 0 {
+		fmt.Println("No orphaned disks found")
+		return nil
+	}
+
+	fmt.Printf("Found %d orphaned disks:\n", len(orphaned))
+	for _, d := range orphaned {
+		fmt.Printf("  %s (created %s, restore ID %s)\n", *d.Name, d.TimeCreated.Format(time.RFC3339), *d.Tags[restoreIDTag])
+	}
+
+	if !yes && !confirm(os.Stdin, os.Stdout, "Delete these disks?") {
+		return nil
+	}
+
+	var failed int
+	for _, d := range orphaned {
+		log := log.WithField("disk", *d.Name)
+
+		future, err := disksClient.Delete(ctx, resourceGroup, *d.Name)
+		if err == nil {
+			err = future.WaitForCompletionRef(ctx, disksClient.Client)
+		}
+		if err != nil {
+			var managedBy string
+			if current, getErr := disksClient.Get(ctx, resourceGroup, *d.Name); getErr == nil && current.ManagedBy != nil {
+				managedBy = *current.ManagedBy
+			}
+			err = explainDeleteFailure(ctx, locks, os.Getenv(subscriptionIDEnvVar), resourceGroup, disksResource, *d.Name, managedBy, err)
+			log.WithError(err).Error("Error deleting disk")
+			failed++
+			continue
+		}
+		log.Info("Deleted disk")
+	}
+
+	if failed > 0 {
+		return errors.Errorf("failed to delete %d disks", failed)
+	}
+
+	return nil
+}
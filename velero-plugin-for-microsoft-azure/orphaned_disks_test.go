@@ -0,0 +1,56 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindOrphanedDisks(t *testing.T) {
+	now := time.Now()
+	newDisk := func(name string, tagged bool, state disk.DiskState, managedBy *string, age time.Duration) disk.Disk {
+		d := disk.Disk{
+			Name:      stringPtr(name),
+			ManagedBy: managedBy,
+			DiskProperties: &disk.DiskProperties{
+				DiskState:   state,
+				TimeCreated: &date.Time{Time: now.Add(-age)},
+			},
+		}
+		if tagged {
+			d.Tags = map[string]*string{restoreIDTag: stringPtr("id")}
+		}
+		return d
+	}
+
+	disks := []disk.Disk{
+		newDisk("orphaned", true, disk.Unattached, nil, 48*time.Hour),
+		newDisk("untagged", false, disk.Unattached, nil, 48*time.Hour),
+		newDisk("attached", true, disk.Attached, stringPtr("vm"), 48*time.Hour),
+		newDisk("recent", true, disk.Unattached, nil, time.Hour),
+	}
+
+	orphaned := findOrphanedDisks(disks, now, 24*time.Hour)
+	if assert.Len(t, orphaned, 1) {
+		assert.Equal(t, "orphaned", *orphaned[0].Name)
+	}
+}
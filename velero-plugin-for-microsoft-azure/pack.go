@@ -0,0 +1,427 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	packSmallObjectsConfigKey = "packSmallObjects"
+
+	// packFile holds the contents of a backup's small objects, one after the
+	// other, and packIndexFile records where each object is within it. Both
+	// are stored in the backup's directory.
+	packFile      = "velero-azure-pack.bin"
+	packIndexFile = "velero-azure-pack.json"
+
+	// objects up to this size are packed
+	packMaxObjectSize = 1024 * 1024
+
+	packInterval = 5 * time.Minute
+
+	// backups whose metadata was written more recently than this may still
+	// be uploading their remaining files, so they're not packed yet.
+	packSettleTime = 10 * time.Minute
+)
+
+type packEntry struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+type packIndex struct {
+	Objects  map[string]packEntry `json:"objects"`
+	PackedAt time.Time            `json:"packedAt"`
+}
+
+// packer aggregates the small objects of completed backups into a single
+// packed blob per backup, so that storing and reading them later costs one
+// transaction rather than one per object. The object store reads, lists and
+// deletes packed objects through the packer, so packing is transparent to
+// Velero.
+type packer struct {
+	log        logrus.FieldLogger
+	containers containerGetter
+	blobs      blobGetter
+	prefix     string
+
+	// serializes updates of the index by deletes within this process
+	mu sync.Mutex
+}
+
+// getPackSmallObjects returns whether config.packSmallObjects is set.
+func getPackSmallObjects(config map[string]string) (bool, error) {
+	val := config[packSmallObjectsConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	pack, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, packSmallObjectsConfigKey)
+	}
+
+	return pack, nil
+}
+
+// isPackFile returns whether the given key is one of the packer's own files.
+func isPackFile(key string) bool {
+	base := path.Base(key)
+	return base == packFile || base == packIndexFile
+}
+
+// packable returns whether the given blob may be packed. A backup's metadata
+// file is never packed, since Velero discovers backups by it.
+func packable(blob storage.Blob) bool {
+	switch path.Base(blob.Name) {
+	case backupMetadataFile, replicationStateFile, packFile, packIndexFile:
+		return false
+	}
+	return blob.Properties.ContentLength <= packMaxObjectSize
+}
+
+func (p *packer) backupsDir() string {
+	return path.Join(p.prefix, "backups") + "/"
+}
+
+func (p *packer) run(bucket string) {
+	for {
+		if err := p.packAll(bucket); err != nil {
+			p.log.WithError(err).Warn("Error packing backups")
+		}
+		time.Sleep(packInterval)
+	}
+}
+
+// packAll packs every completed backup that isn't packed yet.
+func (p *packer) packAll(bucket string) error {
+	container, err := p.containers.getContainer(bucket)
+	if err != nil {
+		return err
+	}
+
+	_, backupDirs, err := listAllBlobs(container, storage.ListBlobsParameters{
+		Prefix:    p.backupsDir(),
+		Delimiter: "/",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range backupDirs {
+		if err := p.packBackup(container, bucket, dir, time.Now()); err != nil {
+			p.log.WithError(err).WithField("backupDir", dir).Warn("Error packing backup")
+		}
+	}
+
+	return nil
+}
+
+// packBackup packs the small objects in the given backup directory, unless
+// the backup is still being written or has already been packed. The pack and
+// its index are written before any object is deleted, and objects that are
+// still present take precedence over packed ones, so an interrupted pack is
+// harmless and is finished on the next run.
+func (p *packer) packBackup(container container, bucket, dir string, now time.Time) error {
+	blobs, _, err := listAllBlobs(container, storage.ListBlobsParameters{Prefix: dir})
+	if err != nil {
+		return err
+	}
+
+	var (
+		candidates []storage.Blob
+		complete   bool
+		packed     bool
+	)
+	for _, blob := range blobs {
+		switch path.Base(blob.Name) {
+		case packIndexFile:
+			packed = true
+		case backupMetadataFile:
+			complete = now.Sub(time.Time(blob.Properties.LastModified)) > packSettleTime
+		}
+		if packable(blob) {
+			candidates = append(candidates, blob)
+		}
+	}
+
+	if packed {
+		return p.removePacked(bucket, dir, candidates)
+	}
+	if !complete || len(candidates) < 2 {
+		return nil
+	}
+
+	var (
+		data  bytes.Buffer
+		index = packIndex{Objects: map[string]packEntry{}, PackedAt: now.UTC()}
+	)
+	for _, candidate := range candidates {
+		blob, err := p.blobs.getBlob(bucket, candidate.Name)
+		if err != nil {
+			return err
+		}
+		res, err := blob.Get(nil)
+		if err != nil {
+			return errors.Wrapf(err, "error reading %s", candidate.Name)
+		}
+		offset := int64(data.Len())
+		n, err := io.Copy(&data, res)
+		res.Close()
+		if err != nil {
+			return errors.Wrapf(err, "error reading %s", candidate.Name)
+		}
+		index.Objects[candidate.Name] = packEntry{Offset: offset, Length: n}
+	}
+
+	packBlob, err := p.blobs.getBlob(bucket, dir+packFile)
+	if err != nil {
+		return err
+	}
+	if err := packBlob.CreateBlockBlobFromReader(&data, nil); err != nil {
+		return errors.Wrap(err, "error writing pack")
+	}
+	if err := p.putIndex(bucket, dir, &index); err != nil {
+		return err
+	}
+
+	p.log.WithField("backupDir", dir).Infof("Packed %d objects", len(index.Objects))
+
+	return p.removePacked(bucket, dir, candidates)
+}
+
+// removePacked deletes the given objects if they're in the directory's pack,
+// unless they've been rewritten since they were packed.
+func (p *packer) removePacked(bucket, dir string, blobs []storage.Blob) error {
+	index, err := p.getIndex(bucket, dir)
+	if err != nil || index == nil {
+		return err
+	}
+
+	for _, b := range blobs {
+		if _, ok := index.Objects[b.Name]; !ok || time.Time(b.Properties.LastModified).After(index.PackedAt) {
+			continue
+		}
+		blob, err := p.blobs.getBlob(bucket, b.Name)
+		if err != nil {
+			return err
+		}
+		if err := blob.Delete(nil); err != nil && !isNotFound(err) {
+			return errors.Wrapf(err, "error deleting packed object %s", b.Name)
+		}
+	}
+
+	return nil
+}
+
+// getIndex returns the pack index of the given directory, or nil if it
+// isn't packed.
+func (p *packer) getIndex(bucket, dir string) (*packIndex, error) {
+	blob, err := p.blobs.getBlob(bucket, dir+packIndexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := blob.Get(nil)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer res.Close()
+
+	index := new(packIndex)
+	if err := json.NewDecoder(res).Decode(index); err != nil {
+		return nil, errors.Wrapf(err, "error decoding pack index %s", dir+packIndexFile)
+	}
+
+	return index, nil
+}
+
+func (p *packer) putIndex(bucket, dir string, index *packIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	blob, err := p.blobs.getBlob(bucket, dir+packIndexFile)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(blob.CreateBlockBlobFromReader(bytes.NewReader(data), nil), "error writing pack index")
+}
+
+// packDir returns the directory whose pack may contain the given key.
+func packDir(key string) string {
+	return key[:strings.LastIndex(key, "/")+1]
+}
+
+// get returns the contents of the given packed object. It returns an error
+// for which isNotFound is true if the object isn't packed.
+func (p *packer) get(bucket, key string) (io.ReadCloser, error) {
+	dir := packDir(key)
+
+	index, err := p.getIndex(bucket, dir)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		entry packEntry
+		ok    bool
+	)
+	if index != nil {
+		entry, ok = index.Objects[key]
+	}
+	if !ok {
+		return nil, errPackedObjectNotFound
+	}
+	if entry.Length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	blob, err := p.blobs.getBlob(bucket, dir+packFile)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := blob.GetRange(&storage.GetBlobRangeOptions{
+		Range: &storage.BlobRange{Start: uint64(entry.Offset), End: uint64(entry.Offset + entry.Length - 1)},
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return res, nil
+}
+
+// exists returns whether the given object is packed.
+func (p *packer) exists(bucket, key string) (bool, error) {
+	index, err := p.getIndex(bucket, packDir(key))
+	if err != nil || index == nil {
+		return false, err
+	}
+
+	_, ok := index.Objects[key]
+	return ok, nil
+}
+
+// list returns the packed objects matching the given prefix, given the
+// blobs listed for it. The pack files themselves are omitted.
+func (p *packer) list(bucket, prefix string, blobs []string) ([]string, error) {
+	var (
+		objects []string
+		dirs    = map[string]bool{}
+		seen    = map[string]bool{}
+	)
+	for _, name := range blobs {
+		seen[name] = true
+		if path.Base(name) == packIndexFile {
+			dirs[packDir(name)] = true
+		}
+		if !isPackFile(name) {
+			objects = append(objects, name)
+		}
+	}
+
+	// a prefix within a directory doesn't match the directory's index, so
+	// look it up directly
+	if dir := packDir(prefix); dir != "" {
+		dirs[dir] = true
+	}
+
+	var packed []string
+	for dir := range dirs {
+		index, err := p.getIndex(bucket, dir)
+		if err != nil {
+			return nil, err
+		}
+		if index == nil {
+			continue
+		}
+		for key := range index.Objects {
+			if strings.HasPrefix(key, prefix) && !seen[key] {
+				packed = append(packed, key)
+			}
+		}
+	}
+	sort.Strings(packed)
+
+	return append(objects, packed...), nil
+}
+
+// delete removes the given object from its directory's pack, deleting the
+// pack once it's empty. It returns an error for which isNotFound is true if
+// the object isn't packed.
+func (p *packer) delete(bucket, key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	dir := packDir(key)
+
+	index, err := p.getIndex(bucket, dir)
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		return errPackedObjectNotFound
+	}
+	if _, ok := index.Objects[key]; !ok {
+		return errPackedObjectNotFound
+	}
+	delete(index.Objects, key)
+
+	if len(index.Objects) > 0 {
+		return p.putIndex(bucket, dir, index)
+	}
+
+	for _, name := range []string{packFile, packIndexFile} {
+		blob, err := p.blobs.getBlob(bucket, dir+name)
+		if err != nil {
+			return err
+		}
+		if err := blob.Delete(nil); err != nil && !isNotFound(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+// errPackedObjectNotFound is returned for objects that aren't packed. It
+// looks like a storage service 404 so callers can treat both alike.
+var errPackedObjectNotFound = storage.AzureStorageServiceError{
+	StatusCode: http.StatusNotFound,
+	Code:       "BlobNotFound",
+	Message:    "The specified blob does not exist in the backup's pack.",
+}
@@ -0,0 +1,218 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memBlobs is an in-memory container, for exercising the packer's reads and
+// writes together.
+type memBlobs struct {
+	data     map[string][]byte
+	modified map[string]time.Time
+	now      time.Time
+}
+
+func newMemBlobs(now time.Time) *memBlobs {
+	return &memBlobs{data: map[string][]byte{}, modified: map[string]time.Time{}, now: now}
+}
+
+func (m *memBlobs) put(key, data string, modified time.Time) {
+	m.data[key] = []byte(data)
+	m.modified[key] = modified
+}
+
+func (m *memBlobs) getBlob(bucket, key string) (blob, error) {
+	return &memBlob{store: m, key: key}, nil
+}
+
+func (m *memBlobs) getContainer(bucket string) (container, error) {
+	return m, nil
+}
+
+func (m *memBlobs) ListBlobs(params storage.ListBlobsParameters) (storage.BlobListResponse, error) {
+	var keys []string
+	for key := range m.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var res storage.BlobListResponse
+	for _, key := range keys {
+		if !strings.HasPrefix(key, params.Prefix) {
+			continue
+		}
+		res.Blobs = append(res.Blobs, storage.Blob{
+			Name: key,
+			Properties: storage.BlobProperties{
+				ContentLength: int64(len(m.data[key])),
+				LastModified:  storage.TimeRFC1123(m.modified[key]),
+			},
+		})
+	}
+	return res, nil
+}
+
+var errMemBlobNotFound = storage.AzureStorageServiceError{StatusCode: http.StatusNotFound}
+
+type memBlob struct {
+	blob
+	store *memBlobs
+	key   string
+}
+
+func (b *memBlob) CreateBlockBlobFromReader(r io.Reader, options *storage.PutBlobOptions) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.store.put(b.key, string(data), b.store.now)
+	return nil
+}
+
+func (b *memBlob) PutAppendBlob(options *storage.PutBlobOptions) error {
+	if _, ok := b.store.data[b.key]; ok && options != nil && options.IfNoneMatch == "*" {
+		return storage.AzureStorageServiceError{StatusCode: http.StatusConflict}
+	}
+	b.store.put(b.key, "", b.store.now)
+	return nil
+}
+
+func (b *memBlob) AppendBlock(chunk []byte, options *storage.AppendBlockOptions) error {
+	data, ok := b.store.data[b.key]
+	if !ok {
+		return errMemBlobNotFound
+	}
+	b.store.put(b.key, string(data)+string(chunk), b.store.now)
+	return nil
+}
+
+func (b *memBlob) Exists() (bool, error) {
+	_, ok := b.store.data[b.key]
+	return ok, nil
+}
+
+func (b *memBlob) Get(options *storage.GetBlobOptions) (io.ReadCloser, error) {
+	data, ok := b.store.data[b.key]
+	if !ok {
+		return nil, errMemBlobNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *memBlob) GetRange(options *storage.GetBlobRangeOptions) (io.ReadCloser, error) {
+	data, ok := b.store.data[b.key]
+	if !ok {
+		return nil, errMemBlobNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(data[options.Range.Start : options.Range.End+1])), nil
+}
+
+func (b *memBlob) Delete(options *storage.DeleteBlobOptions) error {
+	if _, ok := b.store.data[b.key]; !ok {
+		return errMemBlobNotFound
+	}
+	delete(b.store.data, b.key)
+	return nil
+}
+
+func TestPackBackup(t *testing.T) {
+	now := time.Now()
+	dir := "velero/backups/b1/"
+
+	blobs := newMemBlobs(now)
+	blobs.put(dir+backupMetadataFile, "{}", now.Add(-time.Hour))
+	blobs.put(dir+"b1-logs.gz", "logs", now.Add(-time.Hour))
+	blobs.put(dir+"b1-volumesnapshots.json.gz", "snapshots", now.Add(-time.Hour))
+	blobs.put(dir+"b1.tar.gz", strings.Repeat("x", packMaxObjectSize+1), now.Add(-time.Hour))
+
+	p := &packer{log: logrus.New(), containers: blobs, blobs: blobs, prefix: "velero"}
+	require.NoError(t, p.packBackup(blobs, "bucket", dir, now))
+
+	// packed objects are replaced by the pack, large objects and the metadata are kept
+	var stored []string
+	for key := range blobs.data {
+		stored = append(stored, strings.TrimPrefix(key, dir))
+	}
+	assert.ElementsMatch(t, []string{backupMetadataFile, "b1.tar.gz", packFile, packIndexFile}, stored)
+
+	o := &ObjectStore{log: logrus.New(), containerGetter: blobs, blobGetter: blobs, packer: p}
+
+	objects, err := o.ListObjects("bucket", dir)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		dir + backupMetadataFile,
+		dir + "b1.tar.gz",
+		dir + "b1-logs.gz",
+		dir + "b1-volumesnapshots.json.gz",
+	}, objects)
+
+	objects, err = o.ListObjects("bucket", dir+"b1-logs")
+	require.NoError(t, err)
+	assert.Equal(t, []string{dir + "b1-logs.gz"}, objects)
+
+	res, err := o.GetObject("bucket", dir+"b1-volumesnapshots.json.gz")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(res)
+	require.NoError(t, err)
+	assert.Equal(t, "snapshots", string(data))
+
+	exists, err := o.ObjectExists("bucket", dir+"b1-logs.gz")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	_, err = o.GetObject("bucket", dir+"missing")
+	assert.True(t, isNotFound(err))
+
+	// deleting every packed object deletes the pack
+	require.NoError(t, o.DeleteObject("bucket", dir+"b1-logs.gz"))
+	assert.Contains(t, blobs.data, dir+packFile)
+	require.NoError(t, o.DeleteObject("bucket", dir+"b1-volumesnapshots.json.gz"))
+	assert.NotContains(t, blobs.data, dir+packFile)
+	assert.NotContains(t, blobs.data, dir+packIndexFile)
+
+	assert.True(t, isNotFound(o.DeleteObject("bucket", dir+"b1-logs.gz")))
+}
+
+func TestPackBackupSkipsRecentBackups(t *testing.T) {
+	now := time.Now()
+	dir := "velero/backups/b1/"
+
+	blobs := newMemBlobs(now)
+	blobs.put(dir+backupMetadataFile, "{}", now.Add(-time.Minute))
+	blobs.put(dir+"b1-logs.gz", "logs", now.Add(-time.Minute))
+	blobs.put(dir+"b1-volumesnapshots.json.gz", "snapshots", now.Add(-time.Minute))
+
+	p := &packer{log: logrus.New(), containers: blobs, blobs: blobs, prefix: "velero"}
+	require.NoError(t, p.packBackup(blobs, "bucket", dir, now))
+
+	assert.Len(t, blobs.data, 3)
+	assert.NotContains(t, blobs.data, dir+packFile)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	profileConfigKey = "profile"
+
+	defaultPerformanceProfile = "default"
+)
+
+// performanceProfiles are the config values each profile sets, by plugin
+// kind. Values set in the config take precedence.
+var performanceProfiles = map[string]map[string]map[string]string{
+	// small clusters, e.g. with little memory to spare for the plugin:
+	// blocks are buffered in memory while they're uploaded
+	"small": {
+		objectStoreKind: {
+			blockSizeConfigKey:       "8388608",
+			prefetchObjectsConfigKey: "0",
+			storageMaxTriesConfigKey: "5",
+		},
+		volumeSnapshotterKind: {
+			apiRetryAttemptsConfigKey: "3",
+		},
+	},
+	defaultPerformanceProfile: {},
+	// large clusters, whose many volumes and objects make throttling likely
+	"large": {
+		objectStoreKind: {
+			blockSizeConfigKey:            "16777216",
+			uploadConcurrencyConfigKey:    "4",
+			prefetchObjectsConfigKey:      "8",
+			storageMaxTriesConfigKey:      "8",
+			storageMaxRetryDelayConfigKey: "1m",
+		},
+		volumeSnapshotterKind: {
+			apiRetryAttemptsConfigKey: "6",
+			apiTimeoutConfigKey:       "5m",
+		},
+	},
+	// huge clusters, whose backups take hours and mustn't fail on a burst of
+	// throttling
+	"huge": {
+		objectStoreKind: {
+			blockSizeConfigKey:            "33554432",
+			uploadConcurrencyConfigKey:    "8",
+			prefetchObjectsConfigKey:      "32",
+			storageMaxTriesConfigKey:      "10",
+			storageMaxRetryDelayConfigKey: "2m",
+		},
+		volumeSnapshotterKind: {
+			apiRetryAttemptsConfigKey: "10",
+			apiTimeoutConfigKey:       "10m",
+		},
+	},
+}
+
+// withPerformanceProfile returns config with the values of the performance
+// profile in config.profile for the given plugin kind, for the keys config
+// doesn't set.
+func withPerformanceProfile(config map[string]string, kind string) (map[string]string, error) {
+	name := config[profileConfigKey]
+	if name == "" {
+		return config, nil
+	}
+
+	profile, ok := performanceProfiles[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for name := range performanceProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("invalid value %q for config key %q (expected one of %s)", name, profileConfigKey, strings.Join(names, ", "))
+	}
+
+	result := make(map[string]string, len(config))
+	for key, val := range config {
+		result[key] = val
+	}
+	for key, val := range profile[kind] {
+		if _, ok := result[key]; !ok {
+			result[key] = val
+		}
+	}
+	return result, nil
+}
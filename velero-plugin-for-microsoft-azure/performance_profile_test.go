@@ -0,0 +1,57 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithPerformanceProfile(t *testing.T) {
+	config := map[string]string{storageAccountConfigKey: "account"}
+	result, err := withPerformanceProfile(config, objectStoreKind)
+	require.NoError(t, err)
+	assert.Equal(t, config, result)
+
+	config = map[string]string{profileConfigKey: "Large", prefetchObjectsConfigKey: "2"}
+	result, err = withPerformanceProfile(config, objectStoreKind)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		profileConfigKey:              "Large",
+		blockSizeConfigKey:            "16777216",
+		uploadConcurrencyConfigKey:    "4",
+		prefetchObjectsConfigKey:      "2",
+		storageMaxTriesConfigKey:      "8",
+		storageMaxRetryDelayConfigKey: "1m",
+	}, result)
+	// the config isn't modified
+	assert.Len(t, config, 2)
+
+	result, err = withPerformanceProfile(map[string]string{profileConfigKey: "huge"}, volumeSnapshotterKind)
+	require.NoError(t, err)
+	assert.Equal(t, "10", result[apiRetryAttemptsConfigKey])
+	assert.Equal(t, "10m", result[apiTimeoutConfigKey])
+
+	result, err = withPerformanceProfile(map[string]string{profileConfigKey: "default"}, objectStoreKind)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{profileConfigKey: "default"}, result)
+
+	_, err = withPerformanceProfile(map[string]string{profileConfigKey: "medium"}, objectStoreKind)
+	assert.EqualError(t, err, `invalid value "medium" for config key "profile" (expected one of default, huge, large, small)`)
+}
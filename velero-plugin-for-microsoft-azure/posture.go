@@ -0,0 +1,132 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	storagemgmt "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	enforceDataProtectionConfigKey = "enforceDataProtection"
+
+	// defaultSoftDeleteRetentionDays is the blob soft delete retention
+	// applied when remediating a storage account with soft delete disabled.
+	defaultSoftDeleteRetentionDays = 7
+
+	postureCheckTimeout = 30 * time.Second
+)
+
+type blobServicePropertiesClient interface {
+	GetServiceProperties(ctx context.Context, resourceGroupName string, accountName string) (storagemgmt.BlobServiceProperties, error)
+	SetServiceProperties(ctx context.Context, resourceGroupName string, accountName string, parameters storagemgmt.BlobServiceProperties) (storagemgmt.BlobServiceProperties, error)
+}
+
+// newBlobServicePropertiesClient returns a client for the blob service properties
+// of storage accounts in the given subscription, authorized by the given credentials.
+func newBlobServicePropertiesClient(credentials credentialProvider, env *azure.Environment, subscriptionID string) (blobServicePropertiesClient, error) {
+	authorizer, err := credentials.GetARMToken(armResource(env))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting authorizer from environment")
+	}
+
+	client := storagemgmt.NewBlobServicesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	client.Authorizer = authorizer
+
+	return client, nil
+}
+
+// checkDataProtection inspects the storage account's blob soft delete and
+// versioning settings and warns about risky configurations. Soft delete
+// protects backup metadata against accidental deletion, while versioning
+// multiplies storage for repositories (e.g. restic) that rewrite objects
+// frequently. If enforce is true, a missing soft delete policy is enabled
+// rather than just reported.
+func checkDataProtection(log logrus.FieldLogger, client blobServicePropertiesClient, resourceGroup, storageAccount string, enforce bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postureCheckTimeout)
+	defer cancel()
+
+	props, err := client.GetServiceProperties(ctx, resourceGroup, storageAccount)
+	if err != nil {
+		return errors.Wrap(err, "error getting blob service properties")
+	}
+
+	log = log.WithField("storageAccount", storageAccount)
+
+	if props.BlobServicePropertiesProperties == nil {
+		props.BlobServicePropertiesProperties = &storagemgmt.BlobServicePropertiesProperties{}
+	}
+	settings := props.BlobServicePropertiesProperties
+
+	if settings.IsVersioningEnabled != nil && *settings.IsVersioningEnabled {
+		log.Warn("Blob versioning is enabled on the storage account; repositories that rewrite objects frequently will retain every prior version, which can significantly increase storage costs")
+	}
+
+	if settings.DeleteRetentionPolicy != nil && settings.DeleteRetentionPolicy.Enabled != nil && *settings.DeleteRetentionPolicy.Enabled {
+		return nil
+	}
+
+	if !enforce {
+		log.Warnf("Blob soft delete is disabled on the storage account; deleted backups cannot be recovered. Enable it, or set config.%s=true to have it enabled automatically", enforceDataProtectionConfigKey)
+		return nil
+	}
+
+	log.Infof("Blob soft delete is disabled on the storage account, enabling it with a retention of %d days", defaultSoftDeleteRetentionDays)
+
+	update := storagemgmt.BlobServiceProperties{
+		BlobServicePropertiesProperties: &storagemgmt.BlobServicePropertiesProperties{
+			DeleteRetentionPolicy: &storagemgmt.DeleteRetentionPolicy{
+				Enabled: boolPtr(true),
+				Days:    int32Ptr(defaultSoftDeleteRetentionDays),
+			},
+		},
+	}
+	if _, err := client.SetServiceProperties(ctx, resourceGroup, storageAccount, update); err != nil {
+		return errors.Wrap(err, "error enabling blob soft delete")
+	}
+
+	return nil
+}
+
+// getEnforceDataProtection returns whether config.enforceDataProtection is set.
+func getEnforceDataProtection(config map[string]string) (bool, error) {
+	val := config[enforceDataProtectionConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	enforce, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, enforceDataProtectionConfigKey)
+	}
+
+	return enforce, nil
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
@@ -0,0 +1,101 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	storagemgmt "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckDataProtection(t *testing.T) {
+	softDeleteEnabled := storagemgmt.BlobServiceProperties{
+		BlobServicePropertiesProperties: &storagemgmt.BlobServicePropertiesProperties{
+			DeleteRetentionPolicy: &storagemgmt.DeleteRetentionPolicy{Enabled: boolPtr(true), Days: int32Ptr(14)},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		props         storagemgmt.BlobServiceProperties
+		getErr        error
+		enforce       bool
+		expectSet     bool
+		expectedError string
+	}{
+		{
+			name:  "soft delete enabled, nothing to do",
+			props: softDeleteEnabled,
+		},
+		{
+			name:  "soft delete disabled, not enforced",
+			props: storagemgmt.BlobServiceProperties{},
+		},
+		{
+			name:      "soft delete disabled, enforced",
+			props:     storagemgmt.BlobServiceProperties{},
+			enforce:   true,
+			expectSet: true,
+		},
+		{
+			name:          "error getting properties",
+			getErr:        errors.New("bad"),
+			expectedError: "error getting blob service properties: bad",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := new(mockBlobServicePropertiesClient)
+			defer client.AssertExpectations(t)
+
+			client.On("GetServiceProperties", mock.Anything, "rg", "sa").Return(tc.props, tc.getErr)
+			if tc.expectSet {
+				client.On("SetServiceProperties", mock.Anything, "rg", "sa", mock.MatchedBy(func(p storagemgmt.BlobServiceProperties) bool {
+					return *p.DeleteRetentionPolicy.Enabled && *p.DeleteRetentionPolicy.Days == defaultSoftDeleteRetentionDays
+				})).Return(storagemgmt.BlobServiceProperties{}, nil)
+			}
+
+			err := checkDataProtection(logrus.New(), client, "rg", "sa", tc.enforce)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+type mockBlobServicePropertiesClient struct {
+	mock.Mock
+}
+
+func (m *mockBlobServicePropertiesClient) GetServiceProperties(ctx context.Context, resourceGroupName string, accountName string) (storagemgmt.BlobServiceProperties, error) {
+	args := m.Called(ctx, resourceGroupName, accountName)
+	return args.Get(0).(storagemgmt.BlobServiceProperties), args.Error(1)
+}
+
+func (m *mockBlobServicePropertiesClient) SetServiceProperties(ctx context.Context, resourceGroupName string, accountName string, parameters storagemgmt.BlobServiceProperties) (storagemgmt.BlobServiceProperties, error) {
+	args := m.Called(ctx, resourceGroupName, accountName, parameters)
+	return args.Get(0).(storagemgmt.BlobServiceProperties), args.Error(1)
+}
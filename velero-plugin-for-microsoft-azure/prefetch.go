@@ -0,0 +1,236 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	prefetchObjectsConfigKey = "prefetchObjects"
+
+	// objects larger than this are never prefetched, since prefetched
+	// objects are held in memory until they're requested.
+	maxPrefetchObjectSize = 32 * 1024 * 1024
+)
+
+type prefetchCandidate struct {
+	bucket string
+	key    string
+	// position is the candidate's position in the listing
+	position int
+}
+
+type prefetchEntry struct {
+	position int
+	done     chan struct{}
+	data     []byte
+	err      error
+}
+
+// prefetcher downloads the objects returned by the most recent listing
+// ahead of time, keeping up to 'window' of them in flight or in memory, so
+// that subsequent GetObject calls for those objects don't pay the full
+// round-trip latency to the storage account. Velero also lists objects to
+// delete them, so a listing is only prefetched once one of its objects is
+// read, as restores do. Restores read objects in the listing's order, so
+// reading an object discards the objects listed before it that are still
+// prefetched or queued, keeping the window on the objects ahead.
+type prefetcher struct {
+	log        logrus.FieldLogger
+	blobGetter blobGetter
+	window     int
+
+	mu        sync.Mutex
+	queue     []prefetchCandidate
+	entries   map[string]*prefetchEntry
+	positions map[string]int
+	// started is whether the queue is being prefetched, i.e. whether one
+	// of the listed objects was read
+	started bool
+}
+
+func newPrefetcher(log logrus.FieldLogger, blobGetter blobGetter, window int) *prefetcher {
+	return &prefetcher{
+		log:        log,
+		blobGetter: blobGetter,
+		window:     window,
+		entries:    make(map[string]*prefetchEntry),
+	}
+}
+
+// getPrefetchWindow returns the number of objects to prefetch, or 0 if
+// prefetching is disabled.
+func getPrefetchWindow(config map[string]string) (int, error) {
+	val := config[prefetchObjectsConfigKey]
+	if val == "" {
+		return 0, nil
+	}
+
+	window, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a non-negative integer)", val, prefetchObjectsConfigKey)
+	}
+	if window < 0 {
+		return 0, errors.Errorf("invalid value %q for config key %q (expected a non-negative integer)", val, prefetchObjectsConfigKey)
+	}
+
+	return window, nil
+}
+
+func prefetchEntryKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// reset discards any previously prefetched objects and queues the given
+// blobs, in order, to be prefetched once one of them is read.
+func (p *prefetcher) reset(bucket string, blobs []storage.Blob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queue = nil
+	p.entries = make(map[string]*prefetchEntry)
+	p.positions = make(map[string]int)
+	p.started = false
+
+	for _, blob := range blobs {
+		if blob.Properties.ContentLength > maxPrefetchObjectSize {
+			continue
+		}
+		candidate := prefetchCandidate{bucket: bucket, key: blob.Name, position: len(p.queue)}
+		p.queue = append(p.queue, candidate)
+		p.positions[prefetchEntryKey(bucket, blob.Name)] = candidate.position
+	}
+}
+
+// advanceLocked discards the queued and prefetched objects listed up to the
+// given position, that of an object being read, and starts prefetching the
+// objects after it. p.mu must be held.
+func (p *prefetcher) advanceLocked(position int) {
+	queue := p.queue[:0]
+	for _, candidate := range p.queue {
+		if candidate.position > position {
+			queue = append(queue, candidate)
+		}
+	}
+	p.queue = queue
+
+	for entryKey, entry := range p.entries {
+		if entry.position <= position {
+			delete(p.entries, entryKey)
+		}
+	}
+
+	p.started = true
+	p.fillLocked()
+}
+
+// fillLocked starts downloads for queued candidates until the window
+// is full. p.mu must be held.
+func (p *prefetcher) fillLocked() {
+	for len(p.entries) < p.window && len(p.queue) > 0 {
+		candidate := p.queue[0]
+		p.queue = p.queue[1:]
+
+		entry := &prefetchEntry{position: candidate.position, done: make(chan struct{})}
+		p.entries[prefetchEntryKey(candidate.bucket, candidate.key)] = entry
+
+		go p.fetch(candidate, entry)
+	}
+}
+
+func (p *prefetcher) fetch(candidate prefetchCandidate, entry *prefetchEntry) {
+	defer close(entry.done)
+
+	blob, err := p.blobGetter.getBlob(candidate.bucket, candidate.key)
+	if err != nil {
+		entry.err = err
+		return
+	}
+
+	res, err := blob.Get(nil)
+	if err != nil {
+		entry.err = err
+		return
+	}
+	defer res.Close()
+
+	entry.data, entry.err = ioutil.ReadAll(res)
+}
+
+// take returns the prefetched contents of the given object, if it was
+// prefetched successfully. Reading a listed object frees up the slots of the
+// objects listed before it, so the next queued objects start downloading.
+func (p *prefetcher) take(bucket, key string) ([]byte, bool) {
+	entryKey := prefetchEntryKey(bucket, key)
+
+	p.mu.Lock()
+	entry, ok := p.entries[entryKey]
+	if position, listed := p.positions[entryKey]; listed {
+		p.advanceLocked(position)
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	<-entry.done
+	if entry.err != nil {
+		p.log.WithError(entry.err).WithField("key", key).Debug("Prefetch failed, falling back to a direct download")
+		return nil, false
+	}
+
+	return entry.data, true
+}
+
+// invalidate discards the prefetched contents of the given object, which
+// was written or deleted, or of the objects under it if it's a prefix, so
+// that they're read again from the storage account.
+func (p *prefetcher) invalidate(bucket, key string) {
+	target := prefetchEntryKey(bucket, key)
+	invalidated := func(entryKey string) bool {
+		return entryKey == target || strings.HasSuffix(key, "/") && strings.HasPrefix(entryKey, target)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queue := p.queue[:0]
+	for _, candidate := range p.queue {
+		if !invalidated(prefetchEntryKey(candidate.bucket, candidate.key)) {
+			queue = append(queue, candidate)
+		}
+	}
+	p.queue = queue
+
+	for entryKey := range p.entries {
+		if invalidated(entryKey) {
+			delete(p.entries, entryKey)
+		}
+	}
+	if p.started {
+		p.fillLocked()
+	}
+}
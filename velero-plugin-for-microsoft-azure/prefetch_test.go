@@ -0,0 +1,186 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPrefetchWindow(t *testing.T) {
+	window, err := getPrefetchWindow(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, window)
+
+	window, err = getPrefetchWindow(map[string]string{prefetchObjectsConfigKey: "4"})
+	require.NoError(t, err)
+	assert.Equal(t, 4, window)
+
+	_, err = getPrefetchWindow(map[string]string{prefetchObjectsConfigKey: "-1"})
+	assert.EqualError(t, err, `invalid value "-1" for config key "prefetchObjects" (expected a non-negative integer)`)
+
+	_, err = getPrefetchWindow(map[string]string{prefetchObjectsConfigKey: "foo"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unable to parse value "foo" for config key "prefetchObjects"`)
+}
+
+func TestPrefetcher(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	defer blobGetter.AssertExpectations(t)
+
+	blobA := new(mockBlob)
+	blobA.On("Get", mock.Anything).Return(ioutil.NopCloser(strings.NewReader("a-data")), nil)
+	blobGetter.On("getBlob", "b", "a").Return(blobA, nil)
+
+	blobB := new(mockBlob)
+	blobB.On("Get", mock.Anything).Return(ioutil.NopCloser(strings.NewReader("")), errors.New("bad"))
+	blobGetter.On("getBlob", "b", "b").Return(blobB, nil)
+
+	p := newPrefetcher(logrus.New(), blobGetter, 1)
+	p.reset("b", []storage.Blob{
+		{Name: "first"},
+		{Name: "a"},
+		{Name: "b"},
+		{Name: "huge", Properties: storage.BlobProperties{ContentLength: maxPrefetchObjectSize + 1}},
+	})
+
+	// nothing is downloaded until one of the listed objects is read, since
+	// objects are also listed to be deleted
+	p.mu.Lock()
+	assert.Empty(t, p.entries)
+	assert.Len(t, p.queue, 3)
+	p.mu.Unlock()
+
+	// objects that weren't listed are a miss
+	_, ok := p.take("b", "unlisted")
+	assert.False(t, ok)
+	p.mu.Lock()
+	assert.Empty(t, p.entries)
+	p.mu.Unlock()
+
+	// reading a listed object starts prefetching the ones after it, and the
+	// window only allows one object in flight at a time
+	_, ok = p.take("b", "first")
+	assert.False(t, ok)
+	p.mu.Lock()
+	assert.Len(t, p.entries, 1)
+	assert.Len(t, p.queue, 1)
+	p.mu.Unlock()
+
+	// objects that weren't prefetched are a miss
+	_, ok = p.take("b", "huge")
+	assert.False(t, ok)
+
+	data, ok := p.take("b", "a")
+	require.True(t, ok)
+	assert.Equal(t, "a-data", string(data))
+
+	// a second take of the same object is a miss
+	_, ok = p.take("b", "a")
+	assert.False(t, ok)
+
+	// failed prefetches are a miss so the caller falls back to a direct download
+	_, ok = p.take("b", "b")
+	assert.False(t, ok)
+}
+
+func TestPrefetcherInvalidate(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	defer blobGetter.AssertExpectations(t)
+
+	blobA := new(mockBlob)
+	blobA.On("Get", mock.Anything).Return(ioutil.NopCloser(strings.NewReader("a-data")), nil)
+	blobGetter.On("getBlob", "b", "a").Return(blobA, nil)
+
+	blobC := new(mockBlob)
+	blobC.On("Get", mock.Anything).Return(ioutil.NopCloser(strings.NewReader("c-data")), nil)
+	blobGetter.On("getBlob", "b", "dir/c").Return(blobC, nil)
+
+	p := newPrefetcher(logrus.New(), blobGetter, 1)
+	p.reset("b", []storage.Blob{{Name: "first"}, {Name: "a"}, {Name: "dir/c"}, {Name: "dir/d"}})
+	p.take("b", "first")
+
+	prefetched := func(key string) {
+		p.mu.Lock()
+		entry := p.entries[prefetchEntryKey("b", key)]
+		p.mu.Unlock()
+		require.NotNil(t, entry)
+		<-entry.done
+	}
+	prefetched("a")
+
+	// an object written after it was prefetched is read again
+	p.invalidate("b", "a")
+	_, ok := p.take("b", "a")
+	assert.False(t, ok)
+	prefetched("dir/c")
+
+	// and so are the objects under a deleted prefix
+	p.invalidate("b", "dir/")
+	p.mu.Lock()
+	assert.Empty(t, p.entries)
+	assert.Empty(t, p.queue)
+	p.mu.Unlock()
+}
+
+func TestPrefetcherSkip(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	defer blobGetter.AssertExpectations(t)
+
+	blobA := new(mockBlob)
+	blobA.On("Get", mock.Anything).Return(ioutil.NopCloser(strings.NewReader("a-data")), nil)
+	blobGetter.On("getBlob", "b", "a").Return(blobA, nil)
+
+	blobC := new(mockBlob)
+	blobC.On("Get", mock.Anything).Return(ioutil.NopCloser(strings.NewReader("c-data")), nil)
+	blobGetter.On("getBlob", "b", "c").Return(blobC, nil)
+
+	p := newPrefetcher(logrus.New(), blobGetter, 1)
+	p.reset("b", []storage.Blob{{Name: "first"}, {Name: "a"}, {Name: "b"}, {Name: "c"}})
+	p.take("b", "first")
+
+	p.mu.Lock()
+	entryA := p.entries[prefetchEntryKey("b", "a")]
+	p.mu.Unlock()
+	require.NotNil(t, entryA)
+	<-entryA.done
+
+	// reading an object past the prefetched ones frees up their slots, so
+	// the window moves on to the objects after it
+	_, ok := p.take("b", "b")
+	assert.False(t, ok)
+	p.mu.Lock()
+	assert.Len(t, p.entries, 1)
+	assert.Contains(t, p.entries, prefetchEntryKey("b", "c"))
+	assert.Empty(t, p.queue)
+	p.mu.Unlock()
+
+	_, ok = p.take("b", "a")
+	assert.False(t, ok)
+
+	data, ok := p.take("b", "c")
+	require.True(t, ok)
+	assert.Equal(t, "c-data", string(data))
+}
@@ -0,0 +1,93 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	storagemgmt "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type accountPropertiesClient interface {
+	GetProperties(ctx context.Context, resourceGroupName string, accountName string, expand storagemgmt.AccountExpand) (storagemgmt.Account, error)
+}
+
+// newAccountPropertiesClient returns a client for the properties of storage
+// accounts in the given subscription, authorized by the given credentials.
+func newAccountPropertiesClient(credentials credentialProvider, env *azure.Environment, subscriptionID string) (accountPropertiesClient, error) {
+	authorizer, err := credentials.GetARMToken(armResource(env))
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting authorizer from environment")
+	}
+
+	client := storagemgmt.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	client.Authorizer = authorizer
+
+	return client, nil
+}
+
+// accountRecommendations returns recommendations for making the given
+// storage account suitable for backups and for the kopia and restic
+// repositories of file system backups, which read and write many small
+// objects.
+func accountRecommendations(account storagemgmt.Account) []string {
+	var recommendations []string
+
+	switch account.Kind {
+	case storagemgmt.FileStorage:
+		recommendations = append(recommendations, "The storage account is a FileStorage account, which doesn't support blobs; use a StorageV2 or BlockBlobStorage account")
+	case storagemgmt.Storage:
+		recommendations = append(recommendations, "The storage account is a general-purpose v1 account, which has lower throughput limits and no access tiers; upgrade it to general-purpose v2 (StorageV2)")
+	}
+
+	if account.Sku != nil && account.Sku.Tier == storagemgmt.Premium && account.Kind != storagemgmt.BlockBlobStorage && account.Kind != storagemgmt.FileStorage {
+		recommendations = append(recommendations, "The storage account is a premium account that only supports page blobs; use a standard account, or a premium BlockBlobStorage account for low-latency repositories")
+	}
+
+	if props := account.AccountProperties; props != nil {
+		if props.AccessTier == storagemgmt.Cool {
+			recommendations = append(recommendations, "The storage account's default access tier is Cool; kopia and restic repositories read and rewrite objects frequently, which incurs Cool tier transaction and early deletion charges, so use the Hot tier for accounts holding repositories")
+		}
+		if props.IsHnsEnabled != nil && *props.IsHnsEnabled {
+			recommendations = append(recommendations, "The storage account has a hierarchical namespace (Data Lake Storage Gen2) enabled; blob soft delete and versioning have limitations on such accounts, and NFSv3-enabled accounts can't be used by the plugin, so prefer an account without it")
+		}
+	}
+
+	return recommendations
+}
+
+// checkAccountSuitability logs recommendations for making the storage account
+// suitable for backups.
+func checkAccountSuitability(log logrus.FieldLogger, client accountPropertiesClient, resourceGroup, storageAccount string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postureCheckTimeout)
+	defer cancel()
+
+	account, err := client.GetProperties(ctx, resourceGroup, storageAccount, "")
+	if err != nil {
+		return errors.Wrap(err, "error getting storage account properties")
+	}
+
+	log = log.WithField("storageAccount", storageAccount)
+	for _, recommendation := range accountRecommendations(account) {
+		log.Warn(recommendation)
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	storagemgmt "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountRecommendations(t *testing.T) {
+	tests := []struct {
+		name     string
+		account  storagemgmt.Account
+		expected []string
+	}{
+		{
+			name: "suitable account",
+			account: storagemgmt.Account{
+				Kind:              storagemgmt.StorageV2,
+				Sku:               &storagemgmt.Sku{Tier: storagemgmt.Standard},
+				AccountProperties: &storagemgmt.AccountProperties{AccessTier: storagemgmt.Hot},
+			},
+		},
+		{
+			name: "premium block blob account",
+			account: storagemgmt.Account{
+				Kind: storagemgmt.BlockBlobStorage,
+				Sku:  &storagemgmt.Sku{Tier: storagemgmt.Premium},
+			},
+		},
+		{
+			name:     "general-purpose v1",
+			account:  storagemgmt.Account{Kind: storagemgmt.Storage},
+			expected: []string{"general-purpose v1"},
+		},
+		{
+			name:     "file storage",
+			account:  storagemgmt.Account{Kind: storagemgmt.FileStorage, Sku: &storagemgmt.Sku{Tier: storagemgmt.Premium}},
+			expected: []string{"doesn't support blobs"},
+		},
+		{
+			name:     "premium page blob account",
+			account:  storagemgmt.Account{Kind: storagemgmt.StorageV2, Sku: &storagemgmt.Sku{Tier: storagemgmt.Premium}},
+			expected: []string{"only supports page blobs"},
+		},
+		{
+			name: "cool tier with hierarchical namespace",
+			account: storagemgmt.Account{
+				Kind:              storagemgmt.StorageV2,
+				AccountProperties: &storagemgmt.AccountProperties{AccessTier: storagemgmt.Cool, IsHnsEnabled: boolPtr(true)},
+			},
+			expected: []string{"access tier is Cool", "hierarchical namespace"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			recommendations := accountRecommendations(tc.account)
+			require.Len(t, recommendations, len(tc.expected))
+			for i, expected := range tc.expected {
+				assert.Contains(t, recommendations[i], expected)
+			}
+		})
+	}
+}
+
+type mockAccountPropertiesClient struct {
+	mock.Mock
+}
+
+func (m *mockAccountPropertiesClient) GetProperties(ctx context.Context, resourceGroupName string, accountName string, expand storagemgmt.AccountExpand) (storagemgmt.Account, error) {
+	args := m.Called(resourceGroupName, accountName)
+	return args.Get(0).(storagemgmt.Account), args.Error(1)
+}
+
+func TestCheckAccountSuitability(t *testing.T) {
+	client := new(mockAccountPropertiesClient)
+	client.On("GetProperties", "rg", "account").Return(storagemgmt.Account{Kind: storagemgmt.Storage}, nil)
+
+	log, hook := test.NewNullLogger()
+	require.NoError(t, checkAccountSuitability(log, client, "rg", "account"))
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, "account", hook.LastEntry().Data["storageAccount"])
+}
@@ -0,0 +1,114 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	readCacheURLConfigKey = "readCacheURL"
+
+	// readCacheURLPeriod is how long the URLs objects are read through the
+	// cache with stay the same. Every reader signs the same URL for an object
+	// within a period, so the cache serves them all from one entry.
+	readCacheURLPeriod = time.Hour
+)
+
+// getReadCacheURL parses config.readCacheURL, the URL of a CDN or Azure Front
+// Door endpoint whose origin is the storage account's blob endpoint.
+func getReadCacheURL(config map[string]string) (*url.URL, error) {
+	val := config[readCacheURLConfigKey]
+	if val == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(val)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" {
+		return nil, errors.Errorf("invalid value %q for config key %q (expected an https URL without a query)", val, readCacheURLConfigKey)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// readCache reads objects through a CDN or Front Door endpoint in front of
+// the storage account, so that objects read by many restores at once, or
+// over and over, are served from the edge rather than the account. Requests
+// are authorized by signed URLs, which the endpoint passes to the account on
+// cache misses.
+type readCache struct {
+	base   *url.URL
+	sign   func(bucket, key string, opts storage.BlobSASOptions) (string, error)
+	client *http.Client
+	now    func() time.Time
+}
+
+func newReadCache(base *url.URL, sign func(bucket, key string, opts storage.BlobSASOptions) (string, error)) *readCache {
+	return &readCache{base: base, sign: sign, client: &http.Client{}, now: time.Now}
+}
+
+// get reads the given object through the cache. Error responses are
+// returned as storage.AzureStorageServiceError, so that isNotFound works.
+func (c *readCache) get(bucket, key string) (io.ReadCloser, error) {
+	// the URL's expiry is at least a period away, and the same for every
+	// reader until the period ends
+	expiry := c.now().UTC().Truncate(readCacheURLPeriod).Add(2 * readCacheURLPeriod)
+	signed, err := c.sign(bucket, key, storage.BlobSASOptions{
+		SASOptions:                storage.SASOptions{Expiry: expiry},
+		BlobServiceSASPermissions: storage.BlobServiceSASPermissions{Read: true},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(signed)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	u.Scheme = c.base.Scheme
+	u.Host = c.base.Host
+	u.Path = c.base.Path + u.Path
+	u.RawPath = ""
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// objects are returned as stored, e.g. gzipped logs aren't decompressed
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.WithStack(storage.AzureStorageServiceError{
+			StatusCode: resp.StatusCode,
+			Code:       resp.Header.Get("x-ms-error-code"),
+			RequestID:  resp.Header.Get("x-ms-request-id"),
+		})
+	}
+	return resp.Body, nil
+}
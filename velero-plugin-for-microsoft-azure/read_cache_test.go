@@ -0,0 +1,100 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetReadCacheURL(t *testing.T) {
+	u, err := getReadCacheURL(map[string]string{})
+	require.NoError(t, err)
+	assert.Nil(t, u)
+
+	u, err = getReadCacheURL(map[string]string{readCacheURLConfigKey: "https://velero.azureedge.net/backups/"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://velero.azureedge.net/backups", u.String())
+
+	for _, val := range []string{"http://velero.azureedge.net", "velero.azureedge.net", "https://velero.azureedge.net/?sig=abc"} {
+		_, err := getReadCacheURL(map[string]string{readCacheURLConfigKey: val})
+		assert.Error(t, err, val)
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	var requests []*http.Request
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.URL.Path != "/edge/b/backups/b1/b1.tar.gz" {
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("from the edge"))
+	}))
+	defer server.Close()
+
+	base, err := url.Parse(server.URL + "/edge")
+	require.NoError(t, err)
+	now := time.Date(2020, 6, 1, 12, 10, 0, 0, time.UTC)
+	cache := &readCache{
+		base: base,
+		sign: func(bucket, key string, opts storage.BlobSASOptions) (string, error) {
+			return "https://account.blob.core.windows.net/" + bucket + "/" + key + "?se=" + url.QueryEscape(opts.Expiry.Format(time.RFC3339)) + "&sig=abc", nil
+		},
+		client: server.Client(),
+		now:    func() time.Time { return now },
+	}
+
+	res, err := cache.get("b", "backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(res)
+	require.NoError(t, err)
+	assert.Equal(t, "from the edge", string(data))
+	assert.Equal(t, "2020-06-01T14:00:00Z", requests[0].URL.Query().Get("se"))
+	assert.Equal(t, "identity", requests[0].Header.Get("Accept-Encoding"))
+
+	// readers within the same period read the same URL, so the edge serves
+	// them from one cache entry
+	now = now.Add(45 * time.Minute)
+	_, err = cache.get("b", "backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+	assert.Equal(t, requests[0].URL.String(), requests[1].URL.String())
+
+	// objects the edge doesn't have are read from the storage account
+	_, err = cache.get("b", "backups/b1/b1-logs.gz")
+	assert.True(t, isNotFound(err))
+
+	// and GetObject falls back to the storage account, which doesn't have
+	// them either
+	blobs := newMemBlobs(now)
+	o := &ObjectStore{log: logrus.New(), blobGetter: blobs, readCache: cache}
+	_, err = o.GetObject("b", "backups/b1/b1-logs.gz")
+	assert.True(t, isNotFound(err))
+	assert.Len(t, requests, 4)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	redactLogSecretsConfigKey     = "redactLogSecrets"
+	logRedactionPatternsConfigKey = "logRedactionPatterns"
+
+	logsObjectSuffix = "-logs.gz"
+	redacted         = "REDACTED"
+)
+
+// defaultRedactionPatterns match SAS token signatures, storage account keys
+// and bearer tokens. When a pattern has a capturing group, only the group is
+// redacted, so the surrounding text still shows what was removed.
+var defaultRedactionPatterns = []string{
+	`(?i)[?&]sig=([A-Za-z0-9%+/=]+)`,
+	`(?i)AccountKey=([A-Za-z0-9+/]+=*)`,
+	`[A-Za-z0-9+/]{86}==`,
+	`(?i)bearer\s+([A-Za-z0-9\-._~+/]+=*)`,
+}
+
+func getRedactLogSecrets(config map[string]string) (bool, error) {
+	val := config[redactLogSecretsConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	redact, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Errorf("unable to parse value %q for config key %q (expected a boolean value)", val, redactLogSecretsConfigKey)
+	}
+
+	return redact, nil
+}
+
+// logRedactor redacts secrets from the gzipped logs Velero uploads for
+// backups and restores, before they reach long-lived storage.
+type logRedactor struct {
+	log      logrus.FieldLogger
+	patterns []*regexp.Regexp
+}
+
+// newLogRedactor returns a redactor for the default patterns and those in
+// config.logRedactionPatterns, a semicolon-separated list of regular
+// expressions.
+func newLogRedactor(log logrus.FieldLogger, config map[string]string) (*logRedactor, error) {
+	exprs := append([]string{}, defaultRedactionPatterns...)
+	for _, expr := range strings.Split(config[logRedactionPatternsConfigKey], ";") {
+		if expr = strings.TrimSpace(expr); expr != "" {
+			exprs = append(exprs, expr)
+		}
+	}
+
+	r := &logRedactor{log: log}
+	for _, expr := range exprs {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse pattern %q in config key %q", expr, logRedactionPatternsConfigKey)
+		}
+		r.patterns = append(r.patterns, pattern)
+	}
+
+	return r, nil
+}
+
+// redactLine returns the line with every match of the redactor's patterns
+// redacted, and the number of matches.
+func (r *logRedactor) redactLine(line string) (string, int) {
+	var count int
+	for _, pattern := range r.patterns {
+		matches := pattern.FindAllStringSubmatchIndex(line, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		var b strings.Builder
+		last := 0
+		for _, match := range matches {
+			start, end := match[0], match[1]
+			if len(match) >= 4 && match[2] >= 0 {
+				start, end = match[2], match[3]
+			}
+			b.WriteString(line[last:start])
+			b.WriteString(redacted)
+			last = end
+		}
+		b.WriteString(line[last:])
+
+		line = b.String()
+		count += len(matches)
+	}
+	return line, count
+}
+
+// redact returns a reader of the gzipped log in body with its secrets
+// redacted. The log is decompressed, redacted and recompressed as it's read,
+// so it's never held in memory. The reader must be closed if it isn't read
+// to the end.
+func (r *logRedactor) redact(key string, body io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		count, err := r.redactGzip(body, pw)
+		if err == nil && count > 0 {
+			r.log.WithFields(logrus.Fields{"key": key, "count": count}).Info("Redacted secrets from log")
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+func (r *logRedactor) redactGzip(body io.Reader, w io.Writer) (int, error) {
+	gzr, err := gzip.NewReader(body)
+	if err != nil {
+		return 0, errors.Wrap(err, "error decompressing log")
+	}
+	defer gzr.Close()
+
+	gzw := gzip.NewWriter(w)
+	reader := bufio.NewReader(gzr)
+
+	var count int
+	for {
+		line, readErr := reader.ReadString('\n')
+		if line != "" {
+			redactedLine, n := r.redactLine(line)
+			count += n
+			if _, err := gzw.Write([]byte(redactedLine)); err != nil {
+				return count, errors.Wrap(err, "error compressing log")
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return count, errors.Wrap(readErr, "error decompressing log")
+		}
+	}
+
+	return count, errors.Wrap(gzw.Close(), "error compressing log")
+}
@@ -0,0 +1,391 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// veleroPVTag is the tag velero adds to snapshots naming the persistent
+	// volume they were taken of.
+	veleroPVTag = "velero.io-pv"
+
+	// rehearsalTag marks the disks created by restore rehearsals, with the ID
+	// of the snapshot they were restored from.
+	rehearsalTag = "velero.io-rehearsal"
+
+	defaultRehearsalSampleMiB = 64
+	rehearsalAccessSeconds    = 3600
+)
+
+// rehearsalResult is the outcome of a restore rehearsal. It's published to the
+// metadata store so DR validation can be monitored from outside the cluster.
+type rehearsalResult struct {
+	Backup      string            `json:"backup"`
+	StartedAt   time.Time         `json:"startedAt"`
+	CompletedAt time.Time         `json:"completedAt"`
+	Passed      bool              `json:"passed"`
+	Volumes     []rehearsalVolume `json:"volumes"`
+}
+
+type rehearsalVolume struct {
+	PersistentVolume string `json:"persistentVolume"`
+	SnapshotID       string `json:"snapshotID"`
+	SampledBytes     int64  `json:"sampledBytes"`
+	SnapshotSHA256   string `json:"snapshotSHA256,omitempty"`
+	DiskSHA256       string `json:"diskSHA256,omitempty"`
+	Passed           bool   `json:"passed"`
+	Error            string `json:"error,omitempty"`
+}
+
+// selectRehearsalSnapshots returns the Velero snapshots of the given backup,
+// or of the most recent backup if backup is empty, restricted to the given
+// persistent volumes if any. It returns the name of the selected backup.
+func selectRehearsalSnapshots(snapshots []disk.Snapshot, backup string, pvs []string) (string, []disk.Snapshot) {
+	if backup == "" {
+		var latest time.Time
+		for _, snap := range snapshots {
+			name, ok := snap.Tags[veleroBackupTag]
+			if !ok || snap.SnapshotProperties == nil || snap.TimeCreated == nil {
+				continue
+			}
+			if snap.TimeCreated.Time.After(latest) {
+				backup, latest = *name, snap.TimeCreated.Time
+			}
+		}
+	}
+
+	wanted := map[string]bool{}
+	for _, pv := range pvs {
+		wanted[pv] = true
+	}
+
+	var selected []disk.Snapshot
+	for _, snap := range snapshots {
+		if name, ok := snap.Tags[veleroBackupTag]; !ok || *name != backup {
+			continue
+		}
+		if len(wanted) > 0 {
+			if pv, ok := snap.Tags[veleroPVTag]; !ok || !wanted[*pv] {
+				continue
+			}
+		}
+		selected = append(selected, snap)
+	}
+	sort.Slice(selected, func(i, j int) bool { return *selected[i].Name < *selected[j].Name })
+
+	return backup, selected
+}
+
+// sampleChecksum returns the SHA-256 of the first n bytes of the disk or
+// snapshot exported at the given SAS URL, along with the number of bytes read.
+func sampleChecksum(ctx context.Context, client *http.Client, sasURL string, n int64) (string, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, sasURL, nil)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return "", 0, errors.Errorf("unexpected status %s reading exported data", res.Status)
+	}
+
+	hash := sha256.New()
+	read, err := io.Copy(hash, io.LimitReader(res.Body, n))
+	if err != nil {
+		return "", 0, errors.Wrap(err, "error reading exported data")
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), read, nil
+}
+
+// rehearser restores snapshots into a scratch resource group and verifies the
+// restored disks against their snapshots.
+type rehearser struct {
+	log           logrus.FieldLogger
+	disks         *disk.DisksClient
+	snaps         *disk.SnapshotsClient
+	httpClient    *http.Client
+	resourceGroup string
+	scratchGroup  string
+	sampleBytes   int64
+	apiTimeout    time.Duration
+}
+
+func (r *rehearser) rehearse(backup string, pvs []string) (*rehearsalResult, error) {
+	ctx := context.Background()
+
+	var snapshots []disk.Snapshot
+	iter, err := r.snaps.ListByResourceGroupComplete(ctx, r.resourceGroup)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		snapshots = append(snapshots, iter.Value())
+	}
+
+	backup, selected := selectRehearsalSnapshots(snapshots, backup, pvs)
+	if len(selected) == 0 {
+		return nil, errors.Errorf("no snapshots found for backup %q", backup)
+	}
+
+	result := &rehearsalResult{
+		Backup:    backup,
+		StartedAt: time.Now().UTC(),
+		Passed:    true,
+	}
+	for _, snap := range selected {
+		volume := rehearsalVolume{SnapshotID: *snap.ID}
+		if pv, ok := snap.Tags[veleroPVTag]; ok {
+			volume.PersistentVolume = *pv
+		}
+
+		log := r.log.WithField("snapshot", *snap.Name)
+		if err := r.rehearseSnapshot(snap, &volume); err != nil {
+			log.WithError(err).Error("Restore rehearsal failed")
+			volume.Error = err.Error()
+		} else if volume.SnapshotSHA256 != volume.DiskSHA256 {
+			log.Error("Restored disk doesn't match its snapshot")
+			volume.Error = "restored disk doesn't match its snapshot"
+		} else {
+			log.Info("Restore rehearsal passed")
+			volume.Passed = true
+		}
+
+		result.Passed = result.Passed && volume.Passed
+		result.Volumes = append(result.Volumes, volume)
+	}
+	result.CompletedAt = time.Now().UTC()
+
+	return result, nil
+}
+
+// rehearseSnapshot restores the given snapshot to a scratch disk and records
+// the checksums of a sample of the snapshot's and the disk's data. The disk is
+// deleted afterwards.
+func (r *rehearser) rehearseSnapshot(snap disk.Snapshot, volume *rehearsalVolume) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.apiTimeout)
+	defer cancel()
+
+	diskName := "rehearsal-" + uuid.NewV4().String()
+	d := disk.Disk{
+		Name:     &diskName,
+		Location: snap.Location,
+		DiskProperties: &disk.DiskProperties{
+			CreationData: &disk.CreationData{
+				CreateOption:     disk.Copy,
+				SourceResourceID: snap.ID,
+			},
+		},
+		Tags: map[string]*string{rehearsalTag: stringPtr(volume.SnapshotID)},
+	}
+
+	future, err := r.disks.CreateOrUpdate(ctx, r.scratchGroup, diskName, d)
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, r.disks.Client)
+	}
+	if err != nil {
+		return errors.Wrap(err, "error restoring snapshot to scratch disk")
+	}
+	defer func() {
+		// use a fresh context so the disk is deleted even if the timeout expired
+		ctx, cancel := context.WithTimeout(context.Background(), r.apiTimeout)
+		defer cancel()
+		if future, err := r.disks.Delete(ctx, r.scratchGroup, diskName); err != nil {
+			r.log.WithError(err).WithField("disk", diskName).Error("Error deleting scratch disk")
+		} else if err := future.WaitForCompletionRef(ctx, r.disks.Client); err != nil {
+			r.log.WithError(err).WithField("disk", diskName).Error("Error deleting scratch disk")
+		}
+	}()
+
+	access := disk.GrantAccessData{Access: disk.Read, DurationInSeconds: int32Ptr(rehearsalAccessSeconds)}
+
+	snapAccess, err := r.snaps.GrantAccess(ctx, r.resourceGroup, *snap.Name, access)
+	if err == nil {
+		err = snapAccess.WaitForCompletionRef(ctx, r.snaps.Client)
+	}
+	if err != nil {
+		return errors.Wrap(err, "error exporting snapshot")
+	}
+	defer r.snaps.RevokeAccess(context.Background(), r.resourceGroup, *snap.Name)
+	snapURI, err := snapAccess.Result(*r.snaps)
+	if err != nil {
+		return errors.Wrap(err, "error exporting snapshot")
+	}
+	if snapURI.AccessSAS == nil {
+		return errors.New("exported snapshot has no access URL")
+	}
+
+	diskAccess, err := r.disks.GrantAccess(ctx, r.scratchGroup, diskName, access)
+	if err == nil {
+		err = diskAccess.WaitForCompletionRef(ctx, r.disks.Client)
+	}
+	if err != nil {
+		return errors.Wrap(err, "error exporting scratch disk")
+	}
+	defer r.disks.RevokeAccess(context.Background(), r.scratchGroup, diskName)
+	diskURI, err := diskAccess.Result(*r.disks)
+	if err != nil {
+		return errors.Wrap(err, "error exporting scratch disk")
+	}
+	if diskURI.AccessSAS == nil {
+		return errors.New("exported scratch disk has no access URL")
+	}
+
+	if volume.SnapshotSHA256, volume.SampledBytes, err = sampleChecksum(ctx, r.httpClient, *snapURI.AccessSAS, r.sampleBytes); err != nil {
+		return errors.Wrap(err, "error reading snapshot data")
+	}
+	if volume.DiskSHA256, _, err = sampleChecksum(ctx, r.httpClient, *diskURI.AccessSAS, r.sampleBytes); err != nil {
+		return errors.Wrap(err, "error reading scratch disk data")
+	}
+
+	return nil
+}
+
+func runRehearseRestore(log logrus.FieldLogger, args []string) error {
+	var (
+		backup        string
+		pvs           []string
+		resourceGroup string
+		scratchGroup  string
+		sampleMiB     int64
+		interval      time.Duration
+		apiTimeout    time.Duration
+		resultConfig  map[string]string
+	)
+
+	flags := pflag.NewFlagSet("rehearse-restore", pflag.ContinueOnError)
+	flags.StringVar(&backup, "backup", "", "The backup to rehearse restoring (defaults to the most recent backup with snapshots)")
+	flags.StringSliceVar(&pvs, "volumes", nil, "The persistent volumes to restore (defaults to all volumes in the backup)")
+	flags.StringVar(&resourceGroup, "resource-group", "", "Resource group containing the snapshots (defaults to $AZURE_RESOURCE_GROUP)")
+	flags.StringVar(&scratchGroup, "scratch-resource-group", "", "Resource group to restore disks into; they're deleted after verification")
+	flags.Int64Var(&sampleMiB, "sample-mib", defaultRehearsalSampleMiB, "How much data at the start of each disk to verify, in MiB")
+	flags.DurationVar(&interval, "interval", 0, "Rehearse repeatedly at this interval rather than once")
+	flags.DurationVar(&apiTimeout, "api-timeout", 30*time.Minute, "Timeout for rehearsing each volume")
+	flags.StringToStringVar(&resultConfig, "result-config", nil, fmt.Sprintf("Metadata store config to publish results to, e.g. %s=...,%s=...", metadataStorageAccountConfigKey, metadataBucketConfigKey))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	authorizer, env, err := commandAuthorizer()
+	if err != nil {
+		return err
+	}
+
+	if resourceGroup == "" {
+		resourceGroup = os.Getenv(resourceGroupEnvVar)
+	}
+	if _, err := getRequiredValues(os.Getenv, subscriptionIDEnvVar); err != nil {
+		return errors.Wrap(err, "unable to get all required environment variables")
+	}
+	if resourceGroup == "" || scratchGroup == "" {
+		return errors.Errorf("--scratch-resource-group and --resource-group (or %s) are required", resourceGroupEnvVar)
+	}
+
+	var results *metadataStore
+	if len(resultConfig) > 0 {
+		if results, err = newMetadataStore(resultConfig, env); err != nil {
+			return err
+		}
+	}
+
+	disksClient := disk.NewDisksClientWithBaseURI(env.ResourceManagerEndpoint, os.Getenv(subscriptionIDEnvVar))
+	snapsClient := disk.NewSnapshotsClientWithBaseURI(env.ResourceManagerEndpoint, os.Getenv(subscriptionIDEnvVar))
+	disksClient.Authorizer = authorizer
+	snapsClient.Authorizer = authorizer
+	disksClient.PollingDelay = quirksFor(env).pollingDelay
+	snapsClient.PollingDelay = quirksFor(env).pollingDelay
+
+	r := &rehearser{
+		log:           log,
+		disks:         &disksClient,
+		snaps:         &snapsClient,
+		httpClient:    http.DefaultClient,
+		resourceGroup: resourceGroup,
+		scratchGroup:  scratchGroup,
+		sampleBytes:   sampleMiB << 20,
+		apiTimeout:    apiTimeout,
+	}
+
+	for {
+		result, err := r.rehearse(backup, pvs)
+		if err != nil {
+			log.WithError(err).Error("Error rehearsing restore")
+		} else if err := publishRehearsalResult(results, result); err != nil {
+			log.WithError(err).Error("Error publishing restore rehearsal result")
+		} else {
+			log.WithFields(logrus.Fields{"backup": result.Backup, "passed": result.Passed}).Info("Restore rehearsal complete")
+		}
+
+		if interval == 0 {
+			if err != nil {
+				return err
+			}
+			if !result.Passed {
+				return errors.New("restore rehearsal failed")
+			}
+			return nil
+		}
+		time.Sleep(interval)
+	}
+}
+
+// publishRehearsalResult writes the result to the metadata store, both under
+// a unique name and as the latest result.
+func publishRehearsalResult(store *metadataStore, result *rehearsalResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if store == nil {
+		fmt.Println(string(data))
+		return nil
+	}
+
+	name := fmt.Sprintf("rehearsals/%s-%s.json", result.Backup, result.StartedAt.Format("20060102150405"))
+	if err := store.put(name, data); err != nil {
+		return err
+	}
+	return store.put("rehearsals/latest.json", data)
+}
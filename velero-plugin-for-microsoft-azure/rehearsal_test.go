@@ -0,0 +1,105 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectRehearsalSnapshots(t *testing.T) {
+	now := time.Now()
+	newSnapshot := func(name, backup, pv string, age time.Duration) disk.Snapshot {
+		return disk.Snapshot{
+			Name: stringPtr(name),
+			Tags: map[string]*string{
+				veleroBackupTag: stringPtr(backup),
+				veleroPVTag:     stringPtr(pv),
+			},
+			SnapshotProperties: &disk.SnapshotProperties{
+				TimeCreated: &date.Time{Time: now.Add(-age)},
+			},
+		}
+	}
+
+	snapshots := []disk.Snapshot{
+		newSnapshot("old-a", "old", "pv-a", 48*time.Hour),
+		newSnapshot("new-b", "new", "pv-b", time.Hour),
+		newSnapshot("new-a", "new", "pv-a", time.Hour),
+		{Name: stringPtr("untagged"), SnapshotProperties: &disk.SnapshotProperties{TimeCreated: &date.Time{Time: now}}},
+	}
+
+	tests := []struct {
+		name       string
+		backup     string
+		pvs        []string
+		wantBackup string
+		want       []string
+	}{
+		{name: "latest backup", wantBackup: "new", want: []string{"new-a", "new-b"}},
+		{name: "named backup", backup: "old", wantBackup: "old", want: []string{"old-a"}},
+		{name: "selected volumes", pvs: []string{"pv-b"}, wantBackup: "new", want: []string{"new-b"}},
+		{name: "unknown backup", backup: "missing", wantBackup: "missing"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backup, selected := selectRehearsalSnapshots(snapshots, test.backup, test.pvs)
+			assert.Equal(t, test.wantBackup, backup)
+
+			var names []string
+			for _, snap := range selected {
+				names = append(names, *snap.Name)
+			}
+			assert.Equal(t, test.want, names)
+		})
+	}
+}
+
+func TestSampleChecksum(t *testing.T) {
+	data := []byte("0123456789")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		assert.Equal(t, "bytes=0-3", r.Header.Get("Range"))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[:4])
+	}))
+	defer server.Close()
+
+	sum, n, err := sampleChecksum(context.Background(), server.Client(), server.URL+"/disk?sig=x", 4)
+	require.NoError(t, err)
+
+	want := sha256.Sum256(data[:4])
+	assert.Equal(t, hex.EncodeToString(want[:]), sum)
+	assert.Equal(t, int64(4), n)
+
+	_, _, err = sampleChecksum(context.Background(), server.Client(), server.URL+"/disk", 4)
+	assert.Error(t, err)
+}
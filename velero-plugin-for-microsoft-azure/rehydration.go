@@ -0,0 +1,192 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	rehydrateArchivedObjectsConfigKey = "rehydrateArchivedObjects"
+	rehydratePriorityConfigKey        = "rehydratePriority"
+
+	// blobArchivedCode is the storage error code of reads of archived blobs,
+	// including those being rehydrated
+	blobArchivedCode = "BlobArchived"
+
+	// rehydratedAccessTier is the tier archived blobs are rehydrated to. Hot
+	// blobs can be read, and moved to cooler tiers again, without extra charges
+	rehydratedAccessTier = "Hot"
+
+	standardRehydratePriority = "Standard"
+	highRehydratePriority     = "High"
+)
+
+// rehydrationTimes are how long rehydrations of each priority take at most.
+// High priority rehydrations of blobs under 10 GB usually take less than an
+// hour.
+// ref. https://docs.microsoft.com/en-us/azure/storage/blobs/archive-rehydrate-overview
+var rehydrationTimes = map[string]time.Duration{
+	standardRehydratePriority: 15 * time.Hour,
+	highRehydratePriority:     time.Hour,
+}
+
+// getRehydratePriority returns the priority to rehydrate archived objects
+// with when they're read, or "" if they aren't rehydrated.
+func getRehydratePriority(config map[string]string) (string, error) {
+	val := config[rehydrateArchivedObjectsConfigKey]
+	if val == "" {
+		return "", nil
+	}
+	rehydrate, err := strconv.ParseBool(val)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, rehydrateArchivedObjectsConfigKey)
+	}
+	if !rehydrate {
+		return "", nil
+	}
+
+	switch val := config[rehydratePriorityConfigKey]; {
+	case val == "":
+		return standardRehydratePriority, nil
+	case strings.EqualFold(val, standardRehydratePriority):
+		return standardRehydratePriority, nil
+	case strings.EqualFold(val, highRehydratePriority):
+		return highRehydratePriority, nil
+	default:
+		return "", errors.Errorf("invalid value %q for config key %q (expected %s or %s)", val, rehydratePriorityConfigKey, standardRehydratePriority, highRehydratePriority)
+	}
+}
+
+// archiveStatus is the rehydration status of an archived blob.
+type archiveStatus struct {
+	// rehydrating is whether the blob is being rehydrated
+	rehydrating bool
+	// priority is the priority of the rehydration, if any
+	priority string
+	// since is when the blob's tier was last changed, i.e. when it was
+	// archived or when its rehydration started
+	since time.Time
+}
+
+// archivedBlobs inspects and rehydrates archived blobs.
+type archivedBlobs interface {
+	archiveStatus(bucket, key string) (*archiveStatus, error)
+	rehydrate(bucket, key, priority string) error
+}
+
+// archiveStatus gets the blob's properties, which the storage client returns
+// without its archive status.
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/get-blob-properties
+func (s *azureAccessTierSetter) archiveStatus(bucket, key string) (*archiveStatus, error) {
+	resp, err := s.service.do(s.account, blobRequest{
+		method:     http.MethodHead,
+		bucket:     bucket,
+		key:        key,
+		apiVersion: accessTierAPIVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	// e.g. "rehydrate-pending-to-hot"
+	status := &archiveStatus{
+		rehydrating: strings.HasPrefix(resp.Header.Get("x-ms-archive-status"), "rehydrate-pending-to-"),
+		priority:    resp.Header.Get("x-ms-rehydrate-priority"),
+	}
+	if changed := resp.Header.Get("x-ms-access-tier-change-time"); changed != "" {
+		if status.since, err = time.Parse(http.TimeFormat, changed); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse access tier change time %q", changed)
+		}
+	}
+	return status, nil
+}
+
+func (s *azureAccessTierSetter) rehydrate(bucket, key, priority string) error {
+	resp, err := s.service.do(s.account, blobRequest{
+		method: http.MethodPut,
+		bucket: bucket,
+		key:    key,
+		query:  url.Values{"comp": {"tier"}},
+		headers: map[string]string{
+			"x-ms-access-tier":        rehydratedAccessTier,
+			"x-ms-rehydrate-priority": priority,
+		},
+		apiVersion: accessTierAPIVersion,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// archivedObjectError is returned for reads of objects in the Archive tier,
+// which can't be read until they're rehydrated.
+type archivedObjectError struct {
+	key string
+	// rehydrating is whether the object is being rehydrated, in which case
+	// it's expected to be readable by retryAfter
+	rehydrating bool
+	retryAfter  time.Time
+}
+
+func (e *archivedObjectError) Error() string {
+	if !e.rehydrating {
+		return fmt.Sprintf("object %s is in the Archive access tier and can't be read until it's rehydrated: "+
+			"set config.%s to rehydrate archived objects when they're read, or move it to the Hot or Cool tier, then retry", e.key, rehydrateArchivedObjectsConfigKey)
+	}
+	return fmt.Sprintf("object %s is in the Archive access tier and is being rehydrated: retry after %s", e.key, e.retryAfter.Format(time.RFC3339))
+}
+
+// archivedObject returns the error for reading the archived object with the
+// given key, starting its rehydration with the given priority unless it's
+// already being rehydrated or priority is "".
+func archivedObject(archived archivedBlobs, bucket, key, priority string, now time.Time) error {
+	status, err := archived.archiveStatus(bucket, key)
+	if err != nil {
+		return errors.Wrapf(err, "object %s is in the Archive access tier, and its rehydration status can't be read", key)
+	}
+
+	if !status.rehydrating {
+		if priority == "" {
+			return &archivedObjectError{key: key}
+		}
+		if err := archived.rehydrate(bucket, key, priority); err != nil {
+			return errors.Wrapf(err, "object %s is in the Archive access tier, and its rehydration can't be started", key)
+		}
+		status = &archiveStatus{rehydrating: true, priority: priority, since: now}
+	}
+
+	took, ok := rehydrationTimes[status.priority]
+	if !ok {
+		took = rehydrationTimes[standardRehydratePriority]
+	}
+	since := status.since
+	if since.IsZero() {
+		since = now
+	}
+	return &archivedObjectError{key: key, rehydrating: true, retryAfter: since.Add(took)}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRehydratePriority(t *testing.T) {
+	tests := []struct {
+		config   map[string]string
+		expected string
+		err      bool
+	}{
+		{config: map[string]string{}, expected: ""},
+		{config: map[string]string{rehydratePriorityConfigKey: "High"}, expected: ""},
+		{config: map[string]string{rehydrateArchivedObjectsConfigKey: "false"}, expected: ""},
+		{config: map[string]string{rehydrateArchivedObjectsConfigKey: "true"}, expected: standardRehydratePriority},
+		{config: map[string]string{rehydrateArchivedObjectsConfigKey: "true", rehydratePriorityConfigKey: "high"}, expected: highRehydratePriority},
+		{config: map[string]string{rehydrateArchivedObjectsConfigKey: "true", rehydratePriorityConfigKey: "Urgent"}, err: true},
+		{config: map[string]string{rehydrateArchivedObjectsConfigKey: "maybe"}, err: true},
+	}
+
+	for _, test := range tests {
+		priority, err := getRehydratePriority(test.config)
+		if test.err {
+			assert.Error(t, err, test.config)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, priority, test.config)
+	}
+}
+
+type fakeArchivedBlobs struct {
+	status     *archiveStatus
+	rehydrated []string
+}
+
+func (f *fakeArchivedBlobs) archiveStatus(bucket, key string) (*archiveStatus, error) {
+	return f.status, nil
+}
+
+func (f *fakeArchivedBlobs) rehydrate(bucket, key, priority string) error {
+	f.rehydrated = append(f.rehydrated, key+"="+priority)
+	return nil
+}
+
+func TestArchivedObject(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// without rehydration, reads fail with no retry time
+	archived := &fakeArchivedBlobs{status: &archiveStatus{since: now.Add(-time.Hour)}}
+	err := archivedObject(archived, "b", "backups/b1/b1.tar.gz", "", now)
+	assert.Equal(t, &archivedObjectError{key: "backups/b1/b1.tar.gz"}, err)
+	assert.Contains(t, err.Error(), rehydrateArchivedObjectsConfigKey)
+	assert.Empty(t, archived.rehydrated)
+
+	// with rehydration, it's started
+	err = archivedObject(archived, "b", "backups/b1/b1.tar.gz", highRehydratePriority, now)
+	assert.Equal(t, &archivedObjectError{key: "backups/b1/b1.tar.gz", rehydrating: true, retryAfter: now.Add(time.Hour)}, err)
+	assert.Equal(t, []string{"backups/b1/b1.tar.gz=High"}, archived.rehydrated)
+
+	// rehydrations in progress aren't started again, and finish on their own schedule
+	archived = &fakeArchivedBlobs{status: &archiveStatus{rehydrating: true, priority: standardRehydratePriority, since: now.Add(-time.Hour)}}
+	err = archivedObject(archived, "b", "backups/b1/b1.tar.gz", highRehydratePriority, now)
+	assert.Equal(t, &archivedObjectError{key: "backups/b1/b1.tar.gz", rehydrating: true, retryAfter: now.Add(14 * time.Hour)}, err)
+	assert.Equal(t, "object backups/b1/b1.tar.gz is in the Archive access tier and is being rehydrated: retry after 2020-06-02T02:00:00Z", err.Error())
+	assert.Empty(t, archived.rehydrated)
+}
+
+func TestGetObjectArchived(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	blob := new(mockBlob)
+	blobGetter.On("getBlob", "b", "backups/b1/b1.tar.gz").Return(blob, nil)
+	blob.On("Get", mock.Anything).Return(ioutil.NopCloser(nil), storage.AzureStorageServiceError{StatusCode: http.StatusConflict, Code: blobArchivedCode})
+
+	archived := &fakeArchivedBlobs{status: &archiveStatus{}}
+	o := &ObjectStore{
+		log:               logrus.New(),
+		blobGetter:        blobGetter,
+		archived:          archived,
+		rehydratePriority: standardRehydratePriority,
+	}
+
+	_, err := o.GetObject("b", "backups/b1/b1.tar.gz")
+	archivedErr, ok := err.(*archivedObjectError)
+	require.True(t, ok)
+	assert.True(t, archivedErr.rehydrating)
+	assert.Equal(t, []string{"backups/b1/b1.tar.gz=Standard"}, archived.rehydrated)
+}
+
+func TestAzureArchiveStatus(t *testing.T) {
+	credential := &storageCredential{accountKey: "a2V5"}
+	sender := &respondingSender{resp: &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"X-Ms-Archive-Status":          []string{"rehydrate-pending-to-hot"},
+			"X-Ms-Rehydrate-Priority":      []string{"High"},
+			"X-Ms-Access-Tier-Change-Time": []string{"Mon, 01 Jun 2020 12:00:00 GMT"},
+		},
+		Body: ioutil.NopCloser(strings.NewReader("")),
+	}}
+	service := newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+		client, err := newStorageClient("account", credential, &azure.PublicCloud, "")
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		client.Sender = sender
+		return &client, credential, nil
+	})
+	archived := &azureAccessTierSetter{account: "account", service: service}
+
+	status, err := archived.archiveStatus("b", "backups/b1/b1.tar.gz")
+	require.NoError(t, err)
+	assert.Equal(t, &archiveStatus{rehydrating: true, priority: "High", since: time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)}, status)
+	assert.Equal(t, http.MethodHead, sender.requests[0].Method)
+
+	require.NoError(t, archived.rehydrate("b", "backups/b1/b1.tar.gz", "High"))
+	assert.Equal(t, "Hot", sender.requests[1].Header.Get("x-ms-access-tier"))
+	assert.Equal(t, "High", sender.requests[1].Header.Get("x-ms-rehydrate-priority"))
+}
@@ -0,0 +1,542 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	replicationStorageAccountConfigKey          = "replicationStorageAccount"
+	replicationStorageAccountKeyEnvVarConfigKey = "replicationStorageAccountKeyEnvVar"
+	replicationBucketConfigKey                  = "replicationBucket"
+	replicationBackupPrefixesConfigKey          = "replicationBackupPrefixes"
+	readFromReplicaConfigKey                    = "readFromReplica"
+
+	// replicationStateFile records that a backup has been fully replicated.
+	// It's stored in the backup's directory in the primary container, so it's
+	// removed along with the backup.
+	replicationStateFile = "velero-azure-replication.json"
+
+	replicationInterval = 5 * time.Minute
+
+	// backups whose metadata was written more recently than this may still
+	// be uploading their remaining files, so they're not replicated yet.
+	replicationSettleTime = 10 * time.Minute
+
+	replicationSASExpiry = time.Hour
+)
+
+type replicationState struct {
+	Destination string   `json:"destination"`
+	Objects     []string `json:"objects"`
+	// ETags maps each replicated object to the ETag of the primary object
+	// that was copied. States written before ETags were recorded don't have
+	// them, so their backups are replicated again.
+	ETags       map[string]string `json:"etags,omitempty"`
+	CompletedAt time.Time         `json:"completedAt"`
+}
+
+// errNotReplicated is returned by replicator.get for objects whose replica
+// is missing or doesn't match the primary object.
+var errNotReplicated = errors.New("object is not replicated")
+
+// cachedReplicationState is the replication state of a backup directory, as
+// read at some point, or nil if the backup wasn't replicated then.
+type cachedReplicationState struct {
+	state  *replicationState
+	readAt time.Time
+}
+
+// replicator mirrors completed backups from the primary container to a
+// container in a secondary storage account using server-side copies.
+type replicator struct {
+	log              logrus.FieldLogger
+	sourceContainers containerGetter
+	sourceBlobs      blobGetter
+	destBlobs        blobGetter
+	destAccount      string
+	destBucket       string
+	prefix           string
+	backupPrefixes   []string
+	now              func() time.Time
+
+	// states caches the replication state of backup directories, which is
+	// read again after replicationInterval. rewritten has the objects written
+	// or deleted through this process since their backup was last replicated,
+	// and when, so they're read from the primary until it's replicated again.
+	lock      sync.Mutex
+	states    map[string]cachedReplicationState
+	rewritten map[string]time.Time
+}
+
+// newReplicator returns a replicator for the given config, or nil if
+// replication is not configured. The credentials file must already be loaded
+// into the environment.
+func newReplicator(log logrus.FieldLogger, config map[string]string, sourceContainers containerGetter, sourceBlobs blobGetter) (*replicator, error) {
+	account := config[replicationStorageAccountConfigKey]
+	if account == "" {
+		return nil, nil
+	}
+
+	keyEnvVar := config[replicationStorageAccountKeyEnvVarConfigKey]
+	if keyEnvVar == "" {
+		return nil, errors.Errorf("config.%s is required when config.%s is set", replicationStorageAccountKeyEnvVarConfigKey, replicationStorageAccountConfigKey)
+	}
+	if os.Getenv(keyEnvVar) == "" {
+		return nil, errors.Errorf("no storage account key found in env var %s", keyEnvVar)
+	}
+
+	// objects are copied from URLs signed with the location's account key,
+	// and the storage service can't reach an emulator to copy from it
+	if !accountSASAvailable(config) {
+		return nil, errors.Errorf("config.%s requires the location's storage account key, since backups are replicated from URLs signed with it", replicationStorageAccountConfigKey)
+	}
+	if emulatorURI, err := getStorageEmulatorURI(config); err != nil || emulatorURI != nil {
+		return nil, errors.Errorf("config.%s can't be used with a storage emulator", replicationStorageAccountConfigKey)
+	}
+
+	replicaConfig := map[string]string{}
+	for k, v := range config {
+		replicaConfig[k] = v
+	}
+	for _, key := range storageCredentialConfigKeys {
+		delete(replicaConfig, key)
+	}
+	replicaConfig[storageAccountConfigKey] = account
+	replicaConfig[storageAccountKeyEnvVarConfigKey] = keyEnvVar
+
+	blobClient, err := newSecondaryBlobClient(replicaConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting replication storage client")
+	}
+
+	destBucket := config[replicationBucketConfigKey]
+	if destBucket == "" {
+		destBucket = config[bucketConfigKey]
+	}
+
+	var backupPrefixes []string
+	for _, prefix := range strings.Split(config[replicationBackupPrefixesConfigKey], ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			backupPrefixes = append(backupPrefixes, prefix)
+		}
+	}
+
+	return &replicator{
+		log:              log.WithField("replicationStorageAccount", account),
+		sourceContainers: sourceContainers,
+		sourceBlobs:      sourceBlobs,
+		destBlobs:        &azureBlobGetter{blobService: &blobClient},
+		destAccount:      account,
+		destBucket:       destBucket,
+		prefix:           config[prefixConfigKey],
+		backupPrefixes:   backupPrefixes,
+		now:              time.Now,
+		states:           map[string]cachedReplicationState{},
+		rewritten:        map[string]time.Time{},
+	}, nil
+}
+
+// selected returns whether the named backup should be replicated. Scheduled
+// backups are named after their schedule, so prefixes select by schedule.
+func (r *replicator) selected(backup string) bool {
+	if len(r.backupPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range r.backupPrefixes {
+		if strings.HasPrefix(backup, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *replicator) backupsDir() string {
+	return path.Join(r.prefix, "backups") + "/"
+}
+
+// backupDir returns the directory of the backup the given object belongs to,
+// or "" if it isn't part of a backup.
+func (r *replicator) backupDir(key string) string {
+	rest := strings.TrimPrefix(key, r.backupsDir())
+	if rest == key {
+		return ""
+	}
+	i := strings.Index(rest, "/")
+	if i <= 0 {
+		return ""
+	}
+	return r.backupsDir() + rest[:i+1]
+}
+
+func (r *replicator) destination() string {
+	return r.destAccount + "/" + r.destBucket
+}
+
+func (r *replicator) run(bucket string) {
+	for {
+		if err := r.replicateAll(bucket); err != nil {
+			r.log.WithError(err).Warn("Error replicating backups")
+		}
+		time.Sleep(replicationInterval)
+	}
+}
+
+// replicateAll replicates every selected backup that isn't replicated yet.
+func (r *replicator) replicateAll(bucket string) error {
+	container, err := r.sourceContainers.getContainer(bucket)
+	if err != nil {
+		return err
+	}
+
+	_, backupDirs, err := listAllBlobs(container, storage.ListBlobsParameters{
+		Prefix:    r.backupsDir(),
+		Delimiter: "/",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range backupDirs {
+		backup := strings.TrimSuffix(strings.TrimPrefix(dir, r.backupsDir()), "/")
+		if !r.selected(backup) {
+			continue
+		}
+		if err := r.replicateBackup(container, bucket, dir, r.now()); err != nil {
+			r.log.WithError(err).WithField("backup", backup).Warn("Error replicating backup")
+		}
+	}
+
+	return nil
+}
+
+// replicateBackup copies the objects in the given backup directory that
+// changed since the backup was last replicated to the destination container,
+// deletes the replicas of objects that were removed, then records the
+// replication state, unless the backup is still being written.
+func (r *replicator) replicateBackup(container container, bucket, dir string, now time.Time) error {
+	blobs, _, err := listAllBlobs(container, storage.ListBlobsParameters{Prefix: dir})
+	if err != nil {
+		return err
+	}
+
+	var (
+		objects    []string
+		etags      = map[string]string{}
+		complete   bool
+		replicated bool
+	)
+	for _, blob := range blobs {
+		switch path.Base(blob.Name) {
+		case replicationStateFile:
+			replicated = true
+			continue
+		case backupMetadataFile:
+			complete = now.Sub(time.Time(blob.Properties.LastModified)) > replicationSettleTime
+		}
+		objects = append(objects, blob.Name)
+		etags[blob.Name] = blob.Properties.Etag
+	}
+
+	if !complete {
+		return nil
+	}
+
+	var previous map[string]string
+	if replicated {
+		state, err := r.state(bucket, dir)
+		if err != nil {
+			return err
+		}
+		if state != nil && state.Destination == r.destination() {
+			previous = state.ETags
+		}
+	}
+
+	var copied, deleted int
+	for _, key := range objects {
+		if etags[key] != "" && previous[key] == etags[key] {
+			continue
+		}
+		if err := r.copy(bucket, key, etags[key]); err != nil {
+			return errors.Wrapf(err, "error copying %s", key)
+		}
+		copied++
+	}
+	for key := range previous {
+		if _, ok := etags[key]; ok {
+			continue
+		}
+		if err := r.deleteReplica(key); err != nil {
+			return errors.Wrapf(err, "error deleting the replica of %s", key)
+		}
+		deleted++
+	}
+
+	if replicated && copied == 0 && deleted == 0 && len(previous) == len(etags) {
+		r.replicated(dir, nil, now)
+		return nil
+	}
+
+	state := &replicationState{
+		Destination: r.destination(),
+		Objects:     objects,
+		ETags:       etags,
+		CompletedAt: now.UTC(),
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	stateBlob, err := r.sourceBlobs.getBlob(bucket, dir+replicationStateFile)
+	if err != nil {
+		return err
+	}
+
+	r.log.WithField("backupDir", dir).Infof("Replicated %d objects and deleted %d replicas", copied, deleted)
+
+	if err := stateBlob.CreateBlockBlobFromReader(bytes.NewReader(data), nil); err != nil {
+		return errors.WithStack(err)
+	}
+	r.replicated(dir, state, now)
+	return nil
+}
+
+// replicated records that the objects of the given backup directory that
+// weren't rewritten after it was listed at the given time match their
+// replicas, along with the directory's new state, if it was rewritten.
+func (r *replicator) replicated(dir string, state *replicationState, listedAt time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for key, at := range r.rewritten {
+		if strings.HasPrefix(key, dir) && at.Before(listedAt) {
+			delete(r.rewritten, key)
+		}
+	}
+	if state != nil {
+		r.states[dir] = cachedReplicationState{state: state, readAt: r.now()}
+	}
+}
+
+// state returns the replication state of the given backup directory, or nil
+// if the backup hasn't been replicated, reading it again if the cached state
+// is older than replicationInterval.
+func (r *replicator) state(bucket, dir string) (*replicationState, error) {
+	r.lock.Lock()
+	cached, ok := r.states[dir]
+	r.lock.Unlock()
+	if ok && r.now().Sub(cached.readAt) < replicationInterval {
+		return cached.state, nil
+	}
+
+	state, err := r.readState(bucket, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	r.states[dir] = cachedReplicationState{state: state, readAt: r.now()}
+	r.lock.Unlock()
+	return state, nil
+}
+
+// readState returns the replication state recorded in the given backup
+// directory, or nil if the backup hasn't been replicated.
+func (r *replicator) readState(bucket, dir string) (*replicationState, error) {
+	blob, err := r.sourceBlobs.getBlob(bucket, dir+replicationStateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := blob.Get(nil)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer res.Close()
+
+	state := new(replicationState)
+	if err := json.NewDecoder(res).Decode(state); err != nil {
+		return nil, errors.Wrapf(err, "error decoding %s", dir+replicationStateFile)
+	}
+	return state, nil
+}
+
+// copy performs a server-side copy of the given object to the destination
+// container, authorizing the read of the source with a short-lived SAS. The
+// copy fails if the object no longer has the given ETag, so that the
+// recorded state never claims a replica of newer contents than were copied.
+func (r *replicator) copy(bucket, key, etag string) error {
+	source, err := r.sourceBlobs.getBlob(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	sourceURL, err := source.GetSASURI(&storage.BlobSASOptions{
+		SASOptions: storage.SASOptions{
+			Expiry: time.Now().Add(replicationSASExpiry),
+		},
+		BlobServiceSASPermissions: storage.BlobServiceSASPermissions{
+			Read: true,
+		},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	dest, err := r.destBlobs.getBlob(r.destBucket, key)
+	if err != nil {
+		return err
+	}
+
+	return errors.WithStack(dest.Copy(sourceURL, &storage.CopyOptions{
+		Source: storage.CopyOptionsConditions{IfMatch: etag},
+	}))
+}
+
+// deleteReplica deletes the given object from the destination container, if
+// it's there.
+func (r *replicator) deleteReplica(key string) error {
+	blob, err := r.destBlobs.getBlob(r.destBucket, key)
+	if err != nil {
+		return err
+	}
+
+	if err := blob.Delete(nil); err != nil && !isNotFound(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// written records that the given object was written to the primary
+// container, so its replica is stale until its backup is replicated again.
+func (r *replicator) written(key string) {
+	dir := r.backupDir(key)
+	if dir == "" {
+		return
+	}
+
+	r.lock.Lock()
+	r.rewritten[key] = r.now()
+	r.lock.Unlock()
+}
+
+// remove deletes the replica of the given object, which was deleted from the
+// primary container. Objects outside of backups aren't replicated.
+func (r *replicator) remove(key string) {
+	dir := r.backupDir(key)
+	if dir == "" {
+		return
+	}
+
+	// a deleted state file means the backup is being deleted, so its
+	// cached state goes with it
+	if key == dir+replicationStateFile {
+		r.lock.Lock()
+		delete(r.states, dir)
+		for rewritten := range r.rewritten {
+			if strings.HasPrefix(rewritten, dir) {
+				delete(r.rewritten, rewritten)
+			}
+		}
+		r.lock.Unlock()
+		return
+	}
+
+	r.written(key)
+	if err := r.deleteReplica(key); err != nil {
+		r.log.WithError(err).WithField("key", key).Warn("Error deleting the replica of a deleted object")
+	}
+}
+
+// get reads the given object from the destination container. It returns
+// errNotReplicated unless the object was replicated to the destination
+// container according to its backup's replication state, and wasn't written
+// or deleted through this process since. The state is cached, so objects
+// rewritten by other processes may be read from a stale replica until their
+// backup is replicated again.
+func (r *replicator) get(bucket, key string) (io.ReadCloser, error) {
+	dir := r.backupDir(key)
+	if dir == "" {
+		return nil, errNotReplicated
+	}
+
+	r.lock.Lock()
+	_, rewritten := r.rewritten[key]
+	r.lock.Unlock()
+	if rewritten {
+		return nil, errNotReplicated
+	}
+
+	state, err := r.state(bucket, dir)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil || state.Destination != r.destination() || state.ETags[key] == "" {
+		return nil, errNotReplicated
+	}
+
+	blob, err := r.destBlobs.getBlob(r.destBucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := blob.Get(nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return res, nil
+}
+
+// getReadFromReplica returns whether config.readFromReplica is set.
+func getReadFromReplica(config map[string]string) (bool, error) {
+	val := config[readFromReplicaConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	readFromReplica, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, readFromReplicaConfigKey)
+	}
+
+	return readFromReplica, nil
+}
+
+// isNotFound returns whether err is a storage service 404.
+func isNotFound(err error) bool {
+	return storageErrorStatusCode(err) == http.StatusNotFound
+}
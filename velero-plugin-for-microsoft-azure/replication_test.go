@@ -0,0 +1,361 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicatorSelected(t *testing.T) {
+	r := &replicator{}
+	assert.True(t, r.selected("anything"))
+
+	r.backupPrefixes = []string{"daily-", "critical"}
+	assert.True(t, r.selected("daily-20200101000000"))
+	assert.True(t, r.selected("critical-apps"))
+	assert.False(t, r.selected("weekly-20200101000000"))
+}
+
+func TestNewReplicatorRequiresAccountKey(t *testing.T) {
+	defer setEnv(t, map[string]string{"TEST_STORAGE_KEY": "key"})()
+
+	for _, config := range []map[string]string{
+		{useAADConfigKey: "true"},
+		{storageAccountSASEnvVarConfigKey: "TEST_STORAGE_KEY"},
+		{useEmulatorConfigKey: "true"},
+	} {
+		config[replicationStorageAccountConfigKey] = "secondary"
+		config[replicationStorageAccountKeyEnvVarConfigKey] = "TEST_STORAGE_KEY"
+
+		_, err := newReplicator(logrus.New(), config, nil, nil)
+		assert.Error(t, err, "config: %v", config)
+	}
+}
+
+func TestReplicateBackup(t *testing.T) {
+	now := time.Now()
+	dir := "velero/backups/b1/"
+	tarball := dir + "b1.tar.gz"
+	metadata := dir + backupMetadataFile
+
+	listing := func(metadataAge time.Duration, replicated bool) storage.BlobListResponse {
+		res := storage.BlobListResponse{
+			Blobs: []storage.Blob{
+				{Name: tarball, Properties: storage.BlobProperties{Etag: "tarball-2"}},
+				{Name: metadata, Properties: storage.BlobProperties{Etag: "metadata-1", LastModified: storage.TimeRFC1123(now.Add(-metadataAge))}},
+			},
+		}
+		if replicated {
+			res.Blobs = append(res.Blobs, storage.Blob{Name: dir + replicationStateFile})
+		}
+		return res
+	}
+
+	tests := []struct {
+		name          string
+		listing       storage.BlobListResponse
+		state         *replicationState
+		expectCopies  []string
+		expectDeletes []string
+	}{
+		{
+			name:         "settled backup is replicated",
+			listing:      listing(time.Hour, false),
+			expectCopies: []string{tarball, metadata},
+		},
+		{
+			name:    "recently written backup is skipped",
+			listing: listing(time.Minute, false),
+		},
+		{
+			name:    "replicated backup that didn't change is skipped",
+			listing: listing(time.Hour, true),
+			state: &replicationState{
+				Destination: "secondary/replica",
+				ETags:       map[string]string{tarball: "tarball-2", metadata: "metadata-1"},
+			},
+		},
+		{
+			name:    "rewritten objects are copied again and removed ones are deleted",
+			listing: listing(time.Hour, true),
+			state: &replicationState{
+				Destination: "secondary/replica",
+				ETags:       map[string]string{tarball: "tarball-1", metadata: "metadata-1", dir + "b1-logs.gz": "logs-1"},
+			},
+			expectCopies:  []string{tarball},
+			expectDeletes: []string{dir + "b1-logs.gz"},
+		},
+		{
+			name:    "backup replicated to another destination is replicated again",
+			listing: listing(time.Hour, true),
+			state: &replicationState{
+				Destination: "other/replica",
+				ETags:       map[string]string{tarball: "tarball-2", metadata: "metadata-1"},
+			},
+			expectCopies: []string{tarball, metadata},
+		},
+		{
+			name:    "backup replicated before ETags were recorded is replicated again",
+			listing: listing(time.Hour, true),
+			state: &replicationState{
+				Destination: "secondary/replica",
+				Objects:     []string{tarball, metadata},
+			},
+			expectCopies: []string{tarball, metadata},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			container := new(mockContainer)
+			defer container.AssertExpectations(t)
+			sourceBlobs := new(mockBlobGetter)
+			defer sourceBlobs.AssertExpectations(t)
+			destBlobs := new(mockBlobGetter)
+			defer destBlobs.AssertExpectations(t)
+
+			container.On("ListBlobs", storage.ListBlobsParameters{Prefix: dir}).Return(tc.listing, nil)
+
+			state := new(mockBlob)
+			defer state.AssertExpectations(t)
+			if tc.state != nil {
+				data, err := json.Marshal(tc.state)
+				require.NoError(t, err)
+				state.On("Get", (*storage.GetBlobOptions)(nil)).Return(ioutil.NopCloser(bytes.NewReader(data)), nil)
+				sourceBlobs.On("getBlob", "bucket", dir+replicationStateFile).Return(state, nil)
+			}
+
+			copies := map[string]bool{}
+			for _, name := range tc.expectCopies {
+				copies[name] = true
+			}
+			for _, b := range tc.listing.Blobs {
+				if !copies[b.Name] {
+					continue
+				}
+				source := new(mockBlob)
+				source.On("GetSASURI", mock.Anything).Return("https://source/"+b.Name+"?sas", nil)
+				sourceBlobs.On("getBlob", "bucket", b.Name).Return(source, nil)
+
+				dest := new(mockBlob)
+				dest.On("Copy", "https://source/"+b.Name+"?sas", &storage.CopyOptions{
+					Source: storage.CopyOptionsConditions{IfMatch: b.Properties.Etag},
+				}).Return(nil)
+				destBlobs.On("getBlob", "replica", b.Name).Return(dest, nil)
+			}
+			for _, key := range tc.expectDeletes {
+				dest := new(mockBlob)
+				dest.On("Delete", (*storage.DeleteBlobOptions)(nil)).Return(storage.AzureStorageServiceError{StatusCode: http.StatusNotFound})
+				destBlobs.On("getBlob", "replica", key).Return(dest, nil)
+			}
+
+			var written replicationState
+			if len(tc.expectCopies) > 0 || len(tc.expectDeletes) > 0 {
+				state.On("CreateBlockBlobFromReader", mock.Anything, (*storage.PutBlobOptions)(nil)).Run(func(args mock.Arguments) {
+					require.NoError(t, json.NewDecoder(args.Get(0).(io.Reader)).Decode(&written))
+				}).Return(nil)
+				sourceBlobs.On("getBlob", "bucket", dir+replicationStateFile).Return(state, nil)
+			}
+
+			r := &replicator{
+				log:         logrus.New(),
+				sourceBlobs: sourceBlobs,
+				destBlobs:   destBlobs,
+				destAccount: "secondary",
+				destBucket:  "replica",
+				prefix:      "velero",
+				now:         time.Now,
+				states:      map[string]cachedReplicationState{},
+				rewritten:   map[string]time.Time{},
+			}
+
+			require.NoError(t, r.replicateBackup(container, "bucket", dir, now))
+
+			if len(tc.expectCopies) > 0 || len(tc.expectDeletes) > 0 {
+				assert.Equal(t, "secondary/replica", written.Destination)
+				assert.Equal(t, map[string]string{tarball: "tarball-2", metadata: "metadata-1"}, written.ETags)
+			}
+		})
+	}
+}
+
+func TestReplicatorGet(t *testing.T) {
+	dir := "velero/backups/b1/"
+	tarball := dir + "b1.tar.gz"
+
+	tests := []struct {
+		name          string
+		key           string
+		state         *replicationState
+		rewritten     bool
+		expectReplica bool
+	}{
+		{
+			name: "object outside of a backup isn't replicated",
+			key:  "velero/restores/r1/restore-r1-logs.gz",
+		},
+		{
+			name: "object of a backup that wasn't replicated is read from the primary",
+			key:  tarball,
+		},
+		{
+			name: "object of a backup replicated to another destination is read from the primary",
+			key:  tarball,
+			state: &replicationState{
+				Destination: "other/replica",
+				ETags:       map[string]string{tarball: "tarball-1"},
+			},
+		},
+		{
+			name:      "object rewritten since it was replicated is read from the primary",
+			key:       tarball,
+			rewritten: true,
+		},
+		{
+			name: "replicated object is read from the replica",
+			key:  tarball,
+			state: &replicationState{
+				Destination: "secondary/replica",
+				ETags:       map[string]string{tarball: "tarball-1"},
+			},
+			expectReplica: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sourceBlobs := new(mockBlobGetter)
+			defer sourceBlobs.AssertExpectations(t)
+			destBlobs := new(mockBlobGetter)
+			defer destBlobs.AssertExpectations(t)
+
+			if strings.HasPrefix(tc.key, dir) && !tc.rewritten {
+				state := new(mockBlob)
+				if tc.state == nil {
+					state.On("Get", (*storage.GetBlobOptions)(nil)).Return(ioutil.NopCloser(nil), storage.AzureStorageServiceError{StatusCode: http.StatusNotFound})
+				} else {
+					data, err := json.Marshal(tc.state)
+					require.NoError(t, err)
+					state.On("Get", (*storage.GetBlobOptions)(nil)).Return(ioutil.NopCloser(bytes.NewReader(data)), nil)
+				}
+				sourceBlobs.On("getBlob", "bucket", dir+replicationStateFile).Return(state, nil)
+			}
+
+			if tc.expectReplica {
+				replica := new(mockBlob)
+				replica.On("Get", (*storage.GetBlobOptions)(nil)).Return(ioutil.NopCloser(strings.NewReader("replica")), nil)
+				destBlobs.On("getBlob", "replica", tc.key).Return(replica, nil)
+			}
+
+			r := &replicator{
+				log:         logrus.New(),
+				sourceBlobs: sourceBlobs,
+				destBlobs:   destBlobs,
+				destAccount: "secondary",
+				destBucket:  "replica",
+				prefix:      "velero",
+				now:         time.Now,
+				states:      map[string]cachedReplicationState{},
+				rewritten:   map[string]time.Time{},
+			}
+
+			if tc.rewritten {
+				r.written(tc.key)
+			}
+
+			res, err := r.get("bucket", tc.key)
+			if !tc.expectReplica {
+				assert.Equal(t, errNotReplicated, err)
+				return
+			}
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(res)
+			require.NoError(t, err)
+			assert.Equal(t, "replica", string(data))
+		})
+	}
+}
+
+func TestReplicatorCachesState(t *testing.T) {
+	dir := "velero/backups/b1/"
+	tarball := dir + "b1.tar.gz"
+
+	data, err := json.Marshal(replicationState{
+		Destination: "secondary/replica",
+		ETags:       map[string]string{tarball: "tarball-1"},
+	})
+	require.NoError(t, err)
+
+	sourceBlobs := new(mockBlobGetter)
+	defer sourceBlobs.AssertExpectations(t)
+	state := new(mockBlob)
+	state.On("Get", (*storage.GetBlobOptions)(nil)).Return(ioutil.NopCloser(bytes.NewReader(data)), nil).Once()
+	state.On("Get", (*storage.GetBlobOptions)(nil)).Return(ioutil.NopCloser(bytes.NewReader(data)), nil).Once()
+	sourceBlobs.On("getBlob", "bucket", dir+replicationStateFile).Return(state, nil)
+
+	destBlobs := new(mockBlobGetter)
+	replica := new(mockBlob)
+	replica.On("Get", (*storage.GetBlobOptions)(nil)).Return(ioutil.NopCloser(strings.NewReader("replica")), nil)
+	destBlobs.On("getBlob", "replica", tarball).Return(replica, nil)
+
+	now := time.Now()
+	r := &replicator{
+		log:         logrus.New(),
+		sourceBlobs: sourceBlobs,
+		destBlobs:   destBlobs,
+		destAccount: "secondary",
+		destBucket:  "replica",
+		prefix:      "velero",
+		now:         func() time.Time { return now },
+		states:      map[string]cachedReplicationState{},
+		rewritten:   map[string]time.Time{},
+	}
+
+	// the state is read once, rather than with every object
+	for i := 0; i < 3; i++ {
+		_, err := r.get("bucket", tarball)
+		require.NoError(t, err)
+	}
+
+	// objects written through this process are read from the primary until
+	// their backup is replicated again
+	r.written(tarball)
+	_, err = r.get("bucket", tarball)
+	assert.Equal(t, errNotReplicated, err)
+	now = now.Add(time.Second)
+	r.replicated(dir, nil, now)
+	_, err = r.get("bucket", tarball)
+	require.NoError(t, err)
+
+	// and the state is read again once it's older than replicationInterval
+	now = now.Add(replicationInterval)
+	_, err = r.get("bucket", tarball)
+	require.NoError(t, err)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/volume"
+)
+
+const (
+	resourceGraphQueriesConfigKey = "resourceGraphQueries"
+
+	resourceGraphPrefix = pluginObjectsPrefix + "resource-graph/"
+
+	volumeSnapshotsFileSuffix = "-volumesnapshots.json.gz"
+)
+
+// resourceGraphSnapshot is a snapshot of a backup, as listed by its
+// Resource Graph query.
+type resourceGraphSnapshot struct {
+	ID               string `json:"id"`
+	Subscription     string `json:"subscriptionId"`
+	ResourceGroup    string `json:"resourceGroup"`
+	Name             string `json:"name"`
+	PersistentVolume string `json:"persistentVolume,omitempty"`
+}
+
+// resourceGraphRecord is a backup's Resource Graph query, along with the
+// snapshots it listed when the backup was taken.
+type resourceGraphRecord struct {
+	Backup        string                  `json:"backup"`
+	Query         string                  `json:"query"`
+	Subscriptions []string                `json:"subscriptions"`
+	Snapshots     []resourceGraphSnapshot `json:"snapshots"`
+	RecordedAt    time.Time               `json:"recordedAt"`
+}
+
+// getResourceGraphQueries returns whether config.resourceGraphQueries is set.
+func getResourceGraphQueries(config map[string]string) (bool, error) {
+	val := config[resourceGraphQueriesConfigKey]
+	if val == "" {
+		return false, nil
+	}
+
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, resourceGraphQueriesConfigKey)
+	}
+
+	return enabled, nil
+}
+
+// resourceGraphQuery returns the Resource Graph query listing the Azure
+// resources tagged with the given backup's name, which include its
+// snapshots, in every subscription the query is run against.
+func resourceGraphQuery(backup string) string {
+	return fmt.Sprintf("resources\n"+
+		"| where tags['%s'] == '%s'\n"+
+		"| project id, type, name, resourceGroup, subscriptionId, location, persistentVolume = tags['%s']",
+		veleroBackupTag, strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(backup), veleroPVTag)
+}
+
+// resourceGraphRecorder records a Resource Graph query for each backup whose
+// volume snapshots file is uploaded, so that the Azure resources of a backup
+// can be listed across subscriptions without reading its metadata.
+type resourceGraphRecorder struct {
+	log    logrus.FieldLogger
+	store  *metadataStore
+	prefix string
+	now    func() time.Time
+}
+
+// backupName returns the name of the backup whose volume snapshots file is
+// stored at key, or false if key isn't a volume snapshots file.
+func (r *resourceGraphRecorder) backupName(key string) (string, bool) {
+	rel := key
+	if r.prefix != "" {
+		if !strings.HasPrefix(key, r.prefix+"/") {
+			return "", false
+		}
+		rel = strings.TrimPrefix(key, r.prefix+"/")
+	}
+
+	parts := strings.Split(rel, "/")
+	if len(parts) != 3 || parts[0] != "backups" || parts[2] != parts[1]+volumeSnapshotsFileSuffix {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+// snapshotsBuffer returns a buffer to keep the content of the object uploaded
+// to key in, if it's a volume snapshots file.
+func (r *resourceGraphRecorder) snapshotsBuffer(key string) *limitedBuffer {
+	if _, ok := r.backupName(key); !ok {
+		return nil
+	}
+	return &limitedBuffer{limit: maxBackupMetadataSize}
+}
+
+// recordPut writes the Resource Graph query of the backup whose volume
+// snapshots file was uploaded to key, with the given content.
+func (r *resourceGraphRecorder) recordPut(key string, content *limitedBuffer) {
+	backup, ok := r.backupName(key)
+	if !ok || content == nil {
+		return
+	}
+	log := r.log.WithField("backup", backup)
+	if content.truncated {
+		log.Warn("The backup's volume snapshots file is too large to record its Resource Graph query")
+		return
+	}
+
+	snapshots, err := readResourceGraphSnapshots(content.Bytes())
+	if err != nil {
+		log.WithError(err).Warn("Unable to read the backup's volume snapshots to record its Resource Graph query")
+		return
+	}
+
+	record := resourceGraphRecord{
+		Backup:     backup,
+		Query:      resourceGraphQuery(backup),
+		Snapshots:  snapshots,
+		RecordedAt: r.now().UTC(),
+	}
+	subscriptions := map[string]bool{}
+	for _, snap := range snapshots {
+		if !subscriptions[snap.Subscription] {
+			subscriptions[snap.Subscription] = true
+			record.Subscriptions = append(record.Subscriptions, snap.Subscription)
+		}
+	}
+	sort.Strings(record.Subscriptions)
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err == nil {
+		err = r.store.put(resourceGraphPrefix+backup+".json", data)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Error recording the backup's Resource Graph query")
+	}
+}
+
+// recordDelete removes the Resource Graph query of the backup whose volume
+// snapshots file was deleted from key.
+func (r *resourceGraphRecorder) recordDelete(key string) {
+	backup, ok := r.backupName(key)
+	if !ok {
+		return
+	}
+	if err := r.store.delete(resourceGraphPrefix + backup + ".json"); err != nil {
+		r.log.WithError(err).WithField("backup", backup).Warn("Error removing the backup's Resource Graph query")
+	}
+}
+
+// readResourceGraphSnapshots returns the Azure snapshots completed in the
+// given gzipped volume snapshots file.
+func readResourceGraphSnapshots(content []byte) ([]resourceGraphSnapshot, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer gz.Close()
+
+	var snapshots []*volume.Snapshot
+	if err := json.NewDecoder(gz).Decode(&snapshots); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := []resourceGraphSnapshot{}
+	for _, snap := range snapshots {
+		if snap.Status.Phase != volume.SnapshotPhaseCompleted {
+			continue
+		}
+		// snapshots of other providers aren't Azure resources
+		id, err := parseFullSnapshotName(snap.Status.ProviderSnapshotID)
+		if err != nil {
+			continue
+		}
+		result = append(result, resourceGraphSnapshot{
+			ID:               snap.Status.ProviderSnapshotID,
+			Subscription:     id.subscription,
+			ResourceGroup:    id.resourceGroup,
+			Name:             id.name,
+			PersistentVolume: snap.Spec.PersistentVolumeName,
+		})
+	}
+	return result, nil
+}
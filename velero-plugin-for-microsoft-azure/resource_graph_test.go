@@ -0,0 +1,90 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/velero/pkg/volume"
+)
+
+func TestResourceGraphRecorder(t *testing.T) {
+	now := time.Date(2020, 10, 15, 0, 0, 0, 0, time.UTC)
+	blobs := newMemBlobs(now)
+	recorder := &resourceGraphRecorder{
+		log:    logrus.New(),
+		store:  &metadataStore{blobGetter: blobs, bucket: "bucket", prefix: "velero"},
+		prefix: "velero",
+		now:    func() time.Time { return now },
+	}
+
+	snapshot := func(pv, id string, phase volume.SnapshotPhase) *volume.Snapshot {
+		snap := &volume.Snapshot{}
+		snap.Spec.PersistentVolumeName = pv
+		snap.Status.ProviderSnapshotID = id
+		snap.Status.Phase = phase
+		return snap
+	}
+	data, err := json.Marshal([]*volume.Snapshot{
+		snapshot("pv-1", "/subscriptions/sub-2/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap-1", volume.SnapshotPhaseCompleted),
+		snapshot("pv-2", "/subscriptions/sub-1/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap-2", volume.SnapshotPhaseCompleted),
+		snapshot("pv-3", "/subscriptions/sub-1/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap-3", volume.SnapshotPhaseFailed),
+		snapshot("pv-4", "ebs-snapshot", volume.SnapshotPhaseCompleted),
+	})
+	require.NoError(t, err)
+	var content bytes.Buffer
+	gz := gzip.NewWriter(&content)
+	gz.Write(data)
+	require.NoError(t, gz.Close())
+
+	// only volume snapshots files are kept
+	assert.Nil(t, recorder.snapshotsBuffer("velero/backups/b1/velero-backup.json"))
+	assert.Nil(t, recorder.snapshotsBuffer("other/backups/b1/b1-volumesnapshots.json.gz"))
+	buf := recorder.snapshotsBuffer("velero/backups/b1/b1-volumesnapshots.json.gz")
+	require.NotNil(t, buf)
+	buf.Write(content.Bytes())
+
+	recorder.recordPut("velero/backups/b1/b1-volumesnapshots.json.gz", buf)
+	var record resourceGraphRecord
+	require.NoError(t, json.Unmarshal(blobs.data["velero/plugins/azure/resource-graph/b1.json"], &record))
+	assert.Equal(t, resourceGraphRecord{
+		Backup:        "b1",
+		Query:         "resources\n| where tags['velero.io-backup'] == 'b1'\n| project id, type, name, resourceGroup, subscriptionId, location, persistentVolume = tags['velero.io-pv']",
+		Subscriptions: []string{"sub-1", "sub-2"},
+		Snapshots: []resourceGraphSnapshot{
+			{ID: "/subscriptions/sub-2/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap-1", Subscription: "sub-2", ResourceGroup: "rg", Name: "snap-1", PersistentVolume: "pv-1"},
+			{ID: "/subscriptions/sub-1/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap-2", Subscription: "sub-1", ResourceGroup: "rg", Name: "snap-2", PersistentVolume: "pv-2"},
+		},
+		RecordedAt: now,
+	}, record)
+
+	recorder.recordDelete("velero/backups/b1/b1.tar.gz")
+	assert.Contains(t, blobs.data, "velero/plugins/azure/resource-graph/b1.json")
+	recorder.recordDelete("velero/backups/b1/b1-volumesnapshots.json.gz")
+	assert.NotContains(t, blobs.data, "velero/plugins/azure/resource-graph/b1.json")
+}
+
+func TestResourceGraphQueryEscapesBackupName(t *testing.T) {
+	assert.Contains(t, resourceGraphQuery(`it's`), `== 'it\'s'`)
+}
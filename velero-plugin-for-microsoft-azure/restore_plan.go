@@ -0,0 +1,327 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	armTemplateSchema      = "https://schema.management.azure.com/schemas/2019-04-01/deploymentTemplate.json#"
+	armDisksAPIVersion     = "2019-07-01"
+	restorePlanFormatARM   = "arm"
+	restorePlanFormatBicep = "bicep"
+
+	// restorePlanSnapshotTag records, on disks created from a restore plan,
+	// the ID of the snapshot they were restored from.
+	restorePlanSnapshotTag = "velero.io-snapshot"
+)
+
+// restorePlanDisk is a disk to recreate from one of a backup's snapshots.
+type restorePlanDisk struct {
+	name             string
+	persistentVolume string
+	snapshotID       string
+	location         string
+	// priority is the disk's index in restorePriorityClasses
+	priority int
+}
+
+// restorePlan is the set of disks to recreate to restore a backup's volumes.
+type restorePlan struct {
+	backup  string
+	diskSku string
+	disks   []restorePlanDisk
+}
+
+// newRestorePlan returns the plan for recreating the disks of the given
+// snapshots, naming each disk after its persistent volume. Disks are ordered
+// by their priority, given by priorities, and those of each priority class
+// are only created once those of the class before it are.
+func newRestorePlan(backup string, snapshots []disk.Snapshot, diskSku, namePrefix string, priorities []restorePriorityRule) *restorePlan {
+	plan := &restorePlan{backup: backup, diskSku: diskSku}
+	for _, snap := range snapshots {
+		d := restorePlanDisk{
+			name:       namePrefix + *snap.Name,
+			snapshotID: *snap.ID,
+			priority:   restorePriority(priorities, snap),
+		}
+		if pv, ok := snap.Tags[veleroPVTag]; ok {
+			d.persistentVolume = *pv
+			d.name = namePrefix + *pv
+		}
+		if snap.Location != nil {
+			d.location = *snap.Location
+		}
+		plan.disks = append(plan.disks, d)
+	}
+	sort.SliceStable(plan.disks, func(i, j int) bool {
+		return plan.disks[i].priority < plan.disks[j].priority
+	})
+	return plan
+}
+
+// dependencies returns the indexes of the disks the disk at index i waits
+// for: those of the nearest priority class before its own.
+func (p *restorePlan) dependencies(i int) []int {
+	var deps []int
+	wave := -1
+	for j := i - 1; j >= 0; j-- {
+		if p.disks[j].priority == p.disks[i].priority {
+			continue
+		}
+		if wave >= 0 && p.disks[j].priority != wave {
+			break
+		}
+		wave = p.disks[j].priority
+		deps = append([]int{j}, deps...)
+	}
+	return deps
+}
+
+// armTemplate returns the plan as an ARM deployment template. The disks' SKU
+// and zone are template parameters, so they can be chosen per deployment.
+func (p *restorePlan) armTemplate() map[string]interface{} {
+	var (
+		resources []interface{}
+		diskIDs   []string
+	)
+	for i, d := range p.disks {
+		resource := map[string]interface{}{
+			"type":       "Microsoft.Compute/disks",
+			"apiVersion": armDisksAPIVersion,
+			"name":       d.name,
+			"location":   d.location,
+			"sku":        map[string]interface{}{"name": "[parameters('diskSkuName')]"},
+			"zones":      "[if(empty(parameters('zone')), json('null'), createArray(parameters('zone')))]",
+			"tags":       p.tags(d),
+			"properties": map[string]interface{}{
+				"creationData": map[string]interface{}{
+					"createOption":     "Copy",
+					"sourceResourceId": d.snapshotID,
+				},
+			},
+		}
+		if deps := p.dependencies(i); len(deps) > 0 {
+			var dependsOn []string
+			for _, j := range deps {
+				dependsOn = append(dependsOn, fmt.Sprintf("[resourceId('Microsoft.Compute/disks', '%s')]", p.disks[j].name))
+			}
+			resource["dependsOn"] = dependsOn
+		}
+		resources = append(resources, resource)
+		diskIDs = append(diskIDs, fmt.Sprintf("'%s', resourceId('Microsoft.Compute/disks', '%s')", p.outputKey(d), d.name))
+	}
+
+	return map[string]interface{}{
+		"$schema":        armTemplateSchema,
+		"contentVersion": "1.0.0.0",
+		"parameters": map[string]interface{}{
+			"diskSkuName": map[string]interface{}{
+				"type":         "string",
+				"defaultValue": p.diskSku,
+			},
+			"zone": map[string]interface{}{
+				"type":         "string",
+				"defaultValue": "",
+				"metadata":     map[string]interface{}{"description": "The availability zone to create the disks in, if any"},
+			},
+		},
+		"resources": resources,
+		"outputs": map[string]interface{}{
+			"diskIds": map[string]interface{}{
+				"type":  "object",
+				"value": "[createObject(" + strings.Join(diskIDs, ", ") + ")]",
+			},
+		},
+	}
+}
+
+// bicep returns the plan as a Bicep file equivalent to its ARM template.
+func (p *restorePlan) bicep() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "// Recreates the disks of Velero backup %s from its snapshots.\n\n", p.backup)
+	fmt.Fprintf(&b, "param diskSkuName string = '%s'\n\n", p.diskSku)
+	b.WriteString("@description('The availability zone to create the disks in, if any')\n")
+	b.WriteString("param zone string = ''\n")
+
+	for i, d := range p.disks {
+		fmt.Fprintf(&b, "\nresource disk%d 'Microsoft.Compute/disks@%s' = {\n", i, armDisksAPIVersion)
+		fmt.Fprintf(&b, "  name: '%s'\n", d.name)
+		fmt.Fprintf(&b, "  location: '%s'\n", d.location)
+		b.WriteString("  sku: {\n    name: diskSkuName\n  }\n")
+		b.WriteString("  zones: empty(zone) ? null : [\n    zone\n  ]\n")
+		b.WriteString("  tags: {\n")
+		tags := p.tags(d)
+		var names []string
+		for name := range tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, "    '%s': '%s'\n", name, tags[name])
+		}
+		b.WriteString("  }\n")
+		b.WriteString("  properties: {\n    creationData: {\n      createOption: 'Copy'\n")
+		fmt.Fprintf(&b, "      sourceResourceId: '%s'\n", d.snapshotID)
+		b.WriteString("    }\n  }\n")
+		if deps := p.dependencies(i); len(deps) > 0 {
+			b.WriteString("  dependsOn: [\n")
+			for _, j := range deps {
+				fmt.Fprintf(&b, "    disk%d\n", j)
+			}
+			b.WriteString("  ]\n")
+		}
+		b.WriteString("}\n")
+	}
+
+	b.WriteString("\noutput diskIds object = {\n")
+	for i, d := range p.disks {
+		fmt.Fprintf(&b, "  '%s': disk%d.id\n", p.outputKey(d), i)
+	}
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// outputKey returns the key of the given disk in the template's diskIds
+// output: its persistent volume, or its name if it has none.
+func (p *restorePlan) outputKey(d restorePlanDisk) string {
+	if d.persistentVolume != "" {
+		return d.persistentVolume
+	}
+	return d.name
+}
+
+func (p *restorePlan) tags(d restorePlanDisk) map[string]string {
+	tags := map[string]string{
+		veleroBackupTag:        p.backup,
+		restorePlanSnapshotTag: d.snapshotID,
+	}
+	if d.persistentVolume != "" {
+		tags[veleroPVTag] = d.persistentVolume
+	}
+	return tags
+}
+
+// write writes the plan in the given format.
+func (p *restorePlan) write(w io.Writer, format string) error {
+	switch format {
+	case restorePlanFormatARM:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(p.armTemplate()))
+	case restorePlanFormatBicep:
+		_, err := io.WriteString(w, p.bicep())
+		return errors.WithStack(err)
+	default:
+		return errors.Errorf("unsupported format %q (expected %s or %s)", format, restorePlanFormatARM, restorePlanFormatBicep)
+	}
+}
+
+func runExportRestorePlan(_ logrus.FieldLogger, args []string) error {
+	var (
+		backup        string
+		pvs           []string
+		resourceGroup string
+		format        string
+		diskSku       string
+		namePrefix    string
+		output        string
+		priorities    []string
+	)
+
+	flags := pflag.NewFlagSet("export-restore-plan", pflag.ContinueOnError)
+	flags.StringVar(&backup, "backup", "", "The backup whose disks to recreate (defaults to the most recent backup with snapshots)")
+	flags.StringSliceVar(&pvs, "volumes", nil, "The persistent volumes whose disks to recreate (defaults to all volumes in the backup)")
+	flags.StringVar(&resourceGroup, "resource-group", "", "Resource group containing the snapshots (defaults to $AZURE_RESOURCE_GROUP)")
+	flags.StringVar(&format, "format", restorePlanFormatARM, fmt.Sprintf("The format of the plan (%s or %s)", restorePlanFormatARM, restorePlanFormatBicep))
+	flags.StringVar(&diskSku, "disk-sku", string(disk.PremiumLRS), "The default SKU of the recreated disks")
+	flags.StringVar(&namePrefix, "name-prefix", "restore-", "Prefix for the names of the recreated disks, which are named after their persistent volumes")
+	flags.StringVarP(&output, "output", "o", "", "File to write the plan to (defaults to stdout)")
+	flags.StringSliceVar(&priorities, "priority", nil, "Priority class of the volumes of matching claims, as <namespace>/<claim glob>=<critical|high|normal|low>, e.g. databases/*=critical; disks are created class by class (defaults to normal)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	priorityRules, err := parseRestorePriorities(priorities)
+	if err != nil {
+		return err
+	}
+	if format != restorePlanFormatARM && format != restorePlanFormatBicep {
+		return errors.Errorf("unsupported format %q (expected %s or %s)", format, restorePlanFormatARM, restorePlanFormatBicep)
+	}
+
+	authorizer, env, err := commandAuthorizer()
+	if err != nil {
+		return err
+	}
+
+	if resourceGroup == "" {
+		resourceGroup = os.Getenv(resourceGroupEnvVar)
+	}
+	if _, err := getRequiredValues(os.Getenv, subscriptionIDEnvVar); err != nil {
+		return errors.Wrap(err, "unable to get all required environment variables")
+	}
+	if resourceGroup == "" {
+		return errors.Errorf("--resource-group (or %s) is required", resourceGroupEnvVar)
+	}
+
+	snapsClient := disk.NewSnapshotsClientWithBaseURI(env.ResourceManagerEndpoint, os.Getenv(subscriptionIDEnvVar))
+	snapsClient.Authorizer = authorizer
+
+	ctx := context.Background()
+	var snapshots []disk.Snapshot
+	iter, err := snapsClient.ListByResourceGroupComplete(ctx, resourceGroup)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		snapshots = append(snapshots, iter.Value())
+	}
+
+	backup, selected := selectRehearsalSnapshots(snapshots, backup, pvs)
+	if len(selected) == 0 {
+		return errors.Errorf("no snapshots found for backup %q", backup)
+	}
+
+	w := io.Writer(os.Stdout)
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return newRestorePlan(backup, selected, diskSku, namePrefix, priorityRules).write(w, format)
+}
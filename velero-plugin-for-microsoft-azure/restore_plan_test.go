@@ -0,0 +1,172 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRestorePlan() *restorePlan {
+	snapID := "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/"
+	return newRestorePlan("b1", []disk.Snapshot{
+		{
+			Name:     stringPtr("snap-1"),
+			ID:       stringPtr(snapID + "snap-1"),
+			Location: stringPtr("westeurope"),
+			Tags:     map[string]*string{veleroBackupTag: stringPtr("b1"), veleroPVTag: stringPtr("pv-1")},
+		},
+		{
+			Name:     stringPtr("snap-2"),
+			ID:       stringPtr(snapID + "snap-2"),
+			Location: stringPtr("westeurope"),
+			Tags:     map[string]*string{veleroBackupTag: stringPtr("b1")},
+		},
+	}, "Premium_LRS", "restore-", nil)
+}
+
+func TestRestorePlanARMTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, testRestorePlan().write(&buf, restorePlanFormatARM))
+
+	var template struct {
+		Parameters map[string]struct {
+			DefaultValue string `json:"defaultValue"`
+		} `json:"parameters"`
+		Resources []struct {
+			Type       string            `json:"type"`
+			Name       string            `json:"name"`
+			Location   string            `json:"location"`
+			Tags       map[string]string `json:"tags"`
+			Properties struct {
+				CreationData struct {
+					CreateOption     string `json:"createOption"`
+					SourceResourceID string `json:"sourceResourceId"`
+				} `json:"creationData"`
+			} `json:"properties"`
+		} `json:"resources"`
+		Outputs map[string]struct {
+			Value string `json:"value"`
+		} `json:"outputs"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &template))
+
+	assert.Equal(t, "Premium_LRS", template.Parameters["diskSkuName"].DefaultValue)
+	require.Len(t, template.Resources, 2)
+
+	res := template.Resources[0]
+	assert.Equal(t, "Microsoft.Compute/disks", res.Type)
+	assert.Equal(t, "restore-pv-1", res.Name)
+	assert.Equal(t, "westeurope", res.Location)
+	assert.Equal(t, "Copy", res.Properties.CreationData.CreateOption)
+	assert.Equal(t, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap-1", res.Properties.CreationData.SourceResourceID)
+	assert.Equal(t, map[string]string{
+		veleroBackupTag:        "b1",
+		veleroPVTag:            "pv-1",
+		restorePlanSnapshotTag: res.Properties.CreationData.SourceResourceID,
+	}, res.Tags)
+
+	// snapshots without a persistent volume tag are named after themselves
+	assert.Equal(t, "restore-snap-2", template.Resources[1].Name)
+
+	assert.Equal(t,
+		"[createObject('pv-1', resourceId('Microsoft.Compute/disks', 'restore-pv-1'), 'restore-snap-2', resourceId('Microsoft.Compute/disks', 'restore-snap-2'))]",
+		template.Outputs["diskIds"].Value)
+}
+
+func TestRestorePlanBicep(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, testRestorePlan().write(&buf, restorePlanFormatBicep))
+	bicep := buf.String()
+
+	assert.Contains(t, bicep, "param diskSkuName string = 'Premium_LRS'\n")
+	assert.Contains(t, bicep, "resource disk0 'Microsoft.Compute/disks@2019-07-01' = {\n  name: 'restore-pv-1'\n")
+	assert.Contains(t, bicep, "      sourceResourceId: '/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap-2'\n")
+	assert.Contains(t, bicep, "output diskIds object = {\n  'pv-1': disk0.id\n  'restore-snap-2': disk1.id\n}\n")
+}
+
+func TestRestorePlanUnsupportedFormat(t *testing.T) {
+	assert.Error(t, testRestorePlan().write(&bytes.Buffer{}, "terraform"))
+}
+
+func TestRestorePlanPriorities(t *testing.T) {
+	snap := func(name, namespace, claim string) disk.Snapshot {
+		return disk.Snapshot{
+			Name:     stringPtr(name),
+			ID:       stringPtr("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/" + name),
+			Location: stringPtr("westeurope"),
+			Tags:     map[string]*string{pvcNamespaceTag: stringPtr(namespace), pvcNameTag: stringPtr(claim)},
+		}
+	}
+	rules, err := parseRestorePriorities([]string{"databases/*=critical", "*/cache-*=low", "web/frontend=HIGH"})
+	require.NoError(t, err)
+
+	plan := newRestorePlan("b1", []disk.Snapshot{
+		snap("logs", "web", "logs"),
+		snap("cache", "web", "cache-1"),
+		snap("frontend", "web", "frontend"),
+		snap("postgres", "databases", "data-postgres-0"),
+		snap("redis", "databases", "cache-redis"),
+		{Name: stringPtr("untagged"), ID: stringPtr("untagged"), Location: stringPtr("westeurope")},
+	}, "Premium_LRS", "", rules)
+
+	var names []string
+	for _, d := range plan.disks {
+		names = append(names, d.name)
+	}
+	// the first matching rule wins, and disks keep their order within a class
+	assert.Equal(t, []string{"postgres", "redis", "frontend", "logs", "untagged", "cache"}, names)
+
+	var buf bytes.Buffer
+	require.NoError(t, plan.write(&buf, restorePlanFormatARM))
+	var template struct {
+		Resources []struct {
+			DependsOn []string `json:"dependsOn"`
+		} `json:"resources"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &template))
+	require.Len(t, template.Resources, 6)
+	assert.Empty(t, template.Resources[0].DependsOn)
+	assert.Empty(t, template.Resources[1].DependsOn)
+	assert.Equal(t, []string{
+		"[resourceId('Microsoft.Compute/disks', 'postgres')]",
+		"[resourceId('Microsoft.Compute/disks', 'redis')]",
+	}, template.Resources[2].DependsOn)
+	assert.Equal(t, []string{"[resourceId('Microsoft.Compute/disks', 'frontend')]"}, template.Resources[3].DependsOn)
+	assert.Equal(t, []string{"[resourceId('Microsoft.Compute/disks', 'frontend')]"}, template.Resources[4].DependsOn)
+	assert.Equal(t, []string{
+		"[resourceId('Microsoft.Compute/disks', 'logs')]",
+		"[resourceId('Microsoft.Compute/disks', 'untagged')]",
+	}, template.Resources[5].DependsOn)
+
+	buf.Reset()
+	require.NoError(t, plan.write(&buf, restorePlanFormatBicep))
+	assert.Contains(t, buf.String(), "resource disk5 'Microsoft.Compute/disks@2019-07-01' = {\n  name: 'cache'\n")
+	assert.Contains(t, buf.String(), "  dependsOn: [\n    disk3\n    disk4\n  ]\n}\n")
+}
+
+func TestParseRestorePrioritiesInvalid(t *testing.T) {
+	for _, rule := range []string{"databases=critical", "databases/*", "a/b/c=low", "databases/[=low", "databases/*=urgent"} {
+		_, err := parseRestorePriorities([]string{rule})
+		assert.Error(t, err, rule)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path"
+	"strings"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/pkg/errors"
+)
+
+const (
+	// the tags Kubernetes sets on the disks it provisions for claims, which
+	// their snapshots inherit
+	pvcNamespaceTag = "kubernetes.io-created-for-pvc-namespace"
+	pvcNameTag      = "kubernetes.io-created-for-pvc-name"
+
+	// defaultRestorePriority is the priority of the volumes no rule matches,
+	// "normal".
+	defaultRestorePriority = 2
+)
+
+// restorePriorityClasses are the priority classes of restored volumes, in
+// the order they're restored.
+var restorePriorityClasses = []string{"critical", "high", "normal", "low"}
+
+// restorePriorityRule assigns the volumes of the claims matching pattern, a
+// "<namespace>/<claim>" glob, to a priority class, by its index in
+// restorePriorityClasses.
+type restorePriorityRule struct {
+	pattern  string
+	priority int
+}
+
+// parseRestorePriorities parses rules of the form "<namespace>/<claim>=<class>",
+// e.g. "databases/*=critical" or "*/redis-*=low".
+func parseRestorePriorities(rules []string) ([]restorePriorityRule, error) {
+	var parsed []restorePriorityRule
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.Count(parts[0], "/") != 1 {
+			return nil, errors.Errorf("invalid restore priority %q (expected <namespace>/<claim>=<class>)", rule)
+		}
+		if _, err := path.Match(parts[0], ""); err != nil {
+			return nil, errors.Errorf("invalid restore priority %q: malformed pattern %q", rule, parts[0])
+		}
+
+		priority := -1
+		for i, class := range restorePriorityClasses {
+			if strings.EqualFold(parts[1], class) {
+				priority = i
+			}
+		}
+		if priority < 0 {
+			return nil, errors.Errorf("invalid restore priority %q: unknown class %q (expected one of %s)", rule, parts[1], strings.Join(restorePriorityClasses, ", "))
+		}
+		parsed = append(parsed, restorePriorityRule{pattern: parts[0], priority: priority})
+	}
+	return parsed, nil
+}
+
+// restorePriority returns the priority of the given snapshot's volume: that
+// of the first rule matching its claim, or the default one if none does, or
+// if the claim isn't known.
+func restorePriority(rules []restorePriorityRule, snap disk.Snapshot) int {
+	namespace, name := snap.Tags[pvcNamespaceTag], snap.Tags[pvcNameTag]
+	if namespace != nil && name != nil {
+		claim := *namespace + "/" + *name
+		for _, rule := range rules {
+			if ok, _ := path.Match(rule.pattern, claim); ok {
+				return rule.priority
+			}
+		}
+	}
+	return defaultRestorePriority
+}
@@ -0,0 +1,71 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+const restoreResultsSuffix = "-results.gz"
+
+// isRestoreResultsKey returns whether key is the results object of a
+// restore, e.g. "restores/r1/restore-r1-results.gz". These may be written by
+// retried operations concurrently.
+func isRestoreResultsKey(key string) bool {
+	return strings.Contains("/"+key, "/restores/") && strings.HasSuffix(key, restoreResultsSuffix)
+}
+
+// guardedUpload makes an upload safe against concurrent uploads of the same
+// object. Uncommitted blocks are shared by all the uploads of a blob, so
+// concurrent uploads with the same block IDs can commit each other's blocks,
+// interleaving their content. A guarded upload's block IDs are unique to
+// it, and its commit is conditional on the blob not having been written
+// since the upload started, so that exactly one complete version is kept.
+type guardedUpload struct {
+	blockIDPrefix string
+	commit        *storage.PutBlockListOptions
+}
+
+func newGuardedUpload(blob blob) (*guardedUpload, error) {
+	u := &guardedUpload{
+		// block IDs must have the same length for all blocks of a blob,
+		// and the first 8 characters of a UUID are hex digits, which keeps
+		// them valid base64
+		blockIDPrefix: uuid.NewV4().String()[:8],
+	}
+
+	err := blob.GetProperties(nil)
+	switch {
+	case isNotFound(err):
+		u.commit = &storage.PutBlockListOptions{IfNoneMatch: "*"}
+	case err != nil:
+		return nil, errors.WithStack(err)
+	default:
+		u.commit = &storage.PutBlockListOptions{IfMatch: blob.Properties().Etag}
+	}
+
+	return u, nil
+}
+
+func (u *guardedUpload) blockID(n int) string {
+	return fmt.Sprintf("%s%08d", u.blockIDPrefix, n)
+}
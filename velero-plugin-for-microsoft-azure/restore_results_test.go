@@ -0,0 +1,111 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRestoreResultsKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"restores/r1/restore-r1-results.gz", true},
+		{"cluster-1/restores/r1/restore-r1-results.gz", true},
+		{"restores/r1/restore-r1-logs.gz", false},
+		{"backups/b1/b1-results.gz", false},
+		{"myrestores/r1/restore-r1-results.gz", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, isRestoreResultsKey(test.key), test.key)
+	}
+}
+
+func TestNewGuardedUpload(t *testing.T) {
+	missing := new(mockBlob)
+	missing.On("GetProperties", mock.Anything).Return(storage.AzureStorageServiceError{StatusCode: http.StatusNotFound})
+	u, err := newGuardedUpload(missing)
+	require.NoError(t, err)
+	assert.Equal(t, &storage.PutBlockListOptions{IfNoneMatch: "*"}, u.commit)
+
+	existing := new(mockBlob)
+	existing.On("GetProperties", mock.Anything).Return(nil)
+	existing.On("Properties").Return(storage.BlobProperties{Etag: "0x8D1"})
+	u, err = newGuardedUpload(existing)
+	require.NoError(t, err)
+	assert.Equal(t, &storage.PutBlockListOptions{IfMatch: "0x8D1"}, u.commit)
+
+	// block IDs are unique to each upload, and all the same length
+	other, err := newGuardedUpload(existing)
+	require.NoError(t, err)
+	assert.NotEqual(t, u.blockID(0), other.blockID(0))
+	assert.Len(t, u.blockID(0), 16)
+	assert.Len(t, u.blockID(12345), 16)
+
+	failing := new(mockBlob)
+	failing.On("GetProperties", mock.Anything).Return(storage.AzureStorageServiceError{StatusCode: http.StatusForbidden})
+	_, err = newGuardedUpload(failing)
+	assert.Error(t, err)
+}
+
+func TestPutObjectGuardsRestoreResults(t *testing.T) {
+	tests := []struct {
+		name      string
+		commitErr error
+	}{
+		{name: "committed"},
+		{name: "concurrent retry committed first", commitErr: storage.AzureStorageServiceError{StatusCode: http.StatusPreconditionFailed}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key := "restores/r1/restore-r1-results.gz"
+			blobGetter := new(mockBlobGetter)
+			blob := new(mockBlob)
+			blobGetter.On("getBlob", "b", key).Return(blob, nil)
+			blob.On("GetProperties", mock.Anything).Return(nil)
+			blob.On("Properties").Return(storage.BlobProperties{Etag: "0x8D1"})
+			blob.On("PutBlock", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+			blob.On("PutBlockList", mock.Anything, &storage.PutBlockListOptions{IfMatch: "0x8D1"}).Return(tc.commitErr)
+
+			o := &ObjectStore{
+				log:        logrus.New(),
+				blobGetter: blobGetter,
+				blockSize:  4,
+			}
+			require.NoError(t, o.PutObject("b", key, strings.NewReader("results")))
+
+			blob.AssertExpectations(t)
+			for _, call := range blob.Calls {
+				if call.Method == "PutBlock" {
+					assert.Len(t, call.Arguments.String(0), 16)
+					assert.NotEqual(t, "00000000", call.Arguments.String(0))
+				}
+			}
+		})
+	}
+}
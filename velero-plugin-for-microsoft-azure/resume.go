@@ -0,0 +1,125 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxDownloadResumeAttempts is the number of consecutive attempts to resume
+	// a download without reading any data before giving up.
+	maxDownloadResumeAttempts = 5
+
+	downloadResumeBackoff = time.Second
+)
+
+// resumingReader reads a blob's content, transparently reopening the download
+// at the current offset with a range request if the connection fails mid-stream.
+// Reopened downloads are conditional on the blob's ETag so that content from
+// different versions of the blob is never mixed.
+type resumingReader struct {
+	log      logrus.FieldLogger
+	blob     blob
+	body     io.ReadCloser
+	etag     string
+	offset   uint64
+	attempts int
+	backoff  time.Duration
+}
+
+// newResumingReader returns a reader for body, which must be the response of a
+// Get of the given blob.
+func newResumingReader(log logrus.FieldLogger, blob blob, body io.ReadCloser) *resumingReader {
+	return &resumingReader{
+		log:     log,
+		blob:    blob,
+		body:    body,
+		etag:    blob.Properties().Etag,
+		backoff: downloadResumeBackoff,
+	}
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += uint64(n)
+		if n > 0 {
+			r.attempts = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		if resumeErr := r.resume(err); resumeErr != nil {
+			return n, resumeErr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the failed body with a new download starting at the
+// current offset, retrying with a linear backoff.
+func (r *resumingReader) resume(cause error) error {
+	r.body.Close()
+
+	for {
+		r.attempts++
+		if r.attempts > maxDownloadResumeAttempts {
+			return errors.Wrapf(cause, "download failed at offset %d after %d attempts to resume", r.offset, maxDownloadResumeAttempts)
+		}
+
+		r.log.WithError(cause).Warnf("Download interrupted at offset %d, resuming (attempt %d of %d)", r.offset, r.attempts, maxDownloadResumeAttempts)
+		time.Sleep(time.Duration(r.attempts) * r.backoff)
+
+		body, err := r.blob.GetRange(&storage.GetBlobRangeOptions{
+			Range:          &storage.BlobRange{Start: r.offset},
+			GetBlobOptions: &storage.GetBlobOptions{IfMatch: r.etag},
+		})
+		switch storageErrorStatusCode(err) {
+		case 0:
+			if err != nil {
+				cause = err
+				continue
+			}
+			r.body = body
+			return nil
+		case http.StatusRequestedRangeNotSatisfiable:
+			// the connection failed after the last byte was read
+			r.body = ioutil.NopCloser(strings.NewReader(""))
+			return nil
+		case http.StatusPreconditionFailed:
+			return errors.Errorf("object was modified while being downloaded, unable to resume at offset %d", r.offset)
+		default:
+			cause = err
+		}
+	}
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
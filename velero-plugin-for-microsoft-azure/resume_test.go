@@ -0,0 +1,123 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// brokenReader returns its data, then fails with a connection error.
+type brokenReader struct {
+	data io.Reader
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset by peer")
+	}
+	return n, err
+}
+
+func (r *brokenReader) Close() error {
+	return nil
+}
+
+func rangeFrom(start uint64) interface{} {
+	return mock.MatchedBy(func(options *storage.GetBlobRangeOptions) bool {
+		return options.Range.Start == start && options.GetBlobOptions.IfMatch == "etag"
+	})
+}
+
+func TestResumingReader(t *testing.T) {
+	blob := new(mockBlob)
+	defer blob.AssertExpectations(t)
+
+	blob.On("Properties").Return(storage.BlobProperties{Etag: "etag"})
+	blob.On("GetRange", rangeFrom(6)).Return(&brokenReader{data: strings.NewReader("big ")}, nil).Once()
+	blob.On("GetRange", rangeFrom(10)).Return(ioutil.NopCloser(strings.NewReader("")), errors.New("dial timeout")).Once()
+	blob.On("GetRange", rangeFrom(10)).Return(ioutil.NopCloser(strings.NewReader("world")), nil).Once()
+
+	r := newResumingReader(logrus.New(), blob, &brokenReader{data: strings.NewReader("hello ")})
+	r.backoff = 0
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello big world", string(data))
+}
+
+func TestResumingReaderFailures(t *testing.T) {
+	tests := []struct {
+		name          string
+		rangeErr      error
+		expectedError string
+	}{
+		{
+			name:          "object modified",
+			rangeErr:      storage.AzureStorageServiceError{StatusCode: http.StatusPreconditionFailed},
+			expectedError: "object was modified while being downloaded, unable to resume at offset 5",
+		},
+		{
+			name:          "attempts exhausted",
+			rangeErr:      errors.New("dial timeout"),
+			expectedError: "download failed at offset 5 after 5 attempts to resume: dial timeout",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			blob := new(mockBlob)
+			defer blob.AssertExpectations(t)
+
+			blob.On("Properties").Return(storage.BlobProperties{Etag: "etag"})
+			blob.On("GetRange", rangeFrom(5)).Return(ioutil.NopCloser(strings.NewReader("")), tc.rangeErr)
+
+			r := newResumingReader(logrus.New(), blob, &brokenReader{data: strings.NewReader("hello")})
+			r.backoff = 0
+
+			data, err := ioutil.ReadAll(r)
+			assert.EqualError(t, err, tc.expectedError)
+			assert.Equal(t, "hello", string(data))
+		})
+	}
+}
+
+func TestResumingReaderAtEnd(t *testing.T) {
+	blob := new(mockBlob)
+	defer blob.AssertExpectations(t)
+
+	blob.On("Properties").Return(storage.BlobProperties{Etag: "etag"})
+	blob.On("GetRange", rangeFrom(5)).Return(ioutil.NopCloser(strings.NewReader("")), storage.AzureStorageServiceError{StatusCode: http.StatusRequestedRangeNotSatisfiable})
+
+	r := newResumingReader(logrus.New(), blob, &brokenReader{data: strings.NewReader("hello")})
+	r.backoff = 0
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
@@ -0,0 +1,157 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	controlPollIntervalConfigKey = "controlPollInterval"
+	controlObjectName            = pluginObjectsPrefix + "control.json"
+)
+
+// runtimeControl is the content of a location's control object, which
+// adjusts the plugin while it runs, e.g. to diagnose a backup in progress
+// without restarting Velero. Unset fields leave the config's settings.
+type runtimeControl struct {
+	// LogLevel is the level of the plugin process's logs, e.g. "debug"
+	LogLevel          string `json:"logLevel,omitempty"`
+	UploadConcurrency int    `json:"uploadConcurrency,omitempty"`
+	MaxUploadBuffers  int    `json:"maxUploadBuffers,omitempty"`
+}
+
+// the runtime control last read for each location polling one, by
+// storage account, container and prefix
+var (
+	runtimeControlsLock sync.Mutex
+	runtimeControls     = map[string]runtimeControl{}
+)
+
+// currentRuntimeControl returns the runtime control last read for the
+// location with the given key.
+func currentRuntimeControl(key string) runtimeControl {
+	runtimeControlsLock.Lock()
+	defer runtimeControlsLock.Unlock()
+	return runtimeControls[key]
+}
+
+// getControlPollInterval returns how often to read the control object,
+// config.controlPollInterval, or 0 if it isn't read.
+func getControlPollInterval(config map[string]string) (time.Duration, error) {
+	val := config[controlPollIntervalConfigKey]
+	if val == "" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(val)
+	if err != nil || interval <= 0 {
+		return 0, errors.Errorf("invalid value %q for config key %q (expected a positive duration string)", val, controlPollIntervalConfigKey)
+	}
+	return interval, nil
+}
+
+// controlPoller reads a location's control object and applies it.
+type controlPoller struct {
+	log   logrus.FieldLogger
+	store *metadataStore
+	key   string
+
+	// logger is the plugin process's logger, whose level is restored to
+	// defaultLevel when the control object doesn't set one
+	logger       *logrus.Logger
+	defaultLevel logrus.Level
+
+	applied runtimeControl
+}
+
+func newControlPoller(log logrus.FieldLogger, store *metadataStore, key string) *controlPoller {
+	p := &controlPoller{log: log, store: store, key: key}
+	switch logger := log.(type) {
+	case *logrus.Logger:
+		p.logger = logger
+	case *logrus.Entry:
+		p.logger = logger.Logger
+	}
+	if p.logger != nil {
+		p.defaultLevel = p.logger.GetLevel()
+	}
+	return p
+}
+
+// poll reads the control object and applies it if it changed. A missing
+// control object restores the config's settings, and an invalid one leaves
+// those applied.
+func (p *controlPoller) poll() error {
+	var control runtimeControl
+	data, err := p.store.get(controlObjectName)
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &control); err != nil {
+			return errors.Wrapf(err, "error parsing %s", controlObjectName)
+		}
+	}
+
+	level := p.defaultLevel
+	if control.LogLevel != "" {
+		if level, err = logrus.ParseLevel(control.LogLevel); err != nil {
+			return errors.Wrapf(err, "invalid logLevel in %s", controlObjectName)
+		}
+	}
+	if control.UploadConcurrency < 0 || control.UploadConcurrency > maxUploadConcurrency {
+		return errors.Errorf("invalid uploadConcurrency %d in %s (expected an integer from 1 to %d)", control.UploadConcurrency, controlObjectName, maxUploadConcurrency)
+	}
+	if control.MaxUploadBuffers < 0 || (control.MaxUploadBuffers > 0 && control.MaxUploadBuffers < control.UploadConcurrency) {
+		return errors.Errorf("invalid maxUploadBuffers %d in %s (expected an integer of at least uploadConcurrency)", control.MaxUploadBuffers, controlObjectName)
+	}
+
+	if control == p.applied {
+		return nil
+	}
+	p.log.WithFields(logrus.Fields{
+		"logLevel":          control.LogLevel,
+		"uploadConcurrency": control.UploadConcurrency,
+		"maxUploadBuffers":  control.MaxUploadBuffers,
+	}).Info("Applying the location's runtime control")
+	if p.logger != nil {
+		p.logger.SetLevel(level)
+	}
+
+	runtimeControlsLock.Lock()
+	runtimeControls[p.key] = control
+	runtimeControlsLock.Unlock()
+	p.applied = control
+	return nil
+}
+
+// run polls the control object at the given interval, forever.
+func (p *controlPoller) run(interval time.Duration) {
+	for {
+		if err := p.poll(); err != nil {
+			p.log.WithError(err).Warn("Unable to apply the location's runtime control")
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlPoller(t *testing.T) {
+	blobs := newMemBlobs(time.Now())
+	logger := logrus.New()
+	logger.SetLevel(logrus.InfoLevel)
+	key := "account/bucket/control-test"
+	poller := newControlPoller(logrus.NewEntry(logger), &metadataStore{blobGetter: blobs, bucket: "bucket", prefix: "velero"}, key)
+	o := &ObjectStore{uploadConcurrency: 2, uploadBuffers: 3, controlKey: key}
+
+	// without a control object, the config's settings apply
+	require.NoError(t, poller.poll())
+	concurrency, buffers := o.uploadSettings()
+	assert.Equal(t, []int{2, 3}, []int{concurrency, buffers})
+
+	blobs.put("velero/"+controlObjectName, `{"logLevel": "debug", "uploadConcurrency": 8}`, time.Now())
+	require.NoError(t, poller.poll())
+	assert.Equal(t, logrus.DebugLevel, logger.GetLevel())
+	concurrency, buffers = o.uploadSettings()
+	assert.Equal(t, []int{8, 8}, []int{concurrency, buffers})
+
+	// invalid control objects leave the previous settings
+	for _, invalid := range []string{`{"logLevel": "chatty"}`, `{"uploadConcurrency": 100}`, `{"uploadConcurrency": 4, "maxUploadBuffers": 2}`, `{`} {
+		blobs.put("velero/"+controlObjectName, invalid, time.Now())
+		assert.Error(t, poller.poll(), invalid)
+	}
+	assert.Equal(t, logrus.DebugLevel, logger.GetLevel())
+	assert.Equal(t, 8, currentRuntimeControl(key).UploadConcurrency)
+
+	delete(blobs.data, "velero/"+controlObjectName)
+	require.NoError(t, poller.poll())
+	assert.Equal(t, logrus.InfoLevel, logger.GetLevel())
+	concurrency, buffers = o.uploadSettings()
+	assert.Equal(t, []int{2, 3}, []int{concurrency, buffers})
+}
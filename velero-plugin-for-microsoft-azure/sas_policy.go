@@ -0,0 +1,61 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sasAccessPolicyConfigKey = "sasAccessPolicy"
+
+	// maxAccessPolicyIDLength is the maximum length of the ID of a container's
+	// stored access policy.
+	maxAccessPolicyIDLength = 64
+)
+
+// getSASAccessPolicy returns config.sasAccessPolicy, the ID of the container's
+// stored access policy that signed URLs reference.
+func getSASAccessPolicy(config map[string]string) (string, error) {
+	policy := config[sasAccessPolicyConfigKey]
+	if len(policy) > maxAccessPolicyIDLength {
+		return "", errors.Errorf("invalid value %q for config key %q (must be at most %d characters)", policy, sasAccessPolicyConfigKey, maxAccessPolicyIDLength)
+	}
+	return policy, nil
+}
+
+// withStoredAccessPolicy returns the given SAS URI signed with the ID of a
+// stored access policy, referencing that policy. The storage SDK includes the
+// ID in the signature but not in the URI, and always includes the
+// permissions, even if they're left to the policy.
+func withStoredAccessPolicy(sasURI, policy string) (string, error) {
+	u, err := url.Parse(sasURI)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	query := u.Query()
+	if query.Get("sp") == "" {
+		query.Del("sp")
+	}
+	query.Set("si", policy)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
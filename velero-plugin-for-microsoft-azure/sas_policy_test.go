@@ -0,0 +1,88 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSASAccessPolicy(t *testing.T) {
+	policy, err := getSASAccessPolicy(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, "", policy)
+
+	policy, err = getSASAccessPolicy(map[string]string{sasAccessPolicyConfigKey: "velero-downloads"})
+	require.NoError(t, err)
+	assert.Equal(t, "velero-downloads", policy)
+
+	_, err = getSASAccessPolicy(map[string]string{sasAccessPolicyConfigKey: strings.Repeat("a", 65)})
+	assert.Error(t, err)
+}
+
+func TestCreateSignedURLStoredAccessPolicy(t *testing.T) {
+	client, err := storage.NewBasicClient("account", "a2V5")
+	require.NoError(t, err)
+	blobService := client.GetBlobService()
+	blob := &azureBlob{blob: blobService.GetContainerReference("b").GetBlobReference("backups/b1/b1-logs.gz")}
+
+	blobGetter := new(mockBlobGetter)
+	blobGetter.On("getBlob", "b", "backups/b1/b1-logs.gz").Return(blob, nil)
+
+	o := &ObjectStore{
+		log:             logrus.New(),
+		blobGetter:      blobGetter,
+		sasAccessPolicy: "velero-downloads",
+	}
+
+	signedURL, err := o.CreateSignedURL("b", "backups/b1/b1-logs.gz", time.Hour)
+	require.NoError(t, err)
+
+	u, err := url.Parse(signedURL)
+	require.NoError(t, err)
+	query := u.Query()
+	assert.Equal(t, "velero-downloads", query.Get("si"))
+	assert.NotEmpty(t, query.Get("se"))
+	assert.NotEmpty(t, query.Get("sig"))
+	// the permissions are granted by the policy
+	_, ok := query["sp"]
+	assert.False(t, ok)
+}
+
+func TestCreateSignedURLWithoutStoredAccessPolicy(t *testing.T) {
+	blobGetter := new(mockBlobGetter)
+	blob := new(mockBlob)
+	blobGetter.On("getBlob", "b", "backups/b1/b1.tar.gz").Return(blob, nil)
+	blob.On("GetSASURI", mock.MatchedBy(func(opts *storage.BlobSASOptions) bool {
+		return opts.Read && opts.Identifier == ""
+	})).Return("https://url?sp=r", nil)
+
+	o := &ObjectStore{log: logrus.New(), blobGetter: blobGetter}
+
+	signedURL, err := o.CreateSignedURL("b", "backups/b1/b1.tar.gz", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "https://url?sp=r", signedURL)
+	blob.AssertExpectations(t)
+}
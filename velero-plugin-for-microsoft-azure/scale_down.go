@@ -0,0 +1,234 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	scaleDownSnapshotsConfigKey    = "scaleDownSnapshots"
+	scaleDownDeferTimeoutConfigKey = "scaleDownDeferTimeout"
+
+	// scaleDownAccelerate snapshots disks of nodes being deleted right away,
+	// before the node is gone; scaleDownDefer waits for such disks to be
+	// detached first.
+	scaleDownAccelerate = "accelerate"
+	scaleDownDefer      = "defer"
+
+	defaultScaleDownDeferTimeout = 10 * time.Minute
+	scaleDownPollInterval        = 15 * time.Second
+	scaleDownSnapshotAttempts    = 5
+)
+
+// nodeIDRegexp matches the IDs of the VMs and scale set VMs disks are
+// attached to, as found in a disk's managedBy property.
+var nodeIDRegexp = regexp.MustCompile(`(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft\.Compute/(?:virtualMachineScaleSets/([^/]+)/)?virtualMachines/([^/]+)$`)
+
+type diskGetter interface {
+	Get(ctx context.Context, resourceGroupName string, diskName string) (disk.Disk, error)
+}
+
+// nodeStateGetter returns the provisioning state of the VM with the given ID.
+type nodeStateGetter interface {
+	provisioningState(ctx context.Context, nodeID string) (string, error)
+}
+
+// armNodeStateGetter gets the provisioning state of VMs and scale set VMs
+// using the ARM API.
+type armNodeStateGetter struct {
+	env        *azure.Environment
+	authorizer autorest.Authorizer
+}
+
+func (g *armNodeStateGetter) provisioningState(ctx context.Context, nodeID string) (string, error) {
+	parts := nodeIDRegexp.FindStringSubmatch(nodeID)
+	if parts == nil {
+		return "", errors.Errorf("unrecognized node ID %q", nodeID)
+	}
+	subscription, resourceGroup, scaleSet, name := parts[1], parts[2], parts[3], parts[4]
+
+	var state *string
+	if scaleSet != "" {
+		client := disk.NewVirtualMachineScaleSetVMsClientWithBaseURI(g.env.ResourceManagerEndpoint, subscription)
+		client.Authorizer = g.authorizer
+		vm, err := client.Get(ctx, resourceGroup, scaleSet, name, "")
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if vm.VirtualMachineScaleSetVMProperties != nil {
+			state = vm.VirtualMachineScaleSetVMProperties.ProvisioningState
+		}
+	} else {
+		client := disk.NewVirtualMachinesClientWithBaseURI(g.env.ResourceManagerEndpoint, subscription)
+		client.Authorizer = g.authorizer
+		vm, err := client.Get(ctx, resourceGroup, name, "")
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if vm.VirtualMachineProperties != nil {
+			state = vm.VirtualMachineProperties.ProvisioningState
+		}
+	}
+
+	if state == nil {
+		return "", nil
+	}
+	return *state, nil
+}
+
+// scaleDownGuard coordinates snapshots with the deletion of the nodes their
+// disks are attached to, e.g. by the cluster autoscaler scaling down while a
+// backup runs. Disks are detached from nodes being deleted, and snapshots
+// requested while a disk is changing state fail with conflicts.
+type scaleDownGuard struct {
+	log           logrus.FieldLogger
+	disks         diskGetter
+	nodes         nodeStateGetter
+	policy        string
+	deferTimeout  time.Duration
+	pollInterval  time.Duration
+	sleep         func(time.Duration)
+	resourceGroup string
+}
+
+// newScaleDownGuard returns the guard configured by config.scaleDownSnapshots,
+// or nil if it's not set.
+func newScaleDownGuard(log logrus.FieldLogger, config map[string]string, disks diskGetter, nodes nodeStateGetter, resourceGroup string) (*scaleDownGuard, error) {
+	policy := config[scaleDownSnapshotsConfigKey]
+	switch policy {
+	case "":
+		return nil, nil
+	case scaleDownAccelerate, scaleDownDefer:
+	default:
+		return nil, errors.Errorf("unable to parse value %q for config key %q (expected %q or %q)", policy, scaleDownSnapshotsConfigKey, scaleDownAccelerate, scaleDownDefer)
+	}
+
+	deferTimeout := defaultScaleDownDeferTimeout
+	if val := config[scaleDownDeferTimeoutConfigKey]; val != "" {
+		var err error
+		if deferTimeout, err = time.ParseDuration(val); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a duration string)", val, scaleDownDeferTimeoutConfigKey)
+		}
+	}
+
+	return &scaleDownGuard{
+		log:           log,
+		disks:         disks,
+		nodes:         nodes,
+		policy:        policy,
+		deferTimeout:  deferTimeout,
+		pollInterval:  scaleDownPollInterval,
+		sleep:         time.Sleep,
+		resourceGroup: resourceGroup,
+	}, nil
+}
+
+// nodeDeleting returns the ID of the node the disk is attached to if that
+// node is being deleted, or "" otherwise.
+func (g *scaleDownGuard) nodeDeleting(ctx context.Context, d disk.Disk) (string, error) {
+	if d.ManagedBy == nil || *d.ManagedBy == "" {
+		return "", nil
+	}
+
+	state, err := g.nodes.provisioningState(ctx, *d.ManagedBy)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(state, "Deleting") {
+		return "", nil
+	}
+	return *d.ManagedBy, nil
+}
+
+// beforeSnapshot is called before the given disk is snapshotted. If the
+// disk's node is being deleted, it logs this and, with the defer policy,
+// waits for the disk to be detached from the node, for up to the defer
+// timeout. The snapshot is attempted regardless once it returns.
+func (g *scaleDownGuard) beforeSnapshot(ctx context.Context, d disk.Disk) {
+	log := g.log.WithField("disk", *d.Name)
+
+	node, err := g.nodeDeleting(ctx, d)
+	if err != nil {
+		log.WithError(err).Warn("Unable to check whether the disk's node is being deleted")
+		return
+	}
+	if node == "" {
+		return
+	}
+	log = log.WithField("node", node)
+
+	if g.policy == scaleDownAccelerate {
+		log.Info("Node hosting the disk is being deleted, snapshotting the disk before it's detached")
+		return
+	}
+
+	log.Info("Node hosting the disk is being deleted, deferring the snapshot until the disk is detached")
+	for waited := time.Duration(0); waited < g.deferTimeout; waited += g.pollInterval {
+		g.sleep(g.pollInterval)
+
+		current, err := g.disks.Get(ctx, g.resourceGroup, *d.Name)
+		if err != nil {
+			log.WithError(err).Warn("Error getting disk while deferring snapshot")
+			continue
+		}
+		if current.ManagedBy == nil || *current.ManagedBy == "" || !strings.EqualFold(*current.ManagedBy, node) {
+			log.Info("Disk was detached from the deleted node, resuming the snapshot")
+			return
+		}
+	}
+
+	log.Warn("Timed out waiting for the disk to be detached from the deleted node, attempting the snapshot anyway")
+}
+
+// createSnapshot calls create until it succeeds, fails with an error other
+// than a conflict, or has been attempted scaleDownSnapshotAttempts times.
+// Conflicts occur while a disk is being detached from a node.
+func (g *scaleDownGuard) createSnapshot(log logrus.FieldLogger, create func() error) error {
+	var err error
+	for attempt := 1; attempt <= scaleDownSnapshotAttempts; attempt++ {
+		if err = create(); err == nil || !isDiskTransitionConflict(err) {
+			return err
+		}
+		if attempt < scaleDownSnapshotAttempts {
+			log.WithError(err).Info("Disk is changing state, retrying the snapshot")
+			g.sleep(g.pollInterval)
+		}
+	}
+	return err
+}
+
+// isDiskTransitionConflict returns whether err is the conflict ARM returns
+// for operations on a disk that's changing state, e.g. being detached.
+func isDiskTransitionConflict(err error) bool {
+	status, code := armErrorCode(err)
+	return status == http.StatusConflict || isDiskTransitionCode(code)
+}
+
+func isDiskTransitionCode(code string) bool {
+	return code == "Conflict" || code == "OperationNotAllowed"
+}
@@ -0,0 +1,180 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testNodeID = "/subscriptions/sub/resourceGroups/MC_rg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-nodepool1/virtualMachines/3"
+
+type fakeNodeStates map[string]string
+
+func (f fakeNodeStates) provisioningState(_ context.Context, nodeID string) (string, error) {
+	return f[nodeID], nil
+}
+
+// fakeDisks returns the given disks from successive calls to Get, repeating
+// the last one.
+type fakeDisks struct {
+	disks []disk.Disk
+	calls int
+}
+
+func (f *fakeDisks) Get(_ context.Context, _ string, _ string) (disk.Disk, error) {
+	d := f.disks[len(f.disks)-1]
+	if f.calls < len(f.disks) {
+		d = f.disks[f.calls]
+	}
+	f.calls++
+	return d, nil
+}
+
+func testScaleDownGuard(t *testing.T, policy string, nodes fakeNodeStates, disks *fakeDisks) (*scaleDownGuard, *int) {
+	g, err := newScaleDownGuard(logrus.New(), map[string]string{scaleDownSnapshotsConfigKey: policy, scaleDownDeferTimeoutConfigKey: "1m"}, disks, nodes, "MC_rg")
+	require.NoError(t, err)
+
+	var sleeps int
+	g.sleep = func(time.Duration) { sleeps++ }
+	return g, &sleeps
+}
+
+func TestNewScaleDownGuard(t *testing.T) {
+	g, err := newScaleDownGuard(logrus.New(), map[string]string{}, nil, nil, "rg")
+	require.NoError(t, err)
+	assert.Nil(t, g)
+
+	_, err = newScaleDownGuard(logrus.New(), map[string]string{scaleDownSnapshotsConfigKey: "later"}, nil, nil, "rg")
+	assert.Error(t, err)
+
+	_, err = newScaleDownGuard(logrus.New(), map[string]string{scaleDownSnapshotsConfigKey: scaleDownDefer, scaleDownDeferTimeoutConfigKey: "soon"}, nil, nil, "rg")
+	assert.Error(t, err)
+}
+
+func TestScaleDownBeforeSnapshot(t *testing.T) {
+	attached := disk.Disk{Name: stringPtr("pvc-1"), ManagedBy: stringPtr(testNodeID)}
+	detached := disk.Disk{Name: stringPtr("pvc-1")}
+
+	tests := []struct {
+		name           string
+		policy         string
+		nodeState      string
+		disks          []disk.Disk
+		expectedSleeps int
+	}{
+		{
+			name:      "disk of a running node isn't deferred",
+			policy:    scaleDownDefer,
+			nodeState: "Succeeded",
+			disks:     []disk.Disk{attached},
+		},
+		{
+			name:      "disk of a deleted node is snapshotted right away when accelerating",
+			policy:    scaleDownAccelerate,
+			nodeState: "Deleting",
+			disks:     []disk.Disk{attached},
+		},
+		{
+			name:           "disk of a deleted node is deferred until it's detached",
+			policy:         scaleDownDefer,
+			nodeState:      "Deleting",
+			disks:          []disk.Disk{attached, attached, detached},
+			expectedSleeps: 3,
+		},
+		{
+			name:           "deferring times out",
+			policy:         scaleDownDefer,
+			nodeState:      "Deleting",
+			disks:          []disk.Disk{attached},
+			expectedSleeps: 4,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			g, sleeps := testScaleDownGuard(t, tc.policy, fakeNodeStates{testNodeID: tc.nodeState}, &fakeDisks{disks: tc.disks})
+
+			g.beforeSnapshot(context.Background(), attached)
+			assert.Equal(t, tc.expectedSleeps, *sleeps)
+		})
+	}
+}
+
+func TestScaleDownCreateSnapshot(t *testing.T) {
+	conflict := errors.WithStack(autorest.DetailedError{StatusCode: http.StatusConflict})
+
+	t.Run("conflicts are retried", func(t *testing.T) {
+		g, sleeps := testScaleDownGuard(t, scaleDownDefer, nil, nil)
+
+		var calls int
+		err := g.createSnapshot(logrus.New(), func() error {
+			calls++
+			if calls < 3 {
+				return conflict
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 3, calls)
+		assert.Equal(t, 2, *sleeps)
+	})
+
+	t.Run("other errors aren't retried", func(t *testing.T) {
+		g, _ := testScaleDownGuard(t, scaleDownDefer, nil, nil)
+
+		var calls int
+		err := g.createSnapshot(logrus.New(), func() error {
+			calls++
+			return errors.New("forbidden")
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("attempts are limited", func(t *testing.T) {
+		g, _ := testScaleDownGuard(t, scaleDownDefer, nil, nil)
+
+		var calls int
+		err := g.createSnapshot(logrus.New(), func() error {
+			calls++
+			return conflict
+		})
+		assert.Error(t, err)
+		assert.Equal(t, scaleDownSnapshotAttempts, calls)
+	})
+}
+
+func TestIsDiskTransitionConflict(t *testing.T) {
+	assert.True(t, isDiskTransitionConflict(autorest.DetailedError{StatusCode: http.StatusConflict}))
+	assert.True(t, isDiskTransitionConflict(errors.WithStack(autorest.DetailedError{
+		Original: &azure.ServiceError{Code: "OperationNotAllowed"},
+	})))
+	assert.True(t, isDiskTransitionConflict(&azure.RequestError{ServiceError: &azure.ServiceError{Code: "Conflict"}}))
+	assert.False(t, isDiskTransitionConflict(autorest.DetailedError{StatusCode: http.StatusForbidden}))
+	assert.False(t, isDiskTransitionConflict(errors.New("error")))
+}
@@ -0,0 +1,85 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// locationDataKey returns the storage account, container and prefix of the
+// given location's objects, normalized so that prefixes Velero treats the
+// same, e.g. "velero", "/velero/" and "velero//", are the same.
+func locationDataKey(config map[string]string) string {
+	prefix := strings.Trim(path.Clean("/"+config[prefixConfigKey]), "/")
+	return strings.ToLower(config[storageAccountConfigKey]) + "/" + config[bucketConfigKey] + "/" + prefix
+}
+
+// Every backup storage location is initialized by the same plugin process,
+// so the settings the locations storing each (account, container, prefix)
+// were initialized with are kept by locationDataKey, in the order they were
+// first seen.
+var (
+	locationSettingsLock sync.Mutex
+	locationSettings     = map[string][]map[string]string{}
+)
+
+// checkSharedLocation warns when the given location's objects are stored
+// with other settings than they were last initialized with, since another
+// location may be storing the same objects with different settings, e.g.
+// tiers or encryption. Editing a location's config also changes its
+// settings, but only locations sharing objects switch back and forth between
+// them, so settings switching back to ones seen before are refused, rather
+// than have uploads alternate between them.
+func checkSharedLocation(log logrus.FieldLogger, config map[string]string) error {
+	key := locationDataKey(config)
+	settings := sharedSettings(config)
+	digest := settingsDigest(settings)
+
+	locationSettingsLock.Lock()
+	defer locationSettingsLock.Unlock()
+
+	seen := locationSettings[key]
+	if len(seen) == 0 {
+		locationSettings[key] = []map[string]string{settings}
+		return nil
+	}
+	last := seen[len(seen)-1]
+	if settingsDigest(last) == digest {
+		return nil
+	}
+
+	changed := changedSettings(last, settings)
+	for _, earlier := range seen[:len(seen)-1] {
+		if settingsDigest(earlier) == digest {
+			return errors.Errorf("backup storage locations sharing storage account %q, container %q and prefix %q have different settings (%s); give each location its own container or prefix, or the same settings",
+				config[storageAccountConfigKey], config[bucketConfigKey], config[prefixConfigKey], strings.Join(changed, ", "))
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"bucket":      config[bucketConfigKey],
+		"prefix":      config[prefixConfigKey],
+		"changedKeys": changed,
+	}).Warn("The location's objects were last used with other settings; if another backup storage location shares its storage account, container and prefix, give each location its own container or prefix, or the same settings")
+	locationSettings[key] = append(seen, settings)
+	return nil
+}
@@ -0,0 +1,57 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocationDataKey(t *testing.T) {
+	key := locationDataKey(map[string]string{storageAccountConfigKey: "Account", bucketConfigKey: "b", prefixConfigKey: "velero"})
+	for _, prefix := range []string{"/velero", "velero/", "velero//", "./velero"} {
+		assert.Equal(t, key, locationDataKey(map[string]string{storageAccountConfigKey: "account", bucketConfigKey: "b", prefixConfigKey: prefix}), prefix)
+	}
+	assert.NotEqual(t, key, locationDataKey(map[string]string{storageAccountConfigKey: "account", bucketConfigKey: "b", prefixConfigKey: "velero/cluster-1"}))
+	assert.NotEqual(t, key, locationDataKey(map[string]string{storageAccountConfigKey: "account", bucketConfigKey: "c", prefixConfigKey: "velero"}))
+}
+
+func TestCheckSharedLocation(t *testing.T) {
+	config := func(prefix, tier string) map[string]string {
+		return map[string]string{storageAccountConfigKey: "shared-location-test", bucketConfigKey: "b", prefixConfigKey: prefix, blockBlobAccessTierConfigKey: tier}
+	}
+
+	// locations are initialized over and over with the same settings
+	require.NoError(t, checkSharedLocation(logrus.New(), config("velero", "Hot")))
+	require.NoError(t, checkSharedLocation(logrus.New(), config("velero", "Hot")))
+
+	// a location whose settings change may have been edited
+	require.NoError(t, checkSharedLocation(logrus.New(), config("velero/", "Cool")))
+	require.NoError(t, checkSharedLocation(logrus.New(), config("velero", "Cool")))
+
+	// but settings switching back are those of another location storing the
+	// same objects
+	err := checkSharedLocation(logrus.New(), config("/velero", "Hot"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), blockBlobAccessTierConfigKey)
+
+	// locations with their own prefix are independent
+	require.NoError(t, checkSharedLocation(logrus.New(), config("velero/cluster-1", "Hot")))
+}
@@ -0,0 +1,127 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/pkg/errors"
+)
+
+const snapshotSidecarSchemaVersion = 1
+
+// snapshotSidecar describes a snapshot taken by the volume snapshotter. It's
+// stored in the metadata store alongside the backups so that restores and
+// garbage collection don't depend on the snapshot's ARM tags, which may be
+// stripped by policy.
+type snapshotSidecar struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	SnapshotID    string    `json:"snapshotID"`
+	DiskID        string    `json:"diskID"`
+	Location      string    `json:"location"`
+	Zone          string    `json:"zone,omitempty"`
+	SKU           string    `json:"sku,omitempty"`
+	Incremental   bool      `json:"incremental"`
+	ParentID      string    `json:"parentID,omitempty"`
+	Backup        string    `json:"backup,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// snapshotSidecarName returns the name of the sidecar object for the snapshot
+// with the given name within the metadata store.
+func snapshotSidecarName(snapshotName string) string {
+	return "snapshots/" + snapshotName + ".json"
+}
+
+func (s *snapshotSidecar) validate() error {
+	if s.SchemaVersion != snapshotSidecarSchemaVersion {
+		return errors.Errorf("unsupported snapshot sidecar schema version %d", s.SchemaVersion)
+	}
+
+	var missing []string
+	for _, field := range []struct{ name, val string }{
+		{"snapshotID", s.SnapshotID},
+		{"diskID", s.DiskID},
+		{"location", s.Location},
+	} {
+		if field.val == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("snapshot sidecar is missing required fields: %s", strings.Join(missing, ", "))
+	}
+
+	if _, err := parseFullSnapshotName(s.SnapshotID); err != nil {
+		return err
+	}
+	if s.ParentID != "" && !s.Incremental {
+		return errors.New("snapshot sidecar has a parent but isn't incremental")
+	}
+
+	return nil
+}
+
+func encodeSnapshotSidecar(s *snapshotSidecar) ([]byte, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(s)
+	return data, errors.WithStack(err)
+}
+
+func decodeSnapshotSidecar(data []byte) (*snapshotSidecar, error) {
+	s := new(snapshotSidecar)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrap(err, "error decoding snapshot sidecar")
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// incrementalParent returns the ID of the most recent incremental snapshot of
+// the given disk other than the snapshot with the given name, or "" if there
+// is none.
+func incrementalParent(snapshots []disk.Snapshot, diskID, snapshotName string) string {
+	var (
+		parent  string
+		created time.Time
+	)
+	for _, snap := range snapshots {
+		if snap.SnapshotProperties == nil || snap.CreationData == nil || snap.CreationData.SourceResourceID == nil {
+			continue
+		}
+		if snap.Incremental == nil || !*snap.Incremental || snap.TimeCreated == nil || snap.ID == nil {
+			continue
+		}
+		if !strings.EqualFold(*snap.CreationData.SourceResourceID, diskID) || (snap.Name != nil && *snap.Name == snapshotName) {
+			continue
+		}
+		if snap.TimeCreated.Time.After(created) {
+			parent, created = *snap.ID, snap.TimeCreated.Time
+		}
+	}
+
+	return parent
+}
@@ -0,0 +1,115 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotSidecarRoundTrip(t *testing.T) {
+	sidecar := &snapshotSidecar{
+		SchemaVersion: snapshotSidecarSchemaVersion,
+		SnapshotID:    "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap",
+		DiskID:        "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/disk",
+		Location:      "westus",
+		SKU:           "Premium_LRS",
+		Incremental:   true,
+		ParentID:      "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/parent",
+		Backup:        "backup-1",
+		CreatedAt:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	data, err := encodeSnapshotSidecar(sidecar)
+	require.NoError(t, err)
+
+	decoded, err := decodeSnapshotSidecar(data)
+	require.NoError(t, err)
+	assert.Equal(t, sidecar, decoded)
+}
+
+func TestDecodeSnapshotSidecarValidation(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          string
+		expectedError string
+	}{
+		{
+			name:          "not JSON",
+			data:          "foo",
+			expectedError: "error decoding snapshot sidecar: invalid character 'o' in literal false (expecting 'a')",
+		},
+		{
+			name:          "unsupported schema version",
+			data:          `{"schemaVersion":2}`,
+			expectedError: "unsupported snapshot sidecar schema version 2",
+		},
+		{
+			name:          "missing fields",
+			data:          `{"schemaVersion":1,"snapshotID":"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap"}`,
+			expectedError: "snapshot sidecar is missing required fields: diskID, location",
+		},
+		{
+			name:          "invalid snapshot ID",
+			data:          `{"schemaVersion":1,"snapshotID":"snap","diskID":"disk","location":"westus"}`,
+			expectedError: "snapshot URI could not be parsed",
+		},
+		{
+			name:          "parent of a full snapshot",
+			data:          `{"schemaVersion":1,"snapshotID":"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/snapshots/snap","diskID":"disk","location":"westus","parentID":"parent"}`,
+			expectedError: "snapshot sidecar has a parent but isn't incremental",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodeSnapshotSidecar([]byte(tc.data))
+			assert.EqualError(t, err, tc.expectedError)
+		})
+	}
+}
+
+func TestIncrementalParent(t *testing.T) {
+	now := time.Now()
+	snapshot := func(id, diskID string, incremental bool, age time.Duration) disk.Snapshot {
+		return disk.Snapshot{
+			ID:   stringPtr(id),
+			Name: stringPtr(id),
+			SnapshotProperties: &disk.SnapshotProperties{
+				CreationData: &disk.CreationData{SourceResourceID: stringPtr(diskID)},
+				Incremental:  boolPtr(incremental),
+				TimeCreated:  &date.Time{Time: now.Add(-age)},
+			},
+		}
+	}
+
+	snapshots := []disk.Snapshot{
+		snapshot("old", "disk-1", true, 2*time.Hour),
+		snapshot("latest", "DISK-1", true, time.Hour),
+		snapshot("full", "disk-1", false, time.Minute),
+		snapshot("other-disk", "disk-2", true, time.Minute),
+		snapshot("new", "disk-1", true, 0),
+	}
+
+	assert.Equal(t, "latest", incrementalParent(snapshots, "disk-1", "new"))
+	assert.Equal(t, "", incrementalParent(snapshots, "disk-3", "new"))
+}
@@ -0,0 +1,225 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/preview/monitor/2018-09-01-preview/monitor"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotMetricsIntervalConfigKey = "snapshotMetricsInterval"
+
+	snapshotMetricsNamespace = "Velero"
+
+	// velero adds this tag (with the slash replaced, see getSnapshotTags) to every
+	// snapshot it creates, so it identifies the snapshots the metrics cover.
+	veleroBackupTag = "velero.io-backup"
+)
+
+// getSnapshotMetricsInterval returns how often config.snapshotMetricsInterval
+// asks for snapshot metrics to be published, or 0 if they aren't.
+func getSnapshotMetricsInterval(config map[string]string) (time.Duration, error) {
+	val := config[snapshotMetricsIntervalConfigKey]
+	if val == "" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to parse value %q for config key %q (expected a duration string)", val, snapshotMetricsIntervalConfigKey)
+	}
+	// a non-positive interval would have the publisher list snapshots in a
+	// tight loop, each time with an already expired deadline
+	if interval <= 0 {
+		return 0, errors.Errorf("invalid value %q for config key %q (expected a positive duration string)", val, snapshotMetricsIntervalConfigKey)
+	}
+	return interval, nil
+}
+
+// diskSnapshotStats summarizes the Velero-created snapshots of a single disk.
+type diskSnapshotStats struct {
+	diskID    string
+	location  string
+	count     int
+	oldest    time.Time
+	totalSize int64
+}
+
+// computeSnapshotStats groups the given snapshots by their source disk. Snapshots
+// that weren't created by Velero, or whose source disk is unknown, are ignored.
+func computeSnapshotStats(snapshots []disk.Snapshot) []*diskSnapshotStats {
+	byDisk := map[string]*diskSnapshotStats{}
+
+	for _, snap := range snapshots {
+		if _, ok := snap.Tags[veleroBackupTag]; !ok {
+			continue
+		}
+		if snap.SnapshotProperties == nil || snap.CreationData == nil || snap.CreationData.SourceResourceID == nil {
+			continue
+		}
+
+		diskID := strings.ToLower(*snap.CreationData.SourceResourceID)
+		stats, ok := byDisk[diskID]
+		if !ok {
+			stats = &diskSnapshotStats{diskID: *snap.CreationData.SourceResourceID}
+			if snap.Location != nil {
+				stats.location = *snap.Location
+			}
+			byDisk[diskID] = stats
+		}
+
+		stats.count++
+		if snap.DiskSizeGB != nil {
+			stats.totalSize += int64(*snap.DiskSizeGB)
+		}
+		if snap.TimeCreated != nil && (stats.oldest.IsZero() || snap.TimeCreated.Time.Before(stats.oldest)) {
+			stats.oldest = snap.TimeCreated.Time
+		}
+	}
+
+	res := make([]*diskSnapshotStats, 0, len(byDisk))
+	for _, stats := range byDisk {
+		res = append(res, stats)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].diskID < res[j].diskID })
+
+	return res
+}
+
+// metricsDocuments returns the custom metric documents describing the given
+// disk's snapshots as of the given time.
+func (s *diskSnapshotStats) metricsDocuments(now time.Time) []monitor.AzureMetricsDocument {
+	var oldestAge float64
+	if !s.oldest.IsZero() {
+		oldestAge = now.Sub(s.oldest).Seconds()
+	}
+
+	values := []struct {
+		name  string
+		value float64
+	}{
+		{"SnapshotCount", float64(s.count)},
+		{"OldestSnapshotAgeSeconds", oldestAge},
+		{"SnapshotTotalSizeGiB", float64(s.totalSize)},
+	}
+
+	timestamp := now.UTC().Format(time.RFC3339)
+
+	var docs []monitor.AzureMetricsDocument
+	for _, v := range values {
+		value := v.value
+		docs = append(docs, monitor.AzureMetricsDocument{
+			Time: &timestamp,
+			Data: &monitor.AzureMetricsData{
+				BaseData: &monitor.AzureMetricsBaseData{
+					Metric:    stringPtr(v.name),
+					Namespace: stringPtr(snapshotMetricsNamespace),
+					Series: &[]monitor.AzureTimeSeriesData{
+						{Min: &value, Max: &value, Sum: &value, Count: int32Ptr(1)},
+					},
+				},
+			},
+		})
+	}
+
+	return docs
+}
+
+// snapshotMetricsPublisher periodically publishes per-disk snapshot metrics as
+// Azure Monitor custom metrics on the disks themselves, so that backup drift can
+// be alerted on from Azure.
+type snapshotMetricsPublisher struct {
+	log           logrus.FieldLogger
+	snaps         *disk.SnapshotsClient
+	resourceGroup string
+	authorizer    autorest.Authorizer
+	interval      time.Duration
+	// domain is the domain of the regional Azure Monitor endpoints, see
+	// cloudQuirks.customMetricsDomain
+	domain string
+}
+
+func (p *snapshotMetricsPublisher) run() {
+	for {
+		if err := p.publish(); err != nil {
+			p.log.WithError(err).Warn("Error publishing snapshot metrics")
+		}
+		time.Sleep(p.interval)
+	}
+}
+
+func (p *snapshotMetricsPublisher) publish() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+
+	var snapshots []disk.Snapshot
+	iter, err := p.snaps.ListByResourceGroupComplete(ctx, p.resourceGroup)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		snapshots = append(snapshots, iter.Value())
+	}
+
+	now := time.Now()
+	for _, stats := range computeSnapshotStats(snapshots) {
+		if err := p.publishDisk(ctx, stats, now); err != nil {
+			p.log.WithError(err).WithField("disk", stats.diskID).Warn("Error publishing snapshot metrics for disk")
+		}
+	}
+
+	return nil
+}
+
+func (p *snapshotMetricsPublisher) publishDisk(ctx context.Context, stats *diskSnapshotStats, now time.Time) error {
+	resource, err := azure.ParseResourceID(stats.diskID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// custom metrics must be sent to the regional endpoint of the resource
+	client := monitor.NewMetricsClientWithBaseURI(fmt.Sprintf("https://%s.%s", stats.location, p.domain))
+	client.Authorizer = p.authorizer
+
+	for _, doc := range stats.metricsDocuments(now) {
+		body, err := json.Marshal(doc)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if _, err := client.Create(ctx, "application/json", int32(len(body)), resource.SubscriptionID, resource.ResourceGroup, resource.Provider, resource.ResourceType, resource.ResourceName, doc); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSnapshotMetricsInterval(t *testing.T) {
+	interval, err := getSnapshotMetricsInterval(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), interval)
+
+	interval, err = getSnapshotMetricsInterval(map[string]string{snapshotMetricsIntervalConfigKey: "15m"})
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, interval)
+
+	_, err = getSnapshotMetricsInterval(map[string]string{snapshotMetricsIntervalConfigKey: "0s"})
+	assert.Error(t, err)
+	_, err = getSnapshotMetricsInterval(map[string]string{snapshotMetricsIntervalConfigKey: "-5m"})
+	assert.Error(t, err)
+	_, err = getSnapshotMetricsInterval(map[string]string{snapshotMetricsIntervalConfigKey: "hourly"})
+	assert.Error(t, err)
+}
+
+func TestComputeSnapshotStats(t *testing.T) {
+	now := time.Now()
+
+	newSnapshot := func(diskID string, sizeGB int32, created time.Time, tags map[string]*string) disk.Snapshot {
+		return disk.Snapshot{
+			Location: stringPtr("westus"),
+			Tags:     tags,
+			SnapshotProperties: &disk.SnapshotProperties{
+				CreationData: &disk.CreationData{SourceResourceID: stringPtr(diskID)},
+				DiskSizeGB:   &sizeGB,
+				TimeCreated:  &date.Time{Time: created},
+			},
+		}
+	}
+	veleroTags := map[string]*string{veleroBackupTag: stringPtr("backup-1")}
+
+	stats := computeSnapshotStats([]disk.Snapshot{
+		newSnapshot("/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/disks/disk-1", 10, now.Add(-2*time.Hour), veleroTags),
+		newSnapshot("/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/disks/DISK-1", 10, now.Add(-time.Hour), veleroTags),
+		newSnapshot("/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/disks/disk-2", 5, now, veleroTags),
+		// not created by velero
+		newSnapshot("/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/disks/disk-3", 5, now, nil),
+	})
+
+	require.Len(t, stats, 2)
+
+	assert.Equal(t, "/subscriptions/s/resourceGroups/rg/providers/Microsoft.Compute/disks/disk-1", stats[0].diskID)
+	assert.Equal(t, "westus", stats[0].location)
+	assert.Equal(t, 2, stats[0].count)
+	assert.Equal(t, int64(20), stats[0].totalSize)
+	assert.True(t, stats[0].oldest.Equal(now.Add(-2*time.Hour)))
+
+	assert.Equal(t, 1, stats[1].count)
+	assert.Equal(t, int64(5), stats[1].totalSize)
+
+	docs := stats[0].metricsDocuments(now)
+	require.Len(t, docs, 3)
+	assert.Equal(t, "OldestSnapshotAgeSeconds", *docs[1].Data.BaseData.Metric)
+	assert.Equal(t, float64(7200), *(*docs[1].Data.BaseData.Series)[0].Max)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const restoreSnapshotTagSelectorConfigKey = "restoreSnapshotTagSelector"
+
+// tagRequirement is a requirement on one of a snapshot's tags: that it has
+// the tag, or that it has or doesn't have the tag with a value.
+type tagRequirement struct {
+	key      string
+	value    string
+	exists   bool
+	notEqual bool
+}
+
+func (r tagRequirement) String() string {
+	switch {
+	case r.exists:
+		return r.key
+	case r.notEqual:
+		return r.key + "!=" + r.value
+	default:
+		return r.key + "=" + r.value
+	}
+}
+
+// tagSelector selects the snapshots that volumes can be restored from by
+// their tags. All of its requirements must be met.
+type tagSelector []tagRequirement
+
+// parseTagSelector parses a comma-separated list of requirements,
+// "<tag>=<value>", "<tag>!=<value>" or "<tag>", e.g. "environment=prod".
+func parseTagSelector(val string) (tagSelector, error) {
+	var selector tagSelector
+	for _, part := range strings.Split(val, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+
+		var r tagRequirement
+		if i := strings.Index(part, "!="); i >= 0 {
+			r = tagRequirement{key: part[:i], value: part[i+2:], notEqual: true}
+		} else if i := strings.Index(part, "="); i >= 0 {
+			r = tagRequirement{key: part[:i], value: part[i+1:]}
+		} else {
+			r = tagRequirement{key: part, exists: true}
+		}
+		r.key, r.value = strings.TrimSpace(r.key), strings.TrimSpace(r.value)
+		if r.key == "" {
+			return nil, errors.Errorf("invalid requirement %q in config key %q (expected <tag>=<value>, <tag>!=<value> or <tag>)", part, restoreSnapshotTagSelectorConfigKey)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// matches returns whether the given tags meet every requirement. Tag names
+// are case-insensitive, like Azure's, and values are case-sensitive.
+func (s tagSelector) matches(tags map[string]*string) bool {
+	for _, r := range s {
+		var value *string
+		for k, v := range tags {
+			if strings.EqualFold(k, r.key) {
+				value = v
+				break
+			}
+		}
+
+		switch {
+		case r.exists:
+			if value == nil {
+				return false
+			}
+		case r.notEqual:
+			if value != nil && *value == r.value {
+				return false
+			}
+		default:
+			if value == nil || *value != r.value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s tagSelector) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// checkRestoreSnapshotTags returns an error if the snapshot with the given
+// ID and tags can't be restored from because it doesn't match the selector,
+// e.g. because it was taken in another cluster's environment sharing the
+// snapshots' resource group.
+func checkRestoreSnapshotTags(selector tagSelector, snapshotID string, tags map[string]*string) error {
+	if len(selector) == 0 || selector.matches(tags) {
+		return nil
+	}
+	return errors.Errorf("snapshot %s doesn't match config.%s (%s), refusing to restore from it", snapshotID, restoreSnapshotTagSelectorConfigKey, selector)
+}
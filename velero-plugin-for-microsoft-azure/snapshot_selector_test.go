@@ -0,0 +1,92 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTagSelector(t *testing.T) {
+	selector, err := parseTagSelector("")
+	require.NoError(t, err)
+	assert.Empty(t, selector)
+
+	selector, err = parseTagSelector(" environment = prod, team!=payments ,velero.io/backup")
+	require.NoError(t, err)
+	assert.Equal(t, tagSelector{
+		{key: "environment", value: "prod"},
+		{key: "team", value: "payments", notEqual: true},
+		{key: "velero.io/backup", exists: true},
+	}, selector)
+	assert.Equal(t, "environment=prod,team!=payments,velero.io/backup", selector.String())
+
+	_, err = parseTagSelector("=prod")
+	assert.Error(t, err)
+}
+
+func TestCheckRestoreSnapshotTags(t *testing.T) {
+	selector, err := parseTagSelector("environment=prod,team!=payments,velero.io/backup")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		tags    map[string]*string
+		matches bool
+	}{
+		{
+			name:    "matching",
+			tags:    map[string]*string{"Environment": stringPtr("prod"), "velero.io/backup": stringPtr("b1")},
+			matches: true,
+		},
+		{
+			name: "other environment",
+			tags: map[string]*string{"environment": stringPtr("staging"), "velero.io/backup": stringPtr("b1")},
+		},
+		{
+			name: "values are case-sensitive",
+			tags: map[string]*string{"environment": stringPtr("Prod"), "velero.io/backup": stringPtr("b1")},
+		},
+		{
+			name: "excluded team",
+			tags: map[string]*string{"environment": stringPtr("prod"), "team": stringPtr("payments"), "velero.io/backup": stringPtr("b1")},
+		},
+		{
+			name: "missing tag",
+			tags: map[string]*string{"environment": stringPtr("prod")},
+		},
+		{
+			name: "no tags",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkRestoreSnapshotTags(selector, "snap-1", test.tags)
+			if test.matches {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, "snapshot snap-1 doesn't match config.restoreSnapshotTagSelector (environment=prod,team!=payments,velero.io/backup), refusing to restore from it")
+		})
+	}
+
+	// without a selector, any snapshot can be restored from
+	assert.NoError(t, checkRestoreSnapshotTags(nil, "snap-1", nil))
+}
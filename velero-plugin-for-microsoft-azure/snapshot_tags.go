@@ -0,0 +1,112 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+// snapshotTagger reads and replaces the tags of snapshots.
+type snapshotTagger interface {
+	// getTags returns the tags of the given snapshot, or an error for which
+	// isSnapshotNotFound is true if it doesn't exist.
+	getTags(ctx context.Context, resourceGroup, name string) (map[string]*string, error)
+	setTags(ctx context.Context, resourceGroup, name string, tags map[string]*string) error
+}
+
+type azureSnapshotTagger struct {
+	snaps *disk.SnapshotsClient
+}
+
+func (t *azureSnapshotTagger) getTags(ctx context.Context, resourceGroup, name string) (map[string]*string, error) {
+	snap, err := t.snaps.Get(ctx, resourceGroup, name)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return snap.Tags, nil
+}
+
+func (t *azureSnapshotTagger) setTags(ctx context.Context, resourceGroup, name string, tags map[string]*string) error {
+	future, err := t.snaps.Update(ctx, resourceGroup, name, disk.SnapshotUpdate{Tags: tags})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := future.WaitForCompletionRef(ctx, t.snaps.Client); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = future.Result(*t.snaps)
+	return errors.WithStack(err)
+}
+
+func isSnapshotNotFound(err error) bool {
+	azureErr, ok := errors.Cause(err).(autorest.DetailedError)
+	return ok && azureErr.StatusCode == http.StatusNotFound
+}
+
+// missingSnapshotTags returns the tags in want that are missing from have, or
+// have other values there, or nil if there are none.
+func missingSnapshotTags(want, have map[string]*string) map[string]string {
+	var missing map[string]string
+	for k, v := range want {
+		if v == nil {
+			continue
+		}
+		if got, ok := have[k]; ok && got != nil && *got == *v {
+			continue
+		}
+		if missing == nil {
+			missing = map[string]string{}
+		}
+		missing[k] = *v
+	}
+	return missing
+}
+
+// reconcileSnapshotTags applies the given tags to a snapshot whose tags
+// didn't all stick when it was created, keeping its other tags. Snapshots
+// deleted since have nothing left to tag.
+func reconcileSnapshotTags(ctx context.Context, tagger snapshotTagger, snapshotID string, tags map[string]string) error {
+	snapshotInfo, err := parseFullSnapshotName(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	have, err := tagger.getTags(ctx, snapshotInfo.resourceGroup, snapshotInfo.name)
+	if isSnapshotNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	merged := make(map[string]*string, len(have)+len(tags))
+	for k, v := range have {
+		merged[k] = v
+	}
+	for k, v := range tags {
+		merged[k] = stringPtr(v)
+	}
+	if missingSnapshotTags(merged, have) == nil {
+		return nil
+	}
+	return tagger.setTags(ctx, snapshotInfo.resourceGroup, snapshotInfo.name, merged)
+}
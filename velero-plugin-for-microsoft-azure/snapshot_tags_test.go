@@ -0,0 +1,78 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSnapshotTagger struct {
+	tags map[string]map[string]*string
+	sets int
+}
+
+func (t *fakeSnapshotTagger) getTags(ctx context.Context, resourceGroup, name string) (map[string]*string, error) {
+	tags, ok := t.tags[resourceGroup+"/"+name]
+	if !ok {
+		return nil, errors.WithStack(autorest.DetailedError{StatusCode: http.StatusNotFound})
+	}
+	return tags, nil
+}
+
+func (t *fakeSnapshotTagger) setTags(ctx context.Context, resourceGroup, name string, tags map[string]*string) error {
+	t.sets++
+	t.tags[resourceGroup+"/"+name] = tags
+	return nil
+}
+
+func TestMissingSnapshotTags(t *testing.T) {
+	want := map[string]*string{"velero.io/backup": stringPtr("b-1"), "velero.io/pv": stringPtr("pv-1")}
+
+	assert.Nil(t, missingSnapshotTags(want, want))
+	assert.Equal(t, map[string]string{"velero.io/pv": "pv-1"}, missingSnapshotTags(want, map[string]*string{"velero.io/backup": stringPtr("b-1")}))
+	assert.Equal(t, map[string]string{"velero.io/backup": "b-1", "velero.io/pv": "pv-1"}, missingSnapshotTags(want, nil))
+	assert.Equal(t, map[string]string{"velero.io/backup": "b-1"}, missingSnapshotTags(want, map[string]*string{"velero.io/backup": stringPtr("b-0"), "velero.io/pv": stringPtr("pv-1")}))
+}
+
+func TestReconcileSnapshotTags(t *testing.T) {
+	tagger := &fakeSnapshotTagger{tags: map[string]map[string]*string{
+		"rg/snap-1": {"owner": stringPtr("team-a")},
+	}}
+	snapshotID := getComputeResourceName("sub", "rg", snapshotsResource, "snap-1")
+
+	// missing tags are added to the snapshot's other tags
+	require.NoError(t, reconcileSnapshotTags(context.Background(), tagger, snapshotID, map[string]string{"velero.io/backup": "b-1"}))
+	assert.Equal(t, map[string]*string{"owner": stringPtr("team-a"), "velero.io/backup": stringPtr("b-1")}, tagger.tags["rg/snap-1"])
+	assert.Equal(t, 1, tagger.sets)
+
+	// snapshots that already have them aren't updated
+	require.NoError(t, reconcileSnapshotTags(context.Background(), tagger, snapshotID, map[string]string{"velero.io/backup": "b-1"}))
+	assert.Equal(t, 1, tagger.sets)
+
+	// and deleted snapshots have nothing left to tag
+	require.NoError(t, reconcileSnapshotTags(context.Background(), tagger, getComputeResourceName("sub", "rg", snapshotsResource, "snap-2"), map[string]string{"velero.io/backup": "b-1"}))
+	assert.Equal(t, 1, tagger.sets)
+
+	assert.Error(t, reconcileSnapshotTags(context.Background(), tagger, "snap-1", nil))
+}
@@ -0,0 +1,258 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	supportBundlePrefix = pluginObjectsPrefix + "support-bundles/"
+
+	defaultSupportBundleErrors = 20
+)
+
+// supportBundleEnvVars are the environment variables, typically set by the
+// credentials file, whose values are included in support bundles. Only
+// whether the others are set is included, since they may be secrets.
+var supportBundleEnvVars = []string{
+	cloudNameEnvVar,
+	subscriptionIDEnvVar,
+	resourceGroupEnvVar,
+	tenantIDEnvVar,
+	clientIDEnvVar,
+	authorityHostEnvVar,
+	federatedTokenAudienceEnvVar,
+}
+
+var supportBundleSecretEnvVars = []string{
+	clientSecretEnvVar,
+	certificatePathEnvVar,
+	certificatePasswordEnvVar,
+	usernameEnvVar,
+	passwordEnvVar,
+	federatedTokenFileEnvVar,
+	managedIdentityTokenFileEnvVar,
+	storageAccountSASEnvVar,
+}
+
+// supportBundle is the content of a support bundle.
+type supportBundle struct {
+	kind        string
+	config      map[string]string
+	env         map[string]string
+	diagnostics []processDiagnostics
+	errorLimit  int
+	createdAt   time.Time
+}
+
+// write writes the bundle as a gzipped tarball of:
+//   - config.json: the location's config and environment
+//   - capabilities.txt: the optional features active for the config
+//   - errors.json: the most recent failed storage requests, with the request
+//     IDs Azure support needs to trace them
+//   - latencies.json: the latency of each storage endpoint
+//   - logs.json: the recent log entries of the plugin processes
+func (b *supportBundle) write(w io.Writer) error {
+	redactor, err := newLogRedactor(nil, map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	config := map[string]string{}
+	for key, val := range b.config {
+		config[key], _ = redactor.redactLine(val)
+	}
+
+	var capabilities []capability
+	switch b.kind {
+	case objectStoreKind:
+		capabilities = objectStoreCapabilities(b.config)
+	case volumeSnapshotterKind:
+		capabilities = volumeSnapshotterCapabilities(b.config)
+	default:
+		return errors.Errorf("unknown plugin kind %q", b.kind)
+	}
+	var capabilitiesText bytes.Buffer
+	printCapabilities(&capabilitiesText, capabilities)
+
+	var (
+		errs      []errorResponse
+		latencies = map[string]*endpointLatency{}
+		logs      []logRecord
+	)
+	for _, diags := range b.diagnostics {
+		errs = append(errs, diags.Errors...)
+		for host, latency := range diags.Latencies {
+			if latencies[host] == nil {
+				latencies[host] = new(endpointLatency)
+			}
+			latencies[host].add(*latency)
+		}
+		logs = append(logs, diags.Logs...)
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Time.Before(errs[j].Time) })
+	if len(errs) > b.errorLimit {
+		errs = errs[len(errs)-b.errorLimit:]
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].Time.Before(logs[j].Time) })
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"config.json", map[string]interface{}{"kind": b.kind, "config": config, "environment": b.env}},
+		{"capabilities.txt", capabilitiesText.String()},
+		{"errors.json", errs},
+		{"latencies.json", latencies},
+		{"logs.json", logs},
+	}
+	for _, file := range files {
+		data, ok := file.content.(string)
+		if !ok {
+			encoded, err := json.MarshalIndent(file.content, "", "  ")
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			data = string(encoded)
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    file.name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: b.createdAt,
+		}); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := io.WriteString(tw, data); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(gz.Close())
+}
+
+// supportBundleEnv returns the environment to include in a support bundle.
+func supportBundleEnv(getenv func(string) string) map[string]string {
+	env := map[string]string{}
+	for _, name := range supportBundleEnvVars {
+		if val := getenv(name); val != "" {
+			env[name] = val
+		}
+	}
+	for _, name := range supportBundleSecretEnvVars {
+		if getenv(name) != "" {
+			env[name] = "(set)"
+		}
+	}
+	return env
+}
+
+func runSupportBundle(_ logrus.FieldLogger, args []string) error {
+	var (
+		kind       string
+		config     map[string]string
+		output     string
+		errorLimit int
+	)
+
+	flags := pflag.NewFlagSet("support-bundle", pflag.ContinueOnError)
+	flags.StringVar(&kind, "kind", objectStoreKind, fmt.Sprintf("The plugin kind of the location (%s or %s)", objectStoreKind, volumeSnapshotterKind))
+	flags.StringToStringVar(&config, "config", nil, "The location's config, as key=value pairs")
+	flags.StringVarP(&output, "output", "o", "", fmt.Sprintf("The file to write the bundle to. If unset, it's uploaded to the location's container (config %s) under %s", bucketConfigKey, supportBundlePrefix))
+	flags.IntVar(&errorLimit, "errors", defaultSupportBundleErrors, "The number of most recent failed storage requests to include")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := loadCredentialsIntoEnv(credentialsFileFromEnv()); err != nil {
+		return err
+	}
+
+	diags, err := readDiagnostics(diagnosticsDir())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	bundle := &supportBundle{
+		kind:        kind,
+		config:      config,
+		env:         supportBundleEnv(os.Getenv),
+		diagnostics: diags,
+		errorLimit:  errorLimit,
+		createdAt:   now,
+	}
+
+	var buf bytes.Buffer
+	if err := bundle.write(&buf); err != nil {
+		return err
+	}
+
+	if output != "" {
+		if err := ioutil.WriteFile(output, buf.Bytes(), 0600); err != nil {
+			return errors.WithStack(err)
+		}
+		fmt.Printf("Support bundle written to %s\n", output)
+		return nil
+	}
+
+	if config[bucketConfigKey] == "" {
+		return errors.Errorf("either --output or --config %s is required", bucketConfigKey)
+	}
+	env, err := getAzureEnvironment(config)
+	if err != nil {
+		return err
+	}
+	store, err := newMetadataStore(map[string]string{
+		metadataStorageAccountConfigKey:          config[storageAccountConfigKey],
+		metadataStorageAccountKeyEnvVarConfigKey: config[storageAccountKeyEnvVarConfigKey],
+		metadataResourceGroupConfigKey:           config[resourceGroupConfigKey],
+		metadataBucketConfigKey:                  config[bucketConfigKey],
+		metadataPrefixConfigKey:                  config[prefixConfigKey],
+	}, env)
+	if err != nil {
+		return err
+	}
+
+	name := supportBundlePrefix + "support-bundle-" + now.Format("20060102T150405Z") + ".tar.gz"
+	if err := store.put(name, buf.Bytes()); err != nil {
+		return err
+	}
+	fmt.Printf("Support bundle uploaded to %s/%s\n", config[bucketConfigKey], store.key(name))
+	return nil
+}
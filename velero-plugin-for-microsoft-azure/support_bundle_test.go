@@ -0,0 +1,132 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTarball(t *testing.T, data []byte) map[string][]byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	files := map[string][]byte{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = content
+	}
+	return files
+}
+
+func TestSupportBundleWrite(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	bundle := &supportBundle{
+		kind: objectStoreKind,
+		config: map[string]string{
+			storageAccountConfigKey: "sa",
+			"credentials":           "AccountKey=c2VjcmV0",
+		},
+		env: map[string]string{subscriptionIDEnvVar: "sub"},
+		diagnostics: []processDiagnostics{
+			{
+				Errors: []errorResponse{
+					{Time: now.Add(-3 * time.Minute), RequestID: "req-1"},
+					{Time: now.Add(-time.Minute), RequestID: "req-3"},
+				},
+				Latencies: map[string]*endpointLatency{"sa.blob.core.windows.net": {Requests: 2, TotalSeconds: 2, MaxSeconds: 1.5}},
+				Logs:      []logRecord{{Time: now.Add(-time.Minute), Message: "second"}},
+			},
+			{
+				Errors:    []errorResponse{{Time: now.Add(-2 * time.Minute), RequestID: "req-2"}},
+				Latencies: map[string]*endpointLatency{"sa.blob.core.windows.net": {Requests: 1, TotalSeconds: 3, MaxSeconds: 3}},
+				Logs:      []logRecord{{Time: now.Add(-2 * time.Minute), Message: "first"}},
+			},
+		},
+		errorLimit: 2,
+		createdAt:  now,
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, bundle.write(&buf))
+	files := readTarball(t, buf.Bytes())
+
+	var config struct {
+		Kind        string            `json:"kind"`
+		Config      map[string]string `json:"config"`
+		Environment map[string]string `json:"environment"`
+	}
+	require.NoError(t, json.Unmarshal(files["config.json"], &config))
+	assert.Equal(t, objectStoreKind, config.Kind)
+	assert.Equal(t, "sa", config.Config[storageAccountConfigKey])
+	assert.Equal(t, "AccountKey=REDACTED", config.Config["credentials"])
+	assert.Equal(t, map[string]string{subscriptionIDEnvVar: "sub"}, config.Environment)
+
+	assert.Contains(t, string(files["capabilities.txt"]), "signedURLs")
+
+	var errs []errorResponse
+	require.NoError(t, json.Unmarshal(files["errors.json"], &errs))
+	require.Len(t, errs, 2)
+	assert.Equal(t, "req-2", errs[0].RequestID)
+	assert.Equal(t, "req-3", errs[1].RequestID)
+
+	var latencies map[string]endpointLatency
+	require.NoError(t, json.Unmarshal(files["latencies.json"], &latencies))
+	assert.Equal(t, endpointLatency{Requests: 3, TotalSeconds: 5, MaxSeconds: 3}, latencies["sa.blob.core.windows.net"])
+
+	var logs []logRecord
+	require.NoError(t, json.Unmarshal(files["logs.json"], &logs))
+	require.Len(t, logs, 2)
+	assert.Equal(t, "first", logs[0].Message)
+	assert.Equal(t, "second", logs[1].Message)
+}
+
+func TestSupportBundleWriteUnknownKind(t *testing.T) {
+	bundle := &supportBundle{kind: "backupitemaction"}
+	assert.Error(t, bundle.write(ioutil.Discard))
+}
+
+func TestSupportBundleEnv(t *testing.T) {
+	env := map[string]string{
+		subscriptionIDEnvVar: "sub",
+		clientIDEnvVar:       "client",
+		clientSecretEnvVar:   "secret",
+		"UNRELATED":          "value",
+	}
+
+	assert.Equal(t, map[string]string{
+		subscriptionIDEnvVar: "sub",
+		clientIDEnvVar:       "client",
+		clientSecretEnvVar:   "(set)",
+	}, supportBundleEnv(func(name string) string { return env[name] }))
+}
@@ -0,0 +1,327 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// tieringCheckpointPrefix is where tier-old-backups records the backups
+	// it has moved to each tier.
+	tieringCheckpointPrefix = pluginObjectsPrefix + "tiering/"
+
+	defaultTieringParallelism = 16
+)
+
+// tieringCheckpoint records the backups whose objects have all been moved to
+// a tier.
+type tieringCheckpoint struct {
+	Tier      string    `json:"tier"`
+	Backups   []string  `json:"backups"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// backupTierer moves the objects of a location's old backups to a colder
+// access tier, for storage accounts without lifecycle management policies
+// that would. Backups are tiered one at a time, each in a batch of parallel
+// Set Blob Tier requests, and every backup tiered is recorded in a
+// checkpoint in the location's container, so that an interrupted run resumes
+// where it stopped.
+type backupTierer struct {
+	log         logrus.FieldLogger
+	out         io.Writer
+	store       *metadataStore
+	tiers       accessTierSetter
+	audit       *auditLog
+	tier        string
+	olderThan   time.Duration
+	parallelism int
+	now         func() time.Time
+}
+
+func tieringCheckpointName(tier string) string {
+	return tieringCheckpointPrefix + strings.ToLower(tier) + ".json"
+}
+
+// readCheckpoint returns the backups already moved to the tier.
+func (t *backupTierer) readCheckpoint() (map[string]bool, error) {
+	tiered := map[string]bool{}
+
+	data, err := t.store.get(tieringCheckpointName(t.tier))
+	if isNotFound(err) {
+		return tiered, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint tieringCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, errors.Wrapf(err, "unable to read checkpoint %s", t.store.key(tieringCheckpointName(t.tier)))
+	}
+	for _, backup := range checkpoint.Backups {
+		tiered[backup] = true
+	}
+	return tiered, nil
+}
+
+func (t *backupTierer) writeCheckpoint(tiered map[string]bool) error {
+	checkpoint := tieringCheckpoint{Tier: t.tier, Backups: []string{}, UpdatedAt: t.now().UTC()}
+	for backup := range tiered {
+		checkpoint.Backups = append(checkpoint.Backups, backup)
+	}
+	sort.Strings(checkpoint.Backups)
+
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return t.store.put(tieringCheckpointName(t.tier), data)
+}
+
+// startedAt returns when the backup started, from its metadata.
+func (t *backupTierer) startedAt(backup string) (time.Time, error) {
+	data, err := t.store.get("backups/" + backup + "/" + backupMetadataFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var status backupStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return time.Time{}, errors.Wrapf(err, "unable to read %s", backupMetadataFile)
+	}
+	if status.Status.StartTimestamp == nil {
+		return time.Time{}, errors.Errorf("%s has no start timestamp", backupMetadataFile)
+	}
+	return *status.Status.StartTimestamp, nil
+}
+
+// run moves the objects of the backups that started more than t.olderThan
+// ago to the tier, skipping those the checkpoint records as moved already
+// unless restart is set.
+func (t *backupTierer) run(restart bool) error {
+	tiered := map[string]bool{}
+	if !restart {
+		var err error
+		if tiered, err = t.readCheckpoint(); err != nil {
+			return err
+		}
+	}
+
+	names, err := t.store.list("backups/")
+	if err != nil {
+		return err
+	}
+	objects := map[string][]string{}
+	for _, name := range names {
+		// e.g. "backups/b1/b1.tar.gz"
+		parts := strings.SplitN(strings.TrimPrefix(name, "backups/"), "/", 2)
+		if len(parts) == 2 {
+			objects[parts[0]] = append(objects[parts[0]], name)
+		}
+	}
+
+	// don't keep deleted backups in the checkpoint
+	for backup := range tiered {
+		if objects[backup] == nil {
+			delete(tiered, backup)
+		}
+	}
+
+	var due []string
+	for backup := range objects {
+		if tiered[backup] {
+			continue
+		}
+		started, err := t.startedAt(backup)
+		if err != nil {
+			t.log.WithError(err).WithField("backup", backup).Warn("Unable to tell the backup's age, skipping it")
+			continue
+		}
+		if t.now().Sub(started) >= t.olderThan {
+			due = append(due, backup)
+		}
+	}
+	sort.Strings(due)
+	fmt.Fprintf(t.out, "Moving the objects of %d backups to the %s tier (%d of %d backups were moved already)\n", len(due), t.tier, len(tiered), len(objects))
+
+	var failed []string
+	for i, backup := range due {
+		moved, err := t.tierBackup(objects[backup])
+		if err != nil {
+			t.log.WithError(err).WithField("backup", backup).Error("Error moving the backup's objects")
+			fmt.Fprintf(t.out, "[%d/%d] %s: failed, %d objects moved: %v\n", i+1, len(due), backup, moved, err)
+			failed = append(failed, backup)
+			continue
+		}
+
+		tiered[backup] = true
+		if err := t.writeCheckpoint(tiered); err != nil {
+			return errors.WithMessage(err, "error writing checkpoint")
+		}
+		fmt.Fprintf(t.out, "[%d/%d] %s: %d objects moved\n", i+1, len(due), backup, moved)
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("unable to move the objects of %d backups (%s), run the command again to retry them", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// tierBackup moves the given objects of a backup to the tier, up to
+// t.parallelism at a time, returning the number of objects moved.
+func (t *backupTierer) tierBackup(names []string) (int, error) {
+	var keys []string
+	for _, name := range names {
+		// objects that can't be archived are left in their tier
+		if key := t.store.key(name); accessTierFor(t.tier, key) != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		moved    int
+		firstErr error
+	)
+	work := make(chan string)
+	for i := 0; i < t.parallelism && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				err := t.tiers.setAccessTier(t.store.bucket, key, t.tier)
+				if t.audit != nil {
+					t.audit.recordAccessTier(t.store.bucket+"/"+key, t.tier, err)
+				}
+
+				lock.Lock()
+				if err == nil {
+					moved++
+				} else if firstErr == nil {
+					firstErr = errors.WithMessagef(err, "error moving %s", key)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		work <- key
+	}
+	close(work)
+	wg.Wait()
+
+	return moved, firstErr
+}
+
+func runTierOldBackups(log logrus.FieldLogger, args []string) error {
+	var (
+		config      map[string]string
+		olderThan   int
+		tier        string
+		parallelism int
+		restart     bool
+	)
+
+	flags := pflag.NewFlagSet("tier-old-backups", pflag.ContinueOnError)
+	flags.StringToStringVar(&config, "config", nil, fmt.Sprintf("The location's config, as key=value pairs, along with its container as %s and its prefix as %s", bucketConfigKey, prefixConfigKey))
+	flags.IntVar(&olderThan, "older-than-days", 0, "Move the objects of the backups that started more than this many days ago")
+	flags.StringVar(&tier, "tier", "Cool", "The access tier to move the objects to (Cool, Cold or Archive)")
+	flags.IntVar(&parallelism, "parallelism", defaultTieringParallelism, "The number of objects to move at a time")
+	flags.BoolVar(&restart, "restart", false, "Ignore the checkpoint of previous runs, moving the objects of every backup old enough again")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	bucket := config[bucketConfigKey]
+	if bucket == "" {
+		return errors.Errorf("--config %s is required", bucketConfigKey)
+	}
+	if olderThan <= 0 {
+		return errors.New("--older-than-days must be a positive number of days")
+	}
+	if parallelism <= 0 {
+		return errors.New("--parallelism must be positive")
+	}
+	// every tier but Hot
+	colderTiers := accessTiers[1:]
+	var validTier string
+	for _, t := range colderTiers {
+		if strings.EqualFold(tier, t) {
+			validTier = t
+		}
+	}
+	if validTier == "" {
+		return errors.Errorf("invalid --tier %q (expected one of %s)", tier, strings.Join(colderTiers, ", "))
+	}
+
+	// the object store doesn't take the container and prefix as config
+	locationConfig := map[string]string{}
+	for k, v := range config {
+		if k != bucketConfigKey && k != prefixConfigKey {
+			locationConfig[k] = v
+		}
+	}
+
+	if err := loadCredentialsIntoEnv(credentialsFileFromEnv()); err != nil {
+		return err
+	}
+	store := newObjectStore(log)
+	if err := store.Init(locationConfig); err != nil {
+		return err
+	}
+
+	tierer := &backupTierer{
+		log: log,
+		out: os.Stdout,
+		store: &metadataStore{
+			containers: store.containerGetter,
+			blobGetter: store.blobGetter,
+			bucket:     bucket,
+			prefix:     config[prefixConfigKey],
+		},
+		tiers:       store.tierSetter,
+		tier:        validTier,
+		olderThan:   time.Duration(olderThan) * 24 * time.Hour,
+		parallelism: parallelism,
+		now:         time.Now,
+	}
+
+	// objects moved by the command are recorded in the location's audit log
+	auditLog, err := getAuditLog(config)
+	if err != nil {
+		return err
+	}
+	if auditLog {
+		tierer.audit = newAuditLog(log, tierer.store, config)
+	}
+
+	return tierer.run(restart)
+}
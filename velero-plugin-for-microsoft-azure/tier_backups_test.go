@@ -0,0 +1,121 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// concurrentAccessTierSetter records the tiers objects are moved to by
+// concurrent requests, failing those of the keys in fail.
+type concurrentAccessTierSetter struct {
+	lock  sync.Mutex
+	tiers map[string]string
+	fail  map[string]bool
+}
+
+func (s *concurrentAccessTierSetter) setAccessTier(bucket, key, tier string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.fail[key] {
+		return errors.New("boom")
+	}
+	s.tiers[bucket+"/"+key] = tier
+	return nil
+}
+
+func TestBackupTierer(t *testing.T) {
+	now := time.Date(2026, 10, 15, 0, 0, 0, 0, time.UTC)
+	blobs := newMemBlobs(now)
+	addBackup := func(name string, started time.Time) {
+		blobs.put("velero/backups/"+name+"/"+backupMetadataFile, `{"status":{"startTimestamp":"`+started.Format(time.RFC3339)+`"}}`, started)
+		blobs.put("velero/backups/"+name+"/"+name+".tar.gz", "contents", started)
+		blobs.put("velero/backups/"+name+"/"+name+"-logs.gz", "logs", started)
+	}
+	addBackup("old-1", now.Add(-40*24*time.Hour))
+	addBackup("old-2", now.Add(-31*24*time.Hour))
+	addBackup("recent", now.Add(-24*time.Hour))
+	blobs.put("velero/backups/no-metadata/no-metadata.tar.gz", "contents", now)
+	blobs.put("velero/restores/r1/restore-r1-logs.gz", "logs", now)
+
+	setter := &concurrentAccessTierSetter{tiers: map[string]string{}, fail: map[string]bool{"velero/backups/old-2/old-2.tar.gz": true}}
+	var out bytes.Buffer
+	tierer := &backupTierer{
+		log:         logrus.New(),
+		out:         &out,
+		store:       &metadataStore{containers: blobs, blobGetter: blobs, bucket: "bucket", prefix: "velero"},
+		tiers:       setter,
+		tier:        "Archive",
+		olderThan:   30 * 24 * time.Hour,
+		parallelism: 2,
+		now:         func() time.Time { return now },
+	}
+	tierer.audit = newAuditLog(logrus.New(), tierer.store, map[string]string{})
+
+	// only the contents of old backups are archived, and the backups that
+	// failed are left out of the checkpoint
+	err := tierer.run(false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "old-2")
+	assert.Equal(t, map[string]string{"bucket/velero/backups/old-1/old-1.tar.gz": "Archive"}, setter.tiers)
+	assert.Contains(t, out.String(), "[1/2] old-1: 1 objects moved")
+
+	// every object moved, or not, is in the audit log
+	records, err := readAuditRecords(tierer.store, time.Now())
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	for _, r := range records {
+		assert.Equal(t, auditSetAccessTier, r.Operation)
+		assert.Equal(t, "Archive", r.Tier)
+	}
+
+	var checkpoint tieringCheckpoint
+	require.NoError(t, json.Unmarshal(blobs.data["velero/"+tieringCheckpointName("Archive")], &checkpoint))
+	assert.Equal(t, []string{"old-1"}, checkpoint.Backups)
+
+	// a second run resumes with the backups that weren't moved
+	setter.tiers, setter.fail = map[string]string{}, nil
+	require.NoError(t, tierer.run(false))
+	assert.Equal(t, map[string]string{"bucket/velero/backups/old-2/old-2.tar.gz": "Archive"}, setter.tiers)
+
+	checkpoint = tieringCheckpoint{}
+	require.NoError(t, json.Unmarshal(blobs.data["velero/"+tieringCheckpointName("Archive")], &checkpoint))
+	assert.Equal(t, []string{"old-1", "old-2"}, checkpoint.Backups)
+
+	// other tiers move every object, and have their own checkpoint
+	setter.tiers = map[string]string{}
+	tierer.tier = "Cool"
+	require.NoError(t, tierer.run(false))
+	assert.Len(t, setter.tiers, 6)
+	assert.Equal(t, "Cool", setter.tiers["bucket/velero/backups/old-2/"+backupMetadataFile])
+
+	// restarting ignores the checkpoint
+	setter.tiers = map[string]string{}
+	require.NoError(t, tierer.run(false))
+	assert.Empty(t, setter.tiers)
+	require.NoError(t, tierer.run(true))
+	assert.Len(t, setter.tiers, 6)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	uploadConcurrencyConfigKey = "uploadConcurrency"
+	maxUploadBuffersConfigKey  = "maxUploadBuffers"
+
+	// maxUploadConcurrency bounds the blocks staged at once by an upload
+	maxUploadConcurrency = 64
+)
+
+// getUploadConcurrency returns the number of blocks each upload stages at
+// once, config.uploadConcurrency, and the number of blocks it buffers in
+// memory, config.maxUploadBuffers, which defaults to the concurrency.
+func getUploadConcurrency(config map[string]string) (int, int, error) {
+	concurrency, buffers := 1, 0
+	if val := config[uploadConcurrencyConfigKey]; val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 || n > maxUploadConcurrency {
+			return 0, 0, errors.Errorf("invalid value %q for config key %q (expected an integer from 1 to %d)", val, uploadConcurrencyConfigKey, maxUploadConcurrency)
+		}
+		concurrency = n
+	}
+	if val := config[maxUploadBuffersConfigKey]; val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < concurrency {
+			return 0, 0, errors.Errorf("invalid value %q for config key %q (expected an integer of at least config.%s, %d)", val, maxUploadBuffersConfigKey, uploadConcurrencyConfigKey, concurrency)
+		}
+		buffers = n
+	}
+	if buffers == 0 {
+		buffers = concurrency
+	}
+	return concurrency, buffers, nil
+}
+
+// uploadSettings returns the upload concurrency and the number of buffers,
+// as configured or as set by the location's runtime control.
+func (o *ObjectStore) uploadSettings() (int, int) {
+	concurrency, buffers := o.uploadConcurrency, o.uploadBuffers
+	if concurrency == 0 {
+		concurrency, buffers = 1, 1
+	}
+	if o.controlKey == "" {
+		return concurrency, buffers
+	}
+
+	control := currentRuntimeControl(o.controlKey)
+	if control.UploadConcurrency > 0 {
+		concurrency = control.UploadConcurrency
+	}
+	if control.MaxUploadBuffers > 0 {
+		buffers = control.MaxUploadBuffers
+	}
+	if buffers < concurrency {
+		buffers = concurrency
+	}
+	return concurrency, buffers
+}
+
+// blockStager stages the blocks of an upload, up to concurrency at once.
+// Blocks are read into the stager's buffers, of which there are at most
+// maxBuffers, so reading ahead of the blocks being staged is bounded.
+type blockStager struct {
+	blob        blob
+	timings     *uploadTimings
+	blockSize   int
+	concurrency int
+	maxBuffers  int
+
+	free      chan []byte
+	allocated int
+	work      chan stagedBlock
+	workers   sync.WaitGroup
+	closeOnce sync.Once
+
+	lock   sync.Mutex
+	err    error
+	staged time.Duration
+}
+
+type stagedBlock struct {
+	id   string
+	data []byte
+}
+
+func newBlockStager(blob blob, timings *uploadTimings, blockSize, concurrency, maxBuffers int) *blockStager {
+	s := &blockStager{
+		blob:        blob,
+		timings:     timings,
+		blockSize:   blockSize,
+		concurrency: concurrency,
+		maxBuffers:  maxBuffers,
+		free:        make(chan []byte, maxBuffers),
+	}
+	if concurrency > 1 {
+		s.work = make(chan stagedBlock, maxBuffers)
+		for i := 0; i < concurrency; i++ {
+			s.workers.Add(1)
+			go s.run()
+		}
+	}
+	return s
+}
+
+// buffer returns a buffer to read the next block into, waiting for one to
+// be released if all of them are in use.
+func (s *blockStager) buffer() []byte {
+	select {
+	case buf := <-s.free:
+		return buf
+	default:
+	}
+	if s.allocated < s.maxBuffers {
+		s.allocated++
+		return make([]byte, s.blockSize)
+	}
+	return <-s.free
+}
+
+// release returns the buffer of a block that isn't staged.
+func (s *blockStager) release(data []byte) {
+	s.free <- data[:cap(data)]
+}
+
+// stage stages the given block, whose data is in one of the stager's
+// buffers. Concurrent stagers stage it in the background, and return the
+// error of any block that failed before.
+func (s *blockStager) stage(id string, data []byte) error {
+	if s.concurrency <= 1 {
+		defer s.release(data)
+		if err := s.timings.time(uploadStageStageBlock, func() error {
+			return s.blob.PutBlock(id, data, nil)
+		}); err != nil {
+			return errors.Wrapf(err, "error putting block %s", id)
+		}
+		return nil
+	}
+
+	if err := s.failed(); err != nil {
+		s.release(data)
+		return err
+	}
+	s.work <- stagedBlock{id: id, data: data}
+	return nil
+}
+
+func (s *blockStager) run() {
+	defer s.workers.Done()
+	for block := range s.work {
+		// blocks queued after one failed are never committed
+		if s.failed() == nil {
+			start := time.Now()
+			err := s.blob.PutBlock(block.id, block.data, nil)
+
+			s.lock.Lock()
+			s.staged += time.Since(start)
+			if err != nil && s.err == nil {
+				s.err = errors.Wrapf(err, "error putting block %s", block.id)
+			}
+			s.lock.Unlock()
+		}
+		s.release(block.data)
+	}
+}
+
+func (s *blockStager) failed() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// wait waits for the blocks being staged, and returns the error of the first
+// one that failed. The stager can't be used afterwards.
+func (s *blockStager) wait() error {
+	s.closeOnce.Do(func() {
+		if s.work != nil {
+			close(s.work)
+			s.workers.Wait()
+			// the time spent staging blocks is summed across workers
+			s.timings.stages[uploadStageStageBlock] += s.staged
+		}
+	})
+	return s.failed()
+}
@@ -0,0 +1,110 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUploadConcurrency(t *testing.T) {
+	concurrency, buffers, err := getUploadConcurrency(map[string]string{})
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 1}, []int{concurrency, buffers})
+
+	concurrency, buffers, err = getUploadConcurrency(map[string]string{uploadConcurrencyConfigKey: "4"})
+	require.NoError(t, err)
+	assert.Equal(t, []int{4, 4}, []int{concurrency, buffers})
+
+	concurrency, buffers, err = getUploadConcurrency(map[string]string{uploadConcurrencyConfigKey: "4", maxUploadBuffersConfigKey: "6"})
+	require.NoError(t, err)
+	assert.Equal(t, []int{4, 6}, []int{concurrency, buffers})
+
+	for _, config := range []map[string]string{
+		{uploadConcurrencyConfigKey: "0"},
+		{uploadConcurrencyConfigKey: "65"},
+		{uploadConcurrencyConfigKey: "many"},
+		{uploadConcurrencyConfigKey: "4", maxUploadBuffersConfigKey: "2"},
+	} {
+		_, _, err := getUploadConcurrency(config)
+		assert.Error(t, err, config)
+	}
+}
+
+// stagingBlob records the blocks staged concurrently and the committed block
+// list.
+type stagingBlob struct {
+	blob
+	failBlock string
+
+	lock      sync.Mutex
+	staged    map[string]string
+	committed []storage.Block
+}
+
+func (b *stagingBlob) PutBlock(blockID string, chunk []byte, options *storage.PutBlockOptions) error {
+	if blockID == b.failBlock {
+		return errors.New("boom")
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.staged[blockID] = string(chunk)
+	return nil
+}
+
+func (b *stagingBlob) PutBlockList(blocks []storage.Block, options *storage.PutBlockListOptions) error {
+	b.committed = blocks
+	return nil
+}
+
+func TestPutObjectConcurrentBlocks(t *testing.T) {
+	for _, failBlock := range []string{"", "00000002"} {
+		blob := &stagingBlob{failBlock: failBlock, staged: map[string]string{}}
+		blobGetter := new(mockBlobGetter)
+		blobGetter.On("getBlob", "b", "backups/b1/b1.tar.gz").Return(blob, nil)
+
+		o := &ObjectStore{
+			log:               logrus.New(),
+			blobGetter:        blobGetter,
+			blockSize:         2,
+			uploadConcurrency: 3,
+			uploadBuffers:     4,
+		}
+		err := o.PutObject("b", "backups/b1/b1.tar.gz", strings.NewReader("aabbccddeef"))
+		if failBlock != "" {
+			// a block that fails fails the upload, and nothing is committed
+			assert.EqualError(t, err, "error putting block 00000002: boom")
+			assert.Nil(t, blob.committed)
+			continue
+		}
+
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"00000000": "aa", "00000001": "bb", "00000002": "cc", "00000003": "dd", "00000004": "ee", "00000005": "f"}, blob.staged)
+		var ids []string
+		for _, block := range blob.committed {
+			ids = append(ids, block.ID)
+		}
+		assert.Equal(t, []string{"00000000", "00000001", "00000002", "00000003", "00000004", "00000005"}, ids)
+	}
+}
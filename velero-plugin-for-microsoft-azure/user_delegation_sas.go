@@ -0,0 +1,210 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	// userDelegationSASVersion is the storage API version of user delegation
+	// keys and the URLs signed with them, the first that supports them.
+	userDelegationSASVersion = "2018-11-09"
+
+	// userDelegationKeyLifetime is how long a user delegation key is
+	// requested for, unless a URL needs it for longer. The service grants
+	// them for at most 7 days.
+	userDelegationKeyLifetime    = 24 * time.Hour
+	maxUserDelegationKeyLifetime = 7 * 24 * time.Hour
+
+	sasTimeFormat = "2006-01-02T15:04:05Z"
+)
+
+// userDelegationKey is a key for signing URLs on behalf of the AAD identity
+// that requested it, returned by Get User Delegation Key.
+type userDelegationKey struct {
+	SignedOid     string `xml:"SignedOid"`
+	SignedTid     string `xml:"SignedTid"`
+	SignedStart   string `xml:"SignedStart"`
+	SignedExpiry  string `xml:"SignedExpiry"`
+	SignedService string `xml:"SignedService"`
+	SignedVersion string `xml:"SignedVersion"`
+	Value         string `xml:"Value"`
+
+	expiry time.Time
+}
+
+// userDelegationSigner signs blob URLs with user delegation keys, for storage
+// accounts authorized with AAD tokens, which have no account key to sign
+// them with. URLs are valid as long as both the identity's role on the
+// account and the key are.
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/create-user-delegation-sas
+type userDelegationSigner struct {
+	account string
+	service *lazyBlobService
+	now     func() time.Time
+
+	lock sync.Mutex
+	key  *userDelegationKey
+}
+
+func newUserDelegationSigner(account string, service *lazyBlobService) *userDelegationSigner {
+	return &userDelegationSigner{account: account, service: service, now: time.Now}
+}
+
+// getKey returns a user delegation key valid until at least expiry. Keys are
+// reused for as long as they last, since each one takes a request.
+// ref. https://docs.microsoft.com/en-us/rest/api/storageservices/get-user-delegation-key
+func (s *userDelegationSigner) getKey(expiry time.Time) (*userDelegationKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.key != nil && !s.key.expiry.Before(expiry) {
+		return s.key, nil
+	}
+
+	now := s.now().UTC()
+	keyExpiry := now.Add(userDelegationKeyLifetime)
+	if expiry.After(keyExpiry) {
+		keyExpiry = expiry.UTC()
+	}
+	if keyExpiry.Sub(now) > maxUserDelegationKeyLifetime {
+		return nil, errors.Errorf("signed URLs can't be valid for more than %s when signed with a user delegation key", maxUserDelegationKeyLifetime)
+	}
+	// keys are valid from a few minutes ago, in case the service's clock is
+	// behind ours
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"KeyInfo"`
+		Start   string   `xml:"Start"`
+		Expiry  string   `xml:"Expiry"`
+	}{Start: now.Add(-5 * time.Minute).Format(sasTimeFormat), Expiry: keyExpiry.Format(sasTimeFormat)})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	resp, err := s.service.do(s.account, blobRequest{
+		method:     http.MethodPost,
+		query:      url.Values{"restype": {"service"}, "comp": {"userdelegationkey"}},
+		headers:    map[string]string{"Content-Type": "application/xml"},
+		body:       body,
+		apiVersion: userDelegationSASVersion,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get a user delegation key")
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	key := &userDelegationKey{}
+	if err := xml.Unmarshal(respBody, key); err != nil {
+		return nil, errors.Wrap(err, "unable to parse user delegation key")
+	}
+	key.expiry = keyExpiry
+
+	s.key = key
+	return key, nil
+}
+
+// signURL returns the URL of the given blob, signed for reading it until
+// expiry, with the given response headers overridden if set.
+func (s *userDelegationSigner) signURL(bucket, key string, expiry time.Time, overrides storage.OverrideHeaders) (string, error) {
+	client, _, err := s.service.getClient()
+	if err != nil {
+		return "", err
+	}
+	delegationKey, err := s.getKey(expiry)
+	if err != nil {
+		return "", err
+	}
+	secret, err := base64.StdEncoding.DecodeString(delegationKey.Value)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to decode user delegation key")
+	}
+
+	se := expiry.UTC().Format(sasTimeFormat)
+	stringToSign := strings.Join([]string{
+		"r",
+		"", // start
+		se,
+		"/blob/" + s.account + "/" + bucket + "/" + key,
+		delegationKey.SignedOid,
+		delegationKey.SignedTid,
+		delegationKey.SignedStart,
+		delegationKey.SignedExpiry,
+		delegationKey.SignedService,
+		delegationKey.SignedVersion,
+		"", // IP range
+		"", // protocol
+		userDelegationSASVersion,
+		"b",
+		"", // snapshot time
+		overrides.CacheControl,
+		overrides.ContentDisposition,
+		overrides.ContentEncoding,
+		overrides.ContentLanguage,
+		overrides.ContentType,
+	}, "\n")
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(stringToSign))
+
+	query := url.Values{
+		"sv":    {userDelegationSASVersion},
+		"sr":    {"b"},
+		"sp":    {"r"},
+		"se":    {se},
+		"skoid": {delegationKey.SignedOid},
+		"sktid": {delegationKey.SignedTid},
+		"skt":   {delegationKey.SignedStart},
+		"ske":   {delegationKey.SignedExpiry},
+		"sks":   {delegationKey.SignedService},
+		"skv":   {delegationKey.SignedVersion},
+		"sig":   {base64.StdEncoding.EncodeToString(mac.Sum(nil))},
+	}
+	for name, value := range map[string]string{
+		"rscc": overrides.CacheControl,
+		"rscd": overrides.ContentDisposition,
+		"rsce": overrides.ContentEncoding,
+		"rscl": overrides.ContentLanguage,
+		"rsct": overrides.ContentType,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+
+	service := client.GetBlobService()
+	u, err := url.Parse(service.GetContainerReference(bucket).GetBlobReference(key).GetURL())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
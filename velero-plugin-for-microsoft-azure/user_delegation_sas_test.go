@@ -0,0 +1,117 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keySender records requests and answers them with the given response.
+type keySender struct {
+	requests []*http.Request
+	resp     *http.Response
+}
+
+func (s *keySender) Send(_ *storage.Client, req *http.Request) (*http.Response, error) {
+	s.requests = append(s.requests, req)
+	return s.resp, nil
+}
+
+func TestUserDelegationSigner(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	keyResponse := func() *http.Response {
+		body := `<?xml version="1.0" encoding="utf-8"?><UserDelegationKey>` +
+			`<SignedOid>oid</SignedOid><SignedTid>tid</SignedTid>` +
+			`<SignedStart>2020-06-01T11:55:00Z</SignedStart><SignedExpiry>2020-06-02T12:00:00Z</SignedExpiry>` +
+			`<SignedService>b</SignedService><SignedVersion>2018-11-09</SignedVersion>` +
+			`<Value>` + base64.StdEncoding.EncodeToString([]byte("secret")) + `</Value></UserDelegationKey>`
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body))}
+	}
+
+	sender := &keySender{resp: keyResponse()}
+	credential := &storageCredential{accountKey: "a2V5"}
+	signer := newUserDelegationSigner("account", newLazyBlobService(func() (*storage.Client, *storageCredential, error) {
+		client, err := newStorageClient("account", credential, &azure.PublicCloud, "")
+		require.NoError(t, err)
+		client.Sender = sender
+		return &client, credential, nil
+	}))
+	signer.now = func() time.Time { return now }
+
+	overrides := storage.OverrideHeaders{ContentEncoding: "gzip", ContentType: "text/plain; charset=utf-8", ContentDisposition: "inline"}
+	uri, err := signer.signURL("b", "backups/b-1/b-1-logs.gz", now.Add(10*time.Minute), overrides)
+	require.NoError(t, err)
+
+	require.Len(t, sender.requests, 1)
+	assert.Equal(t, http.MethodPost, sender.requests[0].Method)
+	assert.Equal(t, "https://account.blob.core.windows.net/?comp=userdelegationkey&restype=service", sender.requests[0].URL.String())
+	body, err := ioutil.ReadAll(sender.requests[0].Body)
+	require.NoError(t, err)
+	assert.Equal(t, "<KeyInfo><Start>2020-06-01T11:55:00Z</Start><Expiry>2020-06-02T12:00:00Z</Expiry></KeyInfo>", string(body))
+
+	u, err := url.Parse(uri)
+	require.NoError(t, err)
+	assert.Equal(t, "https://account.blob.core.windows.net/b/backups/b-1/b-1-logs.gz", u.Scheme+"://"+u.Host+u.Path)
+	query := u.Query()
+	assert.Equal(t, "2018-11-09", query.Get("sv"))
+	assert.Equal(t, "b", query.Get("sr"))
+	assert.Equal(t, "r", query.Get("sp"))
+	assert.Equal(t, "2020-06-01T12:10:00Z", query.Get("se"))
+	assert.Equal(t, "oid", query.Get("skoid"))
+	assert.Equal(t, "tid", query.Get("sktid"))
+	assert.Equal(t, "gzip", query.Get("rsce"))
+	assert.Equal(t, "inline", query.Get("rscd"))
+	assert.Empty(t, query.Get("rscc"))
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("r\n\n2020-06-01T12:10:00Z\n/blob/account/b/backups/b-1/b-1-logs.gz\n" +
+		"oid\ntid\n2020-06-01T11:55:00Z\n2020-06-02T12:00:00Z\nb\n2018-11-09\n\n\n2018-11-09\nb\n\n" +
+		"\ninline\ngzip\n\ntext/plain; charset=utf-8"))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(mac.Sum(nil)), query.Get("sig"))
+
+	// keys are reused while they last
+	_, err = signer.signURL("b", "backups/b-1/b-1.tar.gz", now.Add(time.Hour), storage.OverrideHeaders{})
+	require.NoError(t, err)
+	assert.Len(t, sender.requests, 1)
+
+	// and replaced by keys that last long enough for longer-lived URLs
+	sender.resp = keyResponse()
+	_, err = signer.signURL("b", "backups/b-1/b-1.tar.gz", now.Add(48*time.Hour), storage.OverrideHeaders{})
+	require.NoError(t, err)
+	require.Len(t, sender.requests, 2)
+	body, err = ioutil.ReadAll(sender.requests[1].Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "<Expiry>2020-06-03T12:00:00Z</Expiry>")
+
+	// which the service only grants for up to 7 days
+	_, err = signer.signURL("b", "backups/b-1/b-1.tar.gz", now.Add(8*24*time.Hour), storage.OverrideHeaders{})
+	assert.Error(t, err)
+	assert.Len(t, sender.requests, 2)
+}
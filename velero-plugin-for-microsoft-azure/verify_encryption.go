@@ -0,0 +1,237 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	storagemgmt "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+const defaultEncryptionSamples = 20
+
+// encryptionSample is a sampled object and whether the storage service
+// reports it as encrypted at rest.
+type encryptionSample struct {
+	name      string
+	encrypted bool
+}
+
+// encryptionReport is the result of verifying the encryption of a location's
+// backups.
+type encryptionReport struct {
+	storageAccount string
+	container      string
+	prefix         string
+	// account describes the storage account's encryption at rest, or why it
+	// couldn't be checked
+	account          string
+	accountChecked   bool
+	accountEncrypted bool
+	total            int
+	samples          []encryptionSample
+	checkedAt        time.Time
+}
+
+// passed returns whether the account, if it was checked, and every sampled
+// object are encrypted.
+func (r *encryptionReport) passed() bool {
+	if r.accountChecked && !r.accountEncrypted {
+		return false
+	}
+	for _, sample := range r.samples {
+		if !sample.encrypted {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *encryptionReport) write(w io.Writer) {
+	result := func(ok bool) string {
+		if ok {
+			return "PASS"
+		}
+		return "FAIL"
+	}
+
+	fmt.Fprintf(w, "Encryption report for %s/%s", r.storageAccount, r.container)
+	if r.prefix != "" {
+		fmt.Fprintf(w, "/%s", r.prefix)
+	}
+	fmt.Fprintf(w, " at %s\n\n", r.checkedAt.Format(time.RFC3339))
+
+	accountResult := "SKIP"
+	if r.accountChecked {
+		accountResult = result(r.accountEncrypted)
+	}
+	fmt.Fprintf(w, "%s  Storage account encryption at rest: %s\n", accountResult, r.account)
+	fmt.Fprintln(w, "N/A   Client-side encryption: not supported by the plugin; backups rely on the storage account's encryption at rest")
+	fmt.Fprintf(w, "N/A   Encryption scopes: not reported by storage API version %s\n\n", storage.DefaultAPIVersion)
+
+	fmt.Fprintf(w, "Sampled %d of %d objects:\n", len(r.samples), r.total)
+	for _, sample := range r.samples {
+		encrypted := "server-side encrypted"
+		if !sample.encrypted {
+			encrypted = "NOT encrypted at rest"
+		}
+		fmt.Fprintf(w, "%s  %s (%s)\n", result(sample.encrypted), sample.name, encrypted)
+	}
+
+	fmt.Fprintf(w, "\nResult: %s\n", result(r.passed()))
+}
+
+// describeAccountEncryption describes the encryption at rest of the given
+// storage account, returning whether its blob service encrypts data.
+func describeAccountEncryption(account storagemgmt.Account) (string, bool) {
+	if account.AccountProperties == nil || account.Encryption == nil {
+		return "no encryption settings reported", false
+	}
+	encryption := account.Encryption
+
+	if encryption.Services == nil || encryption.Services.Blob == nil || encryption.Services.Blob.Enabled == nil || !*encryption.Services.Blob.Enabled {
+		return "the blob service doesn't encrypt data at rest", false
+	}
+
+	if encryption.KeySource != storagemgmt.KeySourceMicrosoftKeyvault {
+		return "enabled, with Microsoft-managed keys", true
+	}
+	description := "enabled, with a customer-managed key"
+	if kv := encryption.KeyVaultProperties; kv != nil && kv.KeyVaultURI != nil && kv.KeyName != nil {
+		description += fmt.Sprintf(" (%s in %s)", *kv.KeyName, *kv.KeyVaultURI)
+	}
+	return description, true
+}
+
+// sampleBlobs returns n of the given blobs, chosen at random, or all of them
+// if there are no more than n.
+func sampleBlobs(blobs []storage.Blob, n int, rnd *rand.Rand) []storage.Blob {
+	if len(blobs) <= n {
+		return blobs
+	}
+
+	sampled := make([]storage.Blob, len(blobs))
+	copy(sampled, blobs)
+	rnd.Shuffle(len(sampled), func(i, j int) { sampled[i], sampled[j] = sampled[j], sampled[i] })
+	return sampled[:n]
+}
+
+func runVerifyEncryption(log logrus.FieldLogger, args []string) error {
+	var (
+		config  map[string]string
+		samples int
+	)
+
+	flags := pflag.NewFlagSet("verify-encryption", pflag.ContinueOnError)
+	flags.StringToStringVar(&config, "config", nil, fmt.Sprintf("The location's config, as key=value pairs, along with its container as %s and its prefix as %s", bucketConfigKey, prefixConfigKey))
+	flags.IntVar(&samples, "samples", defaultEncryptionSamples, "The number of objects to sample at random")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	bucket, prefix := config[bucketConfigKey], config[prefixConfigKey]
+	if bucket == "" {
+		return errors.Errorf("--config %s is required", bucketConfigKey)
+	}
+	// the object store doesn't take the container and prefix as config
+	locationConfig := map[string]string{}
+	for k, v := range config {
+		if k != bucketConfigKey && k != prefixConfigKey {
+			locationConfig[k] = v
+		}
+	}
+
+	if err := loadCredentialsIntoEnv(credentialsFileFromEnv()); err != nil {
+		return err
+	}
+
+	report := &encryptionReport{
+		storageAccount: config[storageAccountConfigKey],
+		container:      bucket,
+		prefix:         prefix,
+		checkedAt:      time.Now().UTC(),
+	}
+
+	// checking the account's settings requires ARM access, so it's only
+	// possible when the account's subscription and resource group are known
+	subscriptionID, resourceGroup := getSubscriptionID(config), config[resourceGroupConfigKey]
+	if subscriptionID == "" || resourceGroup == "" {
+		report.account = "unknown, since the storage account's subscription and resource group aren't configured"
+	} else {
+		credentials, env, err := getCredentialProvider(locationConfig)
+		if err != nil {
+			return err
+		}
+		client, err := newAccountPropertiesClient(credentials, env, subscriptionID)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), postureCheckTimeout)
+		account, err := client.GetProperties(ctx, resourceGroup, report.storageAccount, "")
+		cancel()
+		if err != nil {
+			return errors.Wrap(err, "error getting storage account properties")
+		}
+		report.account, report.accountEncrypted = describeAccountEncryption(account)
+		report.accountChecked = true
+	}
+
+	store := newObjectStore(log)
+	if err := store.Init(locationConfig); err != nil {
+		return err
+	}
+	container, err := store.containerGetter.getContainer(bucket)
+	if err != nil {
+		return err
+	}
+
+	// listing reports whether each blob is encrypted, so sampled objects
+	// don't need to be requested individually
+	var blobs []storage.Blob
+	params := storage.ListBlobsParameters{Prefix: prefix}
+	for {
+		res, err := container.ListBlobs(params)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		blobs = append(blobs, res.Blobs...)
+		if res.NextMarker == "" {
+			break
+		}
+		params.Marker = res.NextMarker
+	}
+
+	report.total = len(blobs)
+	for _, blob := range sampleBlobs(blobs, samples, rand.New(rand.NewSource(time.Now().UnixNano()))) {
+		report.samples = append(report.samples, encryptionSample{name: blob.Name, encrypted: blob.Properties.ServerEncrypted})
+	}
+
+	report.write(os.Stdout)
+	if !report.passed() {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
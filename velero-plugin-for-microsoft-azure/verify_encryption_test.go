@@ -0,0 +1,93 @@
+/*
+Copyright the Velero contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	storagemgmt "github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeAccountEncryption(t *testing.T) {
+	enabled, disabled := true, false
+	keyName, vaultURI := "backups", "https://vault.vault.azure.net"
+	account := func(blobEnabled *bool, keySource storagemgmt.KeySource, kv *storagemgmt.KeyVaultProperties) storagemgmt.Account {
+		return storagemgmt.Account{AccountProperties: &storagemgmt.AccountProperties{Encryption: &storagemgmt.Encryption{
+			Services:           &storagemgmt.EncryptionServices{Blob: &storagemgmt.EncryptionService{Enabled: blobEnabled}},
+			KeySource:          keySource,
+			KeyVaultProperties: kv,
+		}}}
+	}
+
+	description, encrypted := describeAccountEncryption(storagemgmt.Account{})
+	assert.False(t, encrypted)
+	assert.Equal(t, "no encryption settings reported", description)
+
+	_, encrypted = describeAccountEncryption(account(&disabled, storagemgmt.KeySourceMicrosoftStorage, nil))
+	assert.False(t, encrypted)
+
+	description, encrypted = describeAccountEncryption(account(&enabled, storagemgmt.KeySourceMicrosoftStorage, nil))
+	assert.True(t, encrypted)
+	assert.Equal(t, "enabled, with Microsoft-managed keys", description)
+
+	description, encrypted = describeAccountEncryption(account(&enabled, storagemgmt.KeySourceMicrosoftKeyvault, &storagemgmt.KeyVaultProperties{KeyName: &keyName, KeyVaultURI: &vaultURI}))
+	assert.True(t, encrypted)
+	assert.Equal(t, "enabled, with a customer-managed key (backups in https://vault.vault.azure.net)", description)
+}
+
+func TestSampleBlobs(t *testing.T) {
+	blobs := []storage.Blob{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	rnd := rand.New(rand.NewSource(1))
+
+	assert.Equal(t, blobs, sampleBlobs(blobs, 10, rnd))
+
+	sampled := sampleBlobs(blobs, 2, rnd)
+	assert.Len(t, sampled, 2)
+	assert.NotEqual(t, sampled[0].Name, sampled[1].Name)
+	// the listing isn't reordered
+	assert.Equal(t, "a", blobs[0].Name)
+}
+
+func TestEncryptionReport(t *testing.T) {
+	report := &encryptionReport{
+		storageAccount: "sa",
+		container:      "velero",
+		prefix:         "cluster-1",
+		account:        "unknown, since the storage account's subscription and resource group aren't configured",
+		total:          10,
+		samples:        []encryptionSample{{name: "backups/b1/velero-backup.json", encrypted: true}},
+		checkedAt:      time.Date(2020, 10, 15, 0, 0, 0, 0, time.UTC),
+	}
+	// an unchecked account doesn't fail the report
+	assert.True(t, report.passed())
+
+	report.samples = append(report.samples, encryptionSample{name: "backups/b1/b1.tar.gz"})
+	assert.False(t, report.passed())
+
+	var buf bytes.Buffer
+	report.write(&buf)
+	assert.Contains(t, buf.String(), "Encryption report for sa/velero/cluster-1 at 2020-10-15T00:00:00Z")
+	assert.Contains(t, buf.String(), "SKIP  Storage account encryption at rest")
+	assert.Contains(t, buf.String(), "Sampled 2 of 10 objects:")
+	assert.Contains(t, buf.String(), "FAIL  backups/b1/b1.tar.gz (NOT encrypted at rest)")
+	assert.Contains(t, buf.String(), "Result: FAIL")
+}
@@ -28,37 +28,55 @@ import (
 
 	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
 	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-
-	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
 )
 
 const (
 	resourceGroupEnvVar = "AZURE_RESOURCE_GROUP"
 
-	apiTimeoutConfigKey       = "apiTimeout"
-	snapsIncrementalConfigKey = "incremental"
+	apiTimeoutConfigKey             = "apiTimeout"
+	snapsIncrementalConfigKey       = "incremental"
+	restoreDisksDetachedConfigKey   = "restoreDisksDetached"
+	verifySnapshotsConfigKey        = "verifySnapshots"
+	restoreResourceGroupConfigKey   = "restoreResourceGroup"
+	excludedStorageClassesConfigKey = "excludedStorageClasses"
+	restoredDiskTagsConfigKey       = "restoredDiskTags"
 
 	snapshotsResource = "snapshots"
 	disksResource     = "disks"
 )
 
 type VolumeSnapshotter struct {
-	log                logrus.FieldLogger
-	disks              *disk.DisksClient
-	snaps              *disk.SnapshotsClient
-	disksSubscription  string
-	snapsSubscription  string
-	disksResourceGroup string
-	snapsResourceGroup string
-	snapsIncremental   *bool
-	apiTimeout         time.Duration
+	log                    logrus.FieldLogger
+	disks                  *disk.DisksClient
+	snaps                  *disk.SnapshotsClient
+	disksSubscription      string
+	snapsSubscription      string
+	disksResourceGroup     string
+	snapsResourceGroup     string
+	restoreResourceGroup   string
+	excludedStorageClasses map[string]bool
+	restoredDiskTags       map[string]string
+	restoredDiskAccess     *diskNetworkAccess
+	restoreSnapshots       tagSelector
+	snapsIncremental       *bool
+	apiTimeout             time.Duration
+	disksDetached          bool
+	verifySnapshots        bool
+	metadata               *metadataStore
+	audit                  *auditLog
+	scaleDown              *scaleDownGuard
+	locks                  lockLister
+	deleteLockWait         time.Duration
+	costs                  *snapshotCostEstimator
+	deterministicNames     bool
+	journal                *operationJournal
+	tagger                 snapshotTagger
 }
 
 type snapshotIdentifier struct {
@@ -76,15 +94,58 @@ func newVolumeSnapshotter(logger logrus.FieldLogger) *VolumeSnapshotter {
 }
 
 func (b *VolumeSnapshotter) Init(config map[string]string) error {
-	if err := veleroplugin.ValidateVolumeSnapshotterConfigKeys(config,
+	if err := validateVolumeSnapshotterConfigKeys(config,
 		resourceGroupConfigKey,
 		apiTimeoutConfigKey,
 		subscriptionIDConfigKey,
 		snapsIncrementalConfigKey,
+		snapshotMetricsIntervalConfigKey,
+		restoreDisksDetachedConfigKey,
+		verifySnapshotsConfigKey,
+		restoreResourceGroupConfigKey,
+		excludedStorageClassesConfigKey,
+		restoredDiskTagsConfigKey,
+		restoreSnapshotTagSelectorConfigKey,
+		restoredDiskNetworkAccessPolicyConfigKey,
+		restoredDiskAccessIDConfigKey,
+		resourceManagerEndpointConfigKey,
+		cloudNameConfigKey,
+		computeAPIVersionConfigKey,
+		scaleDownSnapshotsConfigKey,
+		scaleDownDeferTimeoutConfigKey,
+		apiRetryAttemptsConfigKey,
+		deleteLockWaitConfigKey,
+		auditLogConfigKey,
+		snapshotCostReportConfigKey,
+		snapshotCostPerGiBMonthConfigKey,
+		deterministicSnapshotNamesConfigKey,
+		operationJournalConfigKey,
+		metadataStorageAccountConfigKey,
+		metadataStorageAccountKeyEnvVarConfigKey,
+		metadataResourceGroupConfigKey,
+		metadataBucketConfigKey,
+		metadataPrefixConfigKey,
+		profileConfigKey,
+		recordDiagnosticsConfigKey,
 	); err != nil {
 		return err
 	}
 
+	config, err := withPerformanceProfile(config, volumeSnapshotterKind)
+	if err != nil {
+		return err
+	}
+
+	// keep recent errors, logs and latencies for the support-bundle command,
+	// unless config["recordDiagnostics"] is false
+	recordDiagnostics, err := getRecordDiagnostics(config)
+	if err != nil {
+		return err
+	}
+	if recordDiagnostics {
+		startDiagnostics(b.log)
+	}
+
 	if err := loadCredentialsIntoEnv(credentialsFileFromEnv()); err != nil {
 		return err
 	}
@@ -105,17 +166,18 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 		snapshotsSubscriptionID = val
 	}
 
-	// Get Azure cloud from AZURE_CLOUD_NAME, if it exists. If the env var does not
-	// exist, parseAzureEnvironment will return azure.PublicCloud.
-	env, err := parseAzureEnvironment(os.Getenv(cloudNameEnvVar))
+	env, err := getAzureEnvironment(config)
 	if err != nil {
-		return errors.Wrap(err, "unable to parse azure cloud name environment variable")
+		return err
 	}
 
-	// if config["apiTimeout"] is empty, default to 2m; otherwise, parse it
+	quirks := quirksFor(env)
+
+	// if config["apiTimeout"] is empty, default to the cloud's default
+	// (2m for most clouds); otherwise, parse it
 	var apiTimeout time.Duration
 	if val := config[apiTimeoutConfigKey]; val == "" {
-		apiTimeout = 2 * time.Minute
+		apiTimeout = quirks.defaultAPITimeout
 	} else {
 		apiTimeout, err = time.ParseDuration(val)
 		if err != nil {
@@ -123,12 +185,9 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 		}
 	}
 
-	// get authorizer from environment in the following order:
-	// 1. client credentials (AZURE_TENANT_ID, AZURE_CLIENT_ID, AZURE_CLIENT_SECRET)
-	// 2. client certificate (AZURE_CERTIFICATE_PATH, AZURE_CERTIFICATE_PASSWORD)
-	// 3. username and password (AZURE_USERNAME, AZURE_PASSWORD)
-	// 4. MSI (managed service identity)
-	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	// get authorizer from the AAD credentials in the environment
+	credentials := newAADCredentialProvider(env)
+	authorizer, err := credentials.GetARMToken(armResource(env))
 	if err != nil {
 		return errors.Wrap(err, "error getting authorizer from environment")
 	}
@@ -149,14 +208,15 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 	disksClient := disk.NewDisksClientWithBaseURI(env.ResourceManagerEndpoint, envVars[subscriptionIDEnvVar])
 	snapsClient := disk.NewSnapshotsClientWithBaseURI(env.ResourceManagerEndpoint, snapshotsSubscriptionID)
 
-	disksClient.PollingDelay = 5 * time.Second
-	snapsClient.PollingDelay = 5 * time.Second
+	disksClient.PollingDelay = quirks.pollingDelay
+	snapsClient.PollingDelay = quirks.pollingDelay
 
 	disksClient.Authorizer = authorizer
 	snapsClient.Authorizer = authorizer
 
 	b.disks = &disksClient
 	b.snaps = &snapsClient
+	b.tagger = &azureSnapshotTagger{snaps: b.snaps}
 	b.disksSubscription = envVars[subscriptionIDEnvVar]
 	b.snapsSubscription = snapshotsSubscriptionID
 	b.disksResourceGroup = envVars[resourceGroupEnvVar]
@@ -169,10 +229,185 @@ func (b *VolumeSnapshotter) Init(config map[string]string) error {
 		b.snapsResourceGroup = envVars[resourceGroupEnvVar]
 	}
 
+	// isolate the location's retries and throttling from those of locations
+	// in other subscriptions
+	retryAttempts, err := getAPIRetryAttempts(config)
+	if err != nil {
+		return err
+	}
+	throttle := getARMThrottle(b.snapsSubscription + "/" + b.snapsResourceGroup)
+	// if config["computeAPIVersion"] is set, disk and snapshot requests use
+	// that API version rather than the SDK's
+	computeAPIVersion, err := getARMAPIVersion(config, computeAPIVersionConfigKey)
+	if err != nil {
+		return err
+	}
+	for _, client := range []*autorest.Client{&b.disks.Client, &b.snaps.Client} {
+		client.RetryAttempts = retryAttempts
+		client.Sender = throttle.sender(autorest.CreateSender())
+		withARMAPIVersion(client, computeAPIVersion)
+	}
+
+	b.restoreResourceGroup = config[restoreResourceGroupConfigKey]
+
+	// if config["excludedStorageClasses"] is set, PVs of those storage
+	// classes aren't snapshotted
+	for _, class := range strings.Split(config[excludedStorageClassesConfigKey], ",") {
+		if class = strings.TrimSpace(class); class != "" {
+			if b.excludedStorageClasses == nil {
+				b.excludedStorageClasses = map[string]bool{}
+			}
+			b.excludedStorageClasses[class] = true
+		}
+	}
+
 	b.apiTimeout = apiTimeout
 
+	// if config["deleteLockWait"] is set, snapshot deletions blocked by
+	// locks or ongoing use are retried for that long
+	b.locks = &armLockLister{env: env, authorizer: authorizer}
+	if val := config[deleteLockWaitConfigKey]; val != "" {
+		if b.deleteLockWait, err = time.ParseDuration(val); err != nil {
+			return errors.Wrapf(err, "unable to parse value %q for config key %q (expected a duration string)", val, deleteLockWaitConfigKey)
+		}
+	}
+
+	// if config["scaleDownSnapshots"] is set, snapshots of disks attached to
+	// nodes being deleted are coordinated with the deletion
+	if b.scaleDown, err = newScaleDownGuard(b.log, config, b.disks, &armNodeStateGetter{env: env, authorizer: authorizer}, b.disksResourceGroup); err != nil {
+		return err
+	}
+
 	b.snapsIncremental = snapshotsIncremental
 
+	// if config["deterministicSnapshotNames"] is set, snapshots are named
+	// after their backup and persistent volume, so retries adopt them
+	if val := config[deterministicSnapshotNamesConfigKey]; val != "" {
+		if b.deterministicNames, err = strconv.ParseBool(val); err != nil {
+			return errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, deterministicSnapshotNamesConfigKey)
+		}
+	}
+
+	// if config["metadataBucket"] is set, describe each snapshot in a
+	// sidecar object in that container. Sidecars are supplementary, so
+	// snapshots are still taken if the metadata store is unavailable.
+	if b.metadata, err = newMetadataStore(config, env); err != nil {
+		b.log.WithError(err).Warn("Unable to set up metadata store, snapshot sidecars will not be written")
+	}
+
+	// if config["auditLog"] is set, snapshot deletions are recorded in the
+	// metadata store
+	auditLog, err := getAuditLog(config)
+	if err != nil {
+		return err
+	}
+	if auditLog {
+		if b.metadata == nil {
+			return errors.Errorf("config.%s requires config.%s", auditLogConfigKey, metadataBucketConfigKey)
+		}
+		b.audit = newAuditLog(b.log, b.metadata, config)
+	}
+
+	// if config["operationJournal"] is set, snapshots in progress are
+	// recorded in the metadata store, and those a stopped plugin process
+	// left unfinished are deleted, since they were never returned to Velero.
+	// Snapshots created without all their tags are recorded too, and tagged
+	// in the background until they have them.
+	operationJournal, err := getOperationJournal(config)
+	if err != nil {
+		return err
+	}
+	if operationJournal {
+		if b.metadata == nil {
+			return errors.Errorf("config.%s requires config.%s", operationJournalConfigKey, metadataBucketConfigKey)
+		}
+		b.journal = newOperationJournal(b.log, b.metadata)
+		journal := b.journal
+		startBackgroundTask("journal/snapshots/"+config[metadataStorageAccountConfigKey]+"/"+config[metadataBucketConfigKey]+"/"+config[metadataPrefixConfigKey], func() {
+			journal.run(map[string]func(journalEntry) error{
+				journalKindSnapshot: func(entry journalEntry) error {
+					return b.DeleteSnapshot(entry.Target)
+				},
+				journalKindSnapshotTags: func(entry journalEntry) error {
+					ctx, cancel := context.WithTimeout(context.Background(), b.apiTimeout)
+					defer cancel()
+					return reconcileSnapshotTags(ctx, b.tagger, entry.Target, entry.Tags)
+				},
+			})
+		})
+	}
+
+	// if config["snapshotCostReport"] is set, the estimated cost of each
+	// snapshot is logged and, if there's a metadata store, reported there
+	if b.costs, err = newSnapshotCostEstimator(b.log, b.metadata, config); err != nil {
+		return err
+	}
+
+	// if config["restoreDisksDetached"] is set, restored disks are left
+	// for manual use and PVs are not rewritten to reference them
+	if val := config[restoreDisksDetachedConfigKey]; val != "" {
+		b.disksDetached, err = strconv.ParseBool(val)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, restoreDisksDetachedConfigKey)
+		}
+	}
+
+	// if config["restoredDiskTags"] is set, restored disks get those tags,
+	// e.g. to exclude them from Azure Backup policies assigned by tag
+	if b.restoredDiskTags, err = parseRestoredDiskTags(config[restoredDiskTagsConfigKey]); err != nil {
+		return err
+	}
+
+	// if config["restoreSnapshotTagSelector"] is set, volumes are only restored
+	// from snapshots with matching tags
+	if b.restoreSnapshots, err = parseTagSelector(config[restoreSnapshotTagSelectorConfigKey]); err != nil {
+		return err
+	}
+
+	// if config["restoredDiskNetworkAccessPolicy"] or
+	// config["restoredDiskAccessId"] is set, restored disks are created with
+	// that network access policy, e.g. for policies denying public access
+	if b.restoredDiskAccess, err = parseDiskNetworkAccess(config); err != nil {
+		return err
+	}
+
+	// if config["verifySnapshots"] is set, snapshots are checked against
+	// their source disks once they're created
+	if val := config[verifySnapshotsConfigKey]; val != "" {
+		b.verifySnapshots, err = strconv.ParseBool(val)
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse value %q for config key %q (expected a boolean value)", val, verifySnapshotsConfigKey)
+		}
+	}
+
+	// if config["snapshotMetricsInterval"] is set, periodically publish
+	// snapshot metrics for the disks in the snapshots resource group
+	if val := config[snapshotMetricsIntervalConfigKey]; val != "" && quirks.customMetricsDomain == "" {
+		b.log.Warnf("Azure Monitor custom metrics are not supported in %s, ignoring config.%s", env.Name, snapshotMetricsIntervalConfigKey)
+	} else if val != "" {
+		interval, err := getSnapshotMetricsInterval(config)
+		if err != nil {
+			return err
+		}
+
+		monitorAuthorizer, err := credentials.GetARMToken("https://" + quirks.customMetricsDomain + "/")
+		if err != nil {
+			return errors.Wrap(err, "error getting Azure Monitor authorizer from environment")
+		}
+
+		publisher := &snapshotMetricsPublisher{
+			log:           b.log,
+			snaps:         b.snaps,
+			resourceGroup: b.snapsResourceGroup,
+			authorizer:    monitorAuthorizer,
+			interval:      interval,
+			domain:        quirks.customMetricsDomain,
+		}
+		startBackgroundTask("snapshot-metrics/"+b.snapsSubscription+"/"+b.snapsResourceGroup, publisher.run)
+	}
+
+	logCapabilities(b.log, volumeSnapshotterKind, volumeSnapshotterCapabilities(config))
+
 	return nil
 }
 
@@ -187,8 +422,27 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
+	if err := checkRestoreSnapshotTags(b.restoreSnapshots, snapshotID, snapshotInfo.Tags); err != nil {
+		return "", err
+	}
 
-	diskName := "restore-" + uuid.NewV4().String()
+	restoreID := uuid.NewV4().String()
+	diskName := "restore-" + restoreID
+
+	// copy the snapshot's tags so the disk can be tagged with its restore ID
+	// while it's created. Detached disks are meant to be used manually, so
+	// they aren't tagged and won't be treated as orphaned. The snapshot's tags
+	// come from the source disk, so configured tags take precedence over them.
+	diskTags := make(map[string]*string, len(snapshotInfo.Tags)+1)
+	for k, v := range snapshotInfo.Tags {
+		diskTags[k] = v
+	}
+	if !b.disksDetached {
+		diskTags[restoreIDTag] = &restoreID
+	}
+	for k, v := range b.restoredDiskTags {
+		diskTags[k] = stringPtr(v)
+	}
 
 	disk := disk.Disk{
 		Name:     &diskName,
@@ -202,7 +456,7 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 		Sku: &disk.DiskSku{
 			Name: disk.DiskStorageAccountTypes(volumeType),
 		},
-		Tags: snapshotInfo.Tags,
+		Tags: diskTags,
 	}
 
 	// Restore the disk in the correct zone
@@ -214,7 +468,7 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 	ctx, cancel := context.WithTimeout(context.Background(), b.apiTimeout)
 	defer cancel()
 
-	future, err := b.disks.CreateOrUpdate(ctx, b.disksResourceGroup, *disk.Name, disk)
+	future, err := b.restoredDiskAccess.createDisk(ctx, b.disks, b.restoreDisksResourceGroup(), *disk.Name, disk)
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
@@ -225,9 +479,38 @@ func (b *VolumeSnapshotter) CreateVolumeFromSnapshot(snapshotID, volumeType, vol
 		return "", errors.WithStack(err)
 	}
 
+	// the restore ID marks disks that were never handed to Velero. Once the
+	// disk is returned it may be attached and later detached again, so the tag
+	// is removed first; if that fails, the disk isn't used and stays tagged.
+	if !b.disksDetached {
+		delete(diskTags, restoreIDTag)
+		if err := b.setRestoredDiskTags(ctx, diskName, diskTags); err != nil {
+			return "", errors.Wrapf(err, "error removing tag %s from restored disk %s", restoreIDTag, diskName)
+		}
+	}
+
+	if b.disksDetached {
+		b.log.WithFields(logrus.Fields{
+			"snapshotID": snapshotID,
+			"diskID":     getComputeResourceName(b.disksSubscription, b.restoreDisksResourceGroup(), disksResource, diskName),
+		}).Info("Restored detached disk from snapshot")
+	}
+
 	return diskName, nil
 }
 
+func (b *VolumeSnapshotter) setRestoredDiskTags(ctx context.Context, diskName string, tags map[string]*string) error {
+	future, err := b.disks.Update(ctx, b.restoreDisksResourceGroup(), diskName, disk.DiskUpdate{Tags: tags})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := future.WaitForCompletionRef(ctx, b.disks.Client); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = future.Result(*b.disks)
+	return errors.WithStack(err)
+}
+
 func (b *VolumeSnapshotter) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
 	res, err := b.disks.Get(context.TODO(), b.disksResourceGroup, volumeID)
 	if err != nil {
@@ -249,14 +532,19 @@ func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 	}
 
 	fullDiskName := getComputeResourceName(b.disksSubscription, b.disksResourceGroup, disksResource, volumeID)
-	// snapshot names must be <= 80 characters long
+	// name the snapshot uniquely, unless it's named after its backup and
+	// persistent volume so that it can be adopted by retries
 	var snapshotName string
-	suffix := "-" + uuid.NewV4().String()
-
-	if len(volumeID) <= (80 - len(suffix)) {
-		snapshotName = volumeID + suffix
-	} else {
-		snapshotName = volumeID[0:80-len(suffix)] + suffix
+	if b.deterministicNames {
+		getCtx, cancel := context.WithTimeout(context.Background(), b.apiTimeout)
+		snapshotName, err = idempotentSnapshotName(getCtx, b.log, b.snaps, b.snapsResourceGroup, volumeID, fullDiskName, tags, time.Now())
+		cancel()
+		if err != nil {
+			return "", err
+		}
+	}
+	if snapshotName == "" {
+		snapshotName = snapshotNameWithSuffix(volumeID, "-"+uuid.NewV4().String())
 	}
 
 	snap := disk.Snapshot{
@@ -272,21 +560,222 @@ func (b *VolumeSnapshotter) CreateSnapshot(volumeID, volumeAZ string, tags map[s
 		Location: diskInfo.Location,
 	}
 
+	if b.scaleDown != nil {
+		b.scaleDown.beforeSnapshot(context.Background(), diskInfo)
+	}
+
+	snapshotID := getComputeResourceName(b.snapsSubscription, b.snapsResourceGroup, snapshotsResource, snapshotName)
+
+	var journalID string
+	if b.journal != nil {
+		if journalID, err = b.journal.begin(journalKindSnapshot, snapshotID); err != nil {
+			return "", err
+		}
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), b.apiTimeout)
 	defer cancel()
 
-	future, err := b.snaps.CreateOrUpdate(ctx, b.snapsResourceGroup, *snap.Name, snap)
+	var created disk.Snapshot
+	create := func() error {
+		future, err := b.snaps.CreateOrUpdate(ctx, b.snapsResourceGroup, *snap.Name, snap)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = future.WaitForCompletionRef(ctx, b.snaps.Client); err != nil {
+			return errors.WithStack(err)
+		}
+		created, err = future.Result(*b.snaps)
+		return errors.WithStack(err)
+	}
+	if b.scaleDown != nil {
+		err = b.scaleDown.createSnapshot(b.log.WithField("disk", volumeID), create)
+	} else {
+		err = create()
+	}
 	if err != nil {
-		return "", errors.WithStack(err)
+		if journalID != "" {
+			// the snapshot may have been created regardless, so leave its
+			// entry to be recovered, unless a retry would adopt it
+			if b.deterministicNames {
+				if endErr := b.journal.end(journalID); endErr != nil {
+					b.log.WithError(endErr).WithField("snapshotID", snapshotID).Warn("Error ending operation journal entry")
+				}
+			} else {
+				b.journal.abandon(journalID)
+			}
+		}
+		return "", err
 	}
-	if err = future.WaitForCompletionRef(ctx, b.snaps.Client); err != nil {
-		return "", errors.WithStack(err)
+
+	if b.verifySnapshots {
+		if err := verifySnapshot(diskInfo, created, fullDiskName); err != nil {
+			// the snapshot isn't returned to Velero, so delete it rather than leak it
+			if future, deleteErr := b.snaps.Delete(ctx, b.snapsResourceGroup, snapshotName); deleteErr != nil {
+				b.log.WithError(deleteErr).WithField("snapshotID", snapshotID).Warn("Error deleting unverified snapshot")
+			} else if deleteErr := future.WaitForCompletionRef(ctx, b.snaps.Client); deleteErr != nil {
+				b.log.WithError(deleteErr).WithField("snapshotID", snapshotID).Warn("Error deleting unverified snapshot")
+			}
+			if journalID != "" {
+				b.journal.abandon(journalID)
+			}
+			return "", errors.Wrapf(err, "snapshot %s failed verification", snapshotID)
+		}
 	}
-	if _, err = future.Result(*b.snaps); err != nil {
-		return "", errors.WithStack(err)
+
+	// once the snapshot's entry is gone, it's no longer deleted if this
+	// process stops, so it must be returned to Velero. A snapshot with a
+	// deterministic name may have been adopted from an earlier attempt whose
+	// entry is still waiting to be recovered, so that entry goes first.
+	if journalID != "" {
+		if b.deterministicNames {
+			if err := b.journal.supersede(journalID); err != nil {
+				b.journal.abandon(journalID)
+				return "", errors.Wrapf(err, "error superseding earlier operation journal entries of snapshot %s", snapshotID)
+			}
+		}
+		if err := b.journal.end(journalID); err != nil {
+			return "", errors.Wrapf(err, "error ending operation journal entry of snapshot %s", snapshotID)
+		}
+	}
+
+	// the snapshot's tags label it for Velero, e.g. for deletion along with
+	// its backup, so tags that didn't stick are applied in the background
+	if missing := missingSnapshotTags(snap.Tags, created.Tags); missing != nil {
+		log := b.log.WithField("snapshotID", snapshotID)
+		if b.journal == nil {
+			log.Warnf("Snapshot was created without all its tags; set config key %q to have them applied", operationJournalConfigKey)
+		} else if err := b.journal.schedule(journalKindSnapshotTags, snapshotID, missing); err != nil {
+			log.WithError(err).Warn("Snapshot was created without all its tags, and they can't be applied in the background")
+		} else {
+			log.Info("Snapshot was created without all its tags; applying them in the background")
+		}
+	}
+
+	if b.metadata != nil {
+		sidecar := &snapshotSidecar{
+			SchemaVersion: snapshotSidecarSchemaVersion,
+			SnapshotID:    snapshotID,
+			DiskID:        fullDiskName,
+			Zone:          volumeAZ,
+			Incremental:   b.snapsIncremental != nil && *b.snapsIncremental,
+			Backup:        tags["velero.io/backup"],
+			CreatedAt:     time.Now().UTC(),
+		}
+		if diskInfo.Location != nil {
+			sidecar.Location = *diskInfo.Location
+		}
+		if diskInfo.Sku != nil {
+			sidecar.SKU = string(diskInfo.Sku.Name)
+		}
+		if err := b.writeSnapshotSidecar(ctx, sidecar, snapshotName); err != nil {
+			b.log.WithError(err).WithField("snapshotID", snapshotID).Warn("Error writing snapshot sidecar")
+		}
+	}
+
+	recordSnapshotOwner(volumeID, diskInfo)
+
+	if b.costs != nil {
+		if created.Location == nil {
+			created.Location = diskInfo.Location
+		}
+		if created.SnapshotProperties == nil {
+			created.SnapshotProperties = snap.SnapshotProperties
+		}
+		if created.DiskSizeGB == nil && diskInfo.DiskProperties != nil {
+			created.DiskSizeGB = diskInfo.DiskSizeGB
+		}
+		b.costs.record(tags["velero.io/backup"], snapshotID, fullDiskName, created)
+	}
+
+	return snapshotID, nil
+}
+
+// verifySnapshot checks that the given snapshot was created successfully
+// from the given disk, since the completion of the ARM operation creating it
+// doesn't guarantee that it did.
+func verifySnapshot(source disk.Disk, snap disk.Snapshot, diskID string) error {
+	props := snap.SnapshotProperties
+	if props == nil {
+		return errors.New("snapshot has no properties")
+	}
+	if props.ProvisioningState == nil || *props.ProvisioningState != "Succeeded" {
+		state := ""
+		if props.ProvisioningState != nil {
+			state = *props.ProvisioningState
+		}
+		return errors.Errorf("snapshot provisioning state is %q, expected \"Succeeded\"", state)
+	}
+	if props.CreationData == nil || props.CreationData.SourceResourceID == nil || !strings.EqualFold(*props.CreationData.SourceResourceID, diskID) {
+		return errors.Errorf("snapshot source is not disk %s", diskID)
+	}
+	if source.DiskProperties != nil && source.UniqueID != nil && props.CreationData.SourceUniqueID != nil &&
+		*props.CreationData.SourceUniqueID != *source.UniqueID {
+		return errors.Errorf("snapshot source unique ID %s doesn't match disk unique ID %s", *props.CreationData.SourceUniqueID, *source.UniqueID)
+	}
+	if source.DiskProperties != nil && source.DiskSizeGB != nil {
+		if props.DiskSizeGB == nil || *props.DiskSizeGB != *source.DiskSizeGB {
+			size := int32(0)
+			if props.DiskSizeGB != nil {
+				size = *props.DiskSizeGB
+			}
+			return errors.Errorf("snapshot size %d GB doesn't match disk size %d GB", size, *source.DiskSizeGB)
+		}
+	}
+
+	return nil
+}
+
+// writeSnapshotSidecar writes the given sidecar to the metadata store, first
+// looking up the snapshot's parent if it's incremental.
+func (b *VolumeSnapshotter) writeSnapshotSidecar(ctx context.Context, sidecar *snapshotSidecar, snapshotName string) error {
+	if sidecar.Incremental {
+		var snapshots []disk.Snapshot
+		iter, err := b.snaps.ListByResourceGroupComplete(ctx, b.snapsResourceGroup)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for ; iter.NotDone(); err = iter.NextWithContext(ctx) {
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			snapshots = append(snapshots, iter.Value())
+		}
+		sidecar.ParentID = incrementalParent(snapshots, sidecar.DiskID, snapshotName)
+	}
+
+	data, err := encodeSnapshotSidecar(sidecar)
+	if err != nil {
+		return err
+	}
+
+	return b.metadata.put(snapshotSidecarName(snapshotName), data)
+}
+
+// restoreDisksResourceGroup returns the resource group to restore disks in:
+// config.restoreResourceGroup if it's set, otherwise the cluster's.
+func (b *VolumeSnapshotter) restoreDisksResourceGroup() string {
+	if b.restoreResourceGroup != "" {
+		return b.restoreResourceGroup
 	}
+	return b.disksResourceGroup
+}
 
-	return getComputeResourceName(b.snapsSubscription, b.snapsResourceGroup, snapshotsResource, snapshotName), nil
+// parseRestoredDiskTags parses config.restoredDiskTags, a comma-separated
+// list of tags, e.g. "backup=excluded,owner=velero".
+func parseRestoredDiskTags(val string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(val, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.Errorf("invalid value %q in config key %q (expected <tag>=<value>)", pair, restoredDiskTagsConfigKey)
+		}
+		tags[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return tags, nil
 }
 
 func getSnapshotTags(veleroTags map[string]string, diskTags map[string]*string) map[string]*string {
@@ -321,6 +810,16 @@ func stringPtr(s string) *string {
 }
 
 func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
+	err := b.deleteSnapshot(snapshotID)
+
+	if b.audit != nil {
+		b.audit.record(auditDeleteSnapshot, snapshotID, err)
+	}
+
+	return err
+}
+
+func (b *VolumeSnapshotter) deleteSnapshot(snapshotID string) error {
 	snapshotInfo, err := parseFullSnapshotName(snapshotID)
 	if err != nil {
 		return err
@@ -338,17 +837,32 @@ func (b *VolumeSnapshotter) DeleteSnapshot(snapshotID string) error {
 		return nil
 	}
 
-	future, err := b.snaps.Delete(ctx, snapshotInfo.resourceGroup, snapshotInfo.name)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if err = future.WaitForCompletionRef(ctx, b.snaps.Client); err != nil {
-		b.log.WithError(err).Errorf("Error waiting for completion ref")
+	err = retryBlockedDelete(b.deleteLockWait, time.Sleep, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), b.apiTimeout)
+		defer cancel()
+
+		future, err := b.snaps.Delete(ctx, snapshotInfo.resourceGroup, snapshotInfo.name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if err = future.WaitForCompletionRef(ctx, b.snaps.Client); err != nil {
+			b.log.WithError(err).Errorf("Error waiting for completion ref")
+			return errors.WithStack(err)
+		}
+		_, err = future.Result(*b.snaps)
 		return errors.WithStack(err)
-	}
-	_, err = future.Result(*b.snaps)
+	})
 	if err != nil {
-		return errors.WithStack(err)
+		// the retries may have outlived ctx
+		ctx, cancel := context.WithTimeout(context.Background(), b.apiTimeout)
+		defer cancel()
+		return explainDeleteFailure(ctx, b.locks, snapshotInfo.subscription, snapshotInfo.resourceGroup, snapshotsResource, snapshotInfo.name, "", err)
+	}
+
+	if b.metadata != nil {
+		if err := b.metadata.delete(snapshotSidecarName(snapshotInfo.name)); err != nil {
+			b.log.WithError(err).WithField("snapshotID", snapshotID).Warn("Error deleting snapshot sidecar")
+		}
 	}
 
 	return nil
@@ -358,6 +872,9 @@ func getComputeResourceName(subscription, resourceGroup, resource, name string)
 	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/%s/%s", subscription, resourceGroup, resource, name)
 }
 
+var diskURIRegexp = regexp.MustCompile(
+	`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft.Compute/disks/([^/]+)$`)
+
 var snapshotURIRegexp = regexp.MustCompile(
 	`^\/subscriptions\/(?P<subscription>.*)\/resourceGroups\/(?P<resourceGroup>.*)\/providers\/Microsoft.Compute\/snapshots\/(?P<snapshotName>.*)$`)
 
@@ -404,6 +921,17 @@ func (b *VolumeSnapshotter) GetVolumeID(unstructuredPV runtime.Unstructured) (st
 		return "", errors.New("spec.azureDisk.diskName not found")
 	}
 
+	// returning no volume ID tells Velero the PV can't be snapshotted, so it
+	// falls back to a file system backup of the volume if one is requested
+	if b.excludedStorageClasses[pv.Spec.StorageClassName] {
+		b.log.WithFields(logrus.Fields{
+			"persistentVolume": pv.Name,
+			"storageClass":     pv.Spec.StorageClassName,
+		}).Info("Not snapshotting persistent volume of excluded storage class")
+		return "", nil
+	}
+
+	rememberVolumeOwner(pv.Spec.AzureDisk.DiskName, pv)
 	return pv.Spec.AzureDisk.DiskName, nil
 }
 
@@ -417,8 +945,26 @@ func (b *VolumeSnapshotter) SetVolumeID(unstructuredPV runtime.Unstructured, vol
 		return nil, errors.New("spec.azureDisk not found")
 	}
 
-	pv.Spec.AzureDisk.DiskName = volumeID
-	pv.Spec.AzureDisk.DataDiskURI = getComputeResourceName(b.disksSubscription, b.disksResourceGroup, disksResource, volumeID)
+	// the volume ID is normally the name of a disk restored by
+	// CreateVolumeFromSnapshot, but may be a disk's full ID
+	diskName, diskID := volumeID, getComputeResourceName(b.disksSubscription, b.restoreDisksResourceGroup(), disksResource, volumeID)
+	if matches := diskURIRegexp.FindStringSubmatch(volumeID); matches != nil {
+		diskName, diskID = matches[1], volumeID
+	}
+
+	// in detached mode the restored disk is not bound to the PV, and the PV
+	// isn't restored since it would still reference the original disk
+	if b.disksDetached {
+		return nil, errors.Errorf("not restoring persistent volume %s since its disk was restored detached as %s", pv.Name, diskID)
+	}
+
+	// the PV may come from a cluster whose disks are in another resource
+	// group or subscription, so the disk's full ID is always rewritten. The
+	// restored disk is a managed disk, even if the original wasn't.
+	managed := v1.AzureManagedDisk
+	pv.Spec.AzureDisk.DiskName = diskName
+	pv.Spec.AzureDisk.DataDiskURI = diskID
+	pv.Spec.AzureDisk.Kind = &managed
 
 	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
 	if err != nil {
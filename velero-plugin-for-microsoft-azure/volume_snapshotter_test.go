@@ -17,8 +17,11 @@ limitations under the License.
 package main
 
 import (
+	"strings"
 	"testing"
 
+	disk "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/core/v1"
@@ -54,6 +57,33 @@ func TestGetVolumeID(t *testing.T) {
 	assert.Equal(t, "foo", volumeID)
 }
 
+func TestGetVolumeIDExcludedStorageClass(t *testing.T) {
+	b := &VolumeSnapshotter{
+		log:                    logrus.New(),
+		excludedStorageClasses: map[string]bool{"ultra": true},
+	}
+
+	pv := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"storageClassName": "ultra",
+				"azureDisk": map[string]interface{}{
+					"diskName": "foo",
+				},
+			},
+		},
+	}
+
+	volumeID, err := b.GetVolumeID(pv)
+	require.NoError(t, err)
+	assert.Equal(t, "", volumeID)
+
+	pv.Object["spec"].(map[string]interface{})["storageClassName"] = "managed-premium"
+	volumeID, err = b.GetVolumeID(pv)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", volumeID)
+}
+
 func TestSetVolumeID(t *testing.T) {
 	b := &VolumeSnapshotter{
 		disksResourceGroup: "rg",
@@ -94,6 +124,76 @@ func TestSetVolumeID(t *testing.T) {
 	assert.Equal(t, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/revised", res.Spec.AzureDisk.DataDiskURI)
 }
 
+func TestSetVolumeIDOtherResourceGroup(t *testing.T) {
+	b := &VolumeSnapshotter{
+		disksResourceGroup:   "rg",
+		disksSubscription:    "sub",
+		restoreResourceGroup: "restore-rg",
+	}
+
+	shared := v1.AzureSharedBlobDisk
+	pv := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"azureDisk": map[string]interface{}{
+					"diskName": "original",
+					"diskURI":  "https://account.blob.core.windows.net/vhds/original.vhd",
+					"kind":     string(shared),
+				},
+			},
+		},
+	}
+
+	// disk name -> ID in the restore resource group
+	updatedPV, err := b.SetVolumeID(pv, "restored")
+	require.NoError(t, err)
+
+	res := new(v1.PersistentVolume)
+	require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(updatedPV.UnstructuredContent(), res))
+	require.NotNil(t, res.Spec.AzureDisk)
+	assert.Equal(t, "restored", res.Spec.AzureDisk.DiskName)
+	assert.Equal(t, "/subscriptions/sub/resourceGroups/restore-rg/providers/Microsoft.Compute/disks/restored", res.Spec.AzureDisk.DataDiskURI)
+	require.NotNil(t, res.Spec.AzureDisk.Kind)
+	assert.Equal(t, v1.AzureManagedDisk, *res.Spec.AzureDisk.Kind)
+
+	// full disk ID -> used as-is
+	diskID := "/subscriptions/other-sub/resourceGroups/MC_other/providers/Microsoft.Compute/disks/restored-2"
+	updatedPV, err = b.SetVolumeID(pv, diskID)
+	require.NoError(t, err)
+
+	res = new(v1.PersistentVolume)
+	require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(updatedPV.UnstructuredContent(), res))
+	assert.Equal(t, "restored-2", res.Spec.AzureDisk.DiskName)
+	assert.Equal(t, diskID, res.Spec.AzureDisk.DataDiskURI)
+}
+
+func TestSetVolumeIDDetached(t *testing.T) {
+	b := &VolumeSnapshotter{
+		log:                logrus.New(),
+		disksResourceGroup: "rg",
+		disksSubscription:  "sub",
+		disksDetached:      true,
+	}
+
+	pv := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name": "pv-1",
+			},
+			"spec": map[string]interface{}{
+				"azureDisk": map[string]interface{}{
+					"diskName": "original",
+					"diskURI":  "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/original",
+				},
+			},
+		},
+	}
+
+	// the PV would still reference the original disk, so it isn't restored
+	_, err := b.SetVolumeID(pv, "restored")
+	assert.EqualError(t, err, "not restoring persistent volume pv-1 since its disk was restored detached as /subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/disks/restored")
+}
+
 func TestParseFullSnapshotName(t *testing.T) {
 	// invalid name
 	fullName := "foo/bar"
@@ -116,6 +216,85 @@ func TestGetComputeResourceName(t *testing.T) {
 	assert.Equal(t, "/subscriptions/sub-1/resourceGroups/rg-1/providers/Microsoft.Compute/snapshots/snap-1", getComputeResourceName("sub-1", "rg-1", snapshotsResource, "snap-1"))
 }
 
+func TestVerifySnapshot(t *testing.T) {
+	diskID := "/subscriptions/sub-1/resourceGroups/rg-1/providers/Microsoft.Compute/disks/disk-1"
+	source := disk.Disk{
+		DiskProperties: &disk.DiskProperties{
+			DiskSizeGB: int32Ptr(10),
+			UniqueID:   stringPtr("disk-uid"),
+		},
+	}
+	snapshot := func(state string, sourceID string, sourceUID string, size int32) disk.Snapshot {
+		return disk.Snapshot{
+			SnapshotProperties: &disk.SnapshotProperties{
+				ProvisioningState: stringPtr(state),
+				DiskSizeGB:        int32Ptr(size),
+				CreationData: &disk.CreationData{
+					SourceResourceID: stringPtr(sourceID),
+					SourceUniqueID:   stringPtr(sourceUID),
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		snapshot      disk.Snapshot
+		expectedError string
+	}{
+		{
+			name:     "valid",
+			snapshot: snapshot("Succeeded", strings.ToUpper(diskID), "disk-uid", 10),
+		},
+		{
+			name:          "failed",
+			snapshot:      snapshot("Failed", diskID, "disk-uid", 10),
+			expectedError: `snapshot provisioning state is "Failed", expected "Succeeded"`,
+		},
+		{
+			name:          "other source",
+			snapshot:      snapshot("Succeeded", diskID+"-other", "disk-uid", 10),
+			expectedError: "snapshot source is not disk " + diskID,
+		},
+		{
+			name:          "other source unique ID",
+			snapshot:      snapshot("Succeeded", diskID, "other-uid", 10),
+			expectedError: "snapshot source unique ID other-uid doesn't match disk unique ID disk-uid",
+		},
+		{
+			name:          "size mismatch",
+			snapshot:      snapshot("Succeeded", diskID, "disk-uid", 5),
+			expectedError: "snapshot size 5 GB doesn't match disk size 10 GB",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifySnapshot(source, test.snapshot, diskID)
+			if test.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.expectedError)
+			}
+		})
+	}
+}
+
+func TestParseRestoredDiskTags(t *testing.T) {
+	tags, err := parseRestoredDiskTags("")
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	tags, err = parseRestoredDiskTags("backup=excluded, owner = velero,empty=")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"backup": "excluded", "owner": "velero", "empty": ""}, tags)
+
+	_, err = parseRestoredDiskTags("backup")
+	assert.EqualError(t, err, `invalid value "backup" in config key "restoredDiskTags" (expected <tag>=<value>)`)
+	_, err = parseRestoredDiskTags("=excluded")
+	assert.Error(t, err)
+}
+
 func TestGetSnapshotTags(t *testing.T) {
 	tests := []struct {
 		name       string